@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+type archiveScanReport struct {
+	Root      string       `json:"root"`
+	CheckedAt string       `json:"checkedAt"`
+	Repair    bool         `json:"repair"`
+	Repos     int          `json:"repos"`
+	Files     int          `json:"files"`
+	Bytes     int64        `json:"bytes"`
+	Issues    []checkIssue `json:"issues"`
+}
+
+type tierStatus struct {
+	Name    string `json:"name"`
+	MaxAge  string `json:"maxAge"`
+	Entries int    `json:"entries"`
+}
+
+type tieredArchiveStatus struct {
+	Running  bool         `json:"running"`
+	Interval string       `json:"interval"`
+	Runs     int64        `json:"runs"`
+	Demoted  int64        `json:"demoted"`
+	Adopted  int64        `json:"adopted"`
+	Failures int64        `json:"failures"`
+	LastRun  string       `json:"lastRun"`
+	Errors   []string     `json:"errors"`
+	Tiers    []tierStatus `json:"tiers"`
+}
+
+type migrationReport struct {
+	From       string   `json:"from"`
+	To         string   `json:"to"`
+	Running    bool     `json:"running"`
+	StartedAt  string   `json:"startedAt"`
+	FinishedAt string   `json:"finishedAt"`
+	Scanned    int      `json:"scanned"`
+	Copied     int      `json:"copied"`
+	Skipped    int      `json:"skipped"`
+	Removed    int      `json:"removed"`
+	Bytes      int64    `json:"bytes"`
+	Failed     int      `json:"failed"`
+	Errors     []string `json:"errors"`
+}
+
+type packStats struct {
+	LooseEntries  int   `json:"looseEntries"`
+	LooseBytes    int64 `json:"looseBytes"`
+	PackedEntries int   `json:"packedEntries"`
+	DeadEntries   int   `json:"deadEntries"`
+	Packs         int   `json:"packs"`
+	PackBytes     int64 `json:"packBytes"`
+}
+
+type packReport struct {
+	Repo         string    `json:"repo"`
+	StartedAt    string    `json:"startedAt"`
+	Duration     string    `json:"duration"`
+	Full         bool      `json:"full"`
+	Packed       int       `json:"packed"`
+	Deltas       int       `json:"deltas"`
+	Skipped      int       `json:"skipped"`
+	PacksWritten int       `json:"packsWritten"`
+	PacksRemoved int       `json:"packsRemoved"`
+	InputBytes   int64     `json:"inputBytes"`
+	PackBytes    int64     `json:"packBytes"`
+	Stats        packStats `json:"stats"`
+	Errors       []string  `json:"errors,omitempty"`
+}
+
+type packJobStatus struct {
+	Running   bool                  `json:"running"`
+	Interval  string                `json:"interval"`
+	Active    string                `json:"active"`
+	Runs      int64                 `json:"runs"`
+	Failures  int64                 `json:"failures"`
+	Packed    int64                 `json:"packed"`
+	LastSweep string                `json:"lastSweep"`
+	Repos     map[string]packReport `json:"repos"`
+}
+
+// runArchiveScan checks the filesystem archive for stale temp files,
+// misplaced, duplicate, corrupt and unexpected files, and optionally repairs
+// them. It exits with status 2 when unresolved issues remain.
+func runArchiveScan(args []string) {
+	fs := flag.NewFlagSet("archive-scan", flag.ExitOnError)
+	api := fs.String("api", envDefault("KVVS_API", defaultAPI), "Base URL of the kv-vs REST API")
+	repair := fs.Bool("repair", false, "Remove stale and duplicate files, move misplaced ones and prune empty directories")
+	dumpJSON := fs.Bool("json", false, "Output JSON instead of table")
+	_ = fs.Parse(args)
+
+	method := http.MethodGet
+	query := url.Values{}
+	if *repair {
+		method = http.MethodPost
+		query.Set("repair", strconv.FormatBool(true))
+	}
+	resp := doRequest(*api, method, "/api/v1/archive/scan", query)
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		fmt.Fprintf(os.Stderr, "archive scan failed: %s %s\n", resp.Status, body)
+		os.Exit(1)
+	}
+
+	var report archiveScanReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		fmt.Fprintf(os.Stderr, "decode response: %v\n", err)
+		os.Exit(1)
+	}
+
+	unresolved := 0
+	for _, issue := range report.Issues {
+		if !issue.Repaired {
+			unresolved++
+		}
+	}
+
+	if *dumpJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+	} else {
+		fmt.Printf("%s: %d repositories, %d files, %d bytes, %d issues (%d unresolved)\n",
+			report.Root, report.Repos, report.Files, report.Bytes, len(report.Issues), unresolved)
+		if len(report.Issues) > 0 {
+			tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintf(tw, "Kind\tPath\tRepairable\tRepaired\tDetail\n")
+			for _, issue := range report.Issues {
+				detail := issue.Detail
+				if issue.RepairError != "" {
+					detail += " (repair failed: " + issue.RepairError + ")"
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%t\t%t\t%s\n", issue.Kind, issue.Key, issue.Repairable, issue.Repaired, detail)
+			}
+			_ = tw.Flush()
+		}
+	}
+
+	if unresolved > 0 {
+		os.Exit(2)
+	}
+}
+
+// runArchiveTiers prints the payloads per tier of a tiered archive and the
+// demotion job state. --run queues a demotion pass.
+func runArchiveTiers(args []string) {
+	fs := flag.NewFlagSet("archive-tiers", flag.ExitOnError)
+	api := fs.String("api", envDefault("KVVS_API", defaultAPI), "Base URL of the kv-vs REST API")
+	trigger := fs.Bool("run", false, "Queue a demotion pass")
+	dumpJSON := fs.Bool("json", false, "Output JSON instead of table")
+	_ = fs.Parse(args)
+
+	method := http.MethodGet
+	if *trigger {
+		method = http.MethodPost
+	}
+	resp := doRequest(*api, method, "/api/v1/archive/tiers", url.Values{})
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		fmt.Fprintf(os.Stderr, "archive tiers failed: %s %s\n", resp.Status, body)
+		os.Exit(1)
+	}
+
+	var status tieredArchiveStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		fmt.Fprintf(os.Stderr, "decode response: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *dumpJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(status)
+		return
+	}
+
+	interval := status.Interval
+	if interval == "" {
+		interval = "off"
+	}
+	fmt.Printf("demotion: running=%t interval=%s; %d runs, %d failures, %d demoted, %d adopted\n",
+		status.Running, interval, status.Runs, status.Failures, status.Demoted, status.Adopted)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Tier\tMaxAge\tEntries\n")
+	for _, tier := range status.Tiers {
+		maxAge := tier.MaxAge
+		if maxAge == "" {
+			maxAge = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\n", tier.Name, maxAge, tier.Entries)
+	}
+	_ = tw.Flush()
+	for _, msg := range status.Errors {
+		fmt.Printf("  error: %s\n", msg)
+	}
+}
+
+// runArchiveMigrate copies archived content from one backend to another
+// while the API keeps serving. Without --from and --to it reports the
+// current or last migration; --wait polls until the migration finishes and
+// exits with status 2 when some payloads failed.
+func runArchiveMigrate(args []string) {
+	fs := flag.NewFlagSet("archive-migrate", flag.ExitOnError)
+	api := fs.String("api", envDefault("KVVS_API", defaultAPI), "Base URL of the kv-vs REST API")
+	from := fs.String("from", "", "Source backend: bolt, fs or s3")
+	to := fs.String("to", "", "Target backend: bolt, fs or s3")
+	remove := fs.Bool("remove", false, "Delete each payload from the source once copied")
+	overwrite := fs.Bool("overwrite", false, "Copy payloads the target already has")
+	cancel := fs.Bool("cancel", false, "Cancel the running migration")
+	wait := fs.Bool("wait", false, "Wait for the migration to finish")
+	dumpJSON := fs.Bool("json", false, "Output JSON instead of a summary")
+	_ = fs.Parse(args)
+
+	method := http.MethodGet
+	query := url.Values{}
+	switch {
+	case *cancel:
+		method = http.MethodDelete
+	case *from != "" || *to != "":
+		if *from == "" || *to == "" {
+			fmt.Fprintln(os.Stderr, "--from and --to are required together")
+			os.Exit(1)
+		}
+		method = http.MethodPost
+		query.Set("from", *from)
+		query.Set("to", *to)
+		query.Set("remove", strconv.FormatBool(*remove))
+		query.Set("overwrite", strconv.FormatBool(*overwrite))
+	}
+
+	report := migrationRequest(*api, method, query)
+	for *wait && report.Running {
+		time.Sleep(time.Second)
+		report = migrationRequest(*api, http.MethodGet, url.Values{})
+	}
+
+	if *dumpJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+	} else {
+		state := "finished"
+		if report.Running {
+			state = "running"
+		}
+		fmt.Printf("%s -> %s: %s; %d scanned, %d copied (%d bytes), %d skipped, %d removed, %d failed\n",
+			report.From, report.To, state, report.Scanned, report.Copied, report.Bytes, report.Skipped, report.Removed, report.Failed)
+		for _, msg := range report.Errors {
+			fmt.Printf("  error: %s\n", msg)
+		}
+	}
+	if !report.Running && report.Failed > 0 {
+		os.Exit(2)
+	}
+}
+
+func migrationRequest(api, method string, query url.Values) migrationReport {
+	resp := doRequest(api, method, "/api/v1/archive/migrate", query)
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		fmt.Fprintf(os.Stderr, "archive migration failed: %s %s\n", resp.Status, body)
+		os.Exit(1)
+	}
+
+	var report migrationReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		fmt.Fprintf(os.Stderr, "decode response: %v\n", err)
+		os.Exit(1)
+	}
+	return report
+}
+
+// runArchivePack prints how the Bolt archive of each repository is packed,
+// as of the last pack pass. --run queues a pass for --repo, or for every
+// repository when --repo is empty; --full also merges existing packs and
+// reclaims removed payloads.
+func runArchivePack(args []string) {
+	fs := flag.NewFlagSet("archive-pack", flag.ExitOnError)
+	api := fs.String("api", envDefault("KVVS_API", defaultAPI), "Base URL of the kv-vs REST API")
+	repo := fs.String("repo", "", "Repository to show or pack; all repositories when empty")
+	trigger := fs.Bool("run", false, "Queue a pack pass instead of only reporting")
+	full := fs.Bool("full", false, "With --run, repack existing packs as well")
+	dumpJSON := fs.Bool("json", false, "Output JSON instead of a table")
+	_ = fs.Parse(args)
+
+	method := http.MethodGet
+	query := url.Values{}
+	if *trigger {
+		method = http.MethodPost
+		if *repo != "" {
+			query.Set("name", *repo)
+		}
+		query.Set("full", strconv.FormatBool(*full))
+	}
+	resp := doRequest(*api, method, "/api/v1/archive/packs", query)
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		fmt.Fprintf(os.Stderr, "archive pack failed: %s %s\n", resp.Status, body)
+		os.Exit(1)
+	}
+
+	var status packJobStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		fmt.Fprintf(os.Stderr, "decode response: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *dumpJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(status)
+		return
+	}
+
+	interval := status.Interval
+	if interval == "" {
+		interval = "off"
+	}
+	fmt.Printf("job: running=%t interval=%s active=%s; %d runs, %d failures, %d packed\n",
+		status.Running, interval, status.Active, status.Runs, status.Failures, status.Packed)
+
+	repos := make([]string, 0, len(status.Repos))
+	for name := range status.Repos {
+		if *repo == "" || name == *repo {
+			repos = append(repos, name)
+		}
+	}
+	slices.Sort(repos)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Repo\tLoose\tPacked\tDead\tPacks\tPackBytes\tLastPacked\tDeltas\tErrors\n")
+	for _, name := range repos {
+		report := status.Repos[name]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", name, report.Stats.LooseEntries, report.Stats.PackedEntries,
+			report.Stats.DeadEntries, report.Stats.Packs, report.Stats.PackBytes, report.Packed, report.Deltas, len(report.Errors))
+	}
+	_ = tw.Flush()
+}
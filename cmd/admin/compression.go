@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"text/tabwriter"
+)
+
+type compressionStats struct {
+	Entries     int            `json:"entries"`
+	RawBytes    int64          `json:"rawBytes"`
+	StoredBytes int64          `json:"storedBytes"`
+	Ratio       float64        `json:"ratio"`
+	ByCodec     map[string]int `json:"byCodec"`
+	Encrypted   int            `json:"encrypted"`
+}
+
+type compressionReport struct {
+	Repo         string           `json:"repo"`
+	StartedAt    string           `json:"startedAt"`
+	Duration     string           `json:"duration"`
+	Codec        string           `json:"codec"`
+	Recompressed int              `json:"recompressed"`
+	Hot          compressionStats `json:"hot"`
+	Archive      compressionStats `json:"archive"`
+	Errors       []string         `json:"errors,omitempty"`
+}
+
+type compressionStatus struct {
+	Running      bool                         `json:"running"`
+	Interval     string                       `json:"interval"`
+	Active       string                       `json:"active"`
+	Runs         int64                        `json:"runs"`
+	Failures     int64                        `json:"failures"`
+	Recompressed int64                        `json:"recompressed"`
+	LastSweep    string                       `json:"lastSweep"`
+	Repos        map[string]compressionReport `json:"repos"`
+}
+
+// runCompression prints per-repository compression stats from the last
+// recompression pass. --run queues a pass for --repo, or for every repository
+// when --repo is empty.
+func runCompression(args []string) {
+	fs := flag.NewFlagSet("compression", flag.ExitOnError)
+	api := fs.String("api", envDefault("KVVS_API", defaultAPI), "Base URL of the kv-vs REST API")
+	repo := fs.String("repo", "", "Repository to show or recompress; all repositories when empty")
+	trigger := fs.Bool("run", false, "Queue a recompression pass instead of only reporting")
+	dumpJSON := fs.Bool("json", false, "Output JSON instead of a table")
+	_ = fs.Parse(args)
+
+	method := http.MethodGet
+	query := url.Values{}
+	if *trigger {
+		method = http.MethodPost
+		if *repo != "" {
+			query.Set("name", *repo)
+		}
+	}
+	resp := doRequest(*api, method, "/api/v1/compression", query)
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		fmt.Fprintf(os.Stderr, "compression failed: %s %s\n", resp.Status, body)
+		os.Exit(1)
+	}
+
+	var status compressionStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		fmt.Fprintf(os.Stderr, "decode response: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *dumpJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(status)
+		return
+	}
+
+	interval := status.Interval
+	if interval == "" {
+		interval = "off"
+	}
+	fmt.Printf("job: running=%t interval=%s active=%s; %d runs, %d failures, %d recompressed\n",
+		status.Running, interval, status.Active, status.Runs, status.Failures, status.Recompressed)
+
+	repos := make([]string, 0, len(status.Repos))
+	for name := range status.Repos {
+		if *repo == "" || name == *repo {
+			repos = append(repos, name)
+		}
+	}
+	slices.Sort(repos)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Repo\tCodec\tHotEntries\tHotRatio\tArchiveEntries\tArchiveRatio\tRecompressed\tErrors\n")
+	for _, name := range repos {
+		report := status.Repos[name]
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%.2f\t%d\t%.2f\t%d\t%d\n", name, report.Codec, report.Hot.Entries, report.Hot.Ratio,
+			report.Archive.Entries, report.Archive.Ratio, report.Recompressed, len(report.Errors))
+	}
+	_ = tw.Flush()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+)
+
+type dataKey struct {
+	ID          int    `json:"id"`
+	MasterKeyID string `json:"masterKeyId"`
+	CreatedAt   string `json:"createdAt"`
+	Current     bool   `json:"current"`
+}
+
+type dataKeyList struct {
+	Repo      string    `json:"repo"`
+	MasterKey string    `json:"masterKey"`
+	DataKeys  []dataKey `json:"dataKeys"`
+}
+
+type reencryptReport struct {
+	Repo      string            `json:"repo"`
+	DataKey   int               `json:"dataKey"`
+	MasterKey string            `json:"masterKey"`
+	Rotated   bool              `json:"rotated"`
+	Rewrapped int               `json:"rewrapped"`
+	Content   compressionReport `json:"content"`
+}
+
+// runReencrypt rewraps a repository's data keys under the active master key
+// and reseals its content under the current data key. --rotate creates a new
+// data key first; --list only shows the repository's data keys.
+func runReencrypt(args []string) {
+	fs := flag.NewFlagSet("reencrypt", flag.ExitOnError)
+	api := fs.String("api", envDefault("KVVS_API", defaultAPI), "Base URL of the kv-vs REST API")
+	repo := fs.String("repo", "", "Repository name (required)")
+	rotate := fs.Bool("rotate", false, "Create a new data key before re-encrypting")
+	list := fs.Bool("list", false, "List data keys instead of re-encrypting")
+	dumpJSON := fs.Bool("json", false, "Output JSON instead of a summary")
+	_ = fs.Parse(args)
+
+	if *repo == "" {
+		fmt.Fprintln(os.Stderr, "--repo is required")
+		os.Exit(1)
+	}
+
+	method := http.MethodPost
+	query := url.Values{"name": {*repo}}
+	if *list {
+		method = http.MethodGet
+	} else if *rotate {
+		query.Set("rotate", "true")
+	}
+	resp := doRequest(*api, method, "/api/v1/encryption", query)
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		fmt.Fprintf(os.Stderr, "reencrypt failed: %s %s\n", resp.Status, body)
+		os.Exit(1)
+	}
+
+	if *list {
+		var keys dataKeyList
+		if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+			fmt.Fprintf(os.Stderr, "decode response: %v\n", err)
+			os.Exit(1)
+		}
+		if *dumpJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			_ = enc.Encode(keys)
+			return
+		}
+		fmt.Printf("%s: active master key %s\n", keys.Repo, keys.MasterKey)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(tw, "DataKey\tMasterKey\tCreated\tCurrent\n")
+		for _, key := range keys.DataKeys {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%t\n", key.ID, key.MasterKeyID, key.CreatedAt, key.Current)
+		}
+		_ = tw.Flush()
+		return
+	}
+
+	var report reencryptReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		fmt.Fprintf(os.Stderr, "decode response: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *dumpJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+	} else {
+		rotated := ""
+		if report.Rotated {
+			rotated = " (rotated)"
+		}
+		fmt.Printf("%s: data key %d%s under master key %s; %d data keys rewrapped, %d payloads resealed; %d hot and %d archived entries encrypted\n",
+			report.Repo, report.DataKey, rotated, report.MasterKey, report.Rewrapped, report.Content.Recompressed,
+			report.Content.Hot.Encrypted, report.Content.Archive.Encrypted)
+		for _, msg := range report.Content.Errors {
+			fmt.Printf("  error: %s\n", msg)
+		}
+	}
+	if len(report.Content.Errors) > 0 {
+		os.Exit(2)
+	}
+}
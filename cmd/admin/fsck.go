@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"text/tabwriter"
+)
+
+type checkIssue struct {
+	Kind        string `json:"kind"`
+	Hash        string `json:"hash,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Key         string `json:"key,omitempty"`
+	Detail      string `json:"detail"`
+	Repairable  bool   `json:"repairable"`
+	Repaired    bool   `json:"repaired"`
+	RepairError string `json:"repairError,omitempty"`
+}
+
+type checkReport struct {
+	Repo      string       `json:"repo"`
+	CheckedAt string       `json:"checkedAt"`
+	Repair    bool         `json:"repair"`
+	Commits   int          `json:"commits"`
+	Branches  int          `json:"branches"`
+	Tags      int          `json:"tags"`
+	Issues    []checkIssue `json:"issues"`
+}
+
+// runFsck checks a repository for integrity problems and optionally repairs
+// them. It exits with status 2 when unresolved issues remain.
+func runFsck(args []string) {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	api := fs.String("api", envDefault("KVVS_API", defaultAPI), "Base URL of the kv-vs REST API")
+	repo := fs.String("repo", "", "Repository name (required)")
+	repair := fs.Bool("repair", false, "Apply safe repairs")
+	dumpJSON := fs.Bool("json", false, "Output JSON instead of table")
+	_ = fs.Parse(args)
+
+	if *repo == "" {
+		fmt.Fprintln(os.Stderr, "--repo is required")
+		os.Exit(1)
+	}
+
+	method := http.MethodGet
+	query := url.Values{"name": {*repo}}
+	if *repair {
+		method = http.MethodPost
+		query.Set("repair", strconv.FormatBool(true))
+	}
+	resp := doRequest(*api, method, "/api/v1/fsck", query)
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		fmt.Fprintf(os.Stderr, "fsck failed: %s %s\n", resp.Status, body)
+		os.Exit(1)
+	}
+
+	var report checkReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		fmt.Fprintf(os.Stderr, "decode response: %v\n", err)
+		os.Exit(1)
+	}
+
+	unresolved := 0
+	for _, issue := range report.Issues {
+		if !issue.Repaired {
+			unresolved++
+		}
+	}
+
+	if *dumpJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+	} else {
+		fmt.Printf("%s: %d commits, %d branches, %d tags, %d issues (%d unresolved)\n",
+			report.Repo, report.Commits, report.Branches, report.Tags, len(report.Issues), unresolved)
+		if len(report.Issues) > 0 {
+			tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintf(tw, "Kind\tTarget\tRepairable\tRepaired\tDetail\n")
+			for _, issue := range report.Issues {
+				target := issue.Hash
+				if issue.Name != "" {
+					target = issue.Name
+				}
+				if target == "" {
+					target = issue.Key
+				}
+				detail := issue.Detail
+				if issue.RepairError != "" {
+					detail += " (repair failed: " + issue.RepairError + ")"
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%t\t%t\t%s\n", issue.Kind, target, issue.Repairable, issue.Repaired, detail)
+			}
+			_ = tw.Flush()
+		}
+	}
+
+	if unresolved > 0 {
+		os.Exit(2)
+	}
+}
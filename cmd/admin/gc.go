@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+type gcReport struct {
+	Repo            string   `json:"repo"`
+	StartedAt       string   `json:"startedAt"`
+	DryRun          bool     `json:"dryRun"`
+	GracePeriod     string   `json:"gracePeriod"`
+	Reachable       int      `json:"reachable"`
+	Retained        int      `json:"retained"`
+	Commits         []string `json:"commits"`
+	OrphanedContent []string `json:"orphanedContent"`
+	OrphanedIndex   []string `json:"orphanedIndex"`
+	ArchiveRemoved  int      `json:"archiveRemoved"`
+	Errors          []string `json:"errors,omitempty"`
+}
+
+// runGC reports or collects unreachable commits. Without --apply it only
+// performs a dry run.
+func runGC(args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	api := fs.String("api", envDefault("KVVS_API", defaultAPI), "Base URL of the kv-vs REST API")
+	repo := fs.String("repo", "", "Repository name (required)")
+	grace := fs.String("grace", "", "Grace period override (e.g. 72h); server default when empty")
+	apply := fs.Bool("apply", false, "Delete unreachable commits instead of a dry run")
+	dumpJSON := fs.Bool("json", false, "Output JSON instead of a summary")
+	_ = fs.Parse(args)
+
+	if *repo == "" {
+		fmt.Fprintln(os.Stderr, "--repo is required")
+		os.Exit(1)
+	}
+
+	method := http.MethodGet
+	query := url.Values{"name": {*repo}}
+	if *grace != "" {
+		query.Set("grace", *grace)
+	}
+	if *apply {
+		method = http.MethodPost
+	}
+	resp := doRequest(*api, method, "/api/v1/gc", query)
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		fmt.Fprintf(os.Stderr, "gc failed: %s %s\n", resp.Status, body)
+		os.Exit(1)
+	}
+
+	var report gcReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		fmt.Fprintf(os.Stderr, "decode response: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *dumpJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+		return
+	}
+
+	verb := "collected"
+	if report.DryRun {
+		verb = "would collect"
+	}
+	fmt.Printf("%s: %d reachable, %d retained by %s grace; %s %d commits, %d orphaned content, %d orphaned index entries\n",
+		report.Repo, report.Reachable, report.Retained, report.GracePeriod, verb,
+		len(report.Commits), len(report.OrphanedContent), len(report.OrphanedIndex))
+	for _, hash := range report.Commits {
+		fmt.Printf("  %s\n", hash)
+	}
+	if len(report.Errors) > 0 {
+		fmt.Fprintf(os.Stderr, "errors:\n  %s\n", strings.Join(report.Errors, "\n  "))
+		os.Exit(2)
+	}
+}
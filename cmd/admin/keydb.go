@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/onexay/kv-vs/internal/config"
+	"github.com/onexay/kv-vs/internal/storage"
+)
+
+// runKeyDBMigrate shows the KeyDB schema version and applies pending schema
+// migrations to the database the KEYDB_* environment describes. It talks to
+// KeyDB directly and takes the same lock as API replicas migrating at
+// startup. Without --apply it only reports what would change.
+func runKeyDBMigrate(args []string) {
+	fs := flag.NewFlagSet("keydb-migrate", flag.ExitOnError)
+	apply := fs.Bool("apply", false, "Apply pending migrations instead of a dry run")
+	lockWait := fs.Duration("lock-wait", 0, "How long to wait for a migration another process is running (default 2m)")
+	dumpJSON := fs.Bool("json", false, "Output JSON instead of a table")
+	_ = fs.Parse(args)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	report, err := storage.MigrateKeyDBSchema(ctx, config.Load().Storage.KeyDB, storage.SchemaOptions{DryRun: !*apply, LockWait: *lockWait})
+
+	if *dumpJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+	} else if err == nil || len(report.Migrations) > 0 {
+		prefix := report.Prefix
+		if prefix == "" {
+			prefix = "(none)"
+		}
+		fmt.Printf("schema version %d of %d, prefix %s\n", report.Version, report.Target, prefix)
+		if len(report.Migrations) > 0 {
+			changed := "CHANGED"
+			if report.DryRun {
+				changed = "WOULD CHANGE"
+			}
+			tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintf(tw, "VERSION\tNAME\t%s\tUNCHANGED\tREPOS\tDURATION\tERRORS\n", changed)
+			for _, step := range report.Migrations {
+				fmt.Fprintf(tw, "%d\t%s\t%d\t%d\t%d\t%s\t%d\n", step.Version, step.Name, step.Changed, step.Unchanged, len(step.Repos), step.Duration, len(step.Errors))
+			}
+			_ = tw.Flush()
+		}
+	}
+	for _, step := range report.Migrations {
+		if len(step.Errors) > 0 {
+			fmt.Fprintf(os.Stderr, "migration %d errors:\n  %s\n", step.Version, strings.Join(step.Errors, "\n  "))
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "keydb migration failed: %v\n", err)
+		if len(report.Migrations) > 0 {
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+}
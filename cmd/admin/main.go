@@ -19,37 +19,74 @@ type policyResponse struct {
 	Name           string `json:"name"`
 	HotCommitLimit int    `json:"hotCommitLimit"`
 	HotDuration    string `json:"hotDuration"`
-	Locked         bool   `json:"locked"`
+	PurgeAfter     string `json:"purgeAfter"`
+	PinTags        bool   `json:"pinTags"`
+	PinBranchHeads bool   `json:"pinBranchHeads"`
+	Compression    string `json:"compression"`
+	Version        int    `json:"version"`
+	UpdatedAt      string `json:"updatedAt"`
+	AuthorID       string `json:"authorId"`
+	Reason         string `json:"reason"`
 }
 
 func main() {
-	api := flag.String("api", envDefault("KVVS_API", defaultAPI), "Base URL of the kv-vs REST API")
-	repo := flag.String("repo", "", "Repository name (required)")
-	dumpJSON := flag.Bool("json", false, "Output JSON instead of table")
-	flag.Parse()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "fsck":
+			runFsck(os.Args[2:])
+			return
+		case "gc":
+			runGC(os.Args[2:])
+			return
+		case "retention":
+			runRetention(os.Args[2:])
+			return
+		case "compression":
+			runCompression(os.Args[2:])
+			return
+		case "reencrypt":
+			runReencrypt(os.Args[2:])
+			return
+		case "archive-scan":
+			runArchiveScan(os.Args[2:])
+			return
+		case "archive-pack":
+			runArchivePack(os.Args[2:])
+			return
+		case "archive-tiers":
+			runArchiveTiers(os.Args[2:])
+			return
+		case "archive-migrate":
+			runArchiveMigrate(os.Args[2:])
+			return
+		case "keydb-migrate":
+			runKeyDBMigrate(os.Args[2:])
+			return
+		}
+	}
+	runPolicy(os.Args[1:])
+}
+
+// runPolicy prints the retention policy of a repository, or every version of
+// it with --history. It is the default command when no subcommand is given.
+func runPolicy(args []string) {
+	fs := flag.NewFlagSet("policy", flag.ExitOnError)
+	api := fs.String("api", envDefault("KVVS_API", defaultAPI), "Base URL of the kv-vs REST API")
+	repo := fs.String("repo", "", "Repository name (required)")
+	dumpJSON := fs.Bool("json", false, "Output JSON instead of table")
+	history := fs.Bool("history", false, "Show every version of the policy")
+	_ = fs.Parse(args)
 
 	if *repo == "" {
 		fmt.Fprintln(os.Stderr, "--repo is required")
 		os.Exit(1)
 	}
 
-	query := url.Values{"name": {*repo}}
-	endpoint := fmt.Sprintf("%s/api/v1/policies?%s", strings.TrimRight(*api, "/"), query.Encode())
-
-	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "build request: %v\n", err)
-		os.Exit(1)
-	}
-
-	req.Header.Set("X-Author-Name", "admin")
-	req.Header.Set("X-Author-ID", "admin-cli")
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "request failed: %v\n", err)
-		os.Exit(1)
+	path := "/api/v1/policies"
+	if *history {
+		path += "/history"
 	}
+	resp := doRequest(*api, http.MethodGet, path, url.Values{"name": {*repo}})
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 300 {
@@ -57,25 +94,66 @@ func main() {
 		os.Exit(1)
 	}
 
-	var policy policyResponse
-	if err := json.NewDecoder(resp.Body).Decode(&policy); err != nil {
-		fmt.Fprintf(os.Stderr, "decode response: %v\n", err)
-		os.Exit(1)
+	var policies []policyResponse
+	if *history {
+		if err := json.NewDecoder(resp.Body).Decode(&policies); err != nil {
+			fmt.Fprintf(os.Stderr, "decode response: %v\n", err)
+			os.Exit(1)
+		}
+	} else {
+		var policy policyResponse
+		if err := json.NewDecoder(resp.Body).Decode(&policy); err != nil {
+			fmt.Fprintf(os.Stderr, "decode response: %v\n", err)
+			os.Exit(1)
+		}
+		policies = append(policies, policy)
 	}
 
 	if *dumpJSON {
 		enc := json.NewEncoder(os.Stdout)
 		enc.SetIndent("", "  ")
-		_ = enc.Encode(policy)
+		if *history {
+			_ = enc.Encode(policies)
+		} else {
+			_ = enc.Encode(policies[0])
+		}
 		return
 	}
 
 	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
-	fmt.Fprintf(tw, "Repo\tHotLimit\tHotDuration\tLocked\n")
-	fmt.Fprintf(tw, "%s\t%d\t%s\t%t\n", policy.Name, policy.HotCommitLimit, policy.HotDuration, policy.Locked)
+	fmt.Fprintf(tw, "Repo\tVersion\tHotLimit\tHotDuration\tPurgeAfter\tPinTags\tPinHeads\tCompression\tUpdatedAt\tUpdatedBy\tReason\n")
+	for _, policy := range policies {
+		compression := policy.Compression
+		if compression == "" {
+			compression = "default"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%t\t%t\t%s\t%s\t%s\t%s\n", *repo, policy.Version, policy.HotCommitLimit, policy.HotDuration,
+			policy.PurgeAfter, policy.PinTags, policy.PinBranchHeads, compression, policy.UpdatedAt, policy.AuthorID, policy.Reason)
+	}
 	_ = tw.Flush()
 }
 
+// doRequest calls the API with the admin author headers, exiting on transport errors.
+func doRequest(api, method, path string, query url.Values) *http.Response {
+	endpoint := fmt.Sprintf("%s%s?%s", strings.TrimRight(api, "/"), path, query.Encode())
+
+	req, err := http.NewRequest(method, endpoint, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "build request: %v\n", err)
+		os.Exit(1)
+	}
+
+	req.Header.Set("X-Author-Name", "admin")
+	req.Header.Set("X-Author-ID", "admin-cli")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "request failed: %v\n", err)
+		os.Exit(1)
+	}
+	return resp
+}
+
 func envDefault(key, def string) string {
 	if v := os.Getenv(key); v != "" {
 		return v
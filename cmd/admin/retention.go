@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+type retentionRun struct {
+	Repo      string   `json:"repo"`
+	StartedAt string   `json:"startedAt"`
+	Duration  string   `json:"duration"`
+	Archived  int      `json:"archived"`
+	Purged    int      `json:"purged"`
+	Restored  int      `json:"restored"`
+	Errors    []string `json:"errors,omitempty"`
+}
+
+type retentionStatus struct {
+	Running       bool                    `json:"running"`
+	Concurrency   int                     `json:"concurrency"`
+	SweepInterval string                  `json:"sweepInterval"`
+	Queued        int                     `json:"queued"`
+	Active        []string                `json:"active"`
+	Runs          int64                   `json:"runs"`
+	Failures      int64                   `json:"failures"`
+	Dropped       int64                   `json:"dropped"`
+	Archived      int64                   `json:"archived"`
+	Purged        int64                   `json:"purged"`
+	Restored      int64                   `json:"restored"`
+	LastSweep     string                  `json:"lastSweep"`
+	LastRun       *retentionRun           `json:"lastRun"`
+	Repos         map[string]retentionRun `json:"repos"`
+}
+
+// runRetention prints the background retention worker status. --run queues a
+// pass for --repo, or a sweep of every repository when --repo is empty.
+func runRetention(args []string) {
+	fs := flag.NewFlagSet("retention", flag.ExitOnError)
+	api := fs.String("api", envDefault("KVVS_API", defaultAPI), "Base URL of the kv-vs REST API")
+	repo := fs.String("repo", "", "Repository to show or queue; all repositories when empty")
+	trigger := fs.Bool("run", false, "Queue a retention pass instead of only reporting")
+	dumpJSON := fs.Bool("json", false, "Output JSON instead of a summary")
+	_ = fs.Parse(args)
+
+	method := http.MethodGet
+	query := url.Values{}
+	if *trigger {
+		method = http.MethodPost
+		if *repo != "" {
+			query.Set("name", *repo)
+		}
+	}
+	resp := doRequest(*api, method, "/api/v1/retention", query)
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		fmt.Fprintf(os.Stderr, "retention failed: %s %s\n", resp.Status, body)
+		os.Exit(1)
+	}
+
+	var status retentionStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		fmt.Fprintf(os.Stderr, "decode response: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *dumpJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(status)
+		return
+	}
+
+	sweep := status.SweepInterval
+	if sweep == "" {
+		sweep = "off"
+	}
+	fmt.Printf("worker: running=%t concurrency=%d sweep=%s queued=%d active=%s\n",
+		status.Running, status.Concurrency, sweep, status.Queued, strings.Join(status.Active, ","))
+	fmt.Printf("totals: %d runs, %d failures, %d dropped; archived %d, purged %d, restored %d\n",
+		status.Runs, status.Failures, status.Dropped, status.Archived, status.Purged, status.Restored)
+	if status.LastSweep != "" {
+		fmt.Printf("last sweep: %s\n", status.LastSweep)
+	}
+
+	run := status.LastRun
+	if *repo != "" {
+		last, ok := status.Repos[*repo]
+		run = &last
+		if !ok {
+			run = nil
+		}
+	}
+	if run == nil {
+		return
+	}
+	fmt.Printf("last run: %s at %s took %s; archived %d, purged %d, restored %d\n",
+		run.Repo, run.StartedAt, run.Duration, run.Archived, run.Purged, run.Restored)
+	if len(run.Errors) > 0 {
+		fmt.Fprintf(os.Stderr, "errors:\n  %s\n", strings.Join(run.Errors, "\n  "))
+		os.Exit(2)
+	}
+}
@@ -3,18 +3,36 @@ package main
 import (
 	"context"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/onexay/kv-vs/internal/httpserver"
 )
 
 func main() {
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	srv, err := httpserver.NewServer(ctx)
 	if err != nil {
 		log.Fatalf("failed to initialize server: %v", err)
 	}
 
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+	}()
+
 	if err := srv.Run(); err != nil {
 		log.Fatalf("server terminated: %v", err)
 	}
+	<-stopped
 }
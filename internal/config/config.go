@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"strconv"
 	"strings"
@@ -17,26 +18,153 @@ const (
 	StorageBackendMemory StorageBackend = "memory"
 	// StorageBackendKeyDB persists data to KeyDB/Redis.
 	StorageBackendKeyDB StorageBackend = "keydb"
+	// StorageBackendBolt persists data to an embedded BoltDB file.
+	StorageBackendBolt StorageBackend = "bolt"
+	// StorageBackendSQLite persists data to a SQLite database.
+	StorageBackendSQLite StorageBackend = "sqlite"
 )
 
 // Config aggregates runtime configuration.
 type Config struct {
-	APIAddr   string
-	Storage   StorageConfig
-	Retention RetentionConfig
+	APIAddr    string
+	Storage    StorageConfig
+	Retention  RetentionConfig
+	Encryption EncryptionConfig
 }
 
 // StorageConfig contains backend selection and nested settings.
 type StorageConfig struct {
 	Backend StorageBackend
 	KeyDB   storage.Config
+	Memory  storage.PersistenceConfig
+	// MemoryMaxBytes bounds the content the memory backend keeps hot; the
+	// least recently used content beyond it is spilled to the archive. Zero
+	// leaves it unbounded.
+	MemoryMaxBytes int64
+	Bolt           storage.BoltConfig
+	SQLite         storage.SQLiteConfig
+	// Cache configures the read cache in front of the KeyDB, Bolt and SQLite
+	// backends; a MaxBytes of zero, the default, disables it.
+	Cache storage.CacheConfig
+}
+
+// ArchiveBackend enumerates supported archive stores.
+type ArchiveBackend string
+
+const (
+	// ArchiveBackendBolt archives content to a local BoltDB file.
+	ArchiveBackendBolt ArchiveBackend = "bolt"
+	// ArchiveBackendFS archives content as plain files in a directory tree.
+	ArchiveBackendFS ArchiveBackend = "fs"
+	// ArchiveBackendS3 archives content to an S3-compatible bucket.
+	ArchiveBackendS3 ArchiveBackend = "s3"
+	// ArchiveBackendTiered chains several backends, see ArchiveTiers.
+	ArchiveBackendTiered ArchiveBackend = "tiered"
+)
+
+// ArchiveTierConfig is one tier of the tiered archive backend.
+type ArchiveTierConfig struct {
+	Backend ArchiveBackend
+	// MaxAge is how long content stays in the tier before demotion; zero
+	// keeps it.
+	MaxAge time.Duration
+}
+
+// ParseArchiveTiers parses a comma-separated list of "<backend>[:<max age>]"
+// tiers, warmest first, such as "bolt:720h,s3".
+func ParseArchiveTiers(spec string) ([]ArchiveTierConfig, error) {
+	var tiers []ArchiveTierConfig
+	seen := make(map[ArchiveBackend]bool)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, age, hasAge := strings.Cut(item, ":")
+		tier := ArchiveTierConfig{Backend: ArchiveBackend(strings.ToLower(name))}
+		switch tier.Backend {
+		case ArchiveBackendBolt, ArchiveBackendFS, ArchiveBackendS3:
+		default:
+			return nil, fmt.Errorf("unknown archive tier %q", name)
+		}
+		if seen[tier.Backend] {
+			return nil, fmt.Errorf("archive tier %q listed twice", name)
+		}
+		seen[tier.Backend] = true
+		if hasAge {
+			d, err := time.ParseDuration(age)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("invalid max age %q for archive tier %q", age, name)
+			}
+			tier.MaxAge = d
+		}
+		tiers = append(tiers, tier)
+	}
+	if len(tiers) == 0 {
+		return nil, fmt.Errorf("tiered archive needs at least one tier")
+	}
+	return tiers, nil
 }
 
 // RetentionConfig holds defaults for blob archival.
 type RetentionConfig struct {
+	// ArchiveBackend selects where archived content lives; ArchivePath is
+	// the Bolt file, FS the directory tree and S3 the bucket settings.
+	ArchiveBackend ArchiveBackend
 	ArchivePath    string
+	FS             storage.FSArchiveConfig
+	S3             storage.S3Config
+	// ArchiveTiers lists the tiers of the tiered backend (see
+	// ParseArchiveTiers); TierIndexPath records where each payload lives and
+	// DemoteInterval schedules demotion.
+	ArchiveTiers   string
+	TierIndexPath  string
+	DemoteInterval time.Duration
 	HotCommitLimit int
 	HotDuration    time.Duration
+	// PurgeAfter permanently deletes content older than this; zero keeps it forever.
+	PurgeAfter time.Duration
+	// GCGracePeriod protects recent unreachable commits from garbage collection.
+	GCGracePeriod time.Duration
+	// PinTags and PinBranchHeads keep tagged and branch-head commits hot by
+	// default for repositories without an explicit policy.
+	PinTags        bool
+	PinBranchHeads bool
+	// PolicyCooldown is the minimum time between changes to a repository's
+	// policy; PolicyAdmins lists the author IDs allowed to set policies (no
+	// one when empty).
+	PolicyCooldown time.Duration
+	PolicyAdmins   []string
+	// Workers, SweepInterval and QueueSize tune the background retention worker.
+	Workers       int
+	SweepInterval time.Duration
+	QueueSize     int
+	// RehydrateBytes bounds the in-memory tier that serves frequently read
+	// archived content (zero disables it); RehydrateTTL and RehydrateMinReads
+	// control how long content stays there and how many reads promote it.
+	RehydrateBytes    int64
+	RehydrateTTL      time.Duration
+	RehydrateMinReads int
+	// Compression is the default codec for stored content (none, gzip or
+	// zstd); RecompressInterval schedules the job that rewrites content to
+	// each repository's codec (zero disables scheduled runs).
+	Compression        string
+	RecompressInterval time.Duration
+	// PackInterval schedules the job that packs loose payloads of the bolt
+	// archive into delta-compressed packs (zero disables scheduled runs);
+	// Pack tunes the packs.
+	PackInterval time.Duration
+	Pack         storage.PackOptions
+}
+
+// EncryptionConfig locates the master keys that wrap per-repository data
+// keys. Content is stored unencrypted when neither is set.
+type EncryptionConfig struct {
+	// KeyFile holds one "<id>:<base64 key>" entry per line.
+	KeyFile string
+	// MasterKeys holds comma-separated "<id>:<base64 key>" entries and takes
+	// precedence over KeyFile for the active key.
+	MasterKeys string
 }
 
 // Load reads configuration from environment variables.
@@ -48,16 +176,110 @@ func Load() Config {
 		Storage: StorageConfig{
 			Backend: backend,
 			KeyDB: storage.Config{
-				Addr:     os.Getenv("KEYDB_ADDR"),
-				Username: os.Getenv("KEYDB_USERNAME"),
-				Password: os.Getenv("KEYDB_PASSWORD"),
-				Database: envInt("KEYDB_DB", 0),
+				Mode:             storage.KeyDBMode(strings.ToLower(envDefault("KEYDB_MODE", string(storage.KeyDBModeStandalone)))),
+				Addr:             os.Getenv("KEYDB_ADDR"),
+				Addrs:            envList("KEYDB_ADDRS"),
+				Username:         os.Getenv("KEYDB_USERNAME"),
+				Password:         os.Getenv("KEYDB_PASSWORD"),
+				Database:         envInt("KEYDB_DB", 0),
+				KeyPrefix:        os.Getenv("KEYDB_KEY_PREFIX"),
+				Migrate:          storage.KeyDBMigrateMode(strings.ToLower(envDefault("KEYDB_MIGRATE", string(storage.KeyDBMigrateAuto)))),
+				MigrateLockWait:  envDuration("KEYDB_MIGRATE_LOCK_WAIT", 2*time.Minute),
+				MasterName:       os.Getenv("KEYDB_MASTER_NAME"),
+				SentinelUsername: os.Getenv("KEYDB_SENTINEL_USERNAME"),
+				SentinelPassword: os.Getenv("KEYDB_SENTINEL_PASSWORD"),
+				TLS: storage.KeyDBTLSConfig{
+					Enabled:            envBool("KEYDB_TLS", false),
+					CAFile:             os.Getenv("KEYDB_TLS_CA_FILE"),
+					CertFile:           os.Getenv("KEYDB_TLS_CERT_FILE"),
+					KeyFile:            os.Getenv("KEYDB_TLS_KEY_FILE"),
+					ServerName:         os.Getenv("KEYDB_TLS_SERVER_NAME"),
+					InsecureSkipVerify: envBool("KEYDB_TLS_INSECURE_SKIP_VERIFY", false),
+				},
+				PoolSize:        envInt("KEYDB_POOL_SIZE", 0),
+				MinIdleConns:    envInt("KEYDB_MIN_IDLE_CONNS", 0),
+				PoolTimeout:     envDuration("KEYDB_POOL_TIMEOUT", 4*time.Second),
+				ConnMaxIdleTime: envDuration("KEYDB_CONN_MAX_IDLE_TIME", 30*time.Minute),
+				DialTimeout:     envDuration("KEYDB_DIAL_TIMEOUT", 5*time.Second),
+				ReadTimeout:     envDuration("KEYDB_READ_TIMEOUT", 3*time.Second),
+				WriteTimeout:    envDuration("KEYDB_WRITE_TIMEOUT", 3*time.Second),
+				TxRetries:       envInt("KEYDB_TX_RETRIES", 10),
+				TxBackoff:       envDuration("KEYDB_TX_BACKOFF", 10*time.Millisecond),
+				TxMaxBackoff:    envDuration("KEYDB_TX_MAX_BACKOFF", 500*time.Millisecond),
+				ReadBatchSize:   envInt("KEYDB_READ_BATCH_SIZE", 100),
+			},
+			Memory: storage.PersistenceConfig{
+				Dir:              os.Getenv("MEMORY_DATA_DIR"),
+				Fsync:            storage.FsyncPolicy(strings.ToLower(envDefault("MEMORY_FSYNC", string(storage.FsyncInterval)))),
+				FsyncInterval:    envDuration("MEMORY_FSYNC_INTERVAL", time.Second),
+				SnapshotInterval: envDuration("MEMORY_SNAPSHOT_INTERVAL", 5*time.Minute),
+				SnapshotRecords:  envInt("MEMORY_SNAPSHOT_RECORDS", 10000),
+			},
+			MemoryMaxBytes: int64(envInt("MEMORY_MAX_BYTES", 0)),
+			Cache: storage.CacheConfig{
+				MaxBytes:  int64(envInt("CACHE_MAX_BYTES", 0)),
+				BranchTTL: envDuration("CACHE_BRANCH_TTL", time.Second),
+				CommitTTL: envDuration("CACHE_COMMIT_TTL", time.Minute),
+			},
+			Bolt: storage.BoltConfig{
+				Path:    envDefault("BOLT_PATH", "data/kv-vs.db"),
+				Timeout: envDuration("BOLT_OPEN_TIMEOUT", 2*time.Second),
+			},
+			SQLite: storage.SQLiteConfig{
+				Path:        envDefault("SQLITE_PATH", "data/kv-vs.sqlite"),
+				BusyTimeout: envDuration("SQLITE_BUSY_TIMEOUT", 5*time.Second),
 			},
 		},
 		Retention: RetentionConfig{
+			ArchiveBackend: ArchiveBackend(strings.ToLower(envDefault("RETENTION_ARCHIVE_BACKEND", string(ArchiveBackendBolt)))),
 			ArchivePath:    envDefault("RETENTION_ARCHIVE_PATH", "data/archive.db"),
-			HotCommitLimit: envInt("RETENTION_HOT_COMMIT_LIMIT", 0),
-			HotDuration:    envDuration("RETENTION_HOT_DURATION", 0),
+			FS: storage.FSArchiveConfig{
+				Root:        envDefault("RETENTION_ARCHIVE_DIR", "data/archive"),
+				ShardDepth:  envInt("RETENTION_ARCHIVE_SHARD_DEPTH", 2),
+				Compression: storage.Codec(strings.ToLower(envDefault("RETENTION_ARCHIVE_COMPRESSION", string(storage.CodecNone)))),
+			},
+			ArchiveTiers:   os.Getenv("RETENTION_ARCHIVE_TIERS"),
+			TierIndexPath:  envDefault("RETENTION_ARCHIVE_TIER_INDEX", "data/archive-tiers.db"),
+			DemoteInterval: envDuration("RETENTION_ARCHIVE_DEMOTE_INTERVAL", time.Hour),
+			S3: storage.S3Config{
+				Endpoint:   os.Getenv("RETENTION_S3_ENDPOINT"),
+				Region:     os.Getenv("RETENTION_S3_REGION"),
+				Bucket:     os.Getenv("RETENTION_S3_BUCKET"),
+				Prefix:     os.Getenv("RETENTION_S3_PREFIX"),
+				AccessKey:  os.Getenv("RETENTION_S3_ACCESS_KEY"),
+				SecretKey:  os.Getenv("RETENTION_S3_SECRET_KEY"),
+				PathStyle:  envBool("RETENTION_S3_PATH_STYLE", false),
+				PartSize:   int64(envInt("RETENTION_S3_PART_SIZE", 8<<20)),
+				MaxRetries: envInt("RETENTION_S3_MAX_RETRIES", 3),
+				Timeout:    envDuration("RETENTION_S3_TIMEOUT", 30*time.Second),
+			},
+			HotCommitLimit:     envInt("RETENTION_HOT_COMMIT_LIMIT", 0),
+			HotDuration:        envDuration("RETENTION_HOT_DURATION", 0),
+			PurgeAfter:         envDuration("RETENTION_PURGE_AFTER", 0),
+			GCGracePeriod:      envDuration("RETENTION_GC_GRACE", 24*time.Hour),
+			PinTags:            envBool("RETENTION_PIN_TAGS", true),
+			PinBranchHeads:     envBool("RETENTION_PIN_BRANCH_HEADS", true),
+			PolicyCooldown:     envDuration("RETENTION_POLICY_COOLDOWN", time.Hour),
+			PolicyAdmins:       envList("RETENTION_POLICY_ADMINS"),
+			Workers:            envInt("RETENTION_WORKERS", 1),
+			SweepInterval:      envDuration("RETENTION_SWEEP_INTERVAL", time.Hour),
+			QueueSize:          envInt("RETENTION_QUEUE_SIZE", 1024),
+			RehydrateBytes:     int64(envInt("RETENTION_REHYDRATE_BYTES", 64<<20)),
+			RehydrateTTL:       envDuration("RETENTION_REHYDRATE_TTL", time.Hour),
+			RehydrateMinReads:  envInt("RETENTION_REHYDRATE_MIN_READS", 2),
+			Compression:        strings.ToLower(envDefault("RETENTION_COMPRESSION", string(storage.CodecNone))),
+			RecompressInterval: envDuration("RETENTION_RECOMPRESS_INTERVAL", 24*time.Hour),
+			PackInterval:       envDuration("RETENTION_PACK_INTERVAL", 6*time.Hour),
+			Pack: storage.PackOptions{
+				MinObjects:   envInt("RETENTION_PACK_MIN_OBJECTS", 64),
+				Window:       envInt("RETENTION_PACK_WINDOW", 10),
+				MaxDepth:     envInt("RETENTION_PACK_DEPTH", 50),
+				MaxPackBytes: int64(envInt("RETENTION_PACK_MAX_BYTES", 256<<20)),
+			},
+		},
+		Encryption: EncryptionConfig{
+			KeyFile:    os.Getenv("ENCRYPTION_KEYFILE"),
+			MasterKeys: os.Getenv("ENCRYPTION_MASTER_KEY"),
 		},
 	}
 }
@@ -86,3 +308,22 @@ func envDuration(key string, def time.Duration) time.Duration {
 	}
 	return def
 }
+
+func envBool(key string, def bool) bool {
+	if val := os.Getenv(key); val != "" {
+		if b, err := strconv.ParseBool(val); err == nil {
+			return b
+		}
+	}
+	return def
+}
+
+func envList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
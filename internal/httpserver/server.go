@@ -2,6 +2,7 @@ package httpserver
 
 import (
 	"context"
+	"errors"
 	"net/http"
 
 	"github.com/onexay/kv-vs/internal/config"
@@ -10,8 +11,8 @@ import (
 
 // Server wraps the HTTP server configuration and dependencies.
 type Server struct {
-	addr    string
-	handler http.Handler
+	svc  *service.Service
+	http *http.Server
 }
 
 // NewServer creates an HTTP server with routes and middleware.
@@ -32,10 +33,22 @@ func NewServer(ctx context.Context) (*Server, error) {
 	mux.Handle("/swagger/", service.SwaggerHandler(svc))
 	mux.Handle("/api/v1/", service.Handler(svc))
 
-	return &Server{addr: cfg.APIAddr, handler: mux}, nil
+	return &Server{svc: svc, http: &http.Server{Addr: cfg.APIAddr, Handler: mux}}, nil
 }
 
 // Run starts the HTTP server and blocks until shutdown.
 func (s *Server) Run() error {
-	return http.ListenAndServe(s.addr, s.handler)
+	if err := s.http.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops accepting requests, drains in-flight ones and closes storage.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.http.Shutdown(ctx)
+	if closeErr := s.svc.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
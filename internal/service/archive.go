@@ -0,0 +1,319 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/onexay/kv-vs/internal/config"
+	"github.com/onexay/kv-vs/internal/storage"
+)
+
+// archiveSet holds the archive backends opened from the configuration.
+type archiveSet struct {
+	// archive is what the store uses; nil disables archival.
+	archive storage.Archive
+	// backends are the open backends by name, reused by migrations.
+	backends map[config.ArchiveBackend]storage.Archive
+	// fs is the filesystem backend scanned by /api/v1/archive/scan, if open.
+	fs *storage.FSArchive
+	// bolt is the Bolt backend packed by /api/v1/archive/packs, if open.
+	bolt   *storage.BoltArchive
+	tiered *storage.TieredArchive
+}
+
+// openArchives opens the configured archive backend, or every tier of the
+// tiered backend.
+func openArchives(cfg config.RetentionConfig) (*archiveSet, error) {
+	set := &archiveSet{backends: make(map[config.ArchiveBackend]storage.Archive)}
+	switch cfg.ArchiveBackend {
+	case config.ArchiveBackendTiered:
+		tierCfgs, err := config.ParseArchiveTiers(cfg.ArchiveTiers)
+		if err != nil {
+			return nil, err
+		}
+		tiers := make([]storage.ArchiveTier, 0, len(tierCfgs))
+		for _, tierCfg := range tierCfgs {
+			arc, err := set.open(cfg, tierCfg.Backend)
+			if err != nil {
+				_ = set.Close()
+				return nil, err
+			}
+			tiers = append(tiers, storage.ArchiveTier{Name: string(tierCfg.Backend), Archive: arc, MaxAge: tierCfg.MaxAge})
+		}
+		tiered, err := storage.NewTieredArchive(storage.TieredArchiveConfig{
+			Tiers:          tiers,
+			IndexPath:      cfg.TierIndexPath,
+			DemoteInterval: cfg.DemoteInterval,
+		})
+		if err != nil {
+			_ = set.Close()
+			return nil, err
+		}
+		set.archive, set.tiered = tiered, tiered
+	case config.ArchiveBackendFS, config.ArchiveBackendS3:
+		arc, err := set.open(cfg, cfg.ArchiveBackend)
+		if err != nil {
+			return nil, err
+		}
+		set.archive = arc
+	case "", config.ArchiveBackendBolt:
+		if cfg.ArchivePath == "" {
+			return set, nil
+		}
+		arc, err := set.open(cfg, config.ArchiveBackendBolt)
+		if err != nil {
+			return nil, err
+		}
+		set.archive = arc
+	default:
+		return nil, fmt.Errorf("unknown archive backend %q", cfg.ArchiveBackend)
+	}
+	return set, nil
+}
+
+// open returns the backend named kind, opening and recording it unless it
+// is open already.
+func (a *archiveSet) open(cfg config.RetentionConfig, kind config.ArchiveBackend) (storage.Archive, error) {
+	if arc, ok := a.backends[kind]; ok {
+		return arc, nil
+	}
+	arc, err := openArchiveBackend(cfg, kind)
+	if err != nil {
+		return nil, err
+	}
+	a.backends[kind] = arc
+	switch typed := arc.(type) {
+	case *storage.FSArchive:
+		a.fs = typed
+	case *storage.BoltArchive:
+		a.bolt = typed
+	}
+	return arc, nil
+}
+
+// Close stops tier demotion and releases the tier index and every open
+// backend.
+func (a *archiveSet) Close() error {
+	if a.tiered != nil {
+		// The tiers are the open backends.
+		return a.tiered.Close()
+	}
+	var err error
+	for _, arc := range a.backends {
+		if closeErr := arc.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func openArchiveBackend(cfg config.RetentionConfig, kind config.ArchiveBackend) (storage.Archive, error) {
+	switch kind {
+	case config.ArchiveBackendBolt:
+		if cfg.ArchivePath == "" {
+			return nil, fmt.Errorf("the bolt archive needs RETENTION_ARCHIVE_PATH")
+		}
+		return storage.NewBoltArchive(cfg.ArchivePath)
+	case config.ArchiveBackendFS:
+		return storage.NewFSArchive(cfg.FS)
+	case config.ArchiveBackendS3:
+		return storage.NewS3Archive(cfg.S3)
+	default:
+		return nil, &storage.ValidationError{Message: fmt.Sprintf("unknown archive backend %q", kind)}
+	}
+}
+
+func (s *Service) stopMigration() {
+	s.migrationMu.Lock()
+	migration := s.migration
+	s.migrationMu.Unlock()
+	if migration != nil {
+		migration.Stop()
+	}
+}
+
+// handleArchiveScan checks the filesystem archive for stray files. GET only
+// reports; POST with repair=true also applies the repairs.
+func (s *Service) handleArchiveScan(w http.ResponseWriter, r *http.Request) {
+	if s.archives.fs == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "archive scans need the fs archive backend"})
+		return
+	}
+	repair := false
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if raw := r.URL.Query().Get("repair"); raw != "" {
+			parsed, err := strconv.ParseBool(raw)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid repair"})
+				return
+			}
+			repair = parsed
+		}
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	report, err := s.archives.fs.Scan(r.Context(), repair)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// handleArchiveTiers reports the tiered archive: payloads per tier and the
+// demotion job. POST queues a demotion pass.
+func (s *Service) handleArchiveTiers(w http.ResponseWriter, r *http.Request) {
+	if s.archives.tiered == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "the archive is not tiered"})
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		s.archives.tiered.Trigger()
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	status, err := s.archives.tiered.Status()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	code := http.StatusOK
+	if r.Method == http.MethodPost {
+		code = http.StatusAccepted
+	}
+	writeJSON(w, code, status)
+}
+
+// handleArchivePacks reports the pack job of the Bolt archive. POST queues a
+// pass for name, or every repository; full=true repacks existing packs too.
+func (s *Service) handleArchivePacks(w http.ResponseWriter, r *http.Request) {
+	if s.packs == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "packing needs the bolt archive backend"})
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.packs.Status())
+	case http.MethodPost:
+		full := false
+		if raw := r.URL.Query().Get("full"); raw != "" {
+			parsed, err := strconv.ParseBool(raw)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid full"})
+				return
+			}
+			full = parsed
+		}
+		s.packs.Trigger(r.URL.Query().Get("name"), full)
+		writeJSON(w, http.StatusAccepted, s.packs.Status())
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+// handleArchiveMigrate copies archived content between backends while the
+// service keeps running. POST starts a migration from one backend kind to
+// another; GET reports the current or last migration and DELETE cancels it.
+func (s *Service) handleArchiveMigrate(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.migrationMu.Lock()
+		migration := s.migration
+		s.migrationMu.Unlock()
+		if migration == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "no migration has run"})
+			return
+		}
+		writeJSON(w, http.StatusOK, migration.Status())
+	case http.MethodDelete:
+		s.migrationMu.Lock()
+		migration := s.migration
+		s.migrationMu.Unlock()
+		if migration == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "no migration has run"})
+			return
+		}
+		writeJSON(w, http.StatusOK, migration.Stop())
+	case http.MethodPost:
+		s.startMigration(w, r)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+func (s *Service) startMigration(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from, to := config.ArchiveBackend(query.Get("from")), config.ArchiveBackend(query.Get("to"))
+	if from == "" || to == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "from and to query parameters required"})
+		return
+	}
+	if from == to {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "from and to must differ"})
+		return
+	}
+	opts := storage.MigrationOptions{From: string(from), To: string(to)}
+	for name, flag := range map[string]*bool{"remove": &opts.RemoveSource, "overwrite": &opts.Overwrite} {
+		if raw := query.Get(name); raw != "" {
+			parsed, err := strconv.ParseBool(raw)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid " + name})
+				return
+			}
+			*flag = parsed
+		}
+	}
+
+	s.migrationMu.Lock()
+	defer s.migrationMu.Unlock()
+	if s.migration != nil {
+		if current := s.migration.Status(); current.Running {
+			writeError(w, &storage.ConflictError{Resource: "archive migration", Key: current.From + "->" + current.To})
+			return
+		}
+	}
+
+	// Backends the service already uses are shared so Bolt files are not
+	// opened twice; others are opened for the migration only.
+	var opened []storage.Archive
+	closeOpened := func() {
+		for _, arc := range opened {
+			_ = arc.Close()
+		}
+	}
+	endpoints := make([]storage.Archive, 2)
+	for i, kind := range []config.ArchiveBackend{from, to} {
+		if arc, ok := s.archives.backends[kind]; ok {
+			endpoints[i] = arc
+			continue
+		}
+		arc, err := openArchiveBackend(s.retentionCfg, kind)
+		if err != nil {
+			closeOpened()
+			writeError(w, err)
+			return
+		}
+		opened = append(opened, arc)
+		endpoints[i] = arc
+	}
+	migration, err := storage.StartArchiveMigration(endpoints[0], endpoints[1], opts)
+	if err != nil {
+		closeOpened()
+		writeError(w, err)
+		return
+	}
+	s.migration = migration
+	go func() {
+		migration.Wait()
+		closeOpened()
+	}()
+	writeJSON(w, http.StatusAccepted, migration.Status())
+}
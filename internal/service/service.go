@@ -6,9 +6,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/onexay/kv-vs/internal/config"
@@ -17,8 +19,32 @@ import (
 
 // Service holds business logic and storage dependencies.
 type Service struct {
-	store   storage.Store
-	archive storage.Archive
+	store      storage.Store
+	archive    storage.Archive
+	gcGrace    time.Duration
+	worker     *storage.RetentionWorker
+	recompress *storage.RecompressionJob
+	// packs packs the Bolt archive; nil without one.
+	packs *storage.PackJob
+	// rehydration serves frequently read archived content; nil when there is
+	// no archive or the tier is disabled.
+	rehydration *storage.RehydrationCache
+	// memory reports the memory backend's usage; nil with other backends.
+	memory storage.MemoryReporter
+	// cache is the read cache wrapping store; nil when disabled or with the
+	// memory backend, which already serves reads from memory.
+	cache *storage.CachingStore
+	// archives holds the configured archive backends; retentionCfg opens
+	// others for migrations.
+	archives     *archiveSet
+	retentionCfg config.RetentionConfig
+	migrationMu  sync.Mutex
+	migration    *storage.ArchiveMigration
+	// masterKeys is nil when encryption at rest is disabled.
+	masterKeys *storage.MasterKeys
+	// policyAdmins holds the author IDs allowed to set policies; with none
+	// configured policies cannot be changed.
+	policyAdmins map[string]bool
 }
 
 const defaultBranchName = "main"
@@ -29,42 +55,145 @@ const (
 
 // New constructs the service wiring.
 func New(ctx context.Context, cfg config.Config) (*Service, error) {
-	var archive storage.Archive
-	if cfg.Retention.ArchivePath != "" {
-		arc, err := storage.NewBoltArchive(cfg.Retention.ArchivePath)
-		if err != nil {
-			return nil, err
-		}
-		archive = arc
+	compression, err := storage.ParseCodec(cfg.Retention.Compression)
+	if err != nil {
+		return nil, err
+	}
+	masterKeys, err := storage.LoadMasterKeys(cfg.Encryption.KeyFile, cfg.Encryption.MasterKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	archives, err := openArchives(cfg.Retention)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		archive     = archives.archive
+		rehydration *storage.RehydrationCache
+	)
+	if archive != nil && cfg.Retention.RehydrateBytes > 0 {
+		rehydration = storage.NewRehydrationCache(archive, storage.RehydrationConfig{
+			MaxBytes: cfg.Retention.RehydrateBytes,
+			TTL:      cfg.Retention.RehydrateTTL,
+			MinReads: cfg.Retention.RehydrateMinReads,
+		})
+		archive = rehydration
 	}
 
+	worker := storage.NewRetentionWorker(storage.RetentionWorkerConfig{
+		Concurrency:   cfg.Retention.Workers,
+		SweepInterval: cfg.Retention.SweepInterval,
+		QueueSize:     cfg.Retention.QueueSize,
+	})
 	options := storage.Options{
-		Archive: archive,
+		Archive:         archive,
+		RetentionNotify: worker.Enqueue,
+		PolicyCooldown:  cfg.Retention.PolicyCooldown,
+		MasterKeys:      masterKeys,
 		Retention: storage.RetentionDefaults{
 			HotCommitLimit: cfg.Retention.HotCommitLimit,
 			HotDuration:    cfg.Retention.HotDuration,
+			PurgeAfter:     cfg.Retention.PurgeAfter,
+			PinTags:        cfg.Retention.PinTags,
+			PinBranchHeads: cfg.Retention.PinBranchHeads,
+			Compression:    compression,
 		},
+		MemoryMaxBytes: cfg.Storage.MemoryMaxBytes,
 	}
 
-	var (
-		store storage.Store
-		err   error
-	)
+	var store storage.Store
 
 	switch cfg.Storage.Backend {
 	case config.StorageBackendKeyDB:
 		store, err = storage.NewKeyDBStore(cfg.Storage.KeyDB, options)
 		if err != nil {
-			if archive != nil {
-				_ = archive.Close()
-			}
+			_ = archives.Close()
+			return nil, err
+		}
+	case config.StorageBackendBolt:
+		store, err = storage.NewBoltStore(cfg.Storage.Bolt, options)
+		if err != nil {
+			_ = archives.Close()
+			return nil, err
+		}
+	case config.StorageBackendSQLite:
+		store, err = storage.NewSQLiteStore(cfg.Storage.SQLite, options)
+		if err != nil {
+			_ = archives.Close()
 			return nil, err
 		}
 	default:
-		store = storage.NewMemoryStore(options)
+		// Content over the budget is spilled to the archive.
+		if cfg.Storage.MemoryMaxBytes > 0 && archive == nil {
+			return nil, errors.New("MEMORY_MAX_BYTES needs an archive backend")
+		}
+		if cfg.Storage.Memory.Dir == "" {
+			store = storage.NewMemoryStore(options)
+			break
+		}
+		store, err = storage.NewDurableMemoryStore(cfg.Storage.Memory, options)
+		if err != nil {
+			_ = archives.Close()
+			return nil, err
+		}
 	}
 
-	return &Service{store: store, archive: archive}, nil
+	var cache *storage.CachingStore
+	if cfg.Storage.Backend != config.StorageBackendMemory && cfg.Storage.Cache.MaxBytes > 0 {
+		cache = storage.NewCachingStore(store, cfg.Storage.Cache)
+		store = cache
+	}
+
+	worker.Start(store)
+	if archives.tiered != nil {
+		archives.tiered.Start()
+	}
+	recompress := storage.NewRecompressionJob(cfg.Retention.RecompressInterval)
+	recompress.Start(store)
+	var packs *storage.PackJob
+	if archives.bolt != nil {
+		packs = storage.NewPackJob(cfg.Retention.PackInterval, cfg.Retention.Pack)
+		packs.Start(archives.bolt)
+	}
+	svc := &Service{
+		store:        store,
+		archive:      archive,
+		gcGrace:      cfg.Retention.GCGracePeriod,
+		worker:       worker,
+		recompress:   recompress,
+		packs:        packs,
+		rehydration:  rehydration,
+		cache:        cache,
+		archives:     archives,
+		retentionCfg: cfg.Retention,
+		masterKeys:   masterKeys,
+	}
+	svc.memory, _ = store.(storage.MemoryReporter)
+	svc.policyAdmins = make(map[string]bool, len(cfg.Retention.PolicyAdmins))
+	for _, id := range cfg.Retention.PolicyAdmins {
+		svc.policyAdmins[id] = true
+	}
+	return svc, nil
+}
+
+// Close stops the background jobs, then flushes and releases the storage
+// backend and archives.
+func (s *Service) Close() error {
+	s.worker.Stop()
+	s.recompress.Stop()
+	if s.packs != nil {
+		s.packs.Stop()
+	}
+	if s.archives.tiered != nil {
+		s.archives.tiered.Stop()
+	}
+	s.stopMigration()
+	err := s.store.Close()
+	if archiveErr := s.archives.Close(); err == nil {
+		err = archiveErr
+	}
+	return err
 }
 
 // Handler builds the REST routes for the service.
@@ -97,8 +226,34 @@ func Handler(svc *Service) http.Handler {
 			svc.handleBranches(w, r, strings.TrimPrefix(path, "/branches"))
 		case strings.HasPrefix(path, "/tags"):
 			svc.handleTags(w, r, strings.TrimPrefix(path, "/tags"))
+		case strings.HasPrefix(path, "/pins"):
+			svc.handlePins(w, r, strings.TrimPrefix(path, "/pins"))
 		case strings.HasPrefix(path, "/policies"):
 			svc.handlePolicies(w, r, strings.TrimPrefix(path, "/policies"))
+		case path == "/fsck":
+			svc.handleFsck(w, r)
+		case path == "/gc":
+			svc.handleGC(w, r)
+		case path == "/retention":
+			svc.handleRetention(w, r)
+		case path == "/restore":
+			svc.handleRestore(w, r)
+		case path == "/memory":
+			svc.handleMemory(w, r)
+		case path == "/cache":
+			svc.handleCache(w, r)
+		case path == "/compression":
+			svc.handleCompression(w, r)
+		case path == "/encryption":
+			svc.handleEncryption(w, r)
+		case path == "/archive/scan":
+			svc.handleArchiveScan(w, r)
+		case path == "/archive/packs":
+			svc.handleArchivePacks(w, r)
+		case path == "/archive/tiers":
+			svc.handleArchiveTiers(w, r)
+		case path == "/archive/migrate":
+			svc.handleArchiveMigrate(w, r)
 		default:
 			writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown resource"})
 		}
@@ -292,12 +447,12 @@ func (s *Service) handleCommits(w http.ResponseWriter, r *http.Request, tail str
 
 	switch {
 	case tail == "" && r.Method == http.MethodGet:
-		commits := s.store.ListCommits(r.Context(), storage.ListCommitsOptions{
+		commits, err := s.store.ListCommits(r.Context(), storage.ListCommitsOptions{
 			Repo:       repo,
 			Descending: desc,
 			Limit:      limit,
 		})
-		writeJSON(w, http.StatusOK, commits)
+		writeList(w, commits, err)
 	case tail != "" && r.Method == http.MethodGet:
 		hash := strings.TrimPrefix(tail, "/")
 		commit, content, err := s.store.GetCommit(r.Context(), repo, hash)
@@ -324,8 +479,8 @@ func (s *Service) handleBranches(w http.ResponseWriter, r *http.Request, tail st
 	tail = strings.TrimPrefix(tail, "/")
 	switch {
 	case tail == "" && r.Method == http.MethodGet:
-		branches := s.store.ListBranches(r.Context(), repo)
-		writeJSON(w, http.StatusOK, branches)
+		branches, err := s.store.ListBranches(r.Context(), repo)
+		writeList(w, branches, err)
 	case tail == "" && r.Method == http.MethodPost:
 		var req storage.BranchRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -361,8 +516,8 @@ func (s *Service) handleTags(w http.ResponseWriter, r *http.Request, tail string
 	tail = strings.TrimPrefix(tail, "/")
 	switch {
 	case tail == "" && r.Method == http.MethodGet:
-		tags := s.store.ListTags(r.Context(), repo)
-		writeJSON(w, http.StatusOK, tags)
+		tags, err := s.store.ListTags(r.Context(), repo)
+		writeList(w, tags, err)
 	case tail == "" && r.Method == http.MethodPost:
 		var req storage.TagRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -392,6 +547,19 @@ func (s *Service) handlePolicies(w http.ResponseWriter, r *http.Request, tail st
 	tail = strings.TrimPrefix(tail, "/")
 	switch {
 	case tail == "" && r.Method == http.MethodPost:
+		authorName, authorID, err := authorFromHeaders(r)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if len(s.policyAdmins) == 0 {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "no retention policy admins are configured"})
+			return
+		}
+		if !s.policyAdmins[authorID] {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "author " + authorID + " may not change retention policies"})
+			return
+		}
 		var req policyRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid payload"})
@@ -401,7 +569,18 @@ func (s *Service) handlePolicies(w http.ResponseWriter, r *http.Request, tail st
 			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "name is required"})
 			return
 		}
-		policy := storage.RetentionPolicy{Repo: req.Name}
+		// Fields left out of the body keep their current values; a repository
+		// without a policy starts from the configured defaults.
+		policy, err := s.store.GetPolicy(r.Context(), req.Name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if policy.Version == 0 {
+			// An empty codec keeps following the server default.
+			policy.Compression = ""
+		}
+		policy.AuthorName, policy.AuthorID, policy.Reason = authorName, authorID, req.Reason
 		if req.HotCommitLimit != nil {
 			policy.HotCommitLimit = *req.HotCommitLimit
 		}
@@ -413,7 +592,27 @@ func (s *Service) handlePolicies(w http.ResponseWriter, r *http.Request, tail st
 			}
 			policy.HotDuration = d
 		}
-		policy, err := s.store.SetPolicy(r.Context(), policy)
+		if req.PurgeAfter != "" {
+			d, err := time.ParseDuration(req.PurgeAfter)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid purgeAfter"})
+				return
+			}
+			policy.PurgeAfter = d
+		}
+		if req.PinTags != nil {
+			policy.PinTags = *req.PinTags
+		}
+		if req.PinBranchHeads != nil {
+			policy.PinBranchHeads = *req.PinBranchHeads
+		}
+		if req.Compression != "" {
+			if policy.Compression, err = storage.ParseCodec(strings.ToLower(req.Compression)); err != nil {
+				writeError(w, err)
+				return
+			}
+		}
+		policy, err = s.store.SetPolicy(r.Context(), policy)
 		if err != nil {
 			writeError(w, err)
 			return
@@ -431,11 +630,282 @@ func (s *Service) handlePolicies(w http.ResponseWriter, r *http.Request, tail st
 			return
 		}
 		writeJSON(w, http.StatusOK, makePolicyResponse(policy))
+	case tail == "history" && r.Method == http.MethodGet:
+		repo := r.URL.Query().Get("name")
+		if repo == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "name query parameter required"})
+			return
+		}
+		history, err := s.store.PolicyHistory(r.Context(), repo)
+		responses := make([]policyResponse, 0, len(history))
+		for _, policy := range history {
+			responses = append(responses, makePolicyResponse(policy))
+		}
+		writeList(w, responses, err)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+// handlePins lists, creates and removes explicit pins. Listing also reports
+// commits pinned by tag or branch head under the repository policy.
+func (s *Service) handlePins(w http.ResponseWriter, r *http.Request, tail string) {
+	repo := r.URL.Query().Get("name")
+	if repo == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "name query parameter required"})
+		return
+	}
+
+	tail = strings.TrimPrefix(tail, "/")
+	switch {
+	case tail == "" && r.Method == http.MethodGet:
+		pins, err := s.store.ListPins(r.Context(), repo)
+		writeList(w, pins, err)
+	case tail == "" && r.Method == http.MethodPost:
+		var req storage.PinRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid payload"})
+			return
+		}
+		req.Repo = repo
+		pin, err := s.store.PinCommit(r.Context(), req)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, pin)
+	case tail != "" && r.Method == http.MethodDelete:
+		if err := s.store.UnpinCommit(r.Context(), repo, tail); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+// handleFsck runs an integrity check. GET only reports; POST with repair=true
+// also applies the safe repairs.
+func (s *Service) handleFsck(w http.ResponseWriter, r *http.Request) {
+	repo := r.URL.Query().Get("name")
+	if repo == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "name query parameter required"})
+		return
+	}
+	opts := storage.CheckOptions{Repo: repo}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if raw := r.URL.Query().Get("repair"); raw != "" {
+			repair, err := strconv.ParseBool(raw)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid repair"})
+				return
+			}
+			opts.Repair = repair
+		}
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	report, err := s.store.Check(r.Context(), opts)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// handleGC collects unreachable commits. GET always reports what would be
+// removed; POST sweeps unless dryRun=true. grace overrides the configured
+// grace period.
+func (s *Service) handleGC(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	repo := query.Get("name")
+	if repo == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "name query parameter required"})
+		return
+	}
+	opts := storage.GCOptions{Repo: repo, GracePeriod: s.gcGrace}
+	if raw := query.Get("grace"); raw != "" {
+		grace, err := time.ParseDuration(raw)
+		if err != nil || grace < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid grace"})
+			return
+		}
+		opts.GracePeriod = grace
+	}
+	switch r.Method {
+	case http.MethodGet:
+		opts.DryRun = true
+	case http.MethodPost:
+		if raw := query.Get("dryRun"); raw != "" {
+			dryRun, err := strconv.ParseBool(raw)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid dryRun"})
+				return
+			}
+			opts.DryRun = dryRun
+		}
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	report, err := s.store.CollectGarbage(r.Context(), opts)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// handleRetention reports the background retention worker. POST queues a pass
+// for one repository, or a sweep of all repositories when name is omitted.
+func (s *Service) handleRetention(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.worker.Status())
+	case http.MethodPost:
+		repo := r.URL.Query().Get("name")
+		if repo == "" {
+			if err := s.worker.Sweep(r.Context()); err != nil {
+				writeError(w, err)
+				return
+			}
+		} else {
+			s.worker.Enqueue(repo)
+		}
+		writeJSON(w, http.StatusAccepted, s.worker.Status())
 	default:
 		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
 	}
 }
 
+// handleCompression reports per-repository compression stats from the last
+// recompression pass. POST queues a pass for name, or every repository.
+func (s *Service) handleCompression(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.recompress.Status())
+	case http.MethodPost:
+		s.recompress.Trigger(r.URL.Query().Get("name"))
+		writeJSON(w, http.StatusAccepted, s.recompress.Status())
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+// handleEncryption lists a repository's data keys. POST re-encrypts the
+// repository: rotate=true first creates a new data key, then data keys are
+// rewrapped under the active master key and content is resealed.
+func (s *Service) handleEncryption(w http.ResponseWriter, r *http.Request) {
+	if s.masterKeys == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "encryption is disabled"})
+		return
+	}
+	repo := r.URL.Query().Get("name")
+	if repo == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "name query parameter required"})
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		keys, err := s.store.DataKeys(r.Context(), repo)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"repo": repo, "masterKey": s.masterKeys.ActiveID(), "dataKeys": keys})
+	case http.MethodPost:
+		rotate := false
+		if raw := r.URL.Query().Get("rotate"); raw != "" {
+			var err error
+			if rotate, err = strconv.ParseBool(raw); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid rotate"})
+				return
+			}
+		}
+		report, err := s.store.Reencrypt(r.Context(), repo, rotate)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+// handleRestore promotes archived commits into the rehydration tier. GET
+// reports the tier's occupancy and counters.
+func (s *Service) handleRestore(w http.ResponseWriter, r *http.Request) {
+	if s.rehydration == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "rehydration tier is disabled"})
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.rehydration.Stats())
+	case http.MethodPost:
+		repo := r.URL.Query().Get("name")
+		if repo == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "name query parameter required"})
+			return
+		}
+		var req restoreRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid payload"})
+			return
+		}
+		restore := storage.RestoreRequest{Repo: repo, From: req.From, To: req.To, Commits: req.Commits}
+		if req.TTL != "" {
+			ttl, err := time.ParseDuration(req.TTL)
+			if err != nil || ttl <= 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid ttl"})
+				return
+			}
+			restore.TTL = ttl
+		}
+		result, err := s.rehydration.Restore(r.Context(), s.store, restore)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+// handleMemory reports the memory backend's hot content, budget and spills.
+func (s *Service) handleMemory(w http.ResponseWriter, r *http.Request) {
+	if s.memory == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "memory backend is not in use"})
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, s.memory.MemoryStats())
+}
+
+// handleCache reports the read cache's occupancy and hit rates.
+func (s *Service) handleCache(w http.ResponseWriter, r *http.Request) {
+	if s.cache == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "read cache is disabled"})
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, s.cache.Stats())
+}
+
 func authorFromHeaders(r *http.Request) (string, string, error) {
 	name := strings.TrimSpace(r.Header.Get(headerAuthorName))
 	id := strings.TrimSpace(r.Header.Get(headerAuthorID))
@@ -445,28 +915,63 @@ func authorFromHeaders(r *http.Request) (string, string, error) {
 	return name, id, nil
 }
 
+type restoreRequest struct {
+	From    string   `json:"from,omitempty"`
+	To      string   `json:"to,omitempty"`
+	Commits []string `json:"commits,omitempty"`
+	TTL     string   `json:"ttl,omitempty"`
+}
+
 type policyRequest struct {
 	Name           string `json:"name"`
 	HotCommitLimit *int   `json:"hotCommitLimit,omitempty"`
 	HotDuration    string `json:"hotDuration,omitempty"`
+	PurgeAfter     string `json:"purgeAfter,omitempty"`
+	PinTags        *bool  `json:"pinTags,omitempty"`
+	PinBranchHeads *bool  `json:"pinBranchHeads,omitempty"`
+	// Compression is none, gzip or zstd; empty keeps the current codec.
+	Compression string `json:"compression,omitempty"`
+	// Reason is recorded in the policy history and required for changes.
+	Reason string `json:"reason,omitempty"`
 }
 
 type policyResponse struct {
-	Name           string `json:"name"`
-	HotCommitLimit int    `json:"hotCommitLimit,omitempty"`
-	HotDuration    string `json:"hotDuration,omitempty"`
-	Locked         bool   `json:"locked"`
+	Name           string     `json:"name"`
+	HotCommitLimit int        `json:"hotCommitLimit,omitempty"`
+	HotDuration    string     `json:"hotDuration,omitempty"`
+	PurgeAfter     string     `json:"purgeAfter,omitempty"`
+	PinTags        bool       `json:"pinTags"`
+	PinBranchHeads bool       `json:"pinBranchHeads"`
+	Compression    string     `json:"compression,omitempty"`
+	Version        int        `json:"version"`
+	UpdatedAt      *time.Time `json:"updatedAt,omitempty"`
+	AuthorName     string     `json:"author,omitempty"`
+	AuthorID       string     `json:"authorId,omitempty"`
+	Reason         string     `json:"reason,omitempty"`
 }
 
 func makePolicyResponse(policy storage.RetentionPolicy) policyResponse {
 	resp := policyResponse{
 		Name:           policy.Repo,
 		HotCommitLimit: policy.HotCommitLimit,
-		Locked:         policy.Locked,
+		PinTags:        policy.PinTags,
+		PinBranchHeads: policy.PinBranchHeads,
+		Compression:    string(policy.Compression),
+		Version:        policy.Version,
+		AuthorName:     policy.AuthorName,
+		AuthorID:       policy.AuthorID,
+		Reason:         policy.Reason,
+	}
+	if !policy.UpdatedAt.IsZero() {
+		updatedAt := policy.UpdatedAt
+		resp.UpdatedAt = &updatedAt
 	}
 	if policy.HotDuration > 0 {
 		resp.HotDuration = policy.HotDuration.String()
 	}
+	if policy.PurgeAfter > 0 {
+		resp.PurgeAfter = policy.PurgeAfter.String()
+	}
 	return resp
 }
 
@@ -477,6 +982,20 @@ func writeError(w http.ResponseWriter, err error) {
 		return
 	}
 
+	var gone *storage.GoneError
+	if errors.As(err, &gone) {
+		writeJSON(w, http.StatusGone, map[string]string{"error": gone.Error()})
+		return
+	}
+
+	var cooldown *storage.CooldownError
+	if errors.As(err, &cooldown) {
+		retryAfter := int(math.Ceil(time.Until(cooldown.Until).Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": cooldown.Error()})
+		return
+	}
+
 	var conflict *storage.ConflictError
 	if errors.As(err, &conflict) {
 		writeJSON(w, http.StatusConflict, map[string]string{"error": conflict.Error()})
@@ -489,9 +1008,41 @@ func writeError(w http.ResponseWriter, err error) {
 		return
 	}
 
+	var unavailable *storage.UnavailableError
+	if errors.As(err, &unavailable) {
+		if unavailable.RetryAfter > 0 {
+			retryAfter := int(math.Ceil(unavailable.RetryAfter.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+		}
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": unavailable.Error()})
+		return
+	}
+
 	writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 }
 
+// writeList renders a list response. When the backend could only read part of
+// the collection the readable items are returned with 206 and the keys that
+// failed, so clients can tell an incomplete listing from an empty one.
+func writeList(w http.ResponseWriter, items any, err error) {
+	if err == nil {
+		writeJSON(w, http.StatusOK, items)
+		return
+	}
+
+	var partial *storage.PartialResultError
+	if errors.As(err, &partial) {
+		writeJSON(w, http.StatusPartialContent, map[string]any{
+			"items":      items,
+			"unreadable": partial.Keys,
+			"error":      partial.Error(),
+		})
+		return
+	}
+
+	writeError(w, err)
+}
+
 func writeJSON(w http.ResponseWriter, status int, payload any) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
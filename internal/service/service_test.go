@@ -0,0 +1,120 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/onexay/kv-vs/internal/config"
+	"github.com/onexay/kv-vs/internal/storage"
+)
+
+// serve sends one request through the service's routes as author id.
+func serve(t *testing.T, h http.Handler, method, target, id, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set(headerAuthorName, id)
+	req.Header.Set(headerAuthorID, id)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestPolicyUpdateKeepsOmittedFields(t *testing.T) {
+	h := Handler(&Service{store: storage.NewMemoryStore(storage.Options{}), policyAdmins: map[string]bool{"alice": true}})
+
+	rec := serve(t, h, http.MethodPost, "/api/v1/policies", "alice", `{"name":"repo","hotCommitLimit":5,"hotDuration":"24h","purgeAfter":"48h","pinTags":true,"compression":"gzip"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create policy: %d %s", rec.Code, rec.Body)
+	}
+	rec = serve(t, h, http.MethodPost, "/api/v1/policies", "alice", `{"name":"repo","hotCommitLimit":10,"reason":"more history"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("update policy: %d %s", rec.Code, rec.Body)
+	}
+	var policy policyResponse
+	if err := json.NewDecoder(rec.Body).Decode(&policy); err != nil {
+		t.Fatalf("decode policy: %v", err)
+	}
+	want := policyResponse{Name: "repo", HotCommitLimit: 10, HotDuration: "24h0m0s", PurgeAfter: "48h0m0s", PinTags: true, Compression: "gzip", Version: 2}
+	got := policy
+	got.UpdatedAt, got.AuthorName, got.AuthorID, got.Reason = nil, "", "", ""
+	if got != want {
+		t.Fatalf("expected omitted fields kept, got %+v", policy)
+	}
+
+	rec = serve(t, h, http.MethodPost, "/api/v1/policies", "alice", `{"name":"repo","hotDuration":"0s","reason":"count only"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("clear hotDuration: %d %s", rec.Code, rec.Body)
+	}
+	policy = policyResponse{}
+	if err := json.NewDecoder(rec.Body).Decode(&policy); err != nil {
+		t.Fatalf("decode policy: %v", err)
+	}
+	if policy.HotDuration != "" || policy.HotCommitLimit != 10 || policy.Version != 3 {
+		t.Fatalf("expected only hotDuration cleared, got %+v", policy)
+	}
+}
+
+func TestPolicyUpdateRequiresAdmin(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		admins map[string]bool
+	}{
+		{"no admins configured", map[string]bool{}},
+		{"author not an admin", map[string]bool{"alice": true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := Handler(&Service{store: storage.NewMemoryStore(storage.Options{}), policyAdmins: tc.admins})
+			rec := serve(t, h, http.MethodPost, "/api/v1/policies", "mallory", `{"name":"repo","hotCommitLimit":1}`)
+			if rec.Code != http.StatusForbidden {
+				t.Fatalf("expected 403, got %d %s", rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestArchiveSetClose(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.RetentionConfig{
+		ArchiveBackend: config.ArchiveBackendTiered,
+		ArchiveTiers:   "bolt:1h,fs",
+		ArchivePath:    filepath.Join(dir, "archive.db"),
+		FS:             storage.FSArchiveConfig{Root: filepath.Join(dir, "archive")},
+		TierIndexPath:  filepath.Join(dir, "tiers.db"),
+		DemoteInterval: time.Hour,
+	}
+	set, err := openArchives(cfg)
+	if err != nil {
+		t.Fatalf("openArchives: %v", err)
+	}
+	set.tiered.Start()
+	if err := set.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	// Status still reports the job after the index is closed.
+	if status, _ := set.tiered.Status(); status.Running {
+		t.Fatalf("expected demotion stopped, got %+v", status)
+	}
+
+	// Bolt files still open would block the second open.
+	reopened := make(chan error, 1)
+	go func() {
+		set, err := openArchives(cfg)
+		if err == nil {
+			err = set.Close()
+		}
+		reopened <- err
+	}()
+	select {
+	case err := <-reopened:
+		if err != nil {
+			t.Fatalf("reopen archives: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("archive files were not released")
+	}
+}
@@ -3,6 +3,7 @@ package storage
 import (
 	"context"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
@@ -14,10 +15,13 @@ const (
 	boltRootBucket = "repos"
 )
 
-// BoltArchive stores blob payloads inside a BoltDB file.
+// BoltArchive stores blob payloads inside a BoltDB file. Payloads are
+// written loose, one key per hash, and Pack later moves them into
+// delta-compressed packs; reads look in both.
 type BoltArchive struct {
-	db   *bolt.DB
-	once sync.Once
+	db     *bolt.DB
+	once   sync.Once
+	packMu sync.Mutex
 }
 
 // NewBoltArchive opens (or creates) a BoltDB archive at the provided path.
@@ -39,8 +43,12 @@ func NewBoltArchive(path string) (*BoltArchive, error) {
 	}
 
 	if err := db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(boltRootBucket))
-		return err
+		for _, name := range []string{boltRootBucket, boltPackBucket, boltPackIndexBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
 	}); err != nil {
 		_ = db.Close()
 		return nil, err
@@ -49,7 +57,8 @@ func NewBoltArchive(path string) (*BoltArchive, error) {
 	return &BoltArchive{db: db}, nil
 }
 
-// Store writes payload data under repo/hash.
+// Store writes payload data under repo/hash. A packed copy is dropped from
+// the pack index; the next full repack reclaims its space.
 func (a *BoltArchive) Store(ctx context.Context, repo, hash string, data []byte) error {
 	return a.db.Update(func(tx *bolt.Tx) error {
 		select {
@@ -68,6 +77,11 @@ func (a *BoltArchive) Store(ctx context.Context, repo, hash string, data []byte)
 			return err
 		}
 
+		if index := tx.Bucket([]byte(boltPackIndexBucket)).Bucket([]byte(repo)); index != nil {
+			if err := index.Delete([]byte(hash)); err != nil {
+				return err
+			}
+		}
 		return repoBucket.Put([]byte(hash), data)
 	})
 }
@@ -87,18 +101,24 @@ func (a *BoltArchive) Fetch(ctx context.Context, repo, hash string) ([]byte, err
 			return &NotFoundError{Resource: "archive", Key: hash}
 		}
 
-		repoBucket := root.Bucket([]byte(repo))
-		if repoBucket == nil {
-			return &NotFoundError{Resource: "archive", Key: hash}
+		if repoBucket := root.Bucket([]byte(repo)); repoBucket != nil {
+			if data := repoBucket.Get([]byte(hash)); data != nil {
+				result = append([]byte{}, data...)
+				return nil
+			}
 		}
 
-		data := repoBucket.Get([]byte(hash))
-		if data == nil {
-			return &NotFoundError{Resource: "archive", Key: hash}
+		if index := tx.Bucket([]byte(boltPackIndexBucket)).Bucket([]byte(repo)); index != nil {
+			if record := index.Get([]byte(hash)); record != nil {
+				data, err := readPacked(tx, repo, record)
+				if err != nil {
+					return fmt.Errorf("read packed %s/%s: %w", repo, hash, err)
+				}
+				result = data
+				return nil
+			}
 		}
-
-		result = append([]byte{}, data...)
-		return nil
+		return &NotFoundError{Resource: "archive", Key: hash}
 	})
 	return result, err
 }
@@ -116,6 +136,11 @@ func (a *BoltArchive) Remove(ctx context.Context, repo, hash string) error {
 		if root == nil {
 			return nil
 		}
+		if index := tx.Bucket([]byte(boltPackIndexBucket)).Bucket([]byte(repo)); index != nil {
+			if err := index.Delete([]byte(hash)); err != nil {
+				return err
+			}
+		}
 		repoBucket := root.Bucket([]byte(repo))
 		if repoBucket == nil {
 			return nil
@@ -124,6 +149,64 @@ func (a *BoltArchive) Remove(ctx context.Context, repo, hash string) error {
 	})
 }
 
+// Walk calls fn for every stored payload, loose or packed. Hashes are read
+// one repository at a time and fn runs outside the read transaction, so it
+// may use the archive.
+func (a *BoltArchive) Walk(ctx context.Context, fn func(repo, hash string) error) error {
+	var repos []string
+	if err := a.db.View(func(tx *bolt.Tx) error {
+		repos = archiveRepos(tx)
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, repo := range repos {
+		var hashes []string
+		if err := a.db.View(func(tx *bolt.Tx) error {
+			for _, name := range []string{boltRootBucket, boltPackIndexBucket} {
+				bucket := tx.Bucket([]byte(name)).Bucket([]byte(repo))
+				if bucket == nil {
+					continue
+				}
+				if err := bucket.ForEach(func(k, _ []byte) error {
+					hashes = append(hashes, string(k))
+					return nil
+				}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, hash := range hashes {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(repo, hash); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// archiveRepos lists the repositories with loose or packed payloads.
+func archiveRepos(tx *bolt.Tx) []string {
+	seen := make(map[string]bool)
+	var repos []string
+	for _, name := range []string{boltRootBucket, boltPackIndexBucket} {
+		_ = tx.Bucket([]byte(name)).ForEach(func(k, v []byte) error {
+			if v == nil && !seen[string(k)] {
+				seen[string(k)] = true
+				repos = append(repos, string(k))
+			}
+			return nil
+		})
+	}
+	return repos
+}
+
 // Close shuts down the Bolt DB.
 func (a *BoltArchive) Close() error {
 	a.once.Do(func() {
@@ -0,0 +1,511 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultFSShardDepth = 2
+	maxFSShardDepth     = 8
+	// fsTempMarker marks files being written by writeFileAtomic; they are
+	// renamed into place once complete.
+	fsTempMarker = ".tmp-"
+	// fsStaleTempAge is how old a temp file must be before the scanner
+	// treats it as left behind by a crashed write.
+	fsStaleTempAge = time.Hour
+)
+
+// fsSuffixes maps file name suffixes to the codec of the file body, in the
+// order Fetch looks for them.
+var fsSuffixes = []struct {
+	suffix string
+	codec  Codec
+}{
+	{"", CodecNone},
+	{".zst", CodecZstd},
+	{".gz", CodecGzip},
+}
+
+const (
+	// IssueStaleTempFile marks a temp file left behind by an interrupted write.
+	IssueStaleTempFile CheckIssueKind = "stale_temp_file"
+	// IssueMisplacedArchiveFile marks an archive file outside its shard directory.
+	IssueMisplacedArchiveFile CheckIssueKind = "misplaced_archive_file"
+	// IssueDuplicateArchiveFile marks an older copy of an archived payload.
+	IssueDuplicateArchiveFile CheckIssueKind = "duplicate_archive_file"
+	// IssueCorruptArchiveFile marks a compressed archive file that cannot be decompressed.
+	IssueCorruptArchiveFile CheckIssueKind = "corrupt_archive_file"
+	// IssueUnexpectedArchiveFile marks a file the archive did not write.
+	IssueUnexpectedArchiveFile CheckIssueKind = "unexpected_archive_file"
+)
+
+// FSArchiveConfig configures a filesystem archive.
+type FSArchiveConfig struct {
+	Root string
+	// ShardDepth is the number of directory levels named after two-character
+	// hash prefixes; zero means two.
+	ShardDepth int
+	// Compression compresses payloads that are not already compressed or
+	// encrypted. Compressed files get a .gz or .zst suffix so standard tools
+	// can read them.
+	Compression Codec
+}
+
+// ArchiveScanReport summarises a consistency scan of a filesystem archive.
+// Issues use CheckIssue with Name set to the repository, Hash to the commit
+// and Key to the path relative to Root.
+type ArchiveScanReport struct {
+	Root      string       `json:"root"`
+	CheckedAt time.Time    `json:"checkedAt"`
+	Repair    bool         `json:"repair"`
+	Repos     int          `json:"repos"`
+	Files     int          `json:"files"`
+	Bytes     int64        `json:"bytes"`
+	Issues    []CheckIssue `json:"issues"`
+}
+
+// FSArchive stores blob payloads as plain files under
+// <root>/<repo>/<shard>.../<hash>, where the shard directories are prefixes
+// of the hash. Writes go to a temp file that is renamed into place, so
+// readers never see partial payloads and several processes can write at
+// once.
+type FSArchive struct {
+	root  string
+	depth int
+	codec Codec
+	clock func() time.Time
+}
+
+// NewFSArchive creates the root directory if needed and returns an archive
+// rooted there.
+func NewFSArchive(cfg FSArchiveConfig) (*FSArchive, error) {
+	if cfg.Root == "" {
+		return nil, errors.New("archive directory is required")
+	}
+	codec, err := ParseCodec(string(cfg.Compression))
+	if err != nil {
+		return nil, err
+	}
+	if codec == "" {
+		codec = CodecNone
+	}
+	depth := cfg.ShardDepth
+	if depth == 0 {
+		depth = defaultFSShardDepth
+	}
+	if depth < 0 || depth > maxFSShardDepth {
+		return nil, fmt.Errorf("archive shard depth must be between 1 and %d", maxFSShardDepth)
+	}
+	root := filepath.Clean(cfg.Root)
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	return &FSArchive{root: root, depth: depth, codec: codec, clock: time.Now}, nil
+}
+
+// Store writes payload data under repo/hash and removes copies stored with
+// a different compression.
+func (a *FSArchive) Store(ctx context.Context, repo, hash string, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	body, codec, err := a.compress(data)
+	if err != nil {
+		return err
+	}
+	dir := a.dir(repo, hash)
+	name := fsEscape(hash)
+	var keep string
+	for _, variant := range fsSuffixes {
+		if variant.codec == codec {
+			keep = name + variant.suffix
+		}
+	}
+	if err := writeArchiveFile(dir, keep, body); err != nil {
+		return err
+	}
+	for _, variant := range fsSuffixes {
+		if other := name + variant.suffix; other != keep {
+			if err := os.Remove(filepath.Join(dir, other)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Fetch retrieves payload data for repo/hash.
+func (a *FSArchive) Fetch(ctx context.Context, repo, hash string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(a.dir(repo, hash), fsEscape(hash))
+	for _, variant := range fsSuffixes {
+		body, err := os.ReadFile(path + variant.suffix)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if variant.codec == CodecNone {
+			return body, nil
+		}
+		return decompressStream(variant.codec, body)
+	}
+	return nil, &NotFoundError{Resource: "archive", Key: hash}
+}
+
+// Remove deletes payload data (best-effort). Empty shard directories are
+// left for the scanner to prune so concurrent writes never lose their
+// directory.
+func (a *FSArchive) Remove(ctx context.Context, repo, hash string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	path := filepath.Join(a.dir(repo, hash), fsEscape(hash))
+	for _, variant := range fsSuffixes {
+		if err := os.Remove(path + variant.suffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Walk calls fn for every stored payload, once even when copies with several
+// suffixes exist. Temp files and files the archive did not write are
+// skipped.
+func (a *FSArchive) Walk(ctx context.Context, fn func(repo, hash string) error) error {
+	var last [2]string
+	return filepath.WalkDir(a.root, func(path string, d fs.DirEntry, walkErr error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if walkErr != nil {
+			return walkErr
+		}
+		if d.IsDir() || strings.Contains(d.Name(), fsTempMarker) {
+			return nil
+		}
+		rel, err := filepath.Rel(a.root, path)
+		if err != nil {
+			return err
+		}
+		entry, ok := a.parse(rel)
+		// Copies of one payload are adjacent: WalkDir visits names in
+		// lexical order and the suffixes start with a dot.
+		if !ok || [2]string{entry.repo, entry.hash} == last {
+			return nil
+		}
+		last = [2]string{entry.repo, entry.hash}
+		return fn(entry.repo, entry.hash)
+	})
+}
+
+// Close is a no-op; the archive holds no open files between calls.
+func (a *FSArchive) Close() error { return nil }
+
+// Root returns the archive's root directory.
+func (a *FSArchive) Root() string { return a.root }
+
+// compress applies the archive codec to data unless it is already
+// compressed or encrypted, or would not shrink.
+func (a *FSArchive) compress(data []byte) ([]byte, Codec, error) {
+	if a.codec == CodecNone || storedCodec(data) != CodecNone || bytes.HasPrefix(data, sealedMagic) {
+		return data, CodecNone, nil
+	}
+	body, err := compressStream(a.codec, data)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(body) >= len(data) {
+		return data, CodecNone, nil
+	}
+	return body, a.codec, nil
+}
+
+// dir returns the shard directory of repo/hash.
+func (a *FSArchive) dir(repo, hash string) string {
+	parts := make([]string, 0, a.depth+2)
+	parts = append(parts, a.root, fsEscape(repo))
+	return filepath.Join(append(parts, fsShards(fsEscape(hash), a.depth)...)...)
+}
+
+// fsShards returns the depth two-character prefixes of name. Short names
+// are padded with "_", and dots become "_" so a shard is never "..".
+func fsShards(name string, depth int) []string {
+	shards := make([]string, depth)
+	for i := range shards {
+		shard := []byte("__")
+		for j := range shard {
+			if k := 2*i + j; k < len(name) && name[k] != '.' {
+				shard[j] = name[k]
+			}
+		}
+		shards[i] = string(shard)
+	}
+	return shards
+}
+
+// fsEscape turns a repository name or hash into a single safe path element:
+// separators and other reserved bytes are percent-encoded, as is a leading
+// dot so names never resolve to "." or ".." or hide as dotfiles.
+func fsEscape(name string) string {
+	escaped := s3Escape(name, false)
+	if strings.HasPrefix(escaped, ".") {
+		escaped = "%2E" + escaped[1:]
+	}
+	return escaped
+}
+
+// writeArchiveFile atomically writes data to dir/name and syncs the
+// directory so the rename survives a crash.
+func writeArchiveFile(dir, name string, data []byte) error {
+	write := func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}
+	var err error
+	// A concurrent scan may prune the directory between MkdirAll and the
+	// write; try once more in that case.
+	for attempt := 0; attempt < 2; attempt++ {
+		if err = os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+		if err = writeFileAtomic(filepath.Join(dir, name), write); !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// fsEntry is an archive file found by Scan.
+type fsEntry struct {
+	rel     string
+	repo    string
+	hash    string
+	codec   Codec
+	modTime time.Time
+	placed  bool
+}
+
+// Scan walks the archive and reports stale temp files, files outside their
+// shard directory (for example after ShardDepth changed), duplicate copies
+// of one payload, corrupt compressed files and files the archive did not
+// write. With repair it removes stale temp files and duplicates, keeping the
+// newest copy, moves misplaced files into place and prunes empty
+// directories. Corrupt and unexpected files are only reported.
+func (a *FSArchive) Scan(ctx context.Context, repair bool) (ArchiveScanReport, error) {
+	now := a.clock()
+	report := ArchiveScanReport{Root: a.root, CheckedAt: now.UTC(), Repair: repair, Issues: []CheckIssue{}}
+	repos := make(map[string]bool)
+	groups := make(map[[2]string][]fsEntry)
+	var dirs []string
+
+	err := filepath.WalkDir(a.root, func(path string, d fs.DirEntry, walkErr error) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if walkErr != nil {
+			return walkErr
+		}
+		rel, err := filepath.Rel(a.root, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if rel != "." {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		issue := CheckIssue{Key: filepath.ToSlash(rel)}
+
+		if strings.Contains(d.Name(), fsTempMarker) {
+			if now.Sub(info.ModTime()) >= fsStaleTempAge {
+				issue.Kind = IssueStaleTempFile
+				issue.Detail = fmt.Sprintf("temp file last written %s", info.ModTime().UTC().Format(time.RFC3339))
+				issue.Repairable = true
+				if repair {
+					a.repairIssue(&issue, os.Remove(path))
+				}
+				report.Issues = append(report.Issues, issue)
+			}
+			return nil
+		}
+
+		report.Files++
+		report.Bytes += info.Size()
+		entry, ok := a.parse(rel)
+		if !ok {
+			issue.Kind = IssueUnexpectedArchiveFile
+			issue.Detail = "file is not named <repo>/<shards>/<hash>[.gz|.zst]"
+			report.Issues = append(report.Issues, issue)
+			return nil
+		}
+		entry.modTime = info.ModTime()
+		issue.Name, issue.Hash = entry.repo, entry.hash
+		if entry.codec != CodecNone {
+			body, err := os.ReadFile(path)
+			if err == nil {
+				_, err = decompressStream(entry.codec, body)
+			}
+			if err != nil {
+				issue.Kind = IssueCorruptArchiveFile
+				issue.Detail = err.Error()
+				report.Issues = append(report.Issues, issue)
+				return nil
+			}
+		}
+		repos[entry.repo] = true
+		key := [2]string{entry.repo, entry.hash}
+		groups[key] = append(groups[key], entry)
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	report.Repos = len(repos)
+
+	keys := make([][2]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	for _, key := range keys {
+		report.Issues = append(report.Issues, a.scanGroup(groups[key], repair)...)
+	}
+
+	if repair {
+		// Deepest first, so parents emptied by pruning their children go too.
+		sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+		for _, dir := range dirs {
+			_ = os.Remove(dir) // fails, as intended, unless the directory is empty
+		}
+	}
+	return report, nil
+}
+
+// scanGroup checks the files holding one payload: all but the newest are
+// duplicates, and the newest must sit in its shard directory.
+func (a *FSArchive) scanGroup(entries []fsEntry, repair bool) []CheckIssue {
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].modTime.Equal(entries[j].modTime) {
+			return entries[i].modTime.After(entries[j].modTime)
+		}
+		return entries[i].placed && !entries[j].placed
+	})
+	var issues []CheckIssue
+	keep := entries[0]
+	for _, dup := range entries[1:] {
+		issue := CheckIssue{
+			Kind:       IssueDuplicateArchiveFile,
+			Name:       dup.repo,
+			Hash:       dup.hash,
+			Key:        dup.rel,
+			Detail:     "superseded by " + keep.rel,
+			Repairable: true,
+		}
+		if repair {
+			a.repairIssue(&issue, os.Remove(filepath.Join(a.root, filepath.FromSlash(dup.rel))))
+		}
+		issues = append(issues, issue)
+	}
+	if !keep.placed {
+		target := filepath.Join(a.dir(keep.repo, keep.hash), filepath.Base(filepath.FromSlash(keep.rel)))
+		rel, _ := filepath.Rel(a.root, target)
+		issue := CheckIssue{
+			Kind:       IssueMisplacedArchiveFile,
+			Name:       keep.repo,
+			Hash:       keep.hash,
+			Key:        keep.rel,
+			Detail:     "belongs at " + filepath.ToSlash(rel),
+			Repairable: true,
+		}
+		if repair {
+			err := os.MkdirAll(filepath.Dir(target), 0o755)
+			if err == nil {
+				err = os.Rename(filepath.Join(a.root, filepath.FromSlash(keep.rel)), target)
+			}
+			a.repairIssue(&issue, err)
+		}
+		issues = append(issues, issue)
+	}
+	return issues
+}
+
+func (a *FSArchive) repairIssue(issue *CheckIssue, err error) {
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		issue.RepairError = err.Error()
+		return
+	}
+	issue.Repaired = true
+}
+
+// parse decodes a path relative to the root into its repository, hash and
+// codec, and reports whether it is in the right shard directory.
+func (a *FSArchive) parse(rel string) (fsEntry, bool) {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) < 2 {
+		return fsEntry{}, false
+	}
+	entry := fsEntry{rel: filepath.ToSlash(rel)}
+	name := parts[len(parts)-1]
+	for _, variant := range fsSuffixes[1:] {
+		if trimmed, ok := strings.CutSuffix(name, variant.suffix); ok {
+			name, entry.codec = trimmed, variant.codec
+			break
+		}
+	}
+	if entry.codec == "" {
+		entry.codec = CodecNone
+	}
+	repo, err := url.PathUnescape(parts[0])
+	if err != nil || repo == "" || fsEscape(repo) != parts[0] {
+		return fsEntry{}, false
+	}
+	hash, err := url.PathUnescape(name)
+	if err != nil || hash == "" || fsEscape(hash) != name {
+		return fsEntry{}, false
+	}
+	entry.repo, entry.hash = repo, hash
+	shards := parts[1 : len(parts)-1]
+	want := fsShards(name, a.depth)
+	entry.placed = len(shards) == len(want)
+	for i := 0; entry.placed && i < len(want); i++ {
+		entry.placed = shards[i] == want[i]
+	}
+	return entry, true
+}
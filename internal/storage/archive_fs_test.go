@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFSArchive(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	archive, err := NewFSArchive(FSArchiveConfig{Root: root, Compression: CodecZstd})
+	if err != nil {
+		t.Fatalf("NewFSArchive: %v", err)
+	}
+
+	text := []byte(strings.Repeat("archived line\n", 100))
+	if err := archive.Store(ctx, "team/analytics", "abcdef01", text); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	path := filepath.Join(root, "team%2Fanalytics", "ab", "cd", "abcdef01.zst")
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected a sharded, compressed file: %v", err)
+	}
+	data, err := archive.Fetch(ctx, "team/analytics", "abcdef01")
+	if err != nil || !bytes.Equal(data, text) {
+		t.Fatalf("Fetch = %d bytes, %v", len(data), err)
+	}
+
+	// Payloads the store already compressed are written as they are.
+	encoded, err := encodeContent(CodecGzip, text)
+	if err != nil {
+		t.Fatalf("encodeContent: %v", err)
+	}
+	if err := archive.Store(ctx, "team/analytics", "abcdef01", encoded); err != nil {
+		t.Fatalf("Store encoded: %v", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the compressed copy to be replaced, got %v", err)
+	}
+	data, err = archive.Fetch(ctx, "team/analytics", "abcdef01")
+	if err != nil || !bytes.Equal(data, encoded) {
+		t.Fatalf("Fetch encoded = %d bytes, %v", len(data), err)
+	}
+
+	// Names cannot escape the root.
+	if err := archive.Store(ctx, "..", "..", []byte("x")); err != nil {
+		t.Fatalf("Store dots: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "%2E.", "%2", "E_", "%2E.")); err != nil {
+		t.Fatalf("expected escaped dot names: %v", err)
+	}
+
+	if err := archive.Remove(ctx, "team/analytics", "abcdef01"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	var notFound *NotFoundError
+	if _, err := archive.Fetch(ctx, "team/analytics", "abcdef01"); !errors.As(err, &notFound) {
+		t.Fatalf("expected NotFoundError after Remove, got %v", err)
+	}
+	if err := archive.Remove(ctx, "team/analytics", "abcdef01"); err != nil {
+		t.Fatalf("Remove missing: %v", err)
+	}
+
+	// Files written with one shard level are misplaced for two levels.
+	shallow, err := NewFSArchive(FSArchiveConfig{Root: root, ShardDepth: 1})
+	if err != nil {
+		t.Fatalf("NewFSArchive: %v", err)
+	}
+	if err := shallow.Store(ctx, "analytics", "1234abcd", []byte("moved")); err != nil {
+		t.Fatalf("Store shallow: %v", err)
+	}
+	if err := archive.Store(ctx, "analytics", "feedbeef", []byte("kept")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	dupDir := filepath.Join(root, "analytics", "fe", "ed")
+	old := time.Now().Add(-2 * time.Hour)
+	older, err := compressStream(CodecGzip, []byte("older copy"))
+	if err != nil {
+		t.Fatalf("compressStream: %v", err)
+	}
+	writeAged(t, filepath.Join(dupDir, "feedbeef.gz"), older, old)
+	writeAged(t, filepath.Join(dupDir, "feedbeef"+fsTempMarker+"1"), []byte("partial"), old)
+	writeAged(t, filepath.Join(dupDir, "feedbeef"+fsTempMarker+"2"), []byte("in flight"), time.Now())
+	writeAged(t, filepath.Join(root, "analytics", "0b", "ad", "0bad.gz"), []byte("not gzip"), old)
+	writeAged(t, filepath.Join(root, "README"), []byte("notes"), old)
+
+	report, err := archive.Scan(ctx, false)
+	if err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	kinds := scanKinds(report)
+	want := map[CheckIssueKind]int{
+		IssueStaleTempFile:         1,
+		IssueMisplacedArchiveFile:  1,
+		IssueDuplicateArchiveFile:  1,
+		IssueCorruptArchiveFile:    1,
+		IssueUnexpectedArchiveFile: 1,
+	}
+	for kind, n := range want {
+		if kinds[kind] != n {
+			t.Fatalf("expected %d %s issues, got %+v", n, kind, report.Issues)
+		}
+	}
+
+	report, err = archive.Scan(ctx, true)
+	if err != nil {
+		t.Fatalf("Scan repair: %v", err)
+	}
+	for _, issue := range report.Issues {
+		if issue.Repaired != issue.Repairable {
+			t.Fatalf("unexpected repair outcome: %+v", issue)
+		}
+	}
+	data, err = archive.Fetch(ctx, "analytics", "1234abcd")
+	if err != nil || string(data) != "moved" {
+		t.Fatalf("Fetch moved = %q, %v", data, err)
+	}
+	data, err = archive.Fetch(ctx, "analytics", "feedbeef")
+	if err != nil || string(data) != "kept" {
+		t.Fatalf("Fetch kept = %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "team%2Fanalytics")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected directories emptied by Remove to be pruned, got %v", err)
+	}
+
+	report, err = archive.Scan(ctx, false)
+	if err != nil {
+		t.Fatalf("Scan after repair: %v", err)
+	}
+	kinds = scanKinds(report)
+	if len(report.Issues) != 2 || kinds[IssueCorruptArchiveFile] != 1 || kinds[IssueUnexpectedArchiveFile] != 1 {
+		t.Fatalf("expected only unrepairable issues after repair, got %+v", report.Issues)
+	}
+}
+
+func writeAged(t *testing.T, path string, data []byte, modTime time.Time) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+}
+
+func scanKinds(report ArchiveScanReport) map[CheckIssueKind]int {
+	kinds := make(map[CheckIssueKind]int)
+	for _, issue := range report.Issues {
+		kinds[issue.Kind]++
+	}
+	return kinds
+}
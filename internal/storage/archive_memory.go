@@ -49,4 +49,25 @@ func (m *MemoryArchive) Remove(ctx context.Context, repo, hash string) error {
 	return nil
 }
 
+// Walk calls fn for every payload stored when the walk started.
+func (m *MemoryArchive) Walk(ctx context.Context, fn func(repo, hash string) error) error {
+	m.mu.RLock()
+	var entries [][2]string
+	for repo, repoData := range m.data {
+		for hash := range repoData {
+			entries = append(entries, [2]string{repo, hash})
+		}
+	}
+	m.mu.RUnlock()
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(entry[0], entry[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (m *MemoryArchive) Close() error { return nil }
@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maxMigrationErrors bounds the error messages kept in a migration report.
+const maxMigrationErrors = 100
+
+// MigrationOptions controls an archive migration.
+type MigrationOptions struct {
+	// From and To name the archives in reports.
+	From string
+	To   string
+	// Overwrite copies payloads the target already has; by default they are
+	// skipped, so an interrupted migration can simply be started again.
+	Overwrite bool
+	// RemoveSource deletes each payload from the source once the target has
+	// it.
+	RemoveSource bool
+}
+
+// MigrationReport reports the progress of an archive migration.
+type MigrationReport struct {
+	From       string     `json:"from"`
+	To         string     `json:"to"`
+	Running    bool       `json:"running"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	Scanned    int        `json:"scanned"`
+	Copied     int        `json:"copied"`
+	Skipped    int        `json:"skipped"`
+	Removed    int        `json:"removed"`
+	Bytes      int64      `json:"bytes"`
+	Failed     int        `json:"failed"`
+	Errors     []string   `json:"errors,omitempty"`
+}
+
+// ArchiveMigration copies every payload of one archive into another in the
+// background while both stay in use. Payloads written to the source after
+// the walk passed them are not copied; serve writes from the target (for
+// example with a TieredArchive listing the target first) while migrating.
+type ArchiveMigration struct {
+	from, to Archive
+	opts     MigrationOptions
+	clock    func() time.Time
+
+	mu     sync.Mutex
+	report MigrationReport
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// StartArchiveMigration starts copying from into to. The source must be
+// able to list its content.
+func StartArchiveMigration(from, to Archive, opts MigrationOptions) (*ArchiveMigration, error) {
+	walker, ok := from.(archiveWalker)
+	if !ok {
+		return nil, &ValidationError{Message: fmt.Sprintf("archive %s cannot list its content", opts.From)}
+	}
+	if from == to {
+		return nil, &ValidationError{Message: "cannot migrate an archive into itself"}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &ArchiveMigration{
+		from:   from,
+		to:     to,
+		opts:   opts,
+		clock:  time.Now,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	m.report = MigrationReport{From: opts.From, To: opts.To, Running: true, StartedAt: m.clock().UTC()}
+	go m.run(ctx, walker)
+	return m, nil
+}
+
+func (m *ArchiveMigration) run(ctx context.Context, walker archiveWalker) {
+	defer close(m.done)
+	err := walker.Walk(ctx, func(repo, hash string) error {
+		m.update(func(r *MigrationReport) { r.Scanned++ })
+		if err := m.migrate(ctx, repo, hash); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			m.fail(fmt.Sprintf("%s/%s: %v", repo, hash, err))
+		}
+		return nil
+	})
+	if err != nil {
+		m.fail(err.Error())
+	}
+	now := m.clock().UTC()
+	m.update(func(r *MigrationReport) {
+		r.Running = false
+		r.FinishedAt = &now
+	})
+}
+
+func (m *ArchiveMigration) migrate(ctx context.Context, repo, hash string) error {
+	var notFound *NotFoundError
+	copied := false
+	if !m.opts.Overwrite {
+		_, err := m.to.Fetch(ctx, repo, hash)
+		if err != nil && !errors.As(err, &notFound) {
+			return err
+		}
+		if err == nil {
+			m.update(func(r *MigrationReport) { r.Skipped++ })
+			copied = true
+		}
+	}
+	if !copied {
+		data, err := m.from.Fetch(ctx, repo, hash)
+		if errors.As(err, &notFound) {
+			// Removed by retention or GC since the walk listed it.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := m.to.Store(ctx, repo, hash, data); err != nil {
+			return err
+		}
+		m.update(func(r *MigrationReport) {
+			r.Copied++
+			r.Bytes += int64(len(data))
+		})
+	}
+	if m.opts.RemoveSource {
+		if err := m.from.Remove(ctx, repo, hash); err != nil {
+			return err
+		}
+		m.update(func(r *MigrationReport) { r.Removed++ })
+	}
+	return nil
+}
+
+func (m *ArchiveMigration) update(fn func(r *MigrationReport)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fn(&m.report)
+}
+
+func (m *ArchiveMigration) fail(msg string) {
+	m.update(func(r *MigrationReport) {
+		r.Failed++
+		if len(r.Errors) < maxMigrationErrors {
+			r.Errors = append(r.Errors, msg)
+		}
+	})
+}
+
+// Status returns a snapshot of the migration's progress.
+func (m *ArchiveMigration) Status() MigrationReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	report := m.report
+	report.Errors = append([]string(nil), m.report.Errors...)
+	return report
+}
+
+// Wait blocks until the migration finishes and returns its report.
+func (m *ArchiveMigration) Wait() MigrationReport {
+	<-m.done
+	return m.Status()
+}
+
+// Stop cancels the migration and waits for it to finish.
+func (m *ArchiveMigration) Stop() MigrationReport {
+	m.cancel()
+	return m.Wait()
+}
@@ -0,0 +1,618 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Packs group a repository's archived payloads into one Bolt value each.
+// Inside a pack, payloads are stored whole or as deltas against a
+// neighbouring payload of the same pack, optionally zstd-compressed. The
+// pack index maps each packed hash to its pack and offset, so a payload is
+// read without decoding the rest of the pack.
+//
+// Pack layout:
+//
+//	"KVPK" version uint32(count) entries...
+//
+// Entry layout:
+//
+//	flags [codec id] [uvarint distance back to base entry] uvarint len body
+const (
+	boltPackBucket      = "packs"
+	boltPackIndexBucket = "pack-index"
+
+	packVersion    byte = 1
+	packHeaderSize      = 9
+
+	// packEntryDelta marks a body that is a delta against the base entry.
+	packEntryDelta byte = 1 << 0
+	// packEntryZstd marks a zstd-compressed body.
+	packEntryZstd byte = 1 << 1
+	// packEntryEncoded marks a compressed content payload that was decoded
+	// before packing; reads encode it again with the stored codec id.
+	packEntryEncoded byte = 1 << 2
+)
+
+var packMagic = []byte("KVPK")
+
+// PackOptions tunes how archived payloads are packed.
+type PackOptions struct {
+	// Full repacks every payload of the repository, packed or loose, and
+	// drops the space held by removed payloads. Otherwise only loose payloads
+	// are packed, and only once there are MinObjects of them.
+	Full       bool `json:"full,omitempty"`
+	MinObjects int  `json:"minObjects,omitempty"`
+	// Window is how many preceding payloads are tried as delta bases and
+	// MaxDepth bounds delta chains, which bounds the work of a read.
+	Window   int `json:"window,omitempty"`
+	MaxDepth int `json:"maxDepth,omitempty"`
+	// MaxPackBytes bounds the payload bytes packed together, and so the
+	// memory a pass needs.
+	MaxPackBytes int64 `json:"maxPackBytes,omitempty"`
+}
+
+func (o PackOptions) withDefaults() PackOptions {
+	if o.MinObjects <= 0 {
+		o.MinObjects = 64
+	}
+	if o.Window <= 0 {
+		o.Window = 10
+	}
+	if o.MaxDepth <= 0 {
+		o.MaxDepth = 50
+	}
+	if o.MaxPackBytes <= 0 {
+		o.MaxPackBytes = 256 << 20
+	}
+	return o
+}
+
+// PackStats describes how a repository's archived payloads are stored.
+// DeadEntries counts packed payloads that were removed or rewritten since;
+// a full repack reclaims their space.
+type PackStats struct {
+	LooseEntries  int   `json:"looseEntries"`
+	LooseBytes    int64 `json:"looseBytes"`
+	PackedEntries int   `json:"packedEntries"`
+	DeadEntries   int   `json:"deadEntries"`
+	Packs         int   `json:"packs"`
+	PackBytes     int64 `json:"packBytes"`
+}
+
+// PackReport reports one packing pass over a repository. InputBytes sums
+// the payloads packed and PackBytes the packs written for them; Skipped
+// counts payloads removed or rewritten while the pass ran, which stay as
+// they are. Stats describes the repository after the pass.
+type PackReport struct {
+	Repo      string    `json:"repo"`
+	StartedAt time.Time `json:"startedAt"`
+	// Duration is filled in by the pack job.
+	Duration     string    `json:"duration,omitempty"`
+	Full         bool      `json:"full"`
+	Packed       int       `json:"packed"`
+	Deltas       int       `json:"deltas"`
+	Skipped      int       `json:"skipped"`
+	PacksWritten int       `json:"packsWritten"`
+	PacksRemoved int       `json:"packsRemoved"`
+	InputBytes   int64     `json:"inputBytes"`
+	PackBytes    int64     `json:"packBytes"`
+	Stats        PackStats `json:"stats"`
+	Errors       []string  `json:"errors,omitempty"`
+}
+
+// packCandidate is a payload selected for packing. record is its index
+// record when it is packed already and nil when it is loose.
+type packCandidate struct {
+	hash   string
+	size   int
+	record []byte
+}
+
+// packObject is a payload being written into a pack.
+type packObject struct {
+	hash string
+	// data is the stored payload and origin the loose payload or index
+	// record it was read from; the pack only replaces an unchanged origin.
+	data   []byte
+	origin []byte
+	loose  bool
+
+	// repr is what is packed and delta-compressed: the raw content of
+	// compressed payloads, the payload itself otherwise.
+	repr    []byte
+	codecID byte
+	encoded bool
+	// opaque payloads (encrypted, or compressed in a way that cannot be
+	// reproduced) are stored verbatim.
+	opaque   bool
+	deltable bool
+
+	offset int
+	depth  int
+	index  *deltaIndex
+}
+
+func newPackObject(hash string, data, origin []byte, loose bool) *packObject {
+	obj := &packObject{hash: hash, data: data, origin: origin, loose: loose, repr: data}
+	switch {
+	case bytes.HasPrefix(data, sealedMagic):
+		obj.opaque = true
+	case storedCodec(data) != CodecNone:
+		// Compressed revisions of one file share little, their raw content
+		// a lot. Only unpack content that encodes back to the same bytes so
+		// reads return exactly what was stored.
+		raw, codec, err := decodeContent(data)
+		if err == nil {
+			var again []byte
+			again, err = encodeContent(codec, raw)
+			if err == nil && !bytes.Equal(again, data) {
+				err = errors.New("not reproducible")
+			}
+		}
+		if err != nil {
+			obj.opaque = true
+			break
+		}
+		obj.repr, obj.codecID, obj.encoded = raw, data[len(contentMagic)], true
+	}
+	obj.deltable = !obj.opaque && len(obj.repr) >= 2*deltaBlock
+	return obj
+}
+
+// buildPack writes objs into a new pack, largest first, trying the previous
+// opts.Window payloads as delta bases for each. It returns the number of
+// deltas.
+func buildPack(objs []*packObject, opts PackOptions) ([]byte, int) {
+	sort.SliceStable(objs, func(i, j int) bool {
+		if len(objs[i].repr) != len(objs[j].repr) {
+			return len(objs[i].repr) > len(objs[j].repr)
+		}
+		return objs[i].hash < objs[j].hash
+	})
+
+	pack := make([]byte, packHeaderSize)
+	copy(pack, packMagic)
+	pack[len(packMagic)] = packVersion
+	binary.BigEndian.PutUint32(pack[len(packMagic)+1:], uint32(len(objs)))
+
+	deltas := 0
+	var window []*packObject
+	for _, obj := range objs {
+		obj.offset = len(pack)
+		var base *packObject
+		body := obj.repr
+		if obj.deltable {
+			// Only keep deltas that at least halve the payload.
+			limit := len(obj.repr) / 2
+			for _, candidate := range window {
+				if candidate.depth >= opts.MaxDepth {
+					continue
+				}
+				if delta := candidate.index.delta(obj.repr, limit); delta != nil {
+					base, body, limit = candidate, delta, len(delta)-1
+				}
+			}
+		}
+
+		var flags byte
+		if base != nil {
+			flags |= packEntryDelta
+			obj.depth = base.depth + 1
+			deltas++
+		}
+		if !obj.opaque {
+			if compressed, err := compressStream(CodecZstd, body); err == nil && len(compressed) < len(body) {
+				flags |= packEntryZstd
+				body = compressed
+			}
+		}
+		if obj.encoded {
+			flags |= packEntryEncoded
+		}
+		pack = append(pack, flags)
+		if obj.encoded {
+			pack = append(pack, obj.codecID)
+		}
+		if base != nil {
+			pack = binary.AppendUvarint(pack, uint64(obj.offset-base.offset))
+		}
+		pack = binary.AppendUvarint(pack, uint64(len(body)))
+		pack = append(pack, body...)
+
+		if obj.deltable {
+			obj.index = newDeltaIndex(obj.repr)
+			window = append(window, obj)
+			if len(window) > opts.Window {
+				window[0].index = nil
+				window = window[1:]
+			}
+		}
+	}
+	return pack, deltas
+}
+
+// packEntry is one parsed pack entry; body still points into the pack.
+type packEntry struct {
+	flags   byte
+	codecID byte
+	base    int
+	body    []byte
+}
+
+func parsePackEntry(pack []byte, off int) (packEntry, error) {
+	var entry packEntry
+	if off < packHeaderSize || off >= len(pack) {
+		return entry, fmt.Errorf("pack entry offset %d out of range", off)
+	}
+	rest := pack[off:]
+	entry.flags, rest = rest[0], rest[1:]
+	if entry.flags&packEntryEncoded != 0 {
+		if len(rest) == 0 {
+			return entry, errors.New("truncated pack entry")
+		}
+		entry.codecID, rest = rest[0], rest[1:]
+	}
+	if entry.flags&packEntryDelta != 0 {
+		distance, n := binary.Uvarint(rest)
+		if n <= 0 || distance == 0 || distance > uint64(off) {
+			return entry, errors.New("invalid delta base in pack entry")
+		}
+		entry.base = off - int(distance)
+		rest = rest[n:]
+	}
+	size, n := binary.Uvarint(rest)
+	if n <= 0 || size > uint64(len(rest)-n) {
+		return entry, errors.New("truncated pack entry")
+	}
+	entry.body = rest[n : n+int(size)]
+	return entry, nil
+}
+
+// readPackEntry returns the payload stored at off, resolving its delta
+// chain. Delta bases always precede their targets, so the chain ends.
+func readPackEntry(pack []byte, off int) ([]byte, error) {
+	if len(pack) < packHeaderSize || !bytes.HasPrefix(pack, packMagic) || pack[len(packMagic)] != packVersion {
+		return nil, errors.New("not a pack")
+	}
+	var chain []packEntry
+	for {
+		entry, err := parsePackEntry(pack, off)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, entry)
+		if entry.flags&packEntryDelta == 0 {
+			break
+		}
+		off = entry.base
+	}
+
+	var repr []byte
+	for i := len(chain) - 1; i >= 0; i-- {
+		body := chain[i].body
+		if chain[i].flags&packEntryZstd != 0 {
+			raw, err := decompressStream(CodecZstd, body)
+			if err != nil {
+				return nil, err
+			}
+			body = raw
+		} else if chain[i].flags&packEntryDelta == 0 {
+			body = append([]byte{}, body...)
+		}
+		if chain[i].flags&packEntryDelta == 0 {
+			repr = body
+			continue
+		}
+		next, err := applyDelta(repr, body)
+		if err != nil {
+			return nil, err
+		}
+		repr = next
+	}
+
+	top := chain[0]
+	if top.flags&packEntryEncoded == 0 {
+		return repr, nil
+	}
+	switch top.codecID {
+	case codecIDGzip:
+		return encodeContent(CodecGzip, repr)
+	case codecIDZstd:
+		return encodeContent(CodecZstd, repr)
+	default:
+		return nil, fmt.Errorf("unknown content codec %d in pack", top.codecID)
+	}
+}
+
+func packKey(id uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, id)
+}
+
+// packRecord encodes an index record: pack id, entry offset and payload
+// size.
+func packRecord(id uint64, off, size int) []byte {
+	record := binary.AppendUvarint(nil, id)
+	record = binary.AppendUvarint(record, uint64(off))
+	return binary.AppendUvarint(record, uint64(size))
+}
+
+func parsePackRecord(record []byte) (id uint64, off, size int, err error) {
+	var fields [3]uint64
+	for i := range fields {
+		v, n := binary.Uvarint(record)
+		if n <= 0 {
+			return 0, 0, 0, errors.New("corrupt pack index record")
+		}
+		fields[i], record = v, record[n:]
+	}
+	return fields[0], int(fields[1]), int(fields[2]), nil
+}
+
+// readPacked returns the payload an index record points at.
+func readPacked(tx *bolt.Tx, repo string, record []byte) ([]byte, error) {
+	id, off, _, err := parsePackRecord(record)
+	if err != nil {
+		return nil, err
+	}
+	var pack []byte
+	if packs := tx.Bucket([]byte(boltPackBucket)).Bucket([]byte(repo)); packs != nil {
+		pack = packs.Get(packKey(id))
+	}
+	if pack == nil {
+		return nil, fmt.Errorf("pack %d of %s is missing", id, repo)
+	}
+	return readPackEntry(pack, off)
+}
+
+// Pack groups the repository's archived payloads into delta-compressed
+// packs. It runs online: payloads are read in one transaction and the packs
+// are committed in another, which only takes over payloads that were not
+// removed or rewritten in between. Packs no payload points at anymore are
+// deleted afterwards.
+func (a *BoltArchive) Pack(ctx context.Context, repo string, opts PackOptions) (PackReport, error) {
+	opts = opts.withDefaults()
+	a.packMu.Lock()
+	defer a.packMu.Unlock()
+
+	report := PackReport{Repo: repo, StartedAt: time.Now().UTC(), Full: opts.Full}
+	candidates, stats, err := a.packCandidates(repo, opts.Full)
+	if err != nil {
+		return report, err
+	}
+	switch {
+	case !opts.Full && stats.LooseEntries < opts.MinObjects:
+		candidates = nil
+	case opts.Full && stats.LooseEntries == 0 && stats.Packs <= 1 && stats.DeadEntries == 0:
+		candidates = nil
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].size > candidates[j].size })
+	for len(candidates) > 0 {
+		if err := ctx.Err(); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			break
+		}
+		n, total := 0, int64(0)
+		for n < len(candidates) && (n == 0 || total+int64(candidates[n].size) <= opts.MaxPackBytes) {
+			total += int64(candidates[n].size)
+			n++
+		}
+		if err := a.writePack(repo, candidates[:n], opts, &report); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		}
+		candidates = candidates[n:]
+	}
+
+	removed, err := a.prunePacks(repo)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	report.PacksRemoved = removed
+	if _, report.Stats, err = a.packCandidates(repo, false); err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	return report, nil
+}
+
+// packCandidates lists the loose payloads of repo, and with packed the
+// packed ones too, along with the repository's pack stats.
+func (a *BoltArchive) packCandidates(repo string, packed bool) ([]packCandidate, PackStats, error) {
+	var candidates []packCandidate
+	var stats PackStats
+	err := a.db.View(func(tx *bolt.Tx) error {
+		if loose := tx.Bucket([]byte(boltRootBucket)).Bucket([]byte(repo)); loose != nil {
+			if err := loose.ForEach(func(k, v []byte) error {
+				stats.LooseEntries++
+				stats.LooseBytes += int64(len(v))
+				candidates = append(candidates, packCandidate{hash: string(k), size: len(v)})
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		if index := tx.Bucket([]byte(boltPackIndexBucket)).Bucket([]byte(repo)); index != nil {
+			if err := index.ForEach(func(k, v []byte) error {
+				stats.PackedEntries++
+				if !packed {
+					return nil
+				}
+				_, _, size, err := parsePackRecord(v)
+				if err != nil {
+					return err
+				}
+				candidates = append(candidates, packCandidate{hash: string(k), size: size, record: append([]byte(nil), v...)})
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		entries := 0
+		if packs := tx.Bucket([]byte(boltPackBucket)).Bucket([]byte(repo)); packs != nil {
+			if err := packs.ForEach(func(_, v []byte) error {
+				stats.Packs++
+				stats.PackBytes += int64(len(v))
+				if len(v) >= packHeaderSize {
+					entries += int(binary.BigEndian.Uint32(v[len(packMagic)+1:]))
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		stats.DeadEntries = entries - stats.PackedEntries
+		return nil
+	})
+	return candidates, stats, err
+}
+
+// writePack reads candidates, packs them and commits the pack.
+func (a *BoltArchive) writePack(repo string, candidates []packCandidate, opts PackOptions, report *PackReport) error {
+	var objs []*packObject
+	if err := a.db.View(func(tx *bolt.Tx) error {
+		loose := tx.Bucket([]byte(boltRootBucket)).Bucket([]byte(repo))
+		index := tx.Bucket([]byte(boltPackIndexBucket)).Bucket([]byte(repo))
+		for _, candidate := range candidates {
+			if candidate.record == nil {
+				var data []byte
+				if loose != nil {
+					data = loose.Get([]byte(candidate.hash))
+				}
+				if data == nil {
+					report.Skipped++
+					continue
+				}
+				data = append([]byte(nil), data...)
+				objs = append(objs, newPackObject(candidate.hash, data, data, true))
+				continue
+			}
+			if index == nil || !bytes.Equal(index.Get([]byte(candidate.hash)), candidate.record) {
+				report.Skipped++
+				continue
+			}
+			data, err := readPacked(tx, repo, candidate.record)
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", candidate.hash, err))
+				continue
+			}
+			objs = append(objs, newPackObject(candidate.hash, data, candidate.record, false))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if len(objs) == 0 {
+		return nil
+	}
+
+	pack, deltas := buildPack(objs, opts)
+	packed, input := 0, int64(0)
+	if err := a.db.Update(func(tx *bolt.Tx) error {
+		packed, input = 0, 0
+		packs, err := tx.Bucket([]byte(boltPackBucket)).CreateBucketIfNotExists([]byte(repo))
+		if err != nil {
+			return err
+		}
+		index, err := tx.Bucket([]byte(boltPackIndexBucket)).CreateBucketIfNotExists([]byte(repo))
+		if err != nil {
+			return err
+		}
+		loose := tx.Bucket([]byte(boltRootBucket)).Bucket([]byte(repo))
+		id, err := packs.NextSequence()
+		if err != nil {
+			return err
+		}
+		for _, obj := range objs {
+			key := []byte(obj.hash)
+			if obj.loose {
+				if loose == nil || !bytes.Equal(loose.Get(key), obj.origin) {
+					continue
+				}
+				if err := loose.Delete(key); err != nil {
+					return err
+				}
+			} else if !bytes.Equal(index.Get(key), obj.origin) {
+				continue
+			}
+			if err := index.Put(key, packRecord(id, obj.offset, len(obj.data))); err != nil {
+				return err
+			}
+			packed++
+			input += int64(len(obj.data))
+		}
+		if packed == 0 {
+			return nil
+		}
+		return packs.Put(packKey(id), pack)
+	}); err != nil {
+		return err
+	}
+	report.Skipped += len(objs) - packed
+	if packed > 0 {
+		report.Packed += packed
+		report.Deltas += deltas
+		report.PacksWritten++
+		report.InputBytes += input
+		report.PackBytes += int64(len(pack))
+	}
+	return nil
+}
+
+// prunePacks deletes the repository's packs that no index record points
+// at.
+func (a *BoltArchive) prunePacks(repo string) (int, error) {
+	removed := 0
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		packs := tx.Bucket([]byte(boltPackBucket)).Bucket([]byte(repo))
+		if packs == nil {
+			return nil
+		}
+		live := make(map[uint64]bool)
+		if index := tx.Bucket([]byte(boltPackIndexBucket)).Bucket([]byte(repo)); index != nil {
+			if err := index.ForEach(func(_, v []byte) error {
+				id, _, _, err := parsePackRecord(v)
+				if err != nil {
+					return err
+				}
+				live[id] = true
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		var dead [][]byte
+		if err := packs.ForEach(func(k, _ []byte) error {
+			if len(k) != 8 || !live[binary.BigEndian.Uint64(k)] {
+				dead = append(dead, append([]byte(nil), k...))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range dead {
+			if err := packs.Delete(k); err != nil {
+				return err
+			}
+		}
+		removed = len(dead)
+		return nil
+	})
+	return removed, err
+}
+
+// PackRepos lists the repositories with archived payloads.
+func (a *BoltArchive) PackRepos(ctx context.Context) ([]string, error) {
+	var repos []string
+	err := a.db.View(func(tx *bolt.Tx) error {
+		repos = archiveRepos(tx)
+		return nil
+	})
+	return repos, err
+}
@@ -0,0 +1,191 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// revisions returns n revisions of a text file, each editing a few lines of
+// the previous one.
+func revisions(n, lines int) [][]byte {
+	rng := rand.New(rand.NewSource(1))
+	file := make([]string, lines)
+	for i := range file {
+		file[i] = fmt.Sprintf("line %d: %x", i, rng.Int63())
+	}
+	out := make([][]byte, 0, n)
+	for r := 0; r < n; r++ {
+		for e := 0; e < 3; e++ {
+			file[rng.Intn(lines)] = fmt.Sprintf("rev %d: %x", r, rng.Int63())
+		}
+		out = append(out, []byte(strings.Join(file, "\n")))
+	}
+	return out
+}
+
+func TestPackDelta(t *testing.T) {
+	revs := revisions(2, 2000)
+	base, target := revs[0], revs[1]
+	delta := newDeltaIndex(base).delta(target, len(target))
+	if delta == nil || len(delta) > len(target)/20 {
+		t.Fatalf("delta of a small edit is %d bytes for a %d byte target", len(delta), len(target))
+	}
+	rebuilt, err := applyDelta(base, delta)
+	if err != nil || !bytes.Equal(rebuilt, target) {
+		t.Fatalf("applyDelta mismatch: %v", err)
+	}
+	if newDeltaIndex(base).delta(target, 10) != nil {
+		t.Fatalf("expected delta over the limit to be dropped")
+	}
+	if _, err := applyDelta(base[1:], delta); !errors.Is(err, errCorruptDelta) {
+		t.Fatalf("expected corrupt delta error for the wrong base, got %v", err)
+	}
+	if _, err := applyDelta(base, delta[:len(delta)-3]); !errors.Is(err, errCorruptDelta) {
+		t.Fatalf("expected corrupt delta error for a truncated delta, got %v", err)
+	}
+}
+
+func TestBoltArchivePack(t *testing.T) {
+	ctx := context.Background()
+	archive, err := NewBoltArchive(filepath.Join(t.TempDir(), "archive.db"))
+	if err != nil {
+		t.Fatalf("NewBoltArchive: %v", err)
+	}
+	defer archive.Close()
+
+	want := make(map[string][]byte)
+	for i, rev := range revisions(40, 500) {
+		payload := rev
+		if i%2 == 1 {
+			if payload, err = encodeContent(CodecZstd, rev); err != nil {
+				t.Fatalf("encodeContent: %v", err)
+			}
+		}
+		want[fmt.Sprintf("rev%02d", i)] = payload
+	}
+	want["sealed"] = append(append([]byte{}, sealedMagic...), bytes.Repeat([]byte{0x5a}, 100)...)
+	want["tiny"] = []byte("x")
+	want["empty"] = []byte{}
+	for hash, payload := range want {
+		if err := archive.Store(ctx, "analytics", hash, payload); err != nil {
+			t.Fatalf("Store %s: %v", hash, err)
+		}
+	}
+	verify := func() {
+		t.Helper()
+		for hash, payload := range want {
+			data, err := archive.Fetch(ctx, "analytics", hash)
+			if err != nil || !bytes.Equal(data, payload) {
+				t.Fatalf("Fetch %s: %d bytes, %v; want %d bytes", hash, len(data), err, len(payload))
+			}
+		}
+	}
+
+	report, err := archive.Pack(ctx, "analytics", PackOptions{MinObjects: 100})
+	if err != nil || report.Packed != 0 || report.Stats.LooseEntries != len(want) {
+		t.Fatalf("Pack below MinObjects = %+v, %v", report, err)
+	}
+
+	report, err = archive.Pack(ctx, "analytics", PackOptions{MinObjects: 1})
+	if err != nil || len(report.Errors) > 0 {
+		t.Fatalf("Pack: %+v, %v", report, err)
+	}
+	if report.Packed != len(want) || report.Deltas < 30 || report.Stats.LooseEntries != 0 || report.Stats.Packs != 1 {
+		t.Fatalf("unexpected pack report %+v", report)
+	}
+	if report.PackBytes*10 > report.InputBytes {
+		t.Fatalf("pack is %d bytes for %d input bytes", report.PackBytes, report.InputBytes)
+	}
+	verify()
+
+	walked := make(map[string]int)
+	if err := archive.Walk(ctx, func(repo, hash string) error {
+		walked[hash]++
+		return nil
+	}); err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+	if len(walked) != len(want) {
+		t.Fatalf("Walk listed %d payloads, want %d", len(walked), len(want))
+	}
+	for hash, n := range walked {
+		if n != 1 {
+			t.Fatalf("Walk listed %s %d times", hash, n)
+		}
+	}
+
+	// Rewriting and removing packed payloads leaves dead pack entries.
+	want["rev03"] = []byte("rewritten")
+	if err := archive.Store(ctx, "analytics", "rev03", want["rev03"]); err != nil {
+		t.Fatalf("Store rewrite: %v", err)
+	}
+	if err := archive.Remove(ctx, "analytics", "rev04"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	delete(want, "rev04")
+	var notFound *NotFoundError
+	if _, err := archive.Fetch(ctx, "analytics", "rev04"); !errors.As(err, &notFound) {
+		t.Fatalf("expected NotFoundError for a removed packed payload, got %v", err)
+	}
+	verify()
+
+	report, err = archive.Pack(ctx, "analytics", PackOptions{Full: true})
+	if err != nil || len(report.Errors) > 0 {
+		t.Fatalf("full Pack: %+v, %v", report, err)
+	}
+	if report.Packed != len(want) || report.PacksRemoved != 1 {
+		t.Fatalf("unexpected full pack report %+v", report)
+	}
+	if stats := report.Stats; stats.Packs != 1 || stats.DeadEntries != 0 || stats.LooseEntries != 0 || stats.PackedEntries != len(want) {
+		t.Fatalf("unexpected stats after full repack %+v", stats)
+	}
+	verify()
+
+	// A clean repository is not repacked again.
+	report, err = archive.Pack(ctx, "analytics", PackOptions{Full: true})
+	if err != nil || report.Packed != 0 || report.PacksWritten != 0 {
+		t.Fatalf("full Pack of a clean repository = %+v, %v", report, err)
+	}
+}
+
+func TestPackJob(t *testing.T) {
+	ctx := context.Background()
+	archive, err := NewBoltArchive(filepath.Join(t.TempDir(), "archive.db"))
+	if err != nil {
+		t.Fatalf("NewBoltArchive: %v", err)
+	}
+	defer archive.Close()
+	for i, rev := range revisions(5, 100) {
+		for _, repo := range []string{"analytics", "billing"} {
+			if err := archive.Store(ctx, repo, fmt.Sprintf("rev%d", i), rev); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+		}
+	}
+
+	job := NewPackJob(0, PackOptions{MinObjects: 5})
+	job.Start(archive)
+	t.Cleanup(job.Stop)
+	job.Trigger("", false)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		status := job.Status()
+		if status.Runs >= 2 && status.Active == "" {
+			if status.Packed != 10 || status.Failures != 0 || status.Repos["billing"].Stats.PackedEntries != 5 {
+				t.Fatalf("unexpected status %+v", status)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job did not finish: %+v", status)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
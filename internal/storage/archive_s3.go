@@ -0,0 +1,520 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultS3Region       = "us-east-1"
+	defaultS3PartSize     = 8 << 20
+	minS3PartSize         = 5 << 20
+	defaultS3Retries      = 3
+	defaultS3RetryBackoff = 100 * time.Millisecond
+	defaultS3Timeout      = 30 * time.Second
+	s3Algorithm           = "AWS4-HMAC-SHA256"
+	s3TimeFormat          = "20060102T150405Z"
+)
+
+// S3Config configures an archive in an S3-compatible object store.
+type S3Config struct {
+	// Endpoint is the store's base URL, such as http://minio:9000. Empty
+	// means AWS S3 in Region.
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is prepended to every object key, e.g. "kv-vs/".
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// PathStyle addresses the bucket in the URL path instead of the host
+	// name; MinIO and most self-hosted stores need it.
+	PathStyle bool
+	// PartSize is the size above which payloads use multipart uploads and
+	// the size of each part. Values below the S3 minimum of 5 MiB are raised
+	// to it; zero means 8 MiB.
+	PartSize int64
+	// MaxRetries is how often a request failing with a network error,
+	// throttling or a server error is retried; zero means three, negative
+	// disables retries. RetryBackoff is the first delay and doubles after
+	// each attempt.
+	MaxRetries   int
+	RetryBackoff time.Duration
+	// Timeout bounds each request attempt; zero means 30s.
+	Timeout time.Duration
+	// Client overrides the HTTP client.
+	Client *http.Client
+}
+
+// S3Archive stores blob payloads as objects named <prefix><repo>/<hash> in an
+// S3-compatible bucket, so several API replicas can share one archive.
+type S3Archive struct {
+	cfg      S3Config
+	client   *http.Client
+	base     *url.URL
+	partSize int64
+	retries  int
+	backoff  time.Duration
+	clock    func() time.Time
+	sleep    func(ctx context.Context, d time.Duration) error
+}
+
+// NewS3Archive validates cfg and returns an archive for its bucket. It does
+// not contact the store.
+func NewS3Archive(cfg S3Config) (*S3Archive, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("s3 archive bucket is required")
+	}
+	if (cfg.AccessKey == "") != (cfg.SecretKey == "") {
+		return nil, errors.New("s3 archive needs both an access key and a secret key")
+	}
+	if cfg.Region == "" {
+		cfg.Region = defaultS3Region
+	}
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	base, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("s3 archive endpoint: %w", err)
+	}
+	if base.Scheme != "http" && base.Scheme != "https" || base.Host == "" {
+		return nil, fmt.Errorf("s3 archive endpoint %q must be an http or https URL", endpoint)
+	}
+	if !cfg.PathStyle {
+		base.Host = cfg.Bucket + "." + base.Host
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+
+	a := &S3Archive{
+		cfg:      cfg,
+		client:   cfg.Client,
+		base:     base,
+		partSize: cfg.PartSize,
+		retries:  cfg.MaxRetries,
+		backoff:  cfg.RetryBackoff,
+		clock:    time.Now,
+		sleep:    sleepContext,
+	}
+	if a.client == nil {
+		a.client = &http.Client{}
+	}
+	if a.partSize == 0 {
+		a.partSize = defaultS3PartSize
+	} else if a.partSize < minS3PartSize {
+		a.partSize = minS3PartSize
+	}
+	if a.retries == 0 {
+		a.retries = defaultS3Retries
+	} else if a.retries < 0 {
+		a.retries = 0
+	}
+	if a.backoff <= 0 {
+		a.backoff = defaultS3RetryBackoff
+	}
+	if a.cfg.Timeout <= 0 {
+		a.cfg.Timeout = defaultS3Timeout
+	}
+	return a, nil
+}
+
+// Store writes payload data under repo/hash, with a multipart upload when
+// data is larger than the part size.
+func (a *S3Archive) Store(ctx context.Context, repo, hash string, data []byte) error {
+	key := a.objectKey(repo, hash)
+	if int64(len(data)) <= a.partSize {
+		resp, err := a.do(ctx, http.MethodPut, key, nil, data)
+		if err != nil {
+			return &UnavailableError{Op: "archive store", Err: err}
+		}
+		resp.Body.Close()
+		return nil
+	}
+	if err := a.storeMultipart(ctx, key, data); err != nil {
+		return &UnavailableError{Op: "archive store", Err: err}
+	}
+	return nil
+}
+
+// Fetch retrieves payload data for repo/hash.
+func (a *S3Archive) Fetch(ctx context.Context, repo, hash string) ([]byte, error) {
+	resp, err := a.do(ctx, http.MethodGet, a.objectKey(repo, hash), nil, nil)
+	if err != nil {
+		var s3Err *s3Error
+		if errors.As(err, &s3Err) && s3Err.Status == http.StatusNotFound {
+			return nil, &NotFoundError{Resource: "archive", Key: hash}
+		}
+		return nil, &UnavailableError{Op: "archive fetch", Err: err}
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &UnavailableError{Op: "archive fetch", Err: err}
+	}
+	return data, nil
+}
+
+// Remove deletes payload data; removing a missing object is not an error.
+func (a *S3Archive) Remove(ctx context.Context, repo, hash string) error {
+	resp, err := a.do(ctx, http.MethodDelete, a.objectKey(repo, hash), nil, nil)
+	if err != nil {
+		var s3Err *s3Error
+		if errors.As(err, &s3Err) && s3Err.Status == http.StatusNotFound {
+			return nil
+		}
+		return &UnavailableError{Op: "archive remove", Err: err}
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// Walk calls fn for every object under the prefix, listing one page at a
+// time. Keys that are not <repo>/<hash> are skipped.
+func (a *S3Archive) Walk(ctx context.Context, fn func(repo, hash string) error) error {
+	query := url.Values{"list-type": {"2"}, "prefix": {a.cfg.Prefix}}
+	for {
+		resp, err := a.do(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return &UnavailableError{Op: "archive list", Err: err}
+		}
+		var page s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return &UnavailableError{Op: "archive list", Err: err}
+		}
+		for _, object := range page.Contents {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			i := strings.LastIndex(object.Key, "/")
+			if i <= len(a.cfg.Prefix) || i == len(object.Key)-1 {
+				continue
+			}
+			if err := fn(object.Key[len(a.cfg.Prefix):i], object.Key[i+1:]); err != nil {
+				return err
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+// Close releases idle connections.
+func (a *S3Archive) Close() error {
+	a.client.CloseIdleConnections()
+	return nil
+}
+
+func (a *S3Archive) objectKey(repo, hash string) string {
+	return a.cfg.Prefix + repo + "/" + hash
+}
+
+type s3InitiateResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3CompletePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteUpload struct {
+	XMLName xml.Name         `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletePart `xml:"Part"`
+}
+
+// storeMultipart uploads data in parts of the configured size. A failed
+// upload is aborted so the store does not keep the parts.
+func (a *S3Archive) storeMultipart(ctx context.Context, key string, data []byte) (err error) {
+	resp, err := a.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return fmt.Errorf("initiate multipart upload: %w", err)
+	}
+	var initiated s3InitiateResult
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil || initiated.UploadID == "" {
+		return fmt.Errorf("initiate multipart upload: no upload id (%v)", err)
+	}
+	uploadID := initiated.UploadID
+	defer func() {
+		if err != nil {
+			abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), a.cfg.Timeout)
+			defer cancel()
+			if resp, abortErr := a.do(abortCtx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil); abortErr == nil {
+				resp.Body.Close()
+			}
+		}
+	}()
+
+	var complete s3CompleteUpload
+	for offset, part := int64(0), 1; offset < int64(len(data)); offset, part = offset+a.partSize, part+1 {
+		end := min(offset+a.partSize, int64(len(data)))
+		query := url.Values{"partNumber": {strconv.Itoa(part)}, "uploadId": {uploadID}}
+		resp, err := a.do(ctx, http.MethodPut, key, query, data[offset:end])
+		if err != nil {
+			return fmt.Errorf("upload part %d: %w", part, err)
+		}
+		resp.Body.Close()
+		etag := resp.Header.Get("ETag")
+		if etag == "" {
+			return fmt.Errorf("upload part %d: no etag", part)
+		}
+		complete.Parts = append(complete.Parts, s3CompletePart{PartNumber: part, ETag: etag})
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	resp, err = a.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body)
+	if err != nil {
+		return fmt.Errorf("complete multipart upload: %w", err)
+	}
+	defer resp.Body.Close()
+	// S3 reports some completion failures in the body of a 200 response.
+	result, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("complete multipart upload: %w", err)
+	}
+	if s3Err := parseS3Error(resp.StatusCode, result); s3Err != nil {
+		return fmt.Errorf("complete multipart upload: %w", s3Err)
+	}
+	return nil
+}
+
+// s3Error is an error response from the object store.
+type s3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: status %d", e.Status)
+	}
+	return fmt.Sprintf("s3: status %d: %s: %s", e.Status, e.Code, e.Message)
+}
+
+// parseS3Error returns the <Error> document in body, if any.
+func parseS3Error(status int, body []byte) *s3Error {
+	if !bytes.Contains(body, []byte("<Error>")) {
+		return nil
+	}
+	s3Err := &s3Error{}
+	_ = xml.Unmarshal(body, s3Err)
+	s3Err.Status = status
+	return s3Err
+}
+
+// retryable reports whether a failed attempt should be repeated.
+func (e *s3Error) retryable() bool {
+	switch e.Status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return e.Code == "SlowDown" || e.Code == "RequestTimeout" || e.Code == "InternalError"
+}
+
+// do sends a signed request and returns the response of the first attempt
+// that succeeds. Network errors, throttling and server errors are retried
+// with exponential backoff; other error responses are returned as *s3Error.
+func (a *S3Archive) do(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Response, error) {
+	var lastErr error
+	for attempt := 0; attempt <= a.retries; attempt++ {
+		if attempt > 0 {
+			if err := a.sleep(ctx, a.backoff<<(attempt-1)); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := a.attempt(ctx, method, key, query, body)
+		if err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		lastErr = err
+		var s3Err *s3Error
+		if errors.As(err, &s3Err) && !s3Err.retryable() {
+			return nil, err
+		}
+	}
+	return nil, lastErr
+}
+
+func (a *S3Archive) attempt(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.Timeout)
+	req, err := a.newRequest(ctx, method, key, query, body)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer cancel()
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if s3Err := parseS3Error(resp.StatusCode, data); s3Err != nil {
+			return nil, s3Err
+		}
+		return nil, &s3Error{Status: resp.StatusCode}
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases a request's timeout once its body has been read.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+func (a *S3Archive) newRequest(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Request, error) {
+	path := a.base.Path
+	if a.cfg.PathStyle {
+		path += "/" + s3Escape(a.cfg.Bucket, false)
+	}
+	path += "/" + s3Escape(key, true)
+	rawQuery := s3CanonicalQuery(query)
+	target := a.base.Scheme + "://" + a.base.Host + path
+	if rawQuery != "" {
+		target += "?" + rawQuery
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	if len(body) == 0 {
+		req.Body = http.NoBody
+	}
+	a.sign(req, path, rawQuery, body)
+	return req, nil
+}
+
+// sign adds AWS Signature Version 4 headers to req. Requests stay unsigned
+// when no credentials are configured.
+func (a *S3Archive) sign(req *http.Request, path, rawQuery string, body []byte) {
+	payloadHash := sha256.Sum256(body)
+	payload := hex.EncodeToString(payloadHash[:])
+	now := a.clock().UTC()
+	amzDate := now.Format(s3TimeFormat)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if a.cfg.AccessKey == "" {
+		return
+	}
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		rawQuery,
+		"host:" + req.URL.Host + "\n" + "x-amz-content-sha256:" + payload + "\n" + "x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payload,
+	}, "\n")
+	day := now.Format("20060102")
+	scope := day + "/" + a.cfg.Region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	toSign := s3Algorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+a.cfg.SecretKey), day)
+	signingKey = hmacSHA256(signingKey, a.cfg.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, a.cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3CanonicalQuery encodes query sorted by key as SigV4 requires.
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes everything except RFC 3986 unreserved characters
+// and, when keepSlash is set, the path separator.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,354 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-process S3 endpoint for path-style requests. It verifies
+// SigV4 signatures against the request it received and supports single and
+// multipart uploads.
+type fakeS3 struct {
+	accessKey, secretKey, region string
+
+	mu       sync.Mutex
+	objects  map[string][]byte
+	uploads  map[string]map[int][]byte
+	nextID   int
+	failures map[string]int // operation -> requests still to fail with 503
+	requests map[string]int
+	pageSize int // list page size unless the request sets max-keys
+}
+
+func newFakeS3(accessKey, secretKey string) *fakeS3 {
+	return &fakeS3{
+		accessKey: accessKey,
+		secretKey: secretKey,
+		region:    defaultS3Region,
+		objects:   make(map[string][]byte),
+		uploads:   make(map[string]map[int][]byte),
+		failures:  make(map[string]int),
+		requests:  make(map[string]int),
+		pageSize:  1000,
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	query := r.URL.Query()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	op := r.Method
+	switch {
+	case query.Has("list-type"):
+		op = "list"
+	case query.Has("uploads"):
+		op = "initiate"
+	case query.Has("partNumber"):
+		op = "part"
+	case query.Has("uploadId"):
+		op = "complete"
+		if r.Method == http.MethodDelete {
+			op = "abort"
+		}
+	}
+	f.requests[op]++
+	if f.failures[op] > 0 {
+		f.failures[op]--
+		fakeS3Error(w, http.StatusServiceUnavailable, "SlowDown", "reduce your request rate")
+		return
+	}
+	if err := f.verify(r, body); err != nil {
+		fakeS3Error(w, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+		return
+	}
+
+	key := r.URL.Path
+	switch op {
+	case http.MethodPut:
+		f.objects[key] = body
+	case http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			fakeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		_, _ = w.Write(data)
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case "list":
+		// Pages hold at most max-keys objects; the token is the last key.
+		bucket := strings.TrimSuffix(key, "/") + "/"
+		limit, err := strconv.Atoi(query.Get("max-keys"))
+		if err != nil || limit <= 0 {
+			limit = f.pageSize
+		}
+		var keys []string
+		for name := range f.objects {
+			objectKey := strings.TrimPrefix(name, bucket)
+			if strings.HasPrefix(objectKey, query.Get("prefix")) && objectKey > query.Get("continuation-token") {
+				keys = append(keys, objectKey)
+			}
+		}
+		sort.Strings(keys)
+		truncated := len(keys) > limit
+		if truncated {
+			keys = keys[:limit]
+		}
+		fmt.Fprint(w, "<ListBucketResult>")
+		for _, objectKey := range keys {
+			fmt.Fprintf(w, "<Contents><Key>%s</Key></Contents>", objectKey)
+		}
+		if truncated {
+			fmt.Fprintf(w, "<IsTruncated>true</IsTruncated><NextContinuationToken>%s</NextContinuationToken>", keys[len(keys)-1])
+		}
+		fmt.Fprint(w, "</ListBucketResult>")
+	case "initiate":
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case "part":
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			fakeS3Error(w, http.StatusNotFound, "NoSuchUpload", "unknown upload")
+			return
+		}
+		n, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[n] = body
+		sum := md5.Sum(body)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	case "complete":
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			fakeS3Error(w, http.StatusNotFound, "NoSuchUpload", "unknown upload")
+			return
+		}
+		var complete s3CompleteUpload
+		if err := xml.Unmarshal(body, &complete); err != nil || len(complete.Parts) != len(parts) {
+			fakeS3Error(w, http.StatusOK, "InvalidPart", "parts do not match")
+			return
+		}
+		var data []byte
+		for _, part := range complete.Parts {
+			data = append(data, parts[part.PartNumber]...)
+		}
+		f.objects[key] = data
+		delete(f.uploads, query.Get("uploadId"))
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case "abort":
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// verify recomputes the request signature from what arrived on the wire.
+func (f *fakeS3) verify(r *http.Request, body []byte) error {
+	sum := sha256.Sum256(body)
+	payload := hex.EncodeToString(sum[:])
+	if r.Header.Get("X-Amz-Content-Sha256") != payload {
+		return errors.New("payload hash mismatch")
+	}
+	auth := r.Header.Get("Authorization")
+	prefix := s3Algorithm + " Credential=" + f.accessKey + "/"
+	if !strings.HasPrefix(auth, prefix) {
+		return fmt.Errorf("unexpected authorization %q", auth)
+	}
+	scope, rest, _ := strings.Cut(strings.TrimPrefix(auth, prefix), ", ")
+	signature := rest[strings.LastIndex(rest, "Signature=")+len("Signature="):]
+	day, _, _ := strings.Cut(scope, "/")
+
+	var pairs []string
+	for key, values := range r.URL.Query() {
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+	sort.Strings(pairs)
+	amzDate := r.Header.Get("X-Amz-Date")
+	canonical := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		strings.Join(pairs, "&"),
+		"host:" + r.Host + "\nx-amz-content-sha256:" + payload + "\nx-amz-date:" + amzDate + "\n",
+		"host;x-amz-content-sha256;x-amz-date",
+		payload,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	toSign := s3Algorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+	key := hmacSHA256([]byte("AWS4"+f.secretKey), day)
+	for _, part := range []string{f.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	if want := hex.EncodeToString(hmacSHA256(key, toSign)); signature != want {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// fail makes the next n requests of op fail with 503 SlowDown. Operations
+// are HTTP methods for single objects and initiate, part, complete and abort
+// for multipart uploads.
+func (f *fakeS3) fail(op string, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[op] = n
+}
+
+func fakeS3Error(w http.ResponseWriter, status int, code, message string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, message)
+}
+
+// newTestS3Archive returns an archive against S3_TEST_ENDPOINT (for example a
+// local MinIO with S3_TEST_BUCKET, S3_TEST_ACCESS_KEY and S3_TEST_SECRET_KEY)
+// or, by default, against an in-process fake.
+func newTestS3Archive(t *testing.T) (*S3Archive, *fakeS3) {
+	t.Helper()
+	cfg := S3Config{
+		Endpoint:     os.Getenv("S3_TEST_ENDPOINT"),
+		Bucket:       os.Getenv("S3_TEST_BUCKET"),
+		AccessKey:    os.Getenv("S3_TEST_ACCESS_KEY"),
+		SecretKey:    os.Getenv("S3_TEST_SECRET_KEY"),
+		Prefix:       fmt.Sprintf("test-%d/", time.Now().UnixNano()),
+		PathStyle:    true,
+		PartSize:     minS3PartSize,
+		RetryBackoff: time.Millisecond,
+	}
+	var fake *fakeS3
+	if cfg.Endpoint == "" {
+		fake = newFakeS3("AKIDEXAMPLE", "secret")
+		server := httptest.NewServer(fake)
+		t.Cleanup(server.Close)
+		cfg.Endpoint, cfg.Bucket = server.URL, "archive"
+		cfg.AccessKey, cfg.SecretKey = fake.accessKey, fake.secretKey
+	}
+	archive, err := NewS3Archive(cfg)
+	if err != nil {
+		t.Fatalf("NewS3Archive: %v", err)
+	}
+	t.Cleanup(func() { _ = archive.Close() })
+	return archive, fake
+}
+
+func TestS3Archive(t *testing.T) {
+	ctx := context.Background()
+	archive, fake := newTestS3Archive(t)
+
+	if err := archive.Store(ctx, "team/analytics", "abc123", []byte("payload")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	data, err := archive.Fetch(ctx, "team/analytics", "abc123")
+	if err != nil || string(data) != "payload" {
+		t.Fatalf("Fetch = %q, %v", data, err)
+	}
+	if fake != nil {
+		if _, ok := fake.objects["/archive/"+archive.cfg.Prefix+"team/analytics/abc123"]; !ok {
+			t.Fatalf("expected object at <prefix><repo>/<hash>, have %v", fake.objects)
+		}
+	}
+
+	var notFound *NotFoundError
+	if _, err := archive.Fetch(ctx, "team/analytics", "missing"); !errors.As(err, &notFound) {
+		t.Fatalf("expected NotFoundError, got %v", err)
+	}
+	if err := archive.Remove(ctx, "team/analytics", "abc123"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if err := archive.Remove(ctx, "team/analytics", "abc123"); err != nil {
+		t.Fatalf("Remove missing: %v", err)
+	}
+	if _, err := archive.Fetch(ctx, "team/analytics", "abc123"); !errors.As(err, &notFound) {
+		t.Fatalf("expected NotFoundError after Remove, got %v", err)
+	}
+
+	// Payloads above the part size go through a multipart upload.
+	large := bytes.Repeat([]byte("0123456789abcdef"), (minS3PartSize*2+1024)/16)
+	if err := archive.Store(ctx, "analytics", "large", large); err != nil {
+		t.Fatalf("Store large: %v", err)
+	}
+	data, err = archive.Fetch(ctx, "analytics", "large")
+	if err != nil || !bytes.Equal(data, large) {
+		t.Fatalf("Fetch large: %d bytes, %v", len(data), err)
+	}
+	if fake == nil {
+		return
+	}
+	if fake.requests["part"] != 3 || fake.requests["complete"] != 1 {
+		t.Fatalf("expected 3 parts and one completion, got %v", fake.requests)
+	}
+
+	// Walk lists every object, across pages.
+	if err := archive.Store(ctx, "team/analytics", "def456", []byte("more")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	fake.mu.Lock()
+	fake.objects["/archive/"+archive.cfg.Prefix+"stray"] = []byte("not an archive object")
+	fake.pageSize = 1
+	fake.mu.Unlock()
+	var walked []string
+	if err := archive.Walk(ctx, func(repo, hash string) error {
+		walked = append(walked, repo+"|"+hash)
+		return nil
+	}); err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+	if strings.Join(walked, ",") != "analytics|large,team/analytics|def456" || fake.requests["list"] != 3 {
+		t.Fatalf("unexpected walk %v in %d pages", walked, fake.requests["list"])
+	}
+
+	// Throttling is retried with backoff.
+	fake.fail(http.MethodPut, 2)
+	if err := archive.Store(ctx, "analytics", "retried", []byte("ok")); err != nil {
+		t.Fatalf("Store with retries: %v", err)
+	}
+
+	// Exhausted retries surface as UnavailableError.
+	archive.retries = 1
+	fake.fail(http.MethodGet, 2)
+	var unavailable *UnavailableError
+	if _, err := archive.Fetch(ctx, "analytics", "retried"); !errors.As(err, &unavailable) {
+		t.Fatalf("expected UnavailableError, got %v", err)
+	}
+
+	// A failed multipart upload is aborted so no parts are left behind.
+	fake.fail("part", 2)
+	if err := archive.Store(ctx, "analytics", "aborted", large); !errors.As(err, &unavailable) {
+		t.Fatalf("expected UnavailableError for a failed part, got %v", err)
+	}
+	if fake.requests["abort"] != 1 || len(fake.uploads) != 0 {
+		t.Fatalf("expected the upload to be aborted, got %v with %d open uploads", fake.requests, len(fake.uploads))
+	}
+
+	// Signature errors are not retried.
+	bad, err := NewS3Archive(S3Config{Endpoint: archive.cfg.Endpoint, Bucket: "archive", PathStyle: true,
+		AccessKey: fake.accessKey, SecretKey: "wrong"})
+	if err != nil {
+		t.Fatalf("NewS3Archive: %v", err)
+	}
+	gets := fake.requests[http.MethodGet]
+	if _, err := bad.Fetch(ctx, "analytics", "large"); !errors.As(err, &unavailable) || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+		t.Fatalf("expected a signature error, got %v", err)
+	}
+	if fake.requests[http.MethodGet] != gets+1 {
+		t.Fatalf("expected one attempt for a signature error, got %d", fake.requests[http.MethodGet]-gets)
+	}
+}
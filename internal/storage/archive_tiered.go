@@ -0,0 +1,461 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const tierIndexBucket = "entries"
+
+// archiveWalker is implemented by archives that can enumerate their
+// payloads. Demotion uses it to adopt content stored before tiering was
+// enabled, and migrations use it to find what to copy.
+type archiveWalker interface {
+	Walk(ctx context.Context, fn func(repo, hash string) error) error
+}
+
+// ArchiveTier is one level of a TieredArchive.
+type ArchiveTier struct {
+	Name    string
+	Archive Archive
+	// MaxAge is how long payloads stay in this tier before they are demoted
+	// to the next one. Zero keeps them; the last tier never demotes.
+	MaxAge time.Duration
+}
+
+// TieredArchiveConfig configures a TieredArchive.
+type TieredArchiveConfig struct {
+	// Tiers are ordered from warmest to coldest.
+	Tiers []ArchiveTier
+	// IndexPath is a BoltDB file recording which tier holds each payload
+	// and since when.
+	IndexPath string
+	// DemoteInterval is how often the background job demotes aged payloads;
+	// zero disables scheduled runs.
+	DemoteInterval time.Duration
+}
+
+// TierStatus reports one tier of a TieredArchive.
+type TierStatus struct {
+	Name    string `json:"name"`
+	MaxAge  string `json:"maxAge,omitempty"`
+	Entries int    `json:"entries"`
+}
+
+// TieredArchiveStatus reports the demotion job and the indexed payloads per
+// tier.
+type TieredArchiveStatus struct {
+	Running  bool         `json:"running"`
+	Interval string       `json:"interval,omitempty"`
+	Runs     int64        `json:"runs"`
+	Demoted  int64        `json:"demoted"`
+	Adopted  int64        `json:"adopted"`
+	Failures int64        `json:"failures"`
+	LastRun  *time.Time   `json:"lastRun,omitempty"`
+	Errors   []string     `json:"errors,omitempty"`
+	Tiers    []TierStatus `json:"tiers"`
+}
+
+// DemotionReport reports one demotion pass.
+type DemotionReport struct {
+	Demoted int      `json:"demoted"`
+	Adopted int      `json:"adopted"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// tierEntry is the index record of a payload.
+type tierEntry struct {
+	Tier      int       `json:"tier"`
+	EnteredAt time.Time `json:"enteredAt"`
+}
+
+// TieredArchive chains archives from warm to cold. New payloads go to the
+// first tier and move down as they age; reads try each tier in order, so a
+// payload is found wherever it currently lives, including content that was
+// in a tier before tiering was enabled.
+type TieredArchive struct {
+	tiers    []ArchiveTier
+	index    *bolt.DB
+	interval time.Duration
+	clock    func() time.Time
+	// locks serialise writes, removals and demotions of one payload.
+	locks [64]sync.Mutex
+
+	mu     sync.Mutex
+	status TieredArchiveStatus
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	wake   chan struct{}
+}
+
+// NewTieredArchive opens the tier index. The tiers stay owned by the
+// caller until Close, which closes them too.
+func NewTieredArchive(cfg TieredArchiveConfig) (*TieredArchive, error) {
+	if len(cfg.Tiers) == 0 {
+		return nil, errors.New("tiered archive needs at least one tier")
+	}
+	if cfg.IndexPath == "" {
+		return nil, errors.New("tiered archive index path is required")
+	}
+	for i, tier := range cfg.Tiers {
+		if tier.Archive == nil {
+			return nil, fmt.Errorf("archive tier %d has no archive", i)
+		}
+		if tier.MaxAge > 0 && i < len(cfg.Tiers)-1 {
+			if _, ok := tier.Archive.(archiveWalker); !ok {
+				return nil, fmt.Errorf("archive tier %s cannot list its content, so it cannot demote", tier.Name)
+			}
+		}
+	}
+	cleaned := filepath.Clean(cfg.IndexPath)
+	if dir := filepath.Dir(cleaned); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	db, err := bolt.Open(cleaned, 0o600, &bolt.Options{Timeout: 2 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(tierIndexBucket))
+		return err
+	}); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &TieredArchive{
+		tiers:    append([]ArchiveTier(nil), cfg.Tiers...),
+		index:    db,
+		interval: cfg.DemoteInterval,
+		clock:    time.Now,
+		wake:     make(chan struct{}, 1),
+	}, nil
+}
+
+// Store writes payload data to the tier that holds it, or to the first tier
+// for new payloads, so rewrites such as recompression keep a payload's age.
+func (t *TieredArchive) Store(ctx context.Context, repo, hash string, data []byte) error {
+	lock := t.lock(repo, hash)
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry, ok, err := t.entry(repo, hash)
+	if err != nil {
+		return err
+	}
+	if !ok || entry.Tier >= len(t.tiers) {
+		entry = tierEntry{Tier: 0, EnteredAt: t.clock().UTC()}
+		ok = false
+	}
+	if err := t.tiers[entry.Tier].Archive.Store(ctx, repo, hash, data); err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+	return t.putEntry(repo, hash, entry)
+}
+
+// Fetch reads payload data from the first tier that has it.
+func (t *TieredArchive) Fetch(ctx context.Context, repo, hash string) ([]byte, error) {
+	for _, tier := range t.tiers {
+		data, err := tier.Archive.Fetch(ctx, repo, hash)
+		var notFound *NotFoundError
+		if errors.As(err, &notFound) {
+			continue
+		}
+		return data, err
+	}
+	return nil, &NotFoundError{Resource: "archive", Key: hash}
+}
+
+// Remove deletes payload data from every tier.
+func (t *TieredArchive) Remove(ctx context.Context, repo, hash string) error {
+	lock := t.lock(repo, hash)
+	lock.Lock()
+	defer lock.Unlock()
+
+	var firstErr error
+	for _, tier := range t.tiers {
+		if err := tier.Archive.Remove(ctx, repo, hash); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	return t.index.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(tierIndexBucket)).Delete(tierKey(repo, hash))
+	})
+}
+
+// Close stops the demotion job and closes the index and every tier.
+func (t *TieredArchive) Close() error {
+	t.Stop()
+	err := t.index.Close()
+	for _, tier := range t.tiers {
+		if closeErr := tier.Archive.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Tiers returns the configured tiers, warmest first.
+func (t *TieredArchive) Tiers() []ArchiveTier {
+	return append([]ArchiveTier(nil), t.tiers...)
+}
+
+// Demote moves payloads that outlived their tier's MaxAge to the next tier.
+// Payloads found in a tier without an index record, such as content stored
+// before tiering was enabled, are recorded first and start ageing then.
+// Each payload is copied, re-indexed and only then removed from its old
+// tier, so reads find it throughout.
+func (t *TieredArchive) Demote(ctx context.Context) (DemotionReport, error) {
+	var report DemotionReport
+	for i, tier := range t.tiers[:len(t.tiers)-1] {
+		if tier.MaxAge <= 0 {
+			continue
+		}
+		adopted, err := t.adopt(ctx, i)
+		report.Adopted += adopted
+		if err != nil {
+			if ctx.Err() != nil {
+				return report, err
+			}
+			report.Errors = append(report.Errors, fmt.Sprintf("tier %s: %v", tier.Name, err))
+		}
+
+		cutoff := t.clock().Add(-tier.MaxAge)
+		var due [][2]string
+		if err := t.index.View(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte(tierIndexBucket)).ForEach(func(k, v []byte) error {
+				var entry tierEntry
+				if json.Unmarshal(v, &entry) != nil || entry.Tier != i || entry.EnteredAt.After(cutoff) {
+					return nil
+				}
+				repo, hash := splitTierKey(k)
+				due = append(due, [2]string{repo, hash})
+				return nil
+			})
+		}); err != nil {
+			return report, err
+		}
+		for _, key := range due {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+			demoted, err := t.demoteOne(ctx, i, cutoff, key[0], key[1])
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s/%s: %v", key[0], key[1], err))
+				continue
+			}
+			if demoted {
+				report.Demoted++
+			}
+		}
+	}
+	return report, nil
+}
+
+// adopt records the unindexed payloads of tier i.
+func (t *TieredArchive) adopt(ctx context.Context, i int) (int, error) {
+	walker := t.tiers[i].Archive.(archiveWalker)
+	adopted := 0
+	err := walker.Walk(ctx, func(repo, hash string) error {
+		lock := t.lock(repo, hash)
+		lock.Lock()
+		defer lock.Unlock()
+		_, ok, err := t.entry(repo, hash)
+		if err != nil || ok {
+			return err
+		}
+		adopted++
+		return t.putEntry(repo, hash, tierEntry{Tier: i, EnteredAt: t.clock().UTC()})
+	})
+	return adopted, err
+}
+
+// demoteOne moves one payload from tier i to tier i+1 unless it changed
+// since the index was read.
+func (t *TieredArchive) demoteOne(ctx context.Context, i int, cutoff time.Time, repo, hash string) (bool, error) {
+	lock := t.lock(repo, hash)
+	lock.Lock()
+	defer lock.Unlock()
+
+	entry, ok, err := t.entry(repo, hash)
+	if err != nil || !ok || entry.Tier != i || entry.EnteredAt.After(cutoff) {
+		return false, err
+	}
+	data, err := t.tiers[i].Archive.Fetch(ctx, repo, hash)
+	var notFound *NotFoundError
+	if errors.As(err, &notFound) {
+		// Removed behind the archive's back; forget it.
+		return false, t.index.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte(tierIndexBucket)).Delete(tierKey(repo, hash))
+		})
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := t.tiers[i+1].Archive.Store(ctx, repo, hash, data); err != nil {
+		return false, err
+	}
+	if err := t.putEntry(repo, hash, tierEntry{Tier: i + 1, EnteredAt: t.clock().UTC()}); err != nil {
+		return false, err
+	}
+	return true, t.tiers[i].Archive.Remove(ctx, repo, hash)
+}
+
+// Start launches the demotion job. With an interval the first pass runs
+// immediately.
+func (t *TieredArchive) Start() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cancel != nil || t.interval <= 0 {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.cancel = cancel
+	t.status.Running = true
+	t.wg.Add(1)
+	go t.loop(ctx)
+	t.Trigger()
+}
+
+// Stop cancels the current pass and waits for the job to exit.
+func (t *TieredArchive) Stop() {
+	t.mu.Lock()
+	cancel := t.cancel
+	t.cancel = nil
+	t.status.Running = false
+	t.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	t.wg.Wait()
+}
+
+// Trigger queues a demotion pass. It never blocks.
+func (t *TieredArchive) Trigger() {
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (t *TieredArchive) loop(ctx context.Context) {
+	defer t.wg.Done()
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.wake:
+		case <-ticker.C:
+		}
+		report, err := t.Demote(ctx)
+		if err != nil && ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		}
+		now := t.clock().UTC()
+		t.mu.Lock()
+		t.status.Runs++
+		t.status.Demoted += int64(report.Demoted)
+		t.status.Adopted += int64(report.Adopted)
+		if len(report.Errors) > 0 {
+			t.status.Failures++
+		}
+		t.status.Errors = report.Errors
+		t.status.LastRun = &now
+		t.mu.Unlock()
+	}
+}
+
+// Status returns the job state and the number of indexed payloads per tier.
+func (t *TieredArchive) Status() (TieredArchiveStatus, error) {
+	t.mu.Lock()
+	status := t.status
+	t.mu.Unlock()
+	if t.interval > 0 {
+		status.Interval = t.interval.String()
+	}
+	status.Tiers = make([]TierStatus, len(t.tiers))
+	for i, tier := range t.tiers {
+		status.Tiers[i].Name = tier.Name
+		if tier.MaxAge > 0 && i < len(t.tiers)-1 {
+			status.Tiers[i].MaxAge = tier.MaxAge.String()
+		}
+	}
+	err := t.index.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(tierIndexBucket)).ForEach(func(_, v []byte) error {
+			var entry tierEntry
+			if json.Unmarshal(v, &entry) == nil && entry.Tier < len(status.Tiers) {
+				status.Tiers[entry.Tier].Entries++
+			}
+			return nil
+		})
+	})
+	return status, err
+}
+
+func (t *TieredArchive) lock(repo, hash string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write(tierKey(repo, hash))
+	return &t.locks[h.Sum32()%uint32(len(t.locks))]
+}
+
+func (t *TieredArchive) entry(repo, hash string) (tierEntry, bool, error) {
+	var (
+		entry tierEntry
+		found bool
+	)
+	err := t.index.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(tierIndexBucket)).Get(tierKey(repo, hash))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &entry)
+	})
+	return entry, found, err
+}
+
+func (t *TieredArchive) putEntry(repo, hash string, entry tierEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return t.index.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(tierIndexBucket)).Put(tierKey(repo, hash), data)
+	})
+}
+
+// tierKey joins repo and hash with a NUL byte, which neither contains.
+func tierKey(repo, hash string) []byte {
+	return []byte(repo + "\x00" + hash)
+}
+
+func splitTierKey(key []byte) (string, string) {
+	for i, b := range key {
+		if b == 0 {
+			return string(key[:i]), string(key[i+1:])
+		}
+	}
+	return string(key), ""
+}
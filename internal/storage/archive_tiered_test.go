@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTieredArchive(t *testing.T) {
+	ctx := context.Background()
+	warm, cold := NewMemoryArchive(), NewMemoryArchive()
+	// Content archived before tiering was enabled.
+	if err := warm.Store(ctx, "analytics", "legacy", []byte("legacy")); err != nil {
+		t.Fatalf("Store legacy: %v", err)
+	}
+	archive, err := NewTieredArchive(TieredArchiveConfig{
+		Tiers: []ArchiveTier{
+			{Name: "warm", Archive: warm, MaxAge: time.Hour},
+			{Name: "cold", Archive: cold},
+		},
+		IndexPath: filepath.Join(t.TempDir(), "tiers.db"),
+	})
+	if err != nil {
+		t.Fatalf("NewTieredArchive: %v", err)
+	}
+	defer archive.Close()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	archive.clock = func() time.Time { return now }
+
+	if err := archive.Store(ctx, "analytics", "fresh", []byte("fresh")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if _, err := warm.Fetch(ctx, "analytics", "fresh"); err != nil {
+		t.Fatalf("expected new content in the first tier: %v", err)
+	}
+	if err := cold.Store(ctx, "analytics", "frozen", []byte("frozen")); err != nil {
+		t.Fatalf("Store frozen: %v", err)
+	}
+	if data, err := archive.Fetch(ctx, "analytics", "frozen"); err != nil || string(data) != "frozen" {
+		t.Fatalf("expected reads to fall through to the cold tier, got %q, %v", data, err)
+	}
+
+	report, err := archive.Demote(ctx)
+	if err != nil || report.Demoted != 0 || report.Adopted != 1 {
+		t.Fatalf("first Demote = %+v, %v; want only the legacy payload adopted", report, err)
+	}
+
+	now = now.Add(2 * time.Hour)
+	// A rewrite keeps the payload's tier and age.
+	if err := archive.Store(ctx, "analytics", "fresh", []byte("fresh v2")); err != nil {
+		t.Fatalf("Store rewrite: %v", err)
+	}
+	report, err = archive.Demote(ctx)
+	if err != nil || report.Demoted != 2 {
+		t.Fatalf("second Demote = %+v, %v; want both payloads demoted", report, err)
+	}
+	for _, hash := range []string{"fresh", "legacy"} {
+		var notFound *NotFoundError
+		if _, err := warm.Fetch(ctx, "analytics", hash); !errors.As(err, &notFound) {
+			t.Fatalf("expected %s gone from the warm tier, got %v", hash, err)
+		}
+		if _, err := cold.Fetch(ctx, "analytics", hash); err != nil {
+			t.Fatalf("expected %s in the cold tier: %v", hash, err)
+		}
+	}
+	if data, err := archive.Fetch(ctx, "analytics", "fresh"); err != nil || string(data) != "fresh v2" {
+		t.Fatalf("Fetch demoted = %q, %v", data, err)
+	}
+	status, err := archive.Status()
+	if err != nil || status.Tiers[0].Entries != 0 || status.Tiers[1].Entries != 2 {
+		t.Fatalf("Status = %+v, %v", status, err)
+	}
+
+	if err := archive.Remove(ctx, "analytics", "fresh"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	var notFound *NotFoundError
+	if _, err := archive.Fetch(ctx, "analytics", "fresh"); !errors.As(err, &notFound) {
+		t.Fatalf("expected NotFoundError after Remove, got %v", err)
+	}
+}
+
+func TestArchiveMigration(t *testing.T) {
+	ctx := context.Background()
+	source := NewMemoryArchive()
+	target, err := NewFSArchive(FSArchiveConfig{Root: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewFSArchive: %v", err)
+	}
+	for _, hash := range []string{"a1", "b2", "c3"} {
+		if err := source.Store(ctx, "analytics", hash, []byte("payload "+hash)); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+	if err := target.Store(ctx, "analytics", "a1", []byte("payload a1")); err != nil {
+		t.Fatalf("Store target: %v", err)
+	}
+
+	migration, err := StartArchiveMigration(source, target, MigrationOptions{From: "memory", To: "fs", RemoveSource: true})
+	if err != nil {
+		t.Fatalf("StartArchiveMigration: %v", err)
+	}
+	report := migration.Wait()
+	if report.Running || report.Scanned != 3 || report.Copied != 2 || report.Skipped != 1 || report.Removed != 3 || report.Failed != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	for _, hash := range []string{"a1", "b2", "c3"} {
+		if data, err := target.Fetch(ctx, "analytics", hash); err != nil || string(data) != "payload "+hash {
+			t.Fatalf("Fetch %s = %q, %v", hash, data, err)
+		}
+	}
+
+	if _, err := StartArchiveMigration(source, source, MigrationOptions{}); err == nil {
+		t.Fatalf("expected migrating an archive into itself to fail")
+	}
+}
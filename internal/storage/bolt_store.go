@@ -0,0 +1,1360 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/onexay/kv-vs/internal/types"
+)
+
+const (
+	boltStoreRootBucket = "repos"
+
+	boltCommitsBucket  = "commits"
+	boltContentBucket  = "content"
+	boltBranchesBucket = "branches"
+	boltTagsBucket     = "tags"
+	boltAuthorsBucket  = "authors"
+	boltPoliciesBucket = "policies"
+	boltIndexBucket    = "commit_index"
+	boltPinsBucket     = "pins"
+	boltDataKeysBucket = "datakeys"
+
+	boltPolicyHistoryPrefix = "history/"
+	boltPolicyKey           = "retention"
+)
+
+var boltRepoBuckets = []string{
+	boltCommitsBucket,
+	boltContentBucket,
+	boltBranchesBucket,
+	boltTagsBucket,
+	boltAuthorsBucket,
+	boltPoliciesBucket,
+	boltIndexBucket,
+	boltPinsBucket,
+	boltDataKeysBucket,
+}
+
+// errColdParent stops a commit update whose branch head content has to be
+// read from the archive first.
+var errColdParent = errors.New("branch head content is not hot")
+
+// BoltConfig defines the BoltDB primary store settings.
+type BoltConfig struct {
+	Path    string
+	Timeout time.Duration
+}
+
+type boltStore struct {
+	db            *bolt.DB
+	clock         func() time.Time
+	archive       Archive
+	keys          *dataKeyring
+	defaultPolicy RetentionPolicy
+	notify        func(repo string)
+	// policyCooldown is the minimum time between policy changes.
+	policyCooldown time.Duration
+}
+
+// NewBoltStore opens (or creates) a Store backed by a BoltDB file. Each
+// repository gets its own bucket holding commits, content, branches, tags,
+// authors, policies, pins, wrapped data keys and a time-ordered commit index.
+func NewBoltStore(cfg BoltConfig, opts Options) (Store, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("bolt store path is required")
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+
+	cleaned := filepath.Clean(cfg.Path)
+	if dir := filepath.Dir(cleaned); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := bolt.Open(cleaned, 0o600, &bolt.Options{Timeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucketIfNotExists([]byte(boltStoreRootBucket))
+		if err != nil {
+			return err
+		}
+		// Repositories created by older versions may lack newer sub-buckets.
+		var repos []string
+		_ = root.ForEach(func(k, v []byte) error {
+			if v == nil {
+				repos = append(repos, string(k))
+			}
+			return nil
+		})
+		for _, repo := range repos {
+			if _, err := boltCreateRepo(tx, repo); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	s := &boltStore{
+		db:             db,
+		clock:          time.Now,
+		archive:        opts.Archive,
+		defaultPolicy:  opts.Retention.policy(),
+		notify:         opts.notifier(),
+		policyCooldown: opts.PolicyCooldown,
+	}
+	s.keys = newDataKeyring(opts.MasterKeys, s)
+	return s, nil
+}
+
+func (s *boltStore) PutBlobAndCommit(ctx context.Context, req BlobWriteRequest) (BlobCommitResult, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if req.Name == "" {
+		return BlobCommitResult{}, &ValidationError{Message: "name is required"}
+	}
+	if req.Content == "" {
+		return BlobCommitResult{}, &ValidationError{Message: "content is required"}
+	}
+	if req.AuthorName == "" || req.AuthorID == "" {
+		return BlobCommitResult{}, &ValidationError{Message: "author name and id are required"}
+	}
+
+	branch := req.Branch
+	if branch == "" {
+		branch = defaultBranch
+	}
+
+	// Data keys are resolved up front: the keyring must not open a bolt
+	// transaction from inside the update below.
+	keys, err := s.keys.prepare(ctx, req.Name)
+	if err != nil {
+		return BlobCommitResult{}, err
+	}
+
+	// Content of a head that left hot storage is read outside the update,
+	// which must not wait on the archive; the update then runs again with it.
+	var (
+		result BlobCommitResult
+		cold   = make(map[string]string)
+		fetch  types.Commit
+	)
+	update := func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		repo, err := boltCreateRepo(tx, req.Name)
+		if err != nil {
+			return err
+		}
+
+		authors := repo.Bucket([]byte(boltAuthorsBucket))
+		if existing := authors.Get([]byte(req.AuthorID)); existing != nil && string(existing) != req.AuthorName {
+			return &ConflictError{Resource: "author", Key: req.AuthorID}
+		}
+
+		parent := ""
+		branches := repo.Bucket([]byte(boltBranchesBucket))
+		if data := branches.Get([]byte(branch)); data != nil {
+			var branchMeta types.Branch
+			if err := json.Unmarshal(data, &branchMeta); err != nil {
+				return err
+			}
+			parent = branchMeta.Commit
+		}
+
+		commits := repo.Bucket([]byte(boltCommitsBucket))
+		contents := repo.Bucket([]byte(boltContentBucket))
+		previousContent := ""
+		if parent != "" {
+			if data := contents.Get([]byte(parent)); data != nil {
+				raw, err := keys.decode(data)
+				if err != nil {
+					return err
+				}
+				previousContent = string(raw)
+			} else if content, ok := cold[parent]; ok {
+				previousContent = content
+			} else {
+				data := commits.Get([]byte(parent))
+				if data == nil {
+					return &NotFoundError{Resource: "content", Key: parent}
+				}
+				if err := json.Unmarshal(data, &fetch); err != nil {
+					return err
+				}
+				return errColdParent
+			}
+		}
+
+		diff := computeDiff(previousContent, req.Content)
+		contentHash := computeContentHash(req.Content)
+		now := s.clock().UTC()
+		commitHash := computeCommitHash(req.Name, branch, req.Content, parent, now)
+
+		if commits.Get([]byte(commitHash)) != nil {
+			return &ConflictError{Resource: "commit", Key: commitHash}
+		}
+
+		commit := types.Commit{
+			Repo:        req.Name,
+			Branch:      branch,
+			Hash:        commitHash,
+			Parent:      parent,
+			AuthorName:  req.AuthorName,
+			AuthorID:    req.AuthorID,
+			Message:     "auto commit",
+			ContentHash: contentHash,
+			Timestamp:   now,
+			Archived:    false,
+		}
+		if err := boltPutJSON(commits, commitHash, commit); err != nil {
+			return err
+		}
+		policy, err := boltPolicy(repo, req.Name, s.defaultPolicy)
+		if err != nil {
+			return err
+		}
+		stored, err := keys.encode(policy.contentCodec(s.defaultPolicy), []byte(req.Content))
+		if err != nil {
+			return err
+		}
+		if err := contents.Put([]byte(commitHash), stored); err != nil {
+			return err
+		}
+		if err := boltPutJSON(branches, branch, types.Branch{
+			Repo:      req.Name,
+			Name:      branch,
+			Commit:    commitHash,
+			UpdatedAt: now,
+		}); err != nil {
+			return err
+		}
+		if err := repo.Bucket([]byte(boltIndexBucket)).Put(boltIndexKey(now, commitHash), []byte(commitHash)); err != nil {
+			return err
+		}
+		if err := authors.Put([]byte(req.AuthorID), []byte(req.AuthorName)); err != nil {
+			return err
+		}
+
+		result = BlobCommitResult{
+			CommitHash: commitHash,
+			Branch:     branch,
+			CreatedAt:  now,
+			Diff:       diff,
+		}
+		return nil
+	}
+	for {
+		err = s.db.Update(update)
+		if !errors.Is(err, errColdParent) {
+			break
+		}
+		content, err := parentContent(ctx, s.archive, s.keys, req.Name, fetch)
+		if err != nil {
+			return BlobCommitResult{}, err
+		}
+		cold[fetch.Hash] = content
+	}
+	if err != nil {
+		return BlobCommitResult{}, err
+	}
+
+	s.notify(req.Name)
+	return result, nil
+}
+
+func (s *boltStore) ListCommits(ctx context.Context, opts ListCommitsOptions) ([]types.Commit, error) {
+	result := []types.Commit{}
+	var unreadable []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		repo := boltRepo(tx, opts.Repo)
+		if repo == nil {
+			return nil
+		}
+		commits := repo.Bucket([]byte(boltCommitsBucket))
+		cursor := repo.Bucket([]byte(boltIndexBucket)).Cursor()
+
+		next := cursor.Next
+		k, v := cursor.First()
+		if opts.Descending {
+			next = cursor.Prev
+			k, v = cursor.Last()
+		}
+		for ; k != nil; k, v = next() {
+			var commit types.Commit
+			data := commits.Get(v)
+			if data == nil || json.Unmarshal(data, &commit) != nil {
+				unreadable = append(unreadable, boltKeyPath(opts.Repo, boltCommitsBucket, string(v)))
+				continue
+			}
+			result = append(result, commit)
+			if opts.Limit > 0 && len(result) >= opts.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, &UnavailableError{Op: "list commits", Err: err}
+	}
+	return result, partialResult("commit", unreadable)
+}
+
+func (s *boltStore) GetCommit(ctx context.Context, repo, hash string) (types.Commit, string, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	var (
+		commit types.Commit
+		stored []byte
+	)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := boltRepo(tx, repo)
+		if bucket == nil {
+			return &NotFoundError{Resource: "commit", Key: hash}
+		}
+		data := bucket.Bucket([]byte(boltCommitsBucket)).Get([]byte(hash))
+		if data == nil {
+			return &NotFoundError{Resource: "commit", Key: hash}
+		}
+		if err := json.Unmarshal(data, &commit); err != nil {
+			return err
+		}
+		if data := bucket.Bucket([]byte(boltContentBucket)).Get([]byte(hash)); data != nil {
+			stored = append([]byte{}, data...)
+		}
+		return nil
+	})
+	if err != nil {
+		return types.Commit{}, "", err
+	}
+	if commit.Purged {
+		return commit, "", &GoneError{Resource: "content", Key: hash}
+	}
+
+	if stored == nil {
+		if s.archive == nil {
+			return commit, "", &NotFoundError{Resource: "content", Key: hash}
+		}
+		data, err := readArchived(ctx, s.archive, s.keys, repo, hash)
+		if err != nil {
+			return commit, "", err
+		}
+		return commit, string(data), nil
+	}
+
+	content, err := s.keys.decode(ctx, repo, stored)
+	if err != nil {
+		return commit, "", err
+	}
+	return commit, string(content), nil
+}
+
+func (s *boltStore) UpsertBranch(ctx context.Context, req BranchRequest) (types.Branch, error) {
+	if req.Repo == "" || req.Name == "" || req.Commit == "" {
+		return types.Branch{}, &ValidationError{Message: "repo, name, and commit are required"}
+	}
+
+	branch := types.Branch{
+		Repo:      req.Repo,
+		Name:      req.Name,
+		Commit:    req.Commit,
+		UpdatedAt: s.clock().UTC(),
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		repo := boltRepo(tx, req.Repo)
+		if repo == nil || repo.Bucket([]byte(boltCommitsBucket)).Get([]byte(req.Commit)) == nil {
+			return &NotFoundError{Resource: "commit", Key: req.Commit}
+		}
+		return boltPutJSON(repo.Bucket([]byte(boltBranchesBucket)), req.Name, branch)
+	})
+	if err != nil {
+		return types.Branch{}, err
+	}
+	s.notify(req.Repo)
+	return branch, nil
+}
+
+func (s *boltStore) ListBranches(ctx context.Context, repo string) ([]types.Branch, error) {
+	result := []types.Branch{}
+	var unreadable []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := boltRepo(tx, repo)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Bucket([]byte(boltBranchesBucket)).ForEach(func(k, v []byte) error {
+			var branch types.Branch
+			if err := json.Unmarshal(v, &branch); err != nil {
+				unreadable = append(unreadable, boltKeyPath(repo, boltBranchesBucket, string(k)))
+				return nil
+			}
+			result = append(result, branch)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, &UnavailableError{Op: "list branches", Err: err}
+	}
+	return result, partialResult("branch", unreadable)
+}
+
+func (s *boltStore) GetBranch(ctx context.Context, repo, name string) (types.Branch, error) {
+	if repo == "" || name == "" {
+		return types.Branch{}, &ValidationError{Message: "repo and name are required"}
+	}
+
+	var branch types.Branch
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := boltRepo(tx, repo)
+		if bucket == nil {
+			return &NotFoundError{Resource: "branch", Key: name}
+		}
+		data := bucket.Bucket([]byte(boltBranchesBucket)).Get([]byte(name))
+		if data == nil {
+			return &NotFoundError{Resource: "branch", Key: name}
+		}
+		return json.Unmarshal(data, &branch)
+	})
+	if err != nil {
+		return types.Branch{}, err
+	}
+	return branch, nil
+}
+
+func (s *boltStore) CreateTag(ctx context.Context, req TagRequest) (types.Tag, error) {
+	if req.Repo == "" || req.Name == "" || req.Commit == "" {
+		return types.Tag{}, &ValidationError{Message: "repo, name, and commit are required"}
+	}
+
+	tag := types.Tag{
+		Repo:      req.Repo,
+		Name:      req.Name,
+		Commit:    req.Commit,
+		Note:      req.Note,
+		CreatedAt: s.clock().UTC(),
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		repo := boltRepo(tx, req.Repo)
+		if repo == nil || repo.Bucket([]byte(boltCommitsBucket)).Get([]byte(req.Commit)) == nil {
+			return &NotFoundError{Resource: "commit", Key: req.Commit}
+		}
+		tags := repo.Bucket([]byte(boltTagsBucket))
+		if tags.Get([]byte(req.Name)) != nil {
+			return &ConflictError{Resource: "tag", Key: req.Name}
+		}
+		return boltPutJSON(tags, req.Name, tag)
+	})
+	if err != nil {
+		return types.Tag{}, err
+	}
+	s.notify(req.Repo)
+	return tag, nil
+}
+
+func (s *boltStore) ListTags(ctx context.Context, repo string) ([]types.Tag, error) {
+	result := []types.Tag{}
+	var unreadable []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := boltRepo(tx, repo)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Bucket([]byte(boltTagsBucket)).ForEach(func(k, v []byte) error {
+			var tag types.Tag
+			if err := json.Unmarshal(v, &tag); err != nil {
+				unreadable = append(unreadable, boltKeyPath(repo, boltTagsBucket, string(k)))
+				return nil
+			}
+			result = append(result, tag)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, &UnavailableError{Op: "list tags", Err: err}
+	}
+	return result, partialResult("tag", unreadable)
+}
+
+func (s *boltStore) GetTag(ctx context.Context, repo, name string) (types.Tag, error) {
+	if repo == "" || name == "" {
+		return types.Tag{}, &ValidationError{Message: "repo and name are required"}
+	}
+
+	var tag types.Tag
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := boltRepo(tx, repo)
+		if bucket == nil {
+			return &NotFoundError{Resource: "tag", Key: name}
+		}
+		data := bucket.Bucket([]byte(boltTagsBucket)).Get([]byte(name))
+		if data == nil {
+			return &NotFoundError{Resource: "tag", Key: name}
+		}
+		return json.Unmarshal(data, &tag)
+	})
+	if err != nil {
+		return types.Tag{}, err
+	}
+	return tag, nil
+}
+
+// SetPolicy stores a new policy version. The policies bucket keeps the current
+// policy under boltPolicyKey and every version under boltPolicyHistoryPrefix.
+func (s *boltStore) SetPolicy(ctx context.Context, policy RetentionPolicy) (RetentionPolicy, error) {
+	var (
+		result  RetentionPolicy
+		changed bool
+	)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		repo, err := boltCreateRepo(tx, policy.Repo)
+		if err != nil {
+			return err
+		}
+		policies := repo.Bucket([]byte(boltPoliciesBucket))
+		current := s.defaultPolicy.WithRepo(policy.Repo)
+		if data := policies.Get([]byte(boltPolicyKey)); data != nil {
+			var rec retentionRecord
+			if err := json.Unmarshal(data, &rec); err != nil {
+				return err
+			}
+			current = rec.toPolicy(policy.Repo)
+		}
+
+		next, unchanged, err := nextPolicy(current, policy, s.policyCooldown, s.clock())
+		if err != nil || unchanged {
+			result = next
+			return err
+		}
+		if current.Version > 0 && policies.Get([]byte(boltPolicyHistoryKey(current.Version))) == nil {
+			// A policy set before versioning has no history entry yet.
+			if err := boltPutJSON(policies, boltPolicyHistoryKey(current.Version), newRetentionRecord(current)); err != nil {
+				return err
+			}
+		}
+		rec := newRetentionRecord(next)
+		if err := boltPutJSON(policies, boltPolicyHistoryKey(next.Version), rec); err != nil {
+			return err
+		}
+		if err := boltPutJSON(policies, boltPolicyKey, rec); err != nil {
+			return err
+		}
+		result, changed = next, true
+		return nil
+	})
+	if err != nil {
+		return RetentionPolicy{}, err
+	}
+	if changed {
+		s.notify(policy.Repo)
+	}
+	return result, nil
+}
+
+func (s *boltStore) PolicyHistory(ctx context.Context, repo string) ([]RetentionPolicy, error) {
+	if repo == "" {
+		return nil, &ValidationError{Message: "name query parameter required"}
+	}
+	history := []RetentionPolicy{}
+	var unreadable []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := boltRepo(tx, repo)
+		if bucket == nil {
+			return nil
+		}
+		policies := bucket.Bucket([]byte(boltPoliciesBucket))
+		c := policies.Cursor()
+		prefix := []byte(boltPolicyHistoryPrefix)
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var rec retentionRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				unreadable = append(unreadable, string(k))
+				continue
+			}
+			history = append(history, rec.toPolicy(repo))
+		}
+		if len(history) == 0 && len(unreadable) == 0 {
+			if data := policies.Get([]byte(boltPolicyKey)); data != nil {
+				var rec retentionRecord
+				if err := json.Unmarshal(data, &rec); err != nil {
+					return err
+				}
+				history = append(history, rec.toPolicy(repo))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, &UnavailableError{Op: "policy history", Err: err}
+	}
+	return history, partialResult("policy", unreadable)
+}
+
+// boltPolicyHistoryKey orders history entries by version within the
+// policies bucket.
+func boltPolicyHistoryKey(version int) string {
+	return fmt.Sprintf("%s%010d", boltPolicyHistoryPrefix, version)
+}
+
+func (s *boltStore) GetPolicy(ctx context.Context, repo string) (RetentionPolicy, error) {
+	if repo == "" {
+		return RetentionPolicy{}, &ValidationError{Message: "name query parameter required"}
+	}
+
+	policy := s.defaultPolicy.WithRepo(repo)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := boltRepo(tx, repo)
+		if bucket == nil {
+			return nil
+		}
+		var err error
+		policy, err = boltPolicy(bucket, repo, s.defaultPolicy)
+		return err
+	})
+	if err != nil {
+		return RetentionPolicy{}, err
+	}
+	return policy, nil
+}
+
+// boltPolicy reads the current policy from a repository bucket, falling back
+// to defaults.
+func boltPolicy(bucket *bolt.Bucket, repo string, defaults RetentionPolicy) (RetentionPolicy, error) {
+	data := bucket.Bucket([]byte(boltPoliciesBucket)).Get([]byte(boltPolicyKey))
+	if data == nil {
+		return defaults.WithRepo(repo), nil
+	}
+	var rec retentionRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return RetentionPolicy{}, err
+	}
+	return rec.toPolicy(repo), nil
+}
+
+// Close releases the Bolt file lock.
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// EnforceRetention runs one retention pass. Planning reads a single snapshot;
+// each step then runs in its own transaction so archive I/O never holds the
+// write lock.
+func (s *boltStore) EnforceRetention(ctx context.Context, repo string) (RetentionRun, error) {
+	if repo == "" {
+		return RetentionRun{}, &ValidationError{Message: "name query parameter required"}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	run := RetentionRun{Repo: repo, StartedAt: s.clock().UTC()}
+	policy, err := s.GetPolicy(ctx, repo)
+	if err != nil {
+		return run, &UnavailableError{Op: "enforce retention", Err: err}
+	}
+	if !policy.enforced() {
+		return run, nil
+	}
+
+	var entries []retentionEntry
+	err = s.db.View(func(tx *bolt.Tx) error {
+		bucket := boltRepo(tx, repo)
+		if bucket == nil {
+			return nil
+		}
+		commits := bucket.Bucket([]byte(boltCommitsBucket))
+		return bucket.Bucket([]byte(boltIndexBucket)).ForEach(func(_, v []byte) error {
+			var commit types.Commit
+			if err := json.Unmarshal(commits.Get(v), &commit); err != nil {
+				return nil
+			}
+			entries = append(entries, retentionEntry{Hash: commit.Hash, Timestamp: commit.Timestamp, Archived: commit.Archived, Purged: commit.Purged})
+			return nil
+		})
+	})
+	if err != nil {
+		return run, &UnavailableError{Op: "enforce retention", Err: err}
+	}
+	reasons, err := s.pinReasons(ctx, repo, policy)
+	if err != nil {
+		return run, &UnavailableError{Op: "enforce retention", Err: err}
+	}
+
+	plan := planRetentionPass(entries, reasons, policy, s.clock(), s.archive != nil)
+	plan.Codec = policy.contentCodec(s.defaultPolicy)
+	applyRetention(ctx, s, repo, plan, &run)
+	return run, nil
+}
+
+func (s *boltStore) ListRepos(ctx context.Context) ([]string, error) {
+	var repos []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(boltStoreRootBucket))
+		if root == nil {
+			return nil
+		}
+		return root.ForEachBucket(func(name []byte) error {
+			repos = append(repos, string(name))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, &UnavailableError{Op: "list repos", Err: err}
+	}
+	return repos, nil
+}
+
+// Recompress rewrites hot content one transaction per commit, so the write
+// lock is never held across the whole repository, then rewrites archived
+// content.
+func (s *boltStore) Recompress(ctx context.Context, repo string) (CompressionReport, error) {
+	if repo == "" {
+		return CompressionReport{}, &ValidationError{Message: "name query parameter required"}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	report := CompressionReport{Repo: repo, StartedAt: s.clock().UTC()}
+	var hot, archived []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := boltRepo(tx, repo)
+		if bucket == nil {
+			report.Codec = s.defaultPolicy.contentCodec(s.defaultPolicy)
+			return nil
+		}
+		policy, err := boltPolicy(bucket, repo, s.defaultPolicy)
+		if err != nil {
+			return err
+		}
+		report.Codec = policy.contentCodec(s.defaultPolicy)
+		if err := bucket.Bucket([]byte(boltContentBucket)).ForEach(func(k, _ []byte) error {
+			hot = append(hot, string(k))
+			return nil
+		}); err != nil {
+			return err
+		}
+		return bucket.Bucket([]byte(boltCommitsBucket)).ForEach(func(k, v []byte) error {
+			var commit types.Commit
+			if err := json.Unmarshal(v, &commit); err == nil && commit.Archived && !commit.Purged {
+				archived = append(archived, string(k))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return report, &UnavailableError{Op: "recompress", Err: err}
+	}
+	var keys *repoDataKeys
+	if len(hot) > 0 {
+		if keys, err = s.keys.prepare(ctx, repo); err != nil {
+			return report, &UnavailableError{Op: "recompress", Err: err}
+		}
+	}
+
+	for _, hash := range hot {
+		if err := ctx.Err(); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			return report, nil
+		}
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			bucket := boltRepo(tx, repo)
+			if bucket == nil {
+				return nil
+			}
+			contents := bucket.Bucket([]byte(boltContentBucket))
+			data := contents.Get([]byte(hash))
+			if data == nil {
+				return nil
+			}
+			content, err := keys.recode(report.Codec, data)
+			if err != nil {
+				return err
+			}
+			if content.changed {
+				if err := contents.Put([]byte(hash), content.data); err != nil {
+					return err
+				}
+				report.Recompressed++
+			}
+			report.Hot.addContent(content)
+			return nil
+		})
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("content %s: %v", hash, err))
+		}
+	}
+
+	recompressArchive(ctx, s.archive, s.keys, repo, archived, report.Codec, func(hash string) bool {
+		live := false
+		_ = s.db.View(func(tx *bolt.Tx) error {
+			bucket := boltRepo(tx, repo)
+			if bucket == nil {
+				return nil
+			}
+			var commit types.Commit
+			if data := bucket.Bucket([]byte(boltCommitsBucket)).Get([]byte(hash)); data != nil && json.Unmarshal(data, &commit) == nil {
+				live = !commit.Purged
+			}
+			return nil
+		})
+		return live
+	}, &report)
+	return report, nil
+}
+
+func (s *boltStore) DataKeys(ctx context.Context, repo string) ([]DataKey, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return s.keys.list(ctx, repo)
+}
+
+func (s *boltStore) Reencrypt(ctx context.Context, repo string, rotate bool) (ReencryptReport, error) {
+	return reencrypt(ctx, s.keys, s, repo, rotate)
+}
+
+func (s *boltStore) loadDataKeys(_ context.Context, repo string) ([]DataKey, error) {
+	var keys []DataKey
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := boltRepo(tx, repo)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Bucket([]byte(boltDataKeysBucket)).ForEach(func(k, v []byte) error {
+			var key DataKey
+			if err := json.Unmarshal(v, &key); err != nil {
+				return fmt.Errorf("data key %s of %s: %w", k, repo, err)
+			}
+			keys = append(keys, key)
+			return nil
+		})
+	})
+	sortDataKeys(keys)
+	return keys, err
+}
+
+func (s *boltStore) createDataKey(_ context.Context, key DataKey) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := boltCreateRepo(tx, key.Repo)
+		if err != nil {
+			return err
+		}
+		id := strconv.Itoa(key.ID)
+		keys := bucket.Bucket([]byte(boltDataKeysBucket))
+		if keys.Get([]byte(id)) != nil {
+			return &ConflictError{Resource: "data key", Key: key.Repo + "/" + id}
+		}
+		return boltPutJSON(keys, id, key)
+	})
+}
+
+func (s *boltStore) rewrapDataKey(_ context.Context, key DataKey) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := boltRepo(tx, key.Repo)
+		if bucket == nil {
+			return &NotFoundError{Resource: "repository", Key: key.Repo}
+		}
+		return boltPutJSON(bucket.Bucket([]byte(boltDataKeysBucket)), strconv.Itoa(key.ID), key)
+	})
+}
+
+// restoreCommit copies archived content of a pinned commit back into hot
+// storage. The archive copy is kept.
+func (s *boltStore) restoreCommit(ctx context.Context, repo, hash string) error {
+	data, err := s.archive.Fetch(ctx, repo, hash)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := boltRepo(tx, repo)
+		if bucket == nil {
+			return &NotFoundError{Resource: "commit", Key: hash}
+		}
+		commits := bucket.Bucket([]byte(boltCommitsBucket))
+		raw := commits.Get([]byte(hash))
+		if raw == nil {
+			return &NotFoundError{Resource: "commit", Key: hash}
+		}
+		var commit types.Commit
+		if err := json.Unmarshal(raw, &commit); err != nil {
+			return err
+		}
+		if commit.Purged {
+			return nil
+		}
+		commit.Archived = false
+		if err := boltPutJSON(commits, hash, commit); err != nil {
+			return err
+		}
+		return bucket.Bucket([]byte(boltContentBucket)).Put([]byte(hash), data)
+	})
+}
+
+// pinReasons resolves the pinned commits of repo under policy. Unreadable
+// refs are skipped rather than failing retention.
+func (s *boltStore) pinReasons(ctx context.Context, repo string, policy RetentionPolicy) (map[string][]PinReason, error) {
+	branches, err := s.ListBranches(ctx, repo)
+	if err != nil && !isPartial(err) {
+		return nil, err
+	}
+	tags, err := s.ListTags(ctx, repo)
+	if err != nil && !isPartial(err) {
+		return nil, err
+	}
+	pins, err := s.listPins(repo)
+	if err != nil {
+		return nil, err
+	}
+	return pinReasons(policy, branches, tags, pins), nil
+}
+
+func (s *boltStore) listPins(repo string) ([]types.Pin, error) {
+	var pins []types.Pin
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := boltRepo(tx, repo)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Bucket([]byte(boltPinsBucket)).ForEach(func(_, v []byte) error {
+			var pin types.Pin
+			if err := json.Unmarshal(v, &pin); err != nil {
+				return nil
+			}
+			pins = append(pins, pin)
+			return nil
+		})
+	})
+	return pins, err
+}
+
+// purgeCommit removes the archived copy first and then drops hot content
+// while marking the metadata purged, so failures are retried on the next pass.
+func (s *boltStore) purgeCommit(ctx context.Context, repo, hash string) error {
+	if s.archive != nil {
+		if err := s.archive.Remove(ctx, repo, hash); err != nil {
+			return err
+		}
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := boltRepo(tx, repo)
+		if bucket == nil {
+			return &NotFoundError{Resource: "commit", Key: hash}
+		}
+		commits := bucket.Bucket([]byte(boltCommitsBucket))
+		data := commits.Get([]byte(hash))
+		if data == nil {
+			return &NotFoundError{Resource: "commit", Key: hash}
+		}
+		var commit types.Commit
+		if err := json.Unmarshal(data, &commit); err != nil {
+			return err
+		}
+		commit.Archived = true
+		commit.Purged = true
+		if err := boltPutJSON(commits, hash, commit); err != nil {
+			return err
+		}
+		return bucket.Bucket([]byte(boltContentBucket)).Delete([]byte(hash))
+	})
+}
+
+func (s *boltStore) archiveCommit(ctx context.Context, repo, hash string, codec Codec) error {
+	commit, content, err := s.GetCommit(ctx, repo, hash)
+	if err != nil {
+		return err
+	}
+	if commit.Archived {
+		return nil
+	}
+	stored, err := s.keys.encode(ctx, repo, codec, []byte(content))
+	if err != nil {
+		return err
+	}
+	if err := s.archive.Store(ctx, repo, hash, stored); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := boltRepo(tx, repo)
+		if bucket == nil {
+			return &NotFoundError{Resource: "commit", Key: hash}
+		}
+		commit.Archived = true
+		if err := boltPutJSON(bucket.Bucket([]byte(boltCommitsBucket)), hash, commit); err != nil {
+			return err
+		}
+		return bucket.Bucket([]byte(boltContentBucket)).Delete([]byte(hash))
+	})
+}
+
+// boltRepo returns the repository bucket or nil when the repo is unknown.
+func boltRepo(tx *bolt.Tx, repo string) *bolt.Bucket {
+	if repo == "" {
+		return nil
+	}
+	root := tx.Bucket([]byte(boltStoreRootBucket))
+	if root == nil {
+		return nil
+	}
+	return root.Bucket([]byte(repo))
+}
+
+func boltCreateRepo(tx *bolt.Tx, repo string) (*bolt.Bucket, error) {
+	root := tx.Bucket([]byte(boltStoreRootBucket))
+	if root == nil {
+		return nil, errors.New("store root bucket missing")
+	}
+	bucket, err := root.CreateBucketIfNotExists([]byte(repo))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range boltRepoBuckets {
+		if _, err := bucket.CreateBucketIfNotExists([]byte(name)); err != nil {
+			return nil, err
+		}
+	}
+	return bucket, nil
+}
+
+// boltKeyPath renders a record location for error reports.
+func boltKeyPath(repo, bucket, key string) string {
+	return boltStoreRootBucket + "/" + repo + "/" + bucket + "/" + key
+}
+
+func boltPutJSON(bucket *bolt.Bucket, key string, value any) error {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), payload)
+}
+
+// boltIndexKey orders commits by timestamp, breaking ties by hash.
+func boltIndexKey(ts time.Time, hash string) []byte {
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.BigEndian, uint64(ts.UnixNano()))
+	buf.WriteString(hash)
+	return buf.Bytes()
+}
+
+func (s *boltStore) Check(ctx context.Context, opts CheckOptions) (CheckReport, error) {
+	if opts.Repo == "" {
+		return CheckReport{}, &ValidationError{Message: "name query parameter required"}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	inv, err := s.inventory(ctx, opts.Repo)
+	if err != nil {
+		return CheckReport{}, err
+	}
+	return runCheck(ctx, opts.Repo, inv, s.archive, s.keys, s, opts.Repair, s.clock()), nil
+}
+
+// inventory gathers the repository state consumed by Check and CollectGarbage.
+func (s *boltStore) inventory(ctx context.Context, repo string) (repoInventory, error) {
+	inv := repoInventory{
+		Commits: make(map[string]types.Commit),
+		Hot:     make(map[string]bool),
+		Indexed: make(map[string]bool),
+		LoadContent: func(ctx context.Context, hash string) (string, error) {
+			var stored []byte
+			err := s.db.View(func(tx *bolt.Tx) error {
+				bucket := boltRepo(tx, repo)
+				if bucket == nil {
+					return &NotFoundError{Resource: "content", Key: hash}
+				}
+				data := bucket.Bucket([]byte(boltContentBucket)).Get([]byte(hash))
+				if data == nil {
+					return &NotFoundError{Resource: "content", Key: hash}
+				}
+				stored = append([]byte{}, data...)
+				return nil
+			})
+			if err != nil {
+				return "", err
+			}
+			content, err := s.keys.decode(ctx, repo, stored)
+			return string(content), err
+		},
+	}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := boltRepo(tx, repo)
+		if bucket == nil {
+			return nil
+		}
+		if err := bucket.Bucket([]byte(boltCommitsBucket)).ForEach(func(k, v []byte) error {
+			var commit types.Commit
+			if err := json.Unmarshal(v, &commit); err != nil {
+				inv.Issues = append(inv.Issues, CheckIssue{
+					Kind:   IssueUnreadableRecord,
+					Hash:   string(k),
+					Key:    boltKeyPath(repo, boltCommitsBucket, string(k)),
+					Detail: err.Error(),
+				})
+				return nil
+			}
+			inv.Commits[string(k)] = commit
+			return nil
+		}); err != nil {
+			return err
+		}
+		if err := bucket.Bucket([]byte(boltContentBucket)).ForEach(func(k, _ []byte) error {
+			inv.Hot[string(k)] = true
+			return nil
+		}); err != nil {
+			return err
+		}
+		if err := bucket.Bucket([]byte(boltIndexBucket)).ForEach(func(_, v []byte) error {
+			inv.Indexed[string(v)] = true
+			return nil
+		}); err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return repoInventory{}, err
+	}
+
+	branches, err := s.ListBranches(ctx, repo)
+	if err != nil && !isPartial(err) {
+		return repoInventory{}, err
+	}
+	inv.Branches = branches
+	inv.Issues = append(inv.Issues, partialIssues(err)...)
+	tags, err := s.ListTags(ctx, repo)
+	if err != nil && !isPartial(err) {
+		return repoInventory{}, err
+	}
+	inv.Tags = tags
+	inv.Issues = append(inv.Issues, partialIssues(err)...)
+	if inv.Pins, err = s.listPins(repo); err != nil {
+		return repoInventory{}, err
+	}
+	return inv, nil
+}
+
+func (s *boltStore) repairCheckIssue(ctx context.Context, repo string, issue CheckIssue, commit types.Commit) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := boltRepo(tx, repo)
+		if bucket == nil {
+			return &NotFoundError{Resource: "repo", Key: repo}
+		}
+		commits := bucket.Bucket([]byte(boltCommitsBucket))
+		index := bucket.Bucket([]byte(boltIndexBucket))
+		switch issue.Kind {
+		case IssueMissingContent:
+			commit.Archived = true
+			return boltPutJSON(commits, issue.Hash, commit)
+		case IssueMissingArchiveEntry:
+			commit.Archived = false
+			return boltPutJSON(commits, issue.Hash, commit)
+		case IssueStaleHotContent:
+			return bucket.Bucket([]byte(boltContentBucket)).Delete([]byte(issue.Hash))
+		case IssueUnindexedCommit:
+			return index.Put(boltIndexKey(commit.Timestamp, issue.Hash), []byte(issue.Hash))
+		case IssueOrphanedIndexEntry:
+			var stale [][]byte
+			_ = index.ForEach(func(k, v []byte) error {
+				if string(v) == issue.Hash {
+					stale = append(stale, append([]byte{}, k...))
+				}
+				return nil
+			})
+			for _, k := range stale {
+				if err := index.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		default:
+			return errors.New("no repair for " + string(issue.Kind))
+		}
+	})
+}
+
+func (s *boltStore) CollectGarbage(ctx context.Context, opts GCOptions) (GCReport, error) {
+	if opts.Repo == "" {
+		return GCReport{}, &ValidationError{Message: "name query parameter required"}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	inv, err := s.inventory(ctx, opts.Repo)
+	if err != nil {
+		return GCReport{}, err
+	}
+	return runGC(ctx, inv, s.archive, s, opts, s.clock())
+}
+
+func (s *boltStore) sweepGC(_ context.Context, repo string, plan gcPlan) error {
+	planned := gcPlanned(plan)
+	orphanIndex := make(map[string]bool, len(plan.Index))
+	for _, hash := range plan.Index {
+		orphanIndex[hash] = true
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := boltRepo(tx, repo)
+		if bucket == nil {
+			return nil
+		}
+		for _, ref := range []struct{ resource, name string }{{"branch", boltBranchesBucket}, {"tag", boltTagsBucket}, {"pin", boltPinsBucket}} {
+			if err := bucket.Bucket([]byte(ref.name)).ForEach(func(k, v []byte) error {
+				var target struct {
+					Commit string `json:"commit"`
+				}
+				if err := json.Unmarshal(v, &target); err != nil {
+					return err
+				}
+				if planned[target.Commit] {
+					return &ConflictError{Resource: ref.resource, Key: string(k)}
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+
+		commits := bucket.Bucket([]byte(boltCommitsBucket))
+		content := bucket.Bucket([]byte(boltContentBucket))
+		index := bucket.Bucket([]byte(boltIndexBucket))
+		for _, commit := range plan.Commits {
+			if err := commits.Delete([]byte(commit.Hash)); err != nil {
+				return err
+			}
+			if err := content.Delete([]byte(commit.Hash)); err != nil {
+				return err
+			}
+			if err := index.Delete(boltIndexKey(commit.Timestamp, commit.Hash)); err != nil {
+				return err
+			}
+		}
+		for _, hash := range plan.Content {
+			if err := content.Delete([]byte(hash)); err != nil {
+				return err
+			}
+		}
+		if len(orphanIndex) > 0 {
+			var stale [][]byte
+			_ = index.ForEach(func(k, v []byte) error {
+				if orphanIndex[string(v)] {
+					stale = append(stale, append([]byte{}, k...))
+				}
+				return nil
+			})
+			for _, k := range stale {
+				if err := index.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) PinCommit(ctx context.Context, req PinRequest) (types.Pin, error) {
+	if req.Repo == "" || req.Commit == "" {
+		return types.Pin{}, &ValidationError{Message: "repo and commit are required"}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	pin := types.Pin{Repo: req.Repo, Commit: req.Commit, Reason: req.Reason, CreatedAt: s.clock().UTC()}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		repo := boltRepo(tx, req.Repo)
+		if repo == nil || repo.Bucket([]byte(boltCommitsBucket)).Get([]byte(req.Commit)) == nil {
+			return &NotFoundError{Resource: "commit", Key: req.Commit}
+		}
+		return boltPutJSON(repo.Bucket([]byte(boltPinsBucket)), req.Commit, pin)
+	})
+	if err != nil {
+		return types.Pin{}, err
+	}
+	s.notify(req.Repo)
+	return pin, nil
+}
+
+func (s *boltStore) UnpinCommit(ctx context.Context, repo, hash string) error {
+	if repo == "" || hash == "" {
+		return &ValidationError{Message: "repo and commit are required"}
+	}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := boltRepo(tx, repo)
+		if bucket == nil {
+			return &NotFoundError{Resource: "pin", Key: hash}
+		}
+		pins := bucket.Bucket([]byte(boltPinsBucket))
+		if pins.Get([]byte(hash)) == nil {
+			return &NotFoundError{Resource: "pin", Key: hash}
+		}
+		return pins.Delete([]byte(hash))
+	})
+	if err != nil {
+		return err
+	}
+	s.notify(repo)
+	return nil
+}
+
+func (s *boltStore) ListPins(ctx context.Context, repo string) ([]PinnedCommit, error) {
+	if repo == "" {
+		return nil, &ValidationError{Message: "name query parameter required"}
+	}
+	policy, err := s.GetPolicy(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	reasons, err := s.pinReasons(ctx, repo, policy)
+	if err != nil {
+		return nil, &UnavailableError{Op: "list pins", Err: err}
+	}
+	archived := make(map[string]bool, len(reasons))
+	err = s.db.View(func(tx *bolt.Tx) error {
+		bucket := boltRepo(tx, repo)
+		if bucket == nil {
+			return nil
+		}
+		commits := bucket.Bucket([]byte(boltCommitsBucket))
+		for hash := range reasons {
+			var commit types.Commit
+			if data := commits.Get([]byte(hash)); data != nil && json.Unmarshal(data, &commit) == nil {
+				archived[hash] = commit.Archived
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, &UnavailableError{Op: "list pins", Err: err}
+	}
+	return pinnedList(reasons, func(hash string) bool { return archived[hash] }), nil
+}
@@ -0,0 +1,303 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+func TestBoltStorePutBlobAndCommit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv-vs.db")
+	archive := NewMemoryArchive()
+	store, err := NewBoltStore(BoltConfig{Path: path}, Options{Archive: archive})
+	if err != nil {
+		t.Fatalf("create store: %v", err)
+	}
+
+	req := BlobWriteRequest{
+		Name:       "analytics",
+		Content:    "line one\nline two\n",
+		AuthorName: "Alice",
+		AuthorID:   "alice@id",
+	}
+
+	ctx := context.Background()
+	result, err := store.PutBlobAndCommit(ctx, req)
+	if err != nil {
+		t.Fatalf("PutBlobAndCommit: %v", err)
+	}
+	if result.Branch != defaultBranch {
+		t.Fatalf("expected branch %s, got %s", defaultBranch, result.Branch)
+	}
+	if result.Diff == "" {
+		t.Fatalf("expected diff for first commit")
+	}
+
+	commit, content, err := store.GetCommit(ctx, "analytics", result.CommitHash)
+	if err != nil {
+		t.Fatalf("GetCommit: %v", err)
+	}
+	if content != req.Content {
+		t.Fatalf("unexpected content: %s", content)
+	}
+	if commit.Parent != "" {
+		t.Fatalf("expected empty parent for first commit")
+	}
+	if commit.AuthorName != "Alice" || commit.AuthorID != "alice@id" {
+		t.Fatalf("unexpected author metadata")
+	}
+
+	second, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{
+		Name:       "analytics",
+		Content:    "line one\nline two updated\n",
+		AuthorName: "Alice",
+		AuthorID:   "alice@id",
+	})
+	if err != nil {
+		t.Fatalf("second PutBlobAndCommit: %v", err)
+	}
+	if second.Diff == "" {
+		t.Fatalf("expected diff for updated content")
+	}
+
+	commits, err := store.ListCommits(ctx, ListCommitsOptions{Repo: "analytics", Descending: true})
+	if err != nil {
+		t.Fatalf("ListCommits: %v", err)
+	}
+	if len(commits) != 2 {
+		t.Fatalf("expected 2 commits, got %d", len(commits))
+	}
+	if commits[0].Hash != second.CommitHash {
+		t.Fatalf("expected newest commit first")
+	}
+	limited, err := store.ListCommits(ctx, ListCommitsOptions{Repo: "analytics", Limit: 1})
+	if err != nil {
+		t.Fatalf("ListCommits: %v", err)
+	}
+	if len(limited) != 1 || limited[0].Hash != result.CommitHash {
+		t.Fatalf("expected oldest commit for ascending limit 1")
+	}
+
+	branch, err := store.UpsertBranch(ctx, BranchRequest{Repo: "analytics", Name: "feature", Commit: result.CommitHash})
+	if err != nil {
+		t.Fatalf("UpsertBranch: %v", err)
+	}
+	if branch.Commit != result.CommitHash {
+		t.Fatalf("unexpected branch commit")
+	}
+	branches, err := store.ListBranches(ctx, "analytics")
+	if err != nil {
+		t.Fatalf("ListBranches: %v", err)
+	}
+	if len(branches) != 2 {
+		t.Fatalf("expected 2 branches, got %d", len(branches))
+	}
+
+	if _, err := store.CreateTag(ctx, TagRequest{Repo: "analytics", Name: "v1", Commit: second.CommitHash}); err != nil {
+		t.Fatalf("CreateTag: %v", err)
+	}
+	if _, err := store.CreateTag(ctx, TagRequest{Repo: "analytics", Name: "v1", Commit: second.CommitHash}); err == nil {
+		t.Fatalf("expected duplicate tag conflict")
+	}
+	tags, err := store.ListTags(ctx, "analytics")
+	if err != nil {
+		t.Fatalf("ListTags: %v", err)
+	}
+	if len(tags) != 1 {
+		t.Fatalf("expected 1 tag, got %d", len(tags))
+	}
+
+	if _, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "analytics", Content: "third", AuthorName: "Bob", AuthorID: "alice@id"}); err == nil {
+		t.Fatalf("expected author conflict")
+	}
+
+	policy, err := store.SetPolicy(ctx, RetentionPolicy{Repo: "analytics", HotCommitLimit: 1})
+	if err != nil {
+		t.Fatalf("SetPolicy: %v", err)
+	}
+	if policy.Version != 1 || policy.HotCommitLimit != 1 {
+		t.Fatalf("unexpected policy response")
+	}
+	var validation *ValidationError
+	if _, err := store.SetPolicy(ctx, RetentionPolicy{Repo: "analytics", HotCommitLimit: 2}); !errors.As(err, &validation) {
+		t.Fatalf("expected reason to be required, got %v", err)
+	}
+	if _, err := store.EnforceRetention(ctx, "analytics"); err != nil {
+		t.Fatalf("EnforceRetention: %v", err)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	reopened, err := NewBoltStore(BoltConfig{Path: path}, Options{Archive: archive})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	t.Cleanup(func() { _ = reopened.Close() })
+
+	archived, content, err := reopened.GetCommit(ctx, "analytics", result.CommitHash)
+	if err != nil {
+		t.Fatalf("GetCommit after reopen: %v", err)
+	}
+	if !archived.Archived || content != req.Content {
+		t.Fatalf("expected archived commit served from archive")
+	}
+
+	policyGet, err := reopened.GetPolicy(ctx, "analytics")
+	if err != nil {
+		t.Fatalf("GetPolicy: %v", err)
+	}
+	if policyGet.HotCommitLimit != 1 {
+		t.Fatalf("unexpected policy limit: %d", policyGet.HotCommitLimit)
+	}
+}
+
+func TestBoltStoreCollectGarbage(t *testing.T) {
+	archive := NewMemoryArchive()
+	store, err := NewBoltStore(BoltConfig{Path: filepath.Join(t.TempDir(), "kv-vs.db")}, Options{Archive: archive})
+	if err != nil {
+		t.Fatalf("create store: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	ctx := context.Background()
+
+	var hashes []string
+	for _, content := range []string{"v1", "v2", "v3"} {
+		res, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "repo", Content: content, AuthorName: "Alice", AuthorID: "alice@id"})
+		if err != nil {
+			t.Fatalf("PutBlobAndCommit: %v", err)
+		}
+		hashes = append(hashes, res.CommitHash)
+	}
+	if err := archive.Store(ctx, "repo", hashes[2], []byte("v3")); err != nil {
+		t.Fatalf("archive.Store: %v", err)
+	}
+	// Rewind main, stranding v2 and v3.
+	if _, err := store.UpsertBranch(ctx, BranchRequest{Repo: "repo", Name: "main", Commit: hashes[0]}); err != nil {
+		t.Fatalf("UpsertBranch: %v", err)
+	}
+
+	report, err := store.CollectGarbage(ctx, GCOptions{Repo: "repo", GracePeriod: time.Hour})
+	if err != nil {
+		t.Fatalf("CollectGarbage with grace: %v", err)
+	}
+	if len(report.Commits) != 0 || report.Retained != 2 {
+		t.Fatalf("expected grace period to retain stranded commits, got %+v", report)
+	}
+
+	report, err = store.CollectGarbage(ctx, GCOptions{Repo: "repo", DryRun: true})
+	if err != nil {
+		t.Fatalf("CollectGarbage dry run: %v", err)
+	}
+	if !slices.Equal(report.Commits, hashes[1:]) || report.Reachable != 1 {
+		t.Fatalf("unexpected dry-run report: %+v", report)
+	}
+	if _, _, err := store.GetCommit(ctx, "repo", hashes[2]); err != nil {
+		t.Fatalf("dry run removed commit: %v", err)
+	}
+
+	if _, err := store.CollectGarbage(ctx, GCOptions{Repo: "repo"}); err != nil {
+		t.Fatalf("CollectGarbage: %v", err)
+	}
+	for _, hash := range hashes[1:] {
+		if _, _, err := store.GetCommit(ctx, "repo", hash); !isNotFound(err) {
+			t.Fatalf("expected %s collected, got %v", hash, err)
+		}
+	}
+	if _, err := archive.Fetch(ctx, "repo", hashes[2]); !isNotFound(err) {
+		t.Fatalf("expected archive entry removed, got %v", err)
+	}
+	commits, err := store.ListCommits(ctx, ListCommitsOptions{Repo: "repo"})
+	if err != nil {
+		t.Fatalf("ListCommits: %v", err)
+	}
+	if len(commits) != 1 || commits[0].Hash != hashes[0] {
+		t.Fatalf("expected only the branch head to survive, got %+v", commits)
+	}
+	check, err := store.Check(ctx, CheckOptions{Repo: "repo"})
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if len(check.Issues) != 0 {
+		t.Fatalf("expected clean repository after gc, got %+v", check.Issues)
+	}
+}
+
+func TestBoltStoreCompression(t *testing.T) {
+	archive := NewMemoryArchive()
+	store, err := NewBoltStore(BoltConfig{Path: filepath.Join(t.TempDir(), "kv-vs.db")}, Options{Archive: archive})
+	if err != nil {
+		t.Fatalf("NewBoltStore: %v", err)
+	}
+	defer store.Close()
+	ctx := context.Background()
+	db := store.(*boltStore).db
+	stored := func(hash string) []byte {
+		t.Helper()
+		var data []byte
+		err := db.View(func(tx *bbolt.Tx) error {
+			data = append([]byte{}, boltRepo(tx, "csv").Bucket([]byte(boltContentBucket)).Get([]byte(hash))...)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("read content: %v", err)
+		}
+		return data
+	}
+
+	v1 := strings.Repeat("id,name,amount\n1,alpha,10\n", 50)
+	first, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "csv", Content: v1, AuthorName: "Alice", AuthorID: "alice@id"})
+	if err != nil {
+		t.Fatalf("PutBlobAndCommit: %v", err)
+	}
+	if got := stored(first.CommitHash); string(got) != v1 {
+		t.Fatalf("expected uncompressed content without a policy codec")
+	}
+
+	if _, err := store.SetPolicy(ctx, RetentionPolicy{Repo: "csv", HotCommitLimit: 1, Compression: CodecZstd}); err != nil {
+		t.Fatalf("SetPolicy: %v", err)
+	}
+	v2 := v1 + strings.Repeat("2,beta,20\n", 50)
+	second, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "csv", Content: v2, AuthorName: "Alice", AuthorID: "alice@id"})
+	if err != nil {
+		t.Fatalf("PutBlobAndCommit: %v", err)
+	}
+	if data := stored(second.CommitHash); storedCodec(data) != CodecZstd || len(data) >= len(v2) {
+		t.Fatalf("expected zstd content, got %d bytes", len(data))
+	}
+	if _, content, err := store.GetCommit(ctx, "csv", second.CommitHash); err != nil || content != v2 {
+		t.Fatalf("GetCommit: %v", err)
+	}
+
+	report, err := store.Recompress(ctx, "csv")
+	if err != nil || report.Recompressed != 1 || report.Hot.ByCodec[CodecZstd] != 2 || report.Hot.Ratio <= 1 {
+		t.Fatalf("unexpected recompression report: %+v, %v", report, err)
+	}
+	if run, err := store.EnforceRetention(ctx, "csv"); err != nil || run.Archived != 1 {
+		t.Fatalf("EnforceRetention: %+v, %v", run, err)
+	}
+	if data, err := archive.Fetch(ctx, "csv", first.CommitHash); err != nil || storedCodec(data) != CodecZstd {
+		t.Fatalf("expected zstd archive entry: %v", err)
+	}
+	if _, content, err := store.GetCommit(ctx, "csv", first.CommitHash); err != nil || content != v1 {
+		t.Fatalf("GetCommit archived: %v", err)
+	}
+
+	if _, err := store.SetPolicy(ctx, RetentionPolicy{Repo: "csv", HotCommitLimit: 1, Compression: CodecGzip, Reason: "compat"}); err != nil {
+		t.Fatalf("SetPolicy gzip: %v", err)
+	}
+	report, err = store.Recompress(ctx, "csv")
+	if err != nil || report.Recompressed != 2 || report.Hot.ByCodec[CodecGzip] != 1 || report.Archive.ByCodec[CodecGzip] != 1 {
+		t.Fatalf("unexpected report after codec change: %+v, %v", report, err)
+	}
+	if _, content, err := store.GetCommit(ctx, "csv", first.CommitHash); err != nil || content != v1 {
+		t.Fatalf("GetCommit after recompression: %v", err)
+	}
+}
@@ -0,0 +1,281 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec names a content compression format.
+type Codec string
+
+const (
+	// CodecNone stores content as written.
+	CodecNone Codec = "none"
+	// CodecGzip compresses content with gzip.
+	CodecGzip Codec = "gzip"
+	// CodecZstd compresses content with Zstandard.
+	CodecZstd Codec = "zstd"
+)
+
+// contentMagic starts every encoded payload. Payloads without it are raw
+// content written before compression existed, so they stay readable. Text
+// content never starts with a NUL byte; raw content that starts like an
+// encoded or encrypted payload is escaped with a header instead of being
+// stored bare.
+var contentMagic = []byte{0x00, 'K', 'V', 'Z'}
+
+// Codec identifiers stored in the byte after contentMagic.
+const (
+	codecIDNone byte = iota
+	codecIDGzip
+	codecIDZstd
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// zstdCodecs returns shared encoder and decoder instances; EncodeAll and
+// DecodeAll are safe for concurrent use.
+func zstdCodecs() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+// ParseCodec validates a codec name. The empty string is returned unchanged
+// and means the store default.
+func ParseCodec(name string) (Codec, error) {
+	switch codec := Codec(name); codec {
+	case "", CodecNone, CodecGzip, CodecZstd:
+		return codec, nil
+	default:
+		return "", &ValidationError{Message: fmt.Sprintf("unknown compression %q", name)}
+	}
+}
+
+// encodeContent compresses data with codec. Content that does not shrink is
+// stored uncompressed, so the stored codec can differ from the requested one.
+func encodeContent(codec Codec, data []byte) ([]byte, error) {
+	var id byte
+	switch codec {
+	case "", CodecNone:
+		if !bytes.HasPrefix(data, contentMagic) && !bytes.HasPrefix(data, sealedMagic) {
+			return data, nil
+		}
+		return withContentHeader(codecIDNone, data), nil
+	case CodecGzip:
+		id = codecIDGzip
+	case CodecZstd:
+		id = codecIDZstd
+	default:
+		return nil, &ValidationError{Message: fmt.Sprintf("unknown compression %q", codec)}
+	}
+	compressed, err := compressStream(codec, data)
+	if err != nil {
+		return nil, err
+	}
+	if len(compressed)+len(contentMagic)+1 >= len(data) {
+		return encodeContent(CodecNone, data)
+	}
+	return withContentHeader(id, compressed), nil
+}
+
+// compressStream compresses data into a plain gzip or zstd stream without
+// a content header.
+func compressStream(codec Codec, data []byte) ([]byte, error) {
+	switch codec {
+	case CodecGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CodecZstd:
+		enc, _, err := zstdCodecs()
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(data, nil), nil
+	default:
+		return nil, fmt.Errorf("compression %q has no stream format", codec)
+	}
+}
+
+// decompressStream reverses compressStream.
+func decompressStream(codec Codec, payload []byte) ([]byte, error) {
+	switch codec {
+	case CodecGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, fmt.Errorf("decode gzip content: %w", err)
+		}
+		raw, err := io.ReadAll(zr)
+		if err != nil {
+			return nil, fmt.Errorf("decode gzip content: %w", err)
+		}
+		return raw, nil
+	case CodecZstd:
+		_, dec, err := zstdCodecs()
+		if err != nil {
+			return nil, err
+		}
+		raw, err := dec.DecodeAll(payload, nil)
+		if err != nil {
+			return nil, fmt.Errorf("decode zstd content: %w", err)
+		}
+		return raw, nil
+	default:
+		return nil, fmt.Errorf("compression %q has no stream format", codec)
+	}
+}
+
+func withContentHeader(id byte, payload []byte) []byte {
+	out := make([]byte, 0, len(contentMagic)+1+len(payload))
+	out = append(out, contentMagic...)
+	out = append(out, id)
+	return append(out, payload...)
+}
+
+// decodeContent returns the raw content of an encoded payload and the codec
+// it was stored with. Encrypted payloads must be opened first.
+func decodeContent(data []byte) ([]byte, Codec, error) {
+	if bytes.HasPrefix(data, sealedMagic) {
+		return nil, "", errors.New("content is encrypted")
+	}
+	if !bytes.HasPrefix(data, contentMagic) || len(data) == len(contentMagic) {
+		return data, CodecNone, nil
+	}
+	payload := data[len(contentMagic)+1:]
+	switch data[len(contentMagic)] {
+	case codecIDNone:
+		return payload, CodecNone, nil
+	case codecIDGzip:
+		raw, err := decompressStream(CodecGzip, payload)
+		return raw, CodecGzip, err
+	case codecIDZstd:
+		raw, err := decompressStream(CodecZstd, payload)
+		return raw, CodecZstd, err
+	default:
+		return nil, "", fmt.Errorf("unknown content codec %d", data[len(contentMagic)])
+	}
+}
+
+// storedCodec reports the codec of a stored payload without decoding it.
+func storedCodec(data []byte) Codec {
+	if !bytes.HasPrefix(data, contentMagic) || len(data) == len(contentMagic) {
+		return CodecNone
+	}
+	switch data[len(contentMagic)] {
+	case codecIDGzip:
+		return CodecGzip
+	case codecIDZstd:
+		return CodecZstd
+	default:
+		return CodecNone
+	}
+}
+
+// CompressionStats sums the stored content of one tier of a repository.
+// Encrypted counts the entries sealed with a data key.
+type CompressionStats struct {
+	Entries     int           `json:"entries"`
+	RawBytes    int64         `json:"rawBytes"`
+	StoredBytes int64         `json:"storedBytes"`
+	Ratio       float64       `json:"ratio"`
+	ByCodec     map[Codec]int `json:"byCodec"`
+	Encrypted   int           `json:"encrypted"`
+}
+
+func (s *CompressionStats) add(codec Codec, encrypted bool, raw, stored int) {
+	if s.ByCodec == nil {
+		s.ByCodec = make(map[Codec]int)
+	}
+	s.Entries++
+	s.RawBytes += int64(raw)
+	s.StoredBytes += int64(stored)
+	s.ByCodec[codec]++
+	if encrypted {
+		s.Encrypted++
+	}
+	if s.StoredBytes > 0 {
+		s.Ratio = float64(s.RawBytes) / float64(s.StoredBytes)
+	}
+}
+
+func (s *CompressionStats) addContent(content recodedContent) {
+	s.add(content.codec, content.dataKey > 0, len(content.raw), len(content.data))
+}
+
+// CompressionReport reports one recompression pass over a repository. Hot
+// and Archive describe the content after the pass; Recompressed counts the
+// payloads rewritten to Codec or resealed under the current data key.
+type CompressionReport struct {
+	Repo      string    `json:"repo"`
+	StartedAt time.Time `json:"startedAt"`
+	// Duration is filled in by the recompression job.
+	Duration     string           `json:"duration,omitempty"`
+	Codec        Codec            `json:"codec"`
+	Recompressed int              `json:"recompressed"`
+	Hot          CompressionStats `json:"hot"`
+	Archive      CompressionStats `json:"archive"`
+	Errors       []string         `json:"errors,omitempty"`
+}
+
+// recompressArchive rewrites the archived payloads of hashes with codec and
+// records archive stats. live reports whether a commit still owns archived
+// content; a payload rewritten for a commit purged meanwhile is removed
+// again so recompression never resurrects purged content.
+func recompressArchive(ctx context.Context, archive Archive, keys *dataKeyring, repo string, hashes []string, codec Codec, live func(hash string) bool, report *CompressionReport) {
+	if archive == nil {
+		return
+	}
+	for _, hash := range hashes {
+		if err := ctx.Err(); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			return
+		}
+		data, err := archive.Fetch(ctx, repo, hash)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("archive %s: %v", hash, err))
+			continue
+		}
+		content, err := keys.recode(ctx, repo, codec, data)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("archive %s: %v", hash, err))
+			continue
+		}
+		if content.changed {
+			if err := archive.Store(ctx, repo, hash, content.data); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("archive %s: %v", hash, err))
+				continue
+			}
+			if !live(hash) {
+				_ = archive.Remove(ctx, repo, hash)
+				continue
+			}
+			report.Recompressed++
+		}
+		report.Archive.addContent(content)
+	}
+}
@@ -0,0 +1,584 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// masterKeySize and dataKeySize select AES-256.
+	masterKeySize = 32
+	dataKeySize   = 32
+	// dataKeyCacheTTL bounds how long unwrapped data keys are served without
+	// reloading, so rotations by another instance are picked up.
+	dataKeyCacheTTL = time.Minute
+)
+
+// sealedMagic starts content encrypted with a data key. It is followed by the
+// data key ID as a uvarint, the nonce and the AES-GCM ciphertext of the
+// encoded (possibly compressed) payload. The repository name is authenticated
+// as additional data, so content cannot be moved between repositories.
+var sealedMagic = []byte{0x00, 'K', 'V', 'E'}
+
+var masterKeyIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// MasterKey is a key-encryption key. Master keys only wrap data keys; they
+// never encrypt content directly.
+type MasterKey struct {
+	ID  string
+	Key []byte
+}
+
+// MasterKeys holds the master keys available to a store. The first key is
+// active: new data keys are wrapped with it and Reencrypt rewraps older data
+// keys to it. The others only unwrap data keys wrapped before a rotation.
+type MasterKeys struct {
+	active string
+	aeads  map[string]cipher.AEAD
+}
+
+// NewMasterKeys validates keys and makes the first one active.
+func NewMasterKeys(keys []MasterKey) (*MasterKeys, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("at least one master key is required")
+	}
+	m := &MasterKeys{active: keys[0].ID, aeads: make(map[string]cipher.AEAD, len(keys))}
+	for _, key := range keys {
+		if !masterKeyIDPattern.MatchString(key.ID) {
+			return nil, fmt.Errorf("invalid master key id %q", key.ID)
+		}
+		if len(key.Key) != masterKeySize {
+			return nil, fmt.Errorf("master key %s must be %d bytes, got %d", key.ID, masterKeySize, len(key.Key))
+		}
+		if _, ok := m.aeads[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate master key id %q", key.ID)
+		}
+		aead, err := newAEAD(key.Key)
+		if err != nil {
+			return nil, err
+		}
+		m.aeads[key.ID] = aead
+	}
+	return m, nil
+}
+
+// ParseMasterKeys parses "<id>:<base64 key>" entries separated by newlines or
+// commas. Blank lines and lines starting with # are ignored.
+func ParseMasterKeys(text string) ([]MasterKey, error) {
+	var keys []MasterKey
+	for _, line := range strings.FieldsFunc(text, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, errors.New("master key entries must look like <id>:<base64 key>")
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("master key %s: %w", strings.TrimSpace(id), err)
+		}
+		keys = append(keys, MasterKey{ID: strings.TrimSpace(id), Key: key})
+	}
+	return keys, nil
+}
+
+// LoadMasterKeys reads master keys from value (normally an environment
+// variable) followed by the keyfile at path. Either may be empty; nil is
+// returned when both are, which leaves encryption disabled.
+func LoadMasterKeys(path, value string) (*MasterKeys, error) {
+	keys, err := ParseMasterKeys(value)
+	if err != nil {
+		return nil, err
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read master keyfile: %w", err)
+		}
+		fileKeys, err := ParseMasterKeys(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("master keyfile %s: %w", path, err)
+		}
+		keys = append(keys, fileKeys...)
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	return NewMasterKeys(keys)
+}
+
+// ActiveID returns the ID of the master key that wraps new data keys.
+func (m *MasterKeys) ActiveID() string {
+	return m.active
+}
+
+func (m *MasterKeys) wrap(repo string, id int, key []byte) ([]byte, error) {
+	return seal(m.aeads[m.active], dataKeyAAD(repo, id), key)
+}
+
+func (m *MasterKeys) unwrap(key DataKey) ([]byte, error) {
+	aead, ok := m.aeads[key.MasterKeyID]
+	if !ok {
+		return nil, fmt.Errorf("data key %d of %s is wrapped by unknown master key %q", key.ID, key.Repo, key.MasterKeyID)
+	}
+	return open(aead, dataKeyAAD(key.Repo, key.ID), key.Wrapped)
+}
+
+func dataKeyAAD(repo string, id int) []byte {
+	return []byte(repo + "/" + strconv.Itoa(id))
+}
+
+// DataKey is a per-repository content key. Only the wrapped form is stored,
+// next to the repository's other records; IDs count up from 1 and the
+// highest ID is current.
+type DataKey struct {
+	Repo        string    `json:"repo"`
+	ID          int       `json:"id"`
+	MasterKeyID string    `json:"masterKeyId"`
+	Wrapped     []byte    `json:"wrapped,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	// Current is set on the key new content is sealed with when listing.
+	Current bool `json:"current,omitempty"`
+}
+
+// ReencryptReport reports a Reencrypt call. Content describes the rewrite of
+// the repository's stored content under the current data key.
+type ReencryptReport struct {
+	Repo      string            `json:"repo"`
+	DataKey   int               `json:"dataKey"`
+	MasterKey string            `json:"masterKey"`
+	Rotated   bool              `json:"rotated"`
+	Rewrapped int               `json:"rewrapped"`
+	Content   CompressionReport `json:"content"`
+}
+
+// dataKeyStore persists wrapped data keys in a backend.
+type dataKeyStore interface {
+	// loadDataKeys returns repo's data keys ordered by ID.
+	loadDataKeys(ctx context.Context, repo string) ([]DataKey, error)
+	// createDataKey stores a new key and returns a ConflictError when its ID
+	// is taken, for example by another instance rotating concurrently.
+	createDataKey(ctx context.Context, key DataKey) error
+	// rewrapDataKey replaces the wrapping of an existing key.
+	rewrapDataKey(ctx context.Context, key DataKey) error
+}
+
+// dataKeyring seals and opens content with per-repository data keys. A nil
+// keyring stores content in the clear and refuses to open sealed content.
+type dataKeyring struct {
+	master *MasterKeys
+	store  dataKeyStore
+	clock  func() time.Time
+
+	mu    sync.Mutex
+	repos map[string]*repoDataKeys
+}
+
+// errUnknownDataKey reports content sealed with a key missing from a
+// snapshot; the keyring reloads once before giving up.
+var errUnknownDataKey = errors.New("unknown data key")
+
+// repoDataKeys is a snapshot of one repository's unwrapped data keys. Its
+// methods never call the store, so backends can use a snapshot inside their
+// own transactions. A nil snapshot means encryption is disabled.
+type repoDataKeys struct {
+	repo     string
+	current  int
+	aeads    map[int]cipher.AEAD
+	loadedAt time.Time
+}
+
+// newDataKeyring returns nil when master is nil, which disables encryption.
+func newDataKeyring(master *MasterKeys, store dataKeyStore) *dataKeyring {
+	if master == nil {
+		return nil
+	}
+	return &dataKeyring{master: master, store: store, clock: time.Now, repos: make(map[string]*repoDataKeys)}
+}
+
+// load returns repo's keys, reloading them when the cache is stale or
+// refresh is set.
+func (k *dataKeyring) load(ctx context.Context, repo string, refresh bool) (*repoDataKeys, error) {
+	if k == nil {
+		return nil, nil
+	}
+	k.mu.Lock()
+	cached, ok := k.repos[repo]
+	k.mu.Unlock()
+	if ok && !refresh && k.clock().Sub(cached.loadedAt) < dataKeyCacheTTL {
+		return cached, nil
+	}
+
+	keys, err := k.store.loadDataKeys(ctx, repo)
+	if err != nil {
+		return nil, fmt.Errorf("data keys of %s: %w", repo, err)
+	}
+	loaded, err := k.unwrap(repo, keys)
+	if err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	k.repos[repo] = loaded
+	k.mu.Unlock()
+	return loaded, nil
+}
+
+// unwrap opens keys, the stored data keys of repo, without touching the
+// cache or the backend.
+func (k *dataKeyring) unwrap(repo string, keys []DataKey) (*repoDataKeys, error) {
+	if k == nil {
+		return nil, nil
+	}
+	unwrapped := &repoDataKeys{repo: repo, aeads: make(map[int]cipher.AEAD, len(keys)), loadedAt: k.clock()}
+	for _, key := range keys {
+		raw, err := k.master.unwrap(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := newAEAD(raw)
+		if err != nil {
+			return nil, err
+		}
+		unwrapped.aeads[key.ID] = aead
+		unwrapped.current = max(unwrapped.current, key.ID)
+	}
+	return unwrapped, nil
+}
+
+// prepare returns repo's keys with a current key, creating the first data key
+// on demand.
+func (k *dataKeyring) prepare(ctx context.Context, repo string) (*repoDataKeys, error) {
+	keys, err := k.load(ctx, repo, false)
+	if err != nil || keys == nil || keys.current > 0 {
+		return keys, err
+	}
+	if _, err := k.create(ctx, repo, 1); err != nil {
+		return nil, err
+	}
+	return k.load(ctx, repo, true)
+}
+
+// create stores a new data key with id. Losing a race to another writer is
+// not an error; the caller reloads and uses the winner's key.
+func (k *dataKeyring) create(ctx context.Context, repo string, id int) (DataKey, error) {
+	raw := make([]byte, dataKeySize)
+	if _, err := rand.Read(raw); err != nil {
+		return DataKey{}, err
+	}
+	wrapped, err := k.master.wrap(repo, id, raw)
+	if err != nil {
+		return DataKey{}, err
+	}
+	key := DataKey{Repo: repo, ID: id, MasterKeyID: k.master.active, Wrapped: wrapped, CreatedAt: k.clock().UTC()}
+	err = k.store.createDataKey(ctx, key)
+	var conflict *ConflictError
+	if err != nil && !errors.As(err, &conflict) {
+		return DataKey{}, fmt.Errorf("create data key for %s: %w", repo, err)
+	}
+	return key, nil
+}
+
+// encode compresses raw content with codec and seals it.
+func (k *dataKeyring) encode(ctx context.Context, repo string, codec Codec, raw []byte) ([]byte, error) {
+	keys, err := k.prepare(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	return keys.encode(codec, raw)
+}
+
+// decode opens and decompresses stored content.
+func (k *dataKeyring) decode(ctx context.Context, repo string, stored []byte) ([]byte, error) {
+	keys, err := k.load(ctx, repo, false)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := keys.decode(stored)
+	if errors.Is(err, errUnknownDataKey) {
+		// The key may have been created by another instance since the last load.
+		if keys, err = k.load(ctx, repo, true); err != nil {
+			return nil, err
+		}
+		raw, err = keys.decode(stored)
+	}
+	return raw, err
+}
+
+// recode brings stored content up to date with codec and the current data
+// key; see repoDataKeys.recode.
+func (k *dataKeyring) recode(ctx context.Context, repo string, codec Codec, stored []byte) (recodedContent, error) {
+	keys, err := k.prepare(ctx, repo)
+	if err != nil {
+		return recodedContent{}, err
+	}
+	content, err := keys.recode(codec, stored)
+	if errors.Is(err, errUnknownDataKey) {
+		if keys, err = k.load(ctx, repo, true); err != nil {
+			return recodedContent{}, err
+		}
+		content, err = keys.recode(codec, stored)
+	}
+	return content, err
+}
+
+// seal encrypts an encoded payload with the current data key.
+func (r *repoDataKeys) seal(payload []byte) ([]byte, error) {
+	if r == nil {
+		return payload, nil
+	}
+	aead, ok := r.aeads[r.current]
+	if !ok {
+		return nil, fmt.Errorf("%s has no current data key", r.repo)
+	}
+	header := binary.AppendUvarint(append([]byte{}, sealedMagic...), uint64(r.current))
+	sealed, err := seal(aead, []byte(r.repo), payload)
+	if err != nil {
+		return nil, err
+	}
+	return append(header, sealed...), nil
+}
+
+// open decrypts sealed content and returns the encoded payload with the ID of
+// the data key it was sealed with. Unsealed content is returned unchanged
+// with ID zero.
+func (r *repoDataKeys) open(data []byte) ([]byte, int, error) {
+	if !bytes.HasPrefix(data, sealedMagic) {
+		return data, 0, nil
+	}
+	id64, n := binary.Uvarint(data[len(sealedMagic):])
+	if n <= 0 || id64 == 0 {
+		return nil, 0, errors.New("malformed encrypted content header")
+	}
+	id := int(id64)
+	if r == nil {
+		return nil, id, errors.New("content is encrypted but no master key is configured")
+	}
+	aead, ok := r.aeads[id]
+	if !ok {
+		return nil, id, fmt.Errorf("data key %d of %s: %w", id, r.repo, errUnknownDataKey)
+	}
+	payload, err := open(aead, []byte(r.repo), data[len(sealedMagic)+n:])
+	if err != nil {
+		return nil, id, fmt.Errorf("decrypt content with data key %d: %w", id, err)
+	}
+	return payload, id, nil
+}
+
+// encode compresses raw content with codec and seals it.
+func (r *repoDataKeys) encode(codec Codec, raw []byte) ([]byte, error) {
+	encoded, err := encodeContent(codec, raw)
+	if err != nil {
+		return nil, err
+	}
+	return r.seal(encoded)
+}
+
+// decode opens and decompresses stored content.
+func (r *repoDataKeys) decode(stored []byte) ([]byte, error) {
+	payload, _, err := r.open(stored)
+	if err != nil {
+		return nil, err
+	}
+	raw, _, err := decodeContent(payload)
+	return raw, err
+}
+
+// recodedContent is the result of bringing one stored payload up to date.
+type recodedContent struct {
+	data    []byte
+	raw     []byte
+	codec   Codec
+	dataKey int
+	changed bool
+}
+
+// recode rewrites stored content with codec under the current data key. The
+// content is left as it is when both already match, or when the only
+// difference is a codec that would not shrink it.
+func (r *repoDataKeys) recode(codec Codec, stored []byte) (recodedContent, error) {
+	payload, keyID, err := r.open(stored)
+	if err != nil {
+		return recodedContent{}, err
+	}
+	raw, current, err := decodeContent(payload)
+	if err != nil {
+		return recodedContent{}, err
+	}
+	if codec == "" {
+		codec = CodecNone
+	}
+	wantKey := 0
+	if r != nil {
+		wantKey = r.current
+	}
+	out := recodedContent{data: stored, raw: raw, codec: current, dataKey: keyID}
+	if current != codec {
+		encoded, err := encodeContent(codec, raw)
+		if err != nil {
+			return recodedContent{}, err
+		}
+		if storedCodec(encoded) != current {
+			payload, out.codec = encoded, storedCodec(encoded)
+		}
+	}
+	if out.codec == current && keyID == wantKey {
+		return out, nil
+	}
+	if out.data, err = r.seal(payload); err != nil {
+		return recodedContent{}, err
+	}
+	out.dataKey = wantKey
+	out.changed = true
+	return out, nil
+}
+
+// list returns repo's data keys without key material.
+func (k *dataKeyring) list(ctx context.Context, repo string) ([]DataKey, error) {
+	if k == nil {
+		return nil, &ValidationError{Message: "encryption is not configured"}
+	}
+	if repo == "" {
+		return nil, &ValidationError{Message: "repository name is required"}
+	}
+	keys, err := k.store.loadDataKeys(ctx, repo)
+	if err != nil {
+		return nil, &UnavailableError{Op: "list data keys", Err: err}
+	}
+	if keys == nil {
+		keys = []DataKey{}
+	}
+	for i := range keys {
+		keys[i].Wrapped = nil
+		keys[i].Current = i == len(keys)-1
+	}
+	return keys, nil
+}
+
+// rotate creates a new current data key for repo.
+func (k *dataKeyring) rotate(ctx context.Context, repo string) (DataKey, error) {
+	keys, err := k.store.loadDataKeys(ctx, repo)
+	if err != nil {
+		return DataKey{}, err
+	}
+	next := 1
+	if len(keys) > 0 {
+		next = keys[len(keys)-1].ID + 1
+	}
+	key, err := k.create(ctx, repo, next)
+	if err != nil {
+		return DataKey{}, err
+	}
+	_, err = k.load(ctx, repo, true)
+	return key, err
+}
+
+// rewrap wraps every data key of repo that uses an older master key with the
+// active one, and returns how many were rewrapped.
+func (k *dataKeyring) rewrap(ctx context.Context, repo string) (int, error) {
+	keys, err := k.store.loadDataKeys(ctx, repo)
+	if err != nil {
+		return 0, err
+	}
+	rewrapped := 0
+	for _, key := range keys {
+		if key.MasterKeyID == k.master.active {
+			continue
+		}
+		raw, err := k.master.unwrap(key)
+		if err != nil {
+			return rewrapped, err
+		}
+		if key.Wrapped, err = k.master.wrap(repo, key.ID, raw); err != nil {
+			return rewrapped, err
+		}
+		key.MasterKeyID = k.master.active
+		if err := k.store.rewrapDataKey(ctx, key); err != nil {
+			return rewrapped, err
+		}
+		rewrapped++
+	}
+	return rewrapped, nil
+}
+
+// reencrypt implements Store.Reencrypt on top of a backend's keyring: it
+// optionally rotates the data key, rewraps data keys under the active master
+// key and then recompresses, which reseals content under the current key.
+func reencrypt(ctx context.Context, k *dataKeyring, store Store, repo string, rotate bool) (ReencryptReport, error) {
+	report := ReencryptReport{Repo: repo}
+	if k == nil {
+		return report, &ValidationError{Message: "encryption is not configured"}
+	}
+	if repo == "" {
+		return report, &ValidationError{Message: "repository name is required"}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if commits, err := store.ListCommits(ctx, ListCommitsOptions{Repo: repo, Limit: 1}); err == nil && len(commits) == 0 {
+		return report, &NotFoundError{Resource: "repository", Key: repo}
+	}
+	report.MasterKey = k.master.active
+	if rotate {
+		if _, err := k.rotate(ctx, repo); err != nil {
+			return report, &UnavailableError{Op: "rotate data key", Err: err}
+		}
+		report.Rotated = true
+	}
+	rewrapped, err := k.rewrap(ctx, repo)
+	report.Rewrapped = rewrapped
+	if err != nil {
+		return report, &UnavailableError{Op: "rewrap data keys", Err: err}
+	}
+	keys, err := k.prepare(ctx, repo)
+	if err != nil {
+		return report, &UnavailableError{Op: "load data key", Err: err}
+	}
+	report.DataKey = keys.current
+	report.Content, err = store.Recompress(ctx, repo)
+	return report, err
+}
+
+// sortDataKeys orders keys by ID, as loadDataKeys promises.
+func sortDataKeys(keys []DataKey) {
+	slices.SortFunc(keys, func(a, b DataKey) int { return a.ID - b.ID })
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a random nonce, which is prepended.
+func seal(aead cipher.AEAD, aad, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func open(aead cipher.AEAD, aad, data []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], aad)
+}
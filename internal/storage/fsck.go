@@ -0,0 +1,375 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/onexay/kv-vs/internal/types"
+)
+
+// CheckIssueKind classifies an integrity problem found by Check.
+type CheckIssueKind string
+
+const (
+	// IssueUnreadableRecord marks a record that exists but cannot be decoded.
+	IssueUnreadableRecord CheckIssueKind = "unreadable_record"
+	// IssueContentHashMismatch marks content whose hash differs from the commit.
+	IssueContentHashMismatch CheckIssueKind = "content_hash_mismatch"
+	// IssueMissingParent marks a commit whose parent commit does not exist.
+	IssueMissingParent CheckIssueKind = "missing_parent"
+	// IssueMissingContent marks a hot commit without hot content.
+	IssueMissingContent CheckIssueKind = "missing_content"
+	// IssueMissingArchiveEntry marks an archived commit absent from the archive.
+	IssueMissingArchiveEntry CheckIssueKind = "missing_archive_entry"
+	// IssueStaleHotContent marks an archived commit that still has hot content.
+	IssueStaleHotContent CheckIssueKind = "stale_hot_content"
+	// IssueUnindexedCommit marks a commit missing from the history index.
+	IssueUnindexedCommit CheckIssueKind = "unindexed_commit"
+	// IssuePurgedArchiveEntry marks a purged commit whose content is still archived.
+	IssuePurgedArchiveEntry CheckIssueKind = "purged_archive_entry"
+	// IssueOrphanedIndexEntry marks an index entry without commit metadata.
+	IssueOrphanedIndexEntry CheckIssueKind = "orphaned_index_entry"
+	// IssueOrphanedSetMember marks a branch or tag listing entry without a record.
+	IssueOrphanedSetMember CheckIssueKind = "orphaned_set_member"
+	// IssueOrphanedContent marks content stored without commit metadata.
+	IssueOrphanedContent CheckIssueKind = "orphaned_content"
+	// IssueDanglingBranch marks a branch pointing at a missing commit.
+	IssueDanglingBranch CheckIssueKind = "dangling_branch"
+	// IssueDanglingTag marks a tag pointing at a missing commit.
+	IssueDanglingTag CheckIssueKind = "dangling_tag"
+)
+
+// CheckOptions controls an integrity check.
+type CheckOptions struct {
+	Repo   string
+	Repair bool
+}
+
+// CheckIssue describes a single integrity problem and, in repair mode, its outcome.
+type CheckIssue struct {
+	Kind        CheckIssueKind `json:"kind"`
+	Hash        string         `json:"hash,omitempty"`
+	Name        string         `json:"name,omitempty"`
+	Key         string         `json:"key,omitempty"`
+	Detail      string         `json:"detail"`
+	Repairable  bool           `json:"repairable"`
+	Repaired    bool           `json:"repaired"`
+	RepairError string         `json:"repairError,omitempty"`
+}
+
+// CheckReport summarises an integrity check for one repository.
+type CheckReport struct {
+	Repo      string       `json:"repo"`
+	CheckedAt time.Time    `json:"checkedAt"`
+	Repair    bool         `json:"repair"`
+	Commits   int          `json:"commits"`
+	Branches  int          `json:"branches"`
+	Tags      int          `json:"tags"`
+	Issues    []CheckIssue `json:"issues"`
+}
+
+// repoInventory is the backend-neutral view of a repository consumed by runCheck.
+type repoInventory struct {
+	Commits  map[string]types.Commit
+	Hot      map[string]bool // hashes with hot content present
+	Indexed  map[string]bool // hashes present in the history index
+	Branches []types.Branch
+	Tags     []types.Tag
+	Pins     []types.Pin
+	// Issues holds backend-specific findings (e.g. undecodable records).
+	Issues      []CheckIssue
+	LoadContent func(ctx context.Context, hash string) (string, error)
+}
+
+// checkRepairer applies the safe fixes runCheck marks as repairable.
+type checkRepairer interface {
+	repairCheckIssue(ctx context.Context, repo string, issue CheckIssue, commit types.Commit) error
+}
+
+// runCheck verifies inv against archive, opening archived content with keys,
+// and when repair is set asks fixer to resolve repairable issues. Only fixes
+// that cannot lose data are repairable: index maintenance, archived-flag
+// corrections backed by a verified copy, and dropping hot copies that the
+// archive already holds.
+func runCheck(ctx context.Context, repo string, inv repoInventory, archive Archive, keys *dataKeyring, fixer checkRepairer, repair bool, now time.Time) CheckReport {
+	report := CheckReport{
+		Repo:      repo,
+		CheckedAt: now.UTC(),
+		Repair:    repair,
+		Commits:   len(inv.Commits),
+		Branches:  len(inv.Branches),
+		Tags:      len(inv.Tags),
+		Issues:    []CheckIssue{},
+	}
+	report.Issues = append(report.Issues, inv.Issues...)
+
+	commits := make([]types.Commit, 0, len(inv.Commits))
+	for _, commit := range inv.Commits {
+		commits = append(commits, commit)
+	}
+	slices.SortFunc(commits, func(a, b types.Commit) int {
+		if c := a.Timestamp.Compare(b.Timestamp); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Hash, b.Hash)
+	})
+
+	for _, commit := range commits {
+		if err := ctx.Err(); err != nil {
+			break
+		}
+		report.Issues = append(report.Issues, checkCommit(ctx, repo, commit, inv, archive, keys)...)
+	}
+
+	indexed := make([]string, 0, len(inv.Indexed))
+	for hash := range inv.Indexed {
+		indexed = append(indexed, hash)
+	}
+	slices.Sort(indexed)
+	for _, hash := range indexed {
+		if _, ok := inv.Commits[hash]; !ok {
+			report.Issues = append(report.Issues, CheckIssue{
+				Kind:       IssueOrphanedIndexEntry,
+				Hash:       hash,
+				Detail:     "history index references a commit without metadata",
+				Repairable: true,
+			})
+		}
+	}
+
+	hot := make([]string, 0, len(inv.Hot))
+	for hash := range inv.Hot {
+		hot = append(hot, hash)
+	}
+	slices.Sort(hot)
+	for _, hash := range hot {
+		if _, ok := inv.Commits[hash]; !ok {
+			report.Issues = append(report.Issues, CheckIssue{
+				Kind:   IssueOrphanedContent,
+				Hash:   hash,
+				Detail: "content stored without commit metadata",
+			})
+		}
+	}
+
+	for _, branch := range inv.Branches {
+		if _, ok := inv.Commits[branch.Commit]; !ok {
+			report.Issues = append(report.Issues, CheckIssue{
+				Kind:   IssueDanglingBranch,
+				Name:   branch.Name,
+				Hash:   branch.Commit,
+				Detail: "branch points at a missing commit",
+			})
+		}
+	}
+	for _, tag := range inv.Tags {
+		if _, ok := inv.Commits[tag.Commit]; !ok {
+			report.Issues = append(report.Issues, CheckIssue{
+				Kind:   IssueDanglingTag,
+				Name:   tag.Name,
+				Hash:   tag.Commit,
+				Detail: "tag points at a missing commit",
+			})
+		}
+	}
+
+	if repair && fixer != nil {
+		for i := range report.Issues {
+			issue := &report.Issues[i]
+			if !issue.Repairable {
+				continue
+			}
+			// Archive cleanup is backend-neutral; everything else goes to the store.
+			var err error
+			if issue.Kind == IssuePurgedArchiveEntry {
+				err = archive.Remove(ctx, repo, issue.Hash)
+			} else {
+				err = fixer.repairCheckIssue(ctx, repo, *issue, inv.Commits[issue.Hash])
+			}
+			if err != nil {
+				issue.RepairError = err.Error()
+				continue
+			}
+			issue.Repaired = true
+		}
+	}
+
+	return report
+}
+
+func checkCommit(ctx context.Context, repo string, commit types.Commit, inv repoInventory, archive Archive, keys *dataKeyring) []CheckIssue {
+	var issues []CheckIssue
+	hash := commit.Hash
+
+	if commit.Parent != "" {
+		if _, ok := inv.Commits[commit.Parent]; !ok {
+			issues = append(issues, CheckIssue{
+				Kind:   IssueMissingParent,
+				Hash:   hash,
+				Detail: "parent " + commit.Parent + " does not exist",
+			})
+		}
+	}
+
+	if !inv.Indexed[hash] {
+		issues = append(issues, CheckIssue{
+			Kind:       IssueUnindexedCommit,
+			Hash:       hash,
+			Detail:     "commit is missing from the history index",
+			Repairable: true,
+		})
+	}
+
+	verify := func(content, source string) {
+		if computeContentHash(content) != commit.ContentHash {
+			issues = append(issues, CheckIssue{
+				Kind:   IssueContentHashMismatch,
+				Hash:   hash,
+				Detail: source + " content does not match contentHash",
+			})
+		}
+	}
+
+	hot := inv.Hot[hash]
+	if commit.Purged {
+		return append(issues, checkPurged(ctx, repo, hash, hot, archive, keys)...)
+	}
+	var hotContent string
+	hotOK := false
+	if hot {
+		content, err := inv.LoadContent(ctx, hash)
+		if err != nil {
+			issues = append(issues, CheckIssue{Kind: IssueUnreadableRecord, Hash: hash, Detail: "hot content: " + err.Error()})
+		} else {
+			hotContent, hotOK = content, true
+		}
+	}
+
+	archived, archiveOK, archiveErr := fetchArchived(ctx, archive, keys, repo, hash)
+	if archiveErr != nil {
+		issues = append(issues, CheckIssue{Kind: IssueUnreadableRecord, Hash: hash, Detail: "archive: " + archiveErr.Error()})
+		return issues
+	}
+
+	if !commit.Archived {
+		switch {
+		case hotOK:
+			verify(hotContent, "hot")
+		case hot:
+			// unreadable hot copy already reported
+		case archiveOK && computeContentHash(archived) == commit.ContentHash:
+			issues = append(issues, CheckIssue{
+				Kind:       IssueMissingContent,
+				Hash:       hash,
+				Detail:     "hot content missing but a verified archive copy exists; commit will be marked archived",
+				Repairable: true,
+			})
+		default:
+			issues = append(issues, CheckIssue{
+				Kind:   IssueMissingContent,
+				Hash:   hash,
+				Detail: "content is missing from hot storage and the archive",
+			})
+		}
+		return issues
+	}
+
+	if !archiveOK {
+		if hotOK && computeContentHash(hotContent) == commit.ContentHash {
+			issues = append(issues, CheckIssue{
+				Kind:       IssueMissingArchiveEntry,
+				Hash:       hash,
+				Detail:     "archived commit missing from archive but a verified hot copy exists; commit will be marked hot",
+				Repairable: true,
+			})
+		} else {
+			issues = append(issues, CheckIssue{
+				Kind:   IssueMissingArchiveEntry,
+				Hash:   hash,
+				Detail: "archived commit content is missing from the archive",
+			})
+		}
+		return issues
+	}
+
+	verify(archived, "archived")
+	if hot {
+		issues = append(issues, CheckIssue{
+			Kind:       IssueStaleHotContent,
+			Hash:       hash,
+			Detail:     "archived commit still holds hot content",
+			Repairable: computeContentHash(archived) == commit.ContentHash,
+		})
+	}
+	return issues
+}
+
+// checkPurged reports content that outlived its purge. Both copies are
+// repairable: deleting them is exactly what the purge intended.
+func checkPurged(ctx context.Context, repo, hash string, hot bool, archive Archive, keys *dataKeyring) []CheckIssue {
+	var issues []CheckIssue
+	if hot {
+		issues = append(issues, CheckIssue{
+			Kind:       IssueStaleHotContent,
+			Hash:       hash,
+			Detail:     "purged commit still holds hot content",
+			Repairable: true,
+		})
+	}
+	_, archived, err := fetchArchived(ctx, archive, keys, repo, hash)
+	switch {
+	case err != nil:
+		issues = append(issues, CheckIssue{Kind: IssueUnreadableRecord, Hash: hash, Detail: "archive: " + err.Error()})
+	case archived:
+		issues = append(issues, CheckIssue{
+			Kind:       IssuePurgedArchiveEntry,
+			Hash:       hash,
+			Detail:     "purged commit content is still in the archive",
+			Repairable: true,
+		})
+	}
+	return issues
+}
+
+// fetchArchived reads and decodes hash from archive, treating NotFoundError
+// as absence.
+func fetchArchived(ctx context.Context, archive Archive, keys *dataKeyring, repo, hash string) (string, bool, error) {
+	if archive == nil {
+		return "", false, nil
+	}
+	data, err := fetchContent(ctx, archive, keys, repo, hash)
+	if err != nil {
+		var notFound *NotFoundError
+		if errors.As(err, &notFound) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return string(data), true, nil
+}
+
+// isPartial reports whether err is a PartialResultError.
+func isPartial(err error) bool {
+	var partial *PartialResultError
+	return errors.As(err, &partial)
+}
+
+// partialIssues converts the unreadable keys of a PartialResultError into issues.
+func partialIssues(err error) []CheckIssue {
+	var partial *PartialResultError
+	if !errors.As(err, &partial) {
+		return nil
+	}
+	issues := make([]CheckIssue, 0, len(partial.Keys))
+	for _, key := range partial.Keys {
+		issues = append(issues, CheckIssue{
+			Kind:   IssueUnreadableRecord,
+			Key:    key,
+			Detail: partial.Resource + " record could not be decoded",
+		})
+	}
+	return issues
+}
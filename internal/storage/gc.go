@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/onexay/kv-vs/internal/types"
+)
+
+// GCOptions controls a garbage collection run for one repository.
+type GCOptions struct {
+	Repo string
+	// GracePeriod protects unreachable commits younger than this, along with
+	// their ancestors, so in-flight writes and recent branch moves can be undone.
+	GracePeriod time.Duration
+	DryRun      bool
+}
+
+// GCReport describes what a garbage collection run removed, or would remove
+// when DryRun is set.
+type GCReport struct {
+	Repo        string    `json:"repo"`
+	StartedAt   time.Time `json:"startedAt"`
+	DryRun      bool      `json:"dryRun"`
+	GracePeriod string    `json:"gracePeriod"`
+	Reachable   int       `json:"reachable"`
+	Retained    int       `json:"retained"`
+	// Commits lists unreachable commits outside the grace period.
+	Commits []string `json:"commits"`
+	// OrphanedContent lists hot content stored without commit metadata.
+	OrphanedContent []string `json:"orphanedContent"`
+	// OrphanedIndex lists history index entries without commit metadata.
+	OrphanedIndex []string `json:"orphanedIndex"`
+	// ArchiveRemoved counts archive entries deleted for collected commits.
+	ArchiveRemoved int      `json:"archiveRemoved"`
+	Errors         []string `json:"errors,omitempty"`
+}
+
+// gcPlan is the set of records a sweep removes.
+type gcPlan struct {
+	Commits []types.Commit
+	Content []string
+	Index   []string
+}
+
+// gcSweeper deletes planned records. Implementations must refuse with a
+// ConflictError when a branch or tag has moved onto a planned commit since the
+// inventory was taken.
+type gcSweeper interface {
+	sweepGC(ctx context.Context, repo string, plan gcPlan) error
+}
+
+// planGC marks every commit reachable from a branch, a tag, a pin, or a commit
+// inside the grace period and returns the unmarked remainder, oldest first.
+func planGC(inv repoInventory, grace time.Duration, now time.Time) (plan gcPlan, reachable, retained int) {
+	marked := make(map[string]bool, len(inv.Commits))
+	mark := func(hash string) int {
+		n := 0
+		for hash != "" && !marked[hash] {
+			commit, ok := inv.Commits[hash]
+			if !ok {
+				break
+			}
+			marked[hash] = true
+			n++
+			hash = commit.Parent
+		}
+		return n
+	}
+
+	for _, branch := range inv.Branches {
+		reachable += mark(branch.Commit)
+	}
+	for _, tag := range inv.Tags {
+		reachable += mark(tag.Commit)
+	}
+	for _, pin := range inv.Pins {
+		reachable += mark(pin.Commit)
+	}
+	cutoff := now.Add(-grace)
+	for hash, commit := range inv.Commits {
+		if commit.Timestamp.After(cutoff) {
+			retained += mark(hash)
+		}
+	}
+
+	for hash, commit := range inv.Commits {
+		if !marked[hash] {
+			plan.Commits = append(plan.Commits, commit)
+		}
+	}
+	slices.SortFunc(plan.Commits, func(a, b types.Commit) int {
+		if c := a.Timestamp.Compare(b.Timestamp); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Hash, b.Hash)
+	})
+	for hash := range inv.Hot {
+		if _, ok := inv.Commits[hash]; !ok {
+			plan.Content = append(plan.Content, hash)
+		}
+	}
+	slices.Sort(plan.Content)
+	for hash := range inv.Indexed {
+		if _, ok := inv.Commits[hash]; !ok {
+			plan.Index = append(plan.Index, hash)
+		}
+	}
+	slices.Sort(plan.Index)
+	return plan, reachable, retained
+}
+
+// runGC plans a collection over inv and, unless opts.DryRun is set, sweeps it
+// through sweeper and removes the collected commits' archive entries. Archive
+// removal happens after the metadata is gone, so a failure there only leaks
+// archive space and never leaves a reachable commit without content.
+func runGC(ctx context.Context, inv repoInventory, archive Archive, sweeper gcSweeper, opts GCOptions, now time.Time) (GCReport, error) {
+	for _, issue := range inv.Issues {
+		if issue.Kind == IssueUnreadableRecord {
+			// Unreadable branches or commits would make reachability unknowable.
+			return GCReport{}, &ConflictError{Resource: "repo", Key: opts.Repo + " (unreadable records; run fsck)"}
+		}
+	}
+
+	plan, reachable, retained := planGC(inv, opts.GracePeriod, now)
+	report := GCReport{
+		Repo:            opts.Repo,
+		StartedAt:       now.UTC(),
+		DryRun:          opts.DryRun,
+		GracePeriod:     opts.GracePeriod.String(),
+		Reachable:       reachable,
+		Retained:        retained,
+		Commits:         make([]string, 0, len(plan.Commits)),
+		OrphanedContent: plan.Content,
+		OrphanedIndex:   plan.Index,
+	}
+	for _, commit := range plan.Commits {
+		report.Commits = append(report.Commits, commit.Hash)
+	}
+	if report.OrphanedContent == nil {
+		report.OrphanedContent = []string{}
+	}
+	if report.OrphanedIndex == nil {
+		report.OrphanedIndex = []string{}
+	}
+	if opts.DryRun || (len(plan.Commits) == 0 && len(plan.Content) == 0 && len(plan.Index) == 0) {
+		return report, nil
+	}
+
+	if err := sweeper.sweepGC(ctx, opts.Repo, plan); err != nil {
+		return GCReport{}, err
+	}
+
+	if archive != nil {
+		for _, commit := range plan.Commits {
+			err := archive.Remove(ctx, opts.Repo, commit.Hash)
+			var notFound *NotFoundError
+			switch {
+			case err == nil:
+				if commit.Archived {
+					report.ArchiveRemoved++
+				}
+			case errors.As(err, &notFound):
+			default:
+				report.Errors = append(report.Errors, "archive "+commit.Hash+": "+err.Error())
+			}
+		}
+	}
+	return report, nil
+}
+
+// gcPlanned returns the set of planned commit hashes for reference checks.
+func gcPlanned(plan gcPlan) map[string]bool {
+	planned := make(map[string]bool, len(plan.Commits))
+	for _, commit := range plan.Commits {
+		planned[commit.Hash] = true
+	}
+	return planned
+}
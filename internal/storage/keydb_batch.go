@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+
+	redis "github.com/redis/go-redis/v9"
+
+	"github.com/onexay/kv-vs/internal/types"
+)
+
+const (
+	defaultKeyDBReadBatch = 100
+	// keydbPipelineBatches bounds how many MGET batches share one round trip,
+	// so hydrating a long history does not buffer it all in one pipeline.
+	keydbPipelineBatches = 16
+)
+
+// getMany reads keys with MGET, readBatch keys per command, and pipelines
+// the batches. Values come back in key order; a missing key yields nil.
+func (s *keydbStore) getMany(ctx context.Context, keys []string) ([][]byte, error) {
+	values := make([][]byte, 0, len(keys))
+	window := s.readBatch * keydbPipelineBatches
+	for start := 0; start < len(keys); start += window {
+		chunk := keys[start:min(start+window, len(keys))]
+		var cmds []*redis.SliceCmd
+		if _, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i := 0; i < len(chunk); i += s.readBatch {
+				cmds = append(cmds, pipe.MGet(ctx, chunk[i:min(i+s.readBatch, len(chunk))]...))
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		for _, cmd := range cmds {
+			for _, value := range cmd.Val() {
+				data, ok := value.(string)
+				if !ok {
+					values = append(values, nil)
+					continue
+				}
+				values = append(values, []byte(data))
+			}
+		}
+	}
+	return values, nil
+}
+
+// getRecords reads and decodes the JSON records under keys. Missing or
+// undecodable records are left out of the result and their keys returned as
+// unreadable.
+func getRecords[T any](ctx context.Context, s *keydbStore, keys []string) ([]T, []string, error) {
+	values, err := s.getMany(ctx, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	records := make([]T, 0, len(values))
+	var unreadable []string
+	for i, data := range values {
+		var record T
+		if data == nil || json.Unmarshal(data, &record) != nil {
+			unreadable = append(unreadable, keys[i])
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, unreadable, nil
+}
+
+// getCommits reads the commit records of hashes in batches.
+func (s *keydbStore) getCommits(ctx context.Context, repo string, hashes []string) ([]types.Commit, []string, error) {
+	keys := make([]string, len(hashes))
+	for i, hash := range hashes {
+		keys[i] = s.keyspace.commitKey(repo, hash)
+	}
+	return getRecords[types.Commit](ctx, s, keys)
+}
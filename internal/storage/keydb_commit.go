@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+const (
+	defaultKeyDBTxRetries    = 10
+	defaultKeyDBTxBackoff    = 10 * time.Millisecond
+	defaultKeyDBTxMaxBackoff = 500 * time.Millisecond
+)
+
+// commitScript writes a commit with its content, branch head, branch set
+// entry, history index entry and author record in one step, provided the
+// branch head still holds the record the commit was computed against.
+//
+// KEYS: branch, commit, content, branch set, repo commits, author.
+// ARGV: expected branch record ("" when the branch does not exist), commit
+// record, stored content, new branch record, branch name, history score,
+// commit hash, author name.
+//
+// It returns "ok", or "stale", "author" or "exists" without writing.
+var commitScript = redis.NewScript(`
+local head = redis.call('GET', KEYS[1]) or ''
+if head ~= ARGV[1] then
+  return 'stale'
+end
+local author = redis.call('GET', KEYS[6])
+if author and author ~= ARGV[8] then
+  return 'author'
+end
+if redis.call('EXISTS', KEYS[2]) == 1 then
+  return 'exists'
+end
+redis.call('SET', KEYS[2], ARGV[2])
+redis.call('SET', KEYS[3], ARGV[3])
+redis.call('SET', KEYS[1], ARGV[4])
+redis.call('SADD', KEYS[4], ARGV[5])
+redis.call('ZADD', KEYS[5], ARGV[6], ARGV[7])
+redis.call('SET', KEYS[6], ARGV[8])
+return 'ok'
+`)
+
+// errTxContention marks an optimistic write that lost a race and may be
+// retried.
+var errTxContention = errors.New("concurrent writes kept conflicting")
+
+// retryTx runs fn until it succeeds, fails with an error other than
+// errTxContention or redis.TxFailedErr, or the retry budget is spent.
+// Retries wait with jittered exponential backoff. A spent budget returns an
+// UnavailableError carrying a Retry-After hint.
+func (s *keydbStore) retryTx(ctx context.Context, op string, fn func() error) error {
+	backoff := s.txBackoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if !errors.Is(err, errTxContention) && !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+		if attempt >= s.txRetries {
+			return &UnavailableError{Op: op, Err: errTxContention, RetryAfter: s.txMaxBackoff}
+		}
+		// Sleep between half and all of the current backoff so contending
+		// writers spread out.
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if err := sleepContext(ctx, wait); err != nil {
+			return err
+		}
+		backoff = min(backoff*2, s.txMaxBackoff)
+	}
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+// KeyDBMode selects how the store reaches KeyDB.
+type KeyDBMode string
+
+const (
+	// KeyDBModeStandalone talks to a single server at Addr.
+	KeyDBModeStandalone KeyDBMode = "standalone"
+	// KeyDBModeCluster talks to a Redis Cluster protocol deployment seeded
+	// from Addrs. Keys are hash-tagged by repository.
+	KeyDBModeCluster KeyDBMode = "cluster"
+	// KeyDBModeSentinel asks the sentinels in Addrs for the current master
+	// of MasterName and follows failovers.
+	KeyDBModeSentinel KeyDBMode = "sentinel"
+)
+
+// KeyDBTLSConfig enables TLS to KeyDB. CAFile replaces the system roots for
+// verifying the server; CertFile and KeyFile present a client certificate.
+type KeyDBTLSConfig struct {
+	Enabled            bool
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+// newKeyDBClient builds the client for cfg's mode.
+func newKeyDBClient(cfg Config) (redis.UniversalClient, error) {
+	addrs := cfg.Addrs
+	if len(addrs) == 0 {
+		addr := cfg.Addr
+		if addr == "" {
+			addr = "localhost:6379"
+		}
+		addrs = []string{addr}
+	}
+	tlsConfig, err := cfg.TLS.config()
+	if err != nil {
+		return nil, err
+	}
+	opts := &redis.UniversalOptions{
+		Addrs:            addrs,
+		Username:         cfg.Username,
+		Password:         cfg.Password,
+		DB:               cfg.Database,
+		MasterName:       cfg.MasterName,
+		SentinelUsername: cfg.SentinelUsername,
+		SentinelPassword: cfg.SentinelPassword,
+		TLSConfig:        tlsConfig,
+		PoolSize:         cfg.PoolSize,
+		MinIdleConns:     cfg.MinIdleConns,
+		PoolTimeout:      cfg.PoolTimeout,
+		ConnMaxIdleTime:  cfg.ConnMaxIdleTime,
+		DialTimeout:      cfg.DialTimeout,
+		ReadTimeout:      cfg.ReadTimeout,
+		WriteTimeout:     cfg.WriteTimeout,
+	}
+
+	switch cfg.Mode {
+	case "", KeyDBModeStandalone:
+		return redis.NewClient(opts.Simple()), nil
+	case KeyDBModeCluster:
+		if cfg.Database != 0 {
+			return nil, fmt.Errorf("keydb cluster mode only supports database 0, got %d", cfg.Database)
+		}
+		return redis.NewClusterClient(opts.Cluster()), nil
+	case KeyDBModeSentinel:
+		if cfg.MasterName == "" {
+			return nil, fmt.Errorf("keydb sentinel mode requires a master name")
+		}
+		return redis.NewFailoverClient(opts.Failover()), nil
+	default:
+		return nil, fmt.Errorf("unknown keydb mode %q", cfg.Mode)
+	}
+}
+
+// config returns the TLS settings, or nil when TLS is disabled.
+func (c KeyDBTLSConfig) config() (*tls.Config, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read keydb ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("keydb ca file %s holds no PEM certificates", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load keydb client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+const (
+	repoCommitsKeyPrefix = "repo:commits"
+	// keyNameReserved lists the bytes escapeKeyName encodes besides
+	// whitespace and control characters: the key separator, the hash tag
+	// braces, SCAN MATCH wildcards and the escape character itself.
+	keyNameReserved = "%:{}*?[]\\"
+)
+
+// keyspace names the keys a KeyDB store writes:
+// "<prefix>:<kind>:<repo>[:<name>]". Repository, branch, tag and author
+// names are escaped with escapeKeyName, so a name containing ':' cannot
+// collide with another repository's keys. In cluster mode the repository is
+// wrapped in a hash tag, as in "commit:{analytics}:<hash>", so every key of
+// a repository maps to the same slot and the commit script, WATCH
+// transactions and batched reads never span slots.
+type keyspace struct {
+	// prefix is the namespace with its trailing separator, or empty.
+	prefix  string
+	hashTag bool
+	// raw leaves names unescaped, as keys were written before names were
+	// escaped. Only the key migration reads this layout.
+	raw bool
+}
+
+// newKeyspace returns the keyspace for namespace prefix, which may not
+// contain hash tag braces, SCAN MATCH wildcards or whitespace.
+func newKeyspace(prefix string, hashTag bool) (keyspace, error) {
+	prefix = strings.TrimSuffix(prefix, ":")
+	if strings.ContainsAny(prefix, "{}*?[]\\") || strings.IndexFunc(prefix, unicode.IsSpace) >= 0 {
+		return keyspace{}, fmt.Errorf("invalid keydb key prefix %q", prefix)
+	}
+	if prefix != "" {
+		prefix += ":"
+	}
+	return keyspace{prefix: prefix, hashTag: hashTag}, nil
+}
+
+// escapeKeyName percent-encodes the reserved bytes of a name used in a key.
+func escapeKeyName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c <= ' ' || c == 0x7f || strings.IndexByte(keyNameReserved, c) >= 0 {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// unescapeKeyName reverses escapeKeyName.
+func unescapeKeyName(name string) (string, error) {
+	if !strings.Contains(name, "%") {
+		return name, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '%' {
+			b.WriteByte(name[i])
+			continue
+		}
+		if i+2 >= len(name) {
+			return "", fmt.Errorf("truncated escape in key name %q", name)
+		}
+		c, err := strconv.ParseUint(name[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in key name %q", name)
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+func (k keyspace) name(name string) string {
+	if k.raw {
+		return name
+	}
+	return escapeKeyName(name)
+}
+
+func (k keyspace) repo(repo string) string {
+	if k.hashTag {
+		return "{" + k.name(repo) + "}"
+	}
+	return k.name(repo)
+}
+
+func (k keyspace) key(kind, repo string, names ...string) string {
+	var b strings.Builder
+	b.WriteString(k.prefix)
+	b.WriteString(kind)
+	b.WriteByte(':')
+	b.WriteString(k.repo(repo))
+	for _, name := range names {
+		b.WriteByte(':')
+		b.WriteString(k.name(name))
+	}
+	return b.String()
+}
+
+// repoCommitsPrefix is the common prefix of the history index keys.
+func (k keyspace) repoCommitsPrefix() string {
+	return k.prefix + repoCommitsKeyPrefix + ":"
+}
+
+// parseRepo returns the repository named by the repository segment of a
+// key.
+func (k keyspace) parseRepo(segment string) (string, error) {
+	if k.hashTag {
+		segment = strings.TrimSuffix(strings.TrimPrefix(segment, "{"), "}")
+	}
+	if k.raw {
+		return segment, nil
+	}
+	return unescapeKeyName(segment)
+}
+
+func (k keyspace) commitKey(repo, hash string) string {
+	return k.key("commit", repo, hash)
+}
+
+func (k keyspace) contentKey(repo, hash string) string {
+	return k.key("content", repo, hash)
+}
+
+func (k keyspace) branchKey(repo, branch string) string {
+	return k.key("branch", repo, branch)
+}
+
+func (k keyspace) repoCommitsKey(repo string) string {
+	return k.key(repoCommitsKeyPrefix, repo)
+}
+
+func (k keyspace) policyHistoryKey(repo string) string {
+	return k.key("policyhistory", repo)
+}
+
+func (k keyspace) branchSetKey(repo string) string {
+	return k.key("branchset", repo)
+}
+
+func (k keyspace) tagKey(repo, name string) string {
+	return k.key("tag", repo, name)
+}
+
+func (k keyspace) tagSetKey(repo string) string {
+	return k.key("tagset", repo)
+}
+
+func (k keyspace) authorKey(repo, authorID string) string {
+	return k.key("author", repo, authorID)
+}
+
+func (k keyspace) pinsKey(repo string) string {
+	return k.key("pins", repo)
+}
+
+func (k keyspace) policyKey(repo string) string {
+	return k.key("policy", repo)
+}
+
+func (k keyspace) dataKeysKey(repo string) string {
+	return k.key("datakeys", repo)
+}
+
+// scanKeys returns the keys matching pattern. A cluster client scans every
+// master.
+func scanKeys(ctx context.Context, client redis.UniversalClient, pattern string) ([]string, error) {
+	cluster, ok := client.(*redis.ClusterClient)
+	if !ok {
+		return scanNode(ctx, client, pattern)
+	}
+	var (
+		mu   sync.Mutex
+		keys []string
+	)
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		found, err := scanNode(ctx, node, pattern)
+		mu.Lock()
+		keys = append(keys, found...)
+		mu.Unlock()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// scanHashes returns the hash suffixes of keys starting with prefix. Keys with
+// further separators belong to other repositories sharing the prefix and are skipped.
+func scanHashes(ctx context.Context, client redis.UniversalClient, prefix string) ([]string, error) {
+	keys, err := scanKeys(ctx, client, escapeGlob(prefix)+"*")
+	if err != nil {
+		return nil, err
+	}
+	var hashes []string
+	for _, key := range keys {
+		hash := strings.TrimPrefix(key, prefix)
+		if hash == "" || strings.Contains(hash, ":") {
+			continue
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+func scanNode(ctx context.Context, client redis.Cmdable, pattern string) ([]string, error) {
+	var keys []string
+	iter := client.Scan(ctx, 0, pattern, 500).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// escapeGlob quotes the characters SCAN MATCH treats as wildcards.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+// keyMigrationKey records the repositories found by migrateKeyLayout, so an
+// interrupted run moves the same ones.
+const keyMigrationKey = "meta:keymigration"
+
+// repoKeyKinds are the key kinds with one key per repository.
+var repoKeyKinds = []string{repoCommitsKeyPrefix, "policy", "policyhistory", "branchset", "tagset", "pins", "datakeys"}
+
+type keyMigrationState struct {
+	Repos []string `json:"repos"`
+	// Done is set by databases migrated before schema versions were
+	// recorded.
+	Done bool `json:"done"`
+}
+
+type keyMigration struct {
+	client redis.UniversalClient
+	from   keyspace
+	to     keyspace
+	dryRun bool
+	report *SchemaStepReport
+}
+
+// migrateKeyLayout is schema migration 1. It moves every repository's keys
+// from the original layout, which had no namespace prefix and did not escape
+// names, to the layout of keys. Keys whose name does not change, such as
+// those of a repository without reserved characters when no prefix is
+// configured, stay in place.
+func migrateKeyLayout(ctx context.Context, client redis.UniversalClient, keys keyspace, dryRun bool, report *SchemaStepReport) error {
+	m := &keyMigration{client: client, from: keyspace{hashTag: keys.hashTag, raw: true}, to: keys, dryRun: dryRun, report: report}
+	stateKey := keys.prefix + keyMigrationKey
+
+	var state keyMigrationState
+	data, err := client.Get(ctx, stateKey).Bytes()
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &state); err != nil {
+			return fmt.Errorf("read key migration state: %w", err)
+		}
+	case !errors.Is(err, redis.Nil):
+		return err
+	}
+	if state.Done {
+		if !dryRun {
+			return client.Del(ctx, stateKey).Err()
+		}
+		return nil
+	}
+	if state.Repos == nil {
+		if state.Repos, err = m.repos(ctx); err != nil {
+			return err
+		}
+		if !dryRun && len(state.Repos) > 0 {
+			if err := m.saveState(ctx, stateKey, state); err != nil {
+				return err
+			}
+		}
+	}
+	report.Repos = state.Repos
+
+	for _, repo := range state.Repos {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		m.moveRepo(ctx, repo, state.Repos)
+	}
+	if dryRun || len(report.Errors) > 0 {
+		return nil
+	}
+	// The schema version records completion from here on.
+	return client.Del(ctx, stateKey).Err()
+}
+
+func (m *keyMigration) saveState(ctx context.Context, key string, state keyMigrationState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return m.client.Set(ctx, key, data, 0).Err()
+}
+
+// repos lists the repositories that own a per-repository key in the
+// original layout.
+func (m *keyMigration) repos(ctx context.Context) ([]string, error) {
+	var repos []string
+	for _, kind := range repoKeyKinds {
+		prefix := kind + ":"
+		keys, err := scanKeys(ctx, m.client, escapeGlob(prefix)+"*")
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if repo, _ := m.from.parseRepo(strings.TrimPrefix(key, prefix)); repo != "" {
+				repos = append(repos, repo)
+			}
+		}
+	}
+	slices.Sort(repos)
+	return slices.Compact(repos), nil
+}
+
+// moveRepo moves the keys of repo. repos lists every known repository, so
+// keys of a repository whose name extends repo's with ':' are left to it.
+func (m *keyMigration) moveRepo(ctx context.Context, repo string, repos []string) {
+	moves := make(map[string]string)
+	for _, kind := range repoKeyKinds {
+		moves[m.from.key(kind, repo)] = m.to.key(kind, repo)
+	}
+
+	// Hashes never contain ':', so a longer suffix belongs to another
+	// repository.
+	for _, kind := range []string{"commit", "content"} {
+		prefix := m.from.key(kind, repo, "")
+		hashes, err := scanHashes(ctx, m.client, prefix)
+		if err != nil {
+			m.fail(repo, kind, err)
+			continue
+		}
+		for _, hash := range hashes {
+			moves[prefix+hash] = m.to.key(kind, repo, hash)
+		}
+	}
+
+	// Branch and tag names come from their sets, read in both layouts in
+	// case an earlier run already moved the set.
+	for _, ref := range []struct{ kind, set string }{{"branch", "branchset"}, {"tag", "tagset"}} {
+		var names []string
+		for _, set := range []string{m.from.key(ref.set, repo), m.to.key(ref.set, repo)} {
+			members, err := m.client.SMembers(ctx, set).Result()
+			if err != nil {
+				m.fail(repo, ref.set, err)
+			}
+			names = append(names, members...)
+		}
+		for _, name := range names {
+			moves[m.from.key(ref.kind, repo, name)] = m.to.key(ref.kind, repo, name)
+		}
+	}
+
+	prefix := m.from.key("author", repo, "")
+	authors, err := scanKeys(ctx, m.client, escapeGlob(prefix)+"*")
+	if err != nil {
+		m.fail(repo, "author", err)
+	}
+	for _, key := range authors {
+		if m.ownedByLonger(key, "author", repo, repos) {
+			continue
+		}
+		moves[key] = m.to.key("author", repo, strings.TrimPrefix(key, prefix))
+	}
+
+	from := make([]string, 0, len(moves))
+	for key := range moves {
+		from = append(from, key)
+	}
+	slices.Sort(from)
+	for _, key := range from {
+		if err := m.move(ctx, key, moves[key]); err != nil {
+			m.report.Errors = append(m.report.Errors, fmt.Sprintf("%s: %v", key, err))
+		}
+	}
+}
+
+// ownedByLonger reports whether key belongs to a repository whose name
+// starts with repo followed by ':'.
+func (m *keyMigration) ownedByLonger(key, kind, repo string, repos []string) bool {
+	for _, other := range repos {
+		if other != repo && strings.HasPrefix(other, repo+":") && strings.HasPrefix(key, m.from.key(kind, other, "")) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *keyMigration) fail(repo, kind string, err error) {
+	m.report.Errors = append(m.report.Errors, fmt.Sprintf("%s %s: %v", repo, kind, err))
+}
+
+// move copies from to to, replacing to, then deletes from. Copying rather
+// than renaming works across cluster slots.
+func (m *keyMigration) move(ctx context.Context, from, to string) error {
+	kind, err := m.client.Type(ctx, from).Result()
+	if err != nil {
+		return err
+	}
+	if kind == "none" {
+		return nil
+	}
+	if from == to {
+		m.report.Unchanged++
+		return nil
+	}
+	if m.dryRun {
+		m.report.Changed++
+		return nil
+	}
+
+	var write func(pipe redis.Pipeliner)
+	switch kind {
+	case "string":
+		value, err := m.client.Get(ctx, from).Bytes()
+		if err != nil {
+			return err
+		}
+		write = func(pipe redis.Pipeliner) { pipe.Set(ctx, to, value, 0) }
+	case "list":
+		values, err := m.client.LRange(ctx, from, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		write = func(pipe redis.Pipeliner) { pipe.RPush(ctx, to, toAny(values)...) }
+	case "set":
+		members, err := m.client.SMembers(ctx, from).Result()
+		if err != nil {
+			return err
+		}
+		write = func(pipe redis.Pipeliner) { pipe.SAdd(ctx, to, toAny(members)...) }
+	case "zset":
+		members, err := m.client.ZRangeWithScores(ctx, from, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		write = func(pipe redis.Pipeliner) { pipe.ZAdd(ctx, to, members...) }
+	case "hash":
+		fields, err := m.client.HGetAll(ctx, from).Result()
+		if err != nil {
+			return err
+		}
+		write = func(pipe redis.Pipeliner) { pipe.HSet(ctx, to, fields) }
+	default:
+		return fmt.Errorf("unsupported key type %s", kind)
+	}
+	if _, err := m.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, to)
+		write(pipe)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := m.client.Del(ctx, from).Err(); err != nil {
+		return err
+	}
+	m.report.Changed++
+	return nil
+}
+
+func toAny(values []string) []any {
+	out := make([]any, len(values))
+	for i, value := range values {
+		out[i] = value
+	}
+	return out
+}
@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	redis "github.com/redis/go-redis/v9"
+)
+
+func TestKeyspaceEncoding(t *testing.T) {
+	keys, err := newKeyspace("tenant-a:", false)
+	if err != nil {
+		t.Fatalf("newKeyspace: %v", err)
+	}
+	if got := keys.branchKey("a:b", "main"); got != "tenant-a:branch:a%3Ab:main" {
+		t.Fatalf("branchKey = %q", got)
+	}
+	// Without escaping, repository "a" with branch "b:main" and repository
+	// "a:b" with branch "main" shared a key.
+	if keys.branchKey("a", "b:main") == keys.branchKey("a:b", "main") {
+		t.Fatalf("branch keys of different repositories collide")
+	}
+	for _, name := range []string{"plain", "a:b", "100%", "{tag}", "glob*?[x]\\", "white space\n"} {
+		escaped := escapeKeyName(name)
+		if back, err := unescapeKeyName(escaped); err != nil || back != name {
+			t.Fatalf("round trip of %q via %q = %q, %v", name, escaped, back, err)
+		}
+		if repo, err := keys.parseRepo(keys.repo(name)); err != nil || repo != name {
+			t.Fatalf("parseRepo of %q = %q, %v", name, repo, err)
+		}
+	}
+	cluster, _ := newKeyspace("", true)
+	if got := cluster.commitKey("x{y}", "c1"); got != "commit:{x%7By%7D}:c1" {
+		t.Fatalf("cluster commitKey = %q", got)
+	}
+	for _, prefix := range []string{"a{b}", "a*", "a b"} {
+		if _, err := newKeyspace(prefix, false); err == nil {
+			t.Fatalf("expected prefix %q to be rejected", prefix)
+		}
+	}
+}
+
+func TestKeyDBMigrateKeyLayout(t *testing.T) {
+	mini, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("start miniredis: %v", err)
+	}
+	t.Cleanup(mini.Close)
+	ctx := context.Background()
+
+	// Write two repositories whose names overlap in the original layout.
+	legacy := keyspace{raw: true}
+	for _, repo := range []string{"team", "team:infra"} {
+		for _, hash := range []string{"c1", "c2"} {
+			mini.Set(legacy.commitKey(repo, hash), `{"hash":"`+hash+`","repo":"`+repo+`"}`)
+			mini.Set(legacy.contentKey(repo, hash), repo+" "+hash)
+			mini.ZAdd(legacy.repoCommitsKey(repo), 1, hash)
+		}
+		mini.Set(legacy.branchKey(repo, "main"), `{"name":"main","commit":"c2"}`)
+		mini.SAdd(legacy.branchSetKey(repo), "main")
+		mini.Set(legacy.tagKey(repo, "v:1"), `{"name":"v:1","commit":"c1"}`)
+		mini.SAdd(legacy.tagSetKey(repo), "v:1")
+		mini.Set(legacy.authorKey(repo, "alice:1"), "Alice")
+		mini.HSet(legacy.pinsKey(repo), "c1", `{}`)
+		mini.Push(legacy.policyHistoryKey(repo), `{"version":1}`)
+		mini.Set(legacy.policyKey(repo), `{"version":1}`)
+	}
+	before := len(mini.Keys())
+
+	cfg := Config{Addr: mini.Addr(), KeyPrefix: "kv"}
+	report, err := MigrateKeyDBSchema(ctx, cfg, SchemaOptions{DryRun: true})
+	if err != nil || len(report.Migrations) != 1 || report.Migrations[0].Changed != before || report.Version != 0 {
+		t.Fatalf("dry run = %+v, %v; want %d moves", report, err, before)
+	}
+	if len(mini.Keys()) != before {
+		t.Fatalf("dry run changed keys")
+	}
+
+	report, err = MigrateKeyDBSchema(ctx, cfg, SchemaOptions{})
+	if err != nil || len(report.Migrations) != 1 || report.Version != 1 {
+		t.Fatalf("migration = %+v, %v", report, err)
+	}
+	step := report.Migrations[0]
+	if step.Changed != before || len(step.Errors) > 0 || !slices.Equal(step.Repos, []string{"team", "team:infra"}) {
+		t.Fatalf("unexpected migration step %+v; want %d moves", step, before)
+	}
+	if got := len(mini.Keys()); got != before+1 {
+		t.Fatalf("%d keys after migration, want %d plus the schema version", got, before)
+	}
+	if report, err := MigrateKeyDBSchema(ctx, cfg, SchemaOptions{}); err != nil || report.From != 1 || len(report.Migrations) != 0 {
+		t.Fatalf("second migration = %+v, %v", report, err)
+	}
+
+	store, err := NewKeyDBStore(cfg, Options{})
+	if err != nil {
+		t.Fatalf("create store: %v", err)
+	}
+	repos, err := store.ListRepos(ctx)
+	if err != nil || !slices.Equal(repos, []string{"team", "team:infra"}) {
+		t.Fatalf("ListRepos = %v, %v", repos, err)
+	}
+	for _, repo := range repos {
+		commits, err := store.ListCommits(ctx, ListCommitsOptions{Repo: repo})
+		if err != nil || len(commits) != 2 || commits[0].Repo != repo {
+			t.Fatalf("ListCommits(%s) = %+v, %v", repo, commits, err)
+		}
+		tags, err := store.ListTags(ctx, repo)
+		if err != nil || len(tags) != 1 || tags[0].Name != "v:1" {
+			t.Fatalf("ListTags(%s) = %+v, %v", repo, tags, err)
+		}
+		if author, _ := mini.Get("kv:author:" + escapeKeyName(repo) + ":alice%3A1"); author != "Alice" {
+			t.Fatalf("author of %s not migrated", repo)
+		}
+	}
+	if _, content, err := store.GetCommit(ctx, "team:infra", "c2"); err != nil || content != "team:infra c2" {
+		t.Fatalf("GetCommit = %q, %v", content, err)
+	}
+}
+
+func TestKeyDBSchemaMigrations(t *testing.T) {
+	mini, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("start miniredis: %v", err)
+	}
+	t.Cleanup(mini.Close)
+	ctx := context.Background()
+	client, err := newKeyDBClient(Config{Addr: mini.Addr()})
+	if err != nil {
+		t.Fatalf("newKeyDBClient: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	keys, _ := newKeyspace("kv", false)
+
+	registered := keydbMigrations
+	t.Cleanup(func() { keydbMigrations = registered })
+	runs := map[int]int{}
+	failSecond := true
+	keydbMigrations = []keydbMigration{
+		{version: 1, name: "first", apply: func(ctx context.Context, client redis.UniversalClient, keys keyspace, dryRun bool, report *SchemaStepReport) error {
+			if !dryRun {
+				runs[1]++
+			}
+			report.Changed = 3
+			return nil
+		}},
+		{version: 2, name: "second", apply: func(ctx context.Context, client redis.UniversalClient, keys keyspace, dryRun bool, report *SchemaStepReport) error {
+			if dryRun {
+				return nil
+			}
+			runs[2]++
+			if failSecond {
+				report.Errors = append(report.Errors, "key: boom")
+			}
+			return nil
+		}},
+	}
+
+	if _, err := NewKeyDBStore(Config{Addr: mini.Addr(), KeyPrefix: "kv", Migrate: KeyDBMigrateManual}, Options{}); err == nil {
+		t.Fatalf("expected manual mode to refuse a database with pending migrations")
+	}
+	report, err := migrateSchema(ctx, client, keys, SchemaOptions{DryRun: true})
+	if err != nil || len(report.Migrations) != 2 || report.Migrations[0].Changed != 3 || len(runs) != 0 {
+		t.Fatalf("dry run = %+v, %v (runs %v)", report, err, runs)
+	}
+
+	// A failed migration keeps the versions before it.
+	report, err = migrateSchema(ctx, client, keys, SchemaOptions{})
+	if err == nil || report.Version != 1 || runs[1] != 1 || runs[2] != 1 {
+		t.Fatalf("failing run = %+v, %v (runs %v)", report, err, runs)
+	}
+	if mini.Exists("kv:" + schemaLockKey) {
+		t.Fatalf("lock not released after a failed run")
+	}
+	failSecond = false
+	report, err = migrateSchema(ctx, client, keys, SchemaOptions{})
+	if err != nil || report.From != 1 || report.Version != 2 || runs[1] != 1 || runs[2] != 2 {
+		t.Fatalf("resumed run = %+v, %v (runs %v)", report, err, runs)
+	}
+	if _, err := NewKeyDBStore(Config{Addr: mini.Addr(), KeyPrefix: "kv", Migrate: KeyDBMigrateManual}, Options{}); err != nil {
+		t.Fatalf("manual mode with a current schema: %v", err)
+	}
+
+	// A database migrated by a newer build is refused.
+	mini.Set("kv:"+schemaVersionKey, "3")
+	if _, err := migrateSchema(ctx, client, keys, SchemaOptions{}); !errors.Is(err, errSchemaNewer) {
+		t.Fatalf("expected errSchemaNewer, got %v", err)
+	}
+}
+
+func TestKeyDBSchemaLock(t *testing.T) {
+	mini, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("start miniredis: %v", err)
+	}
+	t.Cleanup(mini.Close)
+	ctx := context.Background()
+	client, err := newKeyDBClient(Config{Addr: mini.Addr()})
+	if err != nil {
+		t.Fatalf("newKeyDBClient: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	keys, _ := newKeyspace("", false)
+
+	// Another replica holds the lock.
+	mini.Set(schemaLockKey, "other")
+	_, err = migrateSchema(ctx, client, keys, SchemaOptions{LockWait: 10 * time.Millisecond})
+	var unavailable *UnavailableError
+	if !errors.As(err, &unavailable) || !errors.Is(err, errSchemaLocked) {
+		t.Fatalf("expected the held lock to fail the run, got %v", err)
+	}
+	if got, _ := mini.Get(schemaLockKey); got != "other" {
+		t.Fatalf("lock of another process was touched: %q", got)
+	}
+
+	// Once the holder finishes, a waiting replica finds nothing left to do.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		mini.Set(schemaVersionKey, strconv.Itoa(latestSchemaVersion()))
+		mini.Del(schemaLockKey)
+	}()
+	report, err := migrateSchema(ctx, client, keys, SchemaOptions{LockWait: 5 * time.Second})
+	if err != nil || report.From != latestSchemaVersion() || len(report.Migrations) != 0 {
+		t.Fatalf("waiting run = %+v, %v", report, err)
+	}
+	if mini.Exists(schemaLockKey) {
+		t.Fatalf("lock not released")
+	}
+}
@@ -0,0 +1,281 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+const (
+	// schemaVersionKey holds the version of the last migration applied.
+	schemaVersionKey = "meta:schema"
+	// schemaLockKey is held by the process running migrations.
+	schemaLockKey = "meta:schema-lock"
+
+	schemaLockTTL         = 30 * time.Second
+	defaultSchemaLockWait = 2 * time.Minute
+)
+
+// KeyDBMigrateMode selects what NewKeyDBStore does with pending schema
+// migrations.
+type KeyDBMigrateMode string
+
+const (
+	// KeyDBMigrateAuto applies pending migrations before the store opens.
+	KeyDBMigrateAuto KeyDBMigrateMode = "auto"
+	// KeyDBMigrateManual refuses to open a database with pending migrations;
+	// they are applied with kvvs-admin keydb-migrate.
+	KeyDBMigrateManual KeyDBMigrateMode = "manual"
+)
+
+// keydbMigration is one step of the KeyDB schema.
+type keydbMigration struct {
+	version     int
+	name        string
+	description string
+	// apply runs the migration, or only counts what it would change when
+	// dryRun is set. It must be idempotent: a run interrupted before the
+	// version is recorded is repeated from the start.
+	apply func(ctx context.Context, client redis.UniversalClient, keys keyspace, dryRun bool, report *SchemaStepReport) error
+}
+
+// keydbMigrations lists the schema migrations in version order. Versions
+// are never reused or reordered.
+var keydbMigrations = []keydbMigration{
+	{
+		version:     1,
+		name:        "namespaced-keys",
+		description: "move keys to the prefixed layout with escaped names",
+		apply:       migrateKeyLayout,
+	},
+}
+
+var (
+	errSchemaLocked = errors.New("another process is migrating the keydb schema")
+	errSchemaNewer  = errors.New("keydb schema is newer than this build supports")
+)
+
+// SchemaStepReport describes one schema migration of a run.
+type SchemaStepReport struct {
+	Version     int      `json:"version"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Changed     int      `json:"changed"`
+	Unchanged   int      `json:"unchanged"`
+	Repos       []string `json:"repos,omitempty"`
+	Duration    string   `json:"duration,omitempty"`
+	Errors      []string `json:"errors,omitempty"`
+}
+
+// SchemaReport describes a schema migration run. In a dry run Migrations
+// lists what the pending migrations would change.
+type SchemaReport struct {
+	StartedAt time.Time `json:"startedAt"`
+	DryRun    bool      `json:"dryRun"`
+	Prefix    string    `json:"prefix,omitempty"`
+	// From is the version found, Version the version after the run and
+	// Target the latest version this build knows.
+	From       int                `json:"from"`
+	Version    int                `json:"version"`
+	Target     int                `json:"target"`
+	Migrations []SchemaStepReport `json:"migrations"`
+}
+
+// SchemaOptions controls MigrateKeyDBSchema.
+type SchemaOptions struct {
+	DryRun bool
+	// LockWait bounds the wait for a migration run by another process; zero
+	// means two minutes.
+	LockWait time.Duration
+}
+
+// MigrateKeyDBSchema applies the pending schema migrations to the database
+// cfg describes.
+func MigrateKeyDBSchema(ctx context.Context, cfg Config, opts SchemaOptions) (SchemaReport, error) {
+	keys, err := newKeyspace(cfg.KeyPrefix, cfg.Mode == KeyDBModeCluster)
+	if err != nil {
+		return SchemaReport{}, err
+	}
+	client, err := newKeyDBClient(cfg)
+	if err != nil {
+		return SchemaReport{}, err
+	}
+	defer client.Close()
+	return migrateSchema(ctx, client, keys, opts)
+}
+
+// migrateSchema applies pending migrations in order under the schema lock,
+// recording the version after each one, so a failed or interrupted run
+// resumes with the migration that did not finish.
+func migrateSchema(ctx context.Context, client redis.UniversalClient, keys keyspace, opts SchemaOptions) (SchemaReport, error) {
+	report := SchemaReport{
+		StartedAt:  time.Now().UTC(),
+		DryRun:     opts.DryRun,
+		Prefix:     strings.TrimSuffix(keys.prefix, ":"),
+		Target:     latestSchemaVersion(),
+		Migrations: []SchemaStepReport{},
+	}
+	version, err := schemaVersion(ctx, client, keys)
+	if err != nil {
+		return report, err
+	}
+	report.From, report.Version = version, version
+	if version == report.Target {
+		return report, nil
+	}
+
+	if !opts.DryRun {
+		lockCtx, release, err := lockSchema(ctx, client, keys.prefix+schemaLockKey, opts.LockWait)
+		if err != nil {
+			return report, err
+		}
+		defer release()
+		ctx = lockCtx
+		// Another process may have migrated while this one waited.
+		if version, err = schemaVersion(ctx, client, keys); err != nil {
+			return report, err
+		}
+		report.From, report.Version = version, version
+	}
+
+	for _, m := range keydbMigrations {
+		if m.version <= version {
+			continue
+		}
+		started := time.Now()
+		step := SchemaStepReport{Version: m.version, Name: m.name, Description: m.description}
+		err := m.apply(ctx, client, keys, opts.DryRun, &step)
+		step.Duration = time.Since(started).String()
+		report.Migrations = append(report.Migrations, step)
+		if err == nil && len(step.Errors) > 0 {
+			err = fmt.Errorf("%d keys failed", len(step.Errors))
+		}
+		if err != nil {
+			return report, fmt.Errorf("keydb migration %d (%s): %w", m.version, m.name, err)
+		}
+		if opts.DryRun {
+			continue
+		}
+		if err := client.Set(ctx, keys.prefix+schemaVersionKey, m.version, 0).Err(); err != nil {
+			return report, &UnavailableError{Op: "record schema version", Err: err}
+		}
+		report.Version = m.version
+	}
+	return report, nil
+}
+
+// checkSchema fails unless the database is at the latest schema version.
+func checkSchema(ctx context.Context, client redis.UniversalClient, keys keyspace) error {
+	version, err := schemaVersion(ctx, client, keys)
+	if err != nil {
+		return err
+	}
+	if latest := latestSchemaVersion(); version < latest {
+		return fmt.Errorf("keydb schema is at version %d, this build needs %d: run kvvs-admin keydb-migrate --apply", version, latest)
+	}
+	return nil
+}
+
+// schemaVersion reads the recorded schema version; a database without one
+// is at version 0. A version newer than this build knows is an error.
+func schemaVersion(ctx context.Context, client redis.UniversalClient, keys keyspace) (int, error) {
+	version, err := client.Get(ctx, keys.prefix+schemaVersionKey).Int()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, &UnavailableError{Op: "read schema version", Err: err}
+	}
+	if latest := latestSchemaVersion(); version > latest {
+		return version, fmt.Errorf("%w: version %d, latest known %d", errSchemaNewer, version, latest)
+	}
+	return version, nil
+}
+
+func latestSchemaVersion() int {
+	if len(keydbMigrations) == 0 {
+		return 0
+	}
+	return keydbMigrations[len(keydbMigrations)-1].version
+}
+
+// unlockScript deletes the lock if it still holds the caller's token.
+var unlockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// extendScript renews the lock if it still holds the caller's token.
+var extendScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// lockSchema takes the schema lock, waiting up to wait while another process
+// holds it. The lock expires unless renewed, so a crashed holder does not
+// block migrations for long; it is renewed until release is called. The
+// returned context is cancelled if the lock is lost.
+func lockSchema(ctx context.Context, client redis.UniversalClient, key string, wait time.Duration) (context.Context, func(), error) {
+	if wait <= 0 {
+		wait = defaultSchemaLockWait
+	}
+	var raw [16]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return nil, nil, err
+	}
+	token := hex.EncodeToString(raw[:])
+	deadline := time.Now().Add(wait)
+	for {
+		ok, err := client.SetNX(ctx, key, token, schemaLockTTL).Result()
+		if err != nil {
+			return nil, nil, &UnavailableError{Op: "lock schema", Err: err}
+		}
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, nil, &UnavailableError{Op: "lock schema", Err: errSchemaLocked, RetryAfter: schemaLockTTL}
+		}
+		if err := sleepContext(ctx, min(250*time.Millisecond, wait)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	lockCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(schemaLockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-lockCtx.Done():
+				return
+			case <-ticker.C:
+				held, err := extendScript.Run(lockCtx, client, []string{key}, token, schemaLockTTL.Milliseconds()).Int()
+				if err != nil || held == 0 {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	release := func() {
+		cancel()
+		<-done
+		ctx, stop := context.WithTimeout(context.Background(), 5*time.Second)
+		defer stop()
+		_ = unlockScript.Run(ctx, client, []string{key}, token).Err()
+	}
+	return lockCtx, release, nil
+}
@@ -6,6 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	redis "github.com/redis/go-redis/v9"
@@ -13,70 +15,190 @@ import (
 	"github.com/onexay/kv-vs/internal/types"
 )
 
-const (
-	repoCommitsKeyPrefix = "repo:commits"
-)
-
 type keydbStore struct {
-	client        *redis.Client
+	client        redis.UniversalClient
+	keyspace      keyspace
 	clock         func() time.Time
 	archive       Archive
+	keys          *dataKeyring
 	defaultPolicy RetentionPolicy
+	notify        func(repo string)
+	// policyCooldown is the minimum time between policy changes.
+	policyCooldown time.Duration
+	// txRetries, txBackoff and txMaxBackoff bound retries of optimistic
+	// writes that lost a race.
+	txRetries    int
+	txBackoff    time.Duration
+	txMaxBackoff time.Duration
+	// readBatch is the number of keys read per MGET by listings and
+	// history scans.
+	readBatch int
 }
 
 type retentionRecord struct {
 	HotCommitLimit     int   `json:"hotCommitLimit,omitempty"`
 	HotDurationSeconds int64 `json:"hotDurationSeconds,omitempty"`
-	Locked             bool  `json:"locked"`
+	PurgeAfterSeconds  int64 `json:"purgeAfterSeconds,omitempty"`
+	PinTags            bool  `json:"pinTags,omitempty"`
+	PinBranchHeads     bool  `json:"pinBranchHeads,omitempty"`
+	Compression        Codec `json:"compression,omitempty"`
+	// Locked is only present on records written before policies were
+	// versioned; such a record is treated as version 1.
+	Locked     bool      `json:"locked,omitempty"`
+	Version    int       `json:"version,omitempty"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+	AuthorName string    `json:"author,omitempty"`
+	AuthorID   string    `json:"authorId,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+func newRetentionRecord(policy RetentionPolicy) retentionRecord {
+	return retentionRecord{
+		HotCommitLimit:     policy.HotCommitLimit,
+		HotDurationSeconds: int64(policy.HotDuration / time.Second),
+		PurgeAfterSeconds:  int64(policy.PurgeAfter / time.Second),
+		PinTags:            policy.PinTags,
+		PinBranchHeads:     policy.PinBranchHeads,
+		Compression:        policy.Compression,
+		Version:            policy.Version,
+		UpdatedAt:          policy.UpdatedAt,
+		AuthorName:         policy.AuthorName,
+		AuthorID:           policy.AuthorID,
+		Reason:             policy.Reason,
+	}
 }
 
 func (r retentionRecord) toPolicy(repo string) RetentionPolicy {
+	version := r.Version
+	if version == 0 && r.Locked {
+		version = 1
+	}
 	return RetentionPolicy{
 		Repo:           repo,
 		HotCommitLimit: r.HotCommitLimit,
 		HotDuration:    time.Duration(r.HotDurationSeconds) * time.Second,
-		Locked:         r.Locked,
+		PurgeAfter:     time.Duration(r.PurgeAfterSeconds) * time.Second,
+		PinTags:        r.PinTags,
+		PinBranchHeads: r.PinBranchHeads,
+		Compression:    r.Compression,
+		Version:        version,
+		UpdatedAt:      r.UpdatedAt,
+		AuthorName:     r.AuthorName,
+		AuthorID:       r.AuthorID,
+		Reason:         r.Reason,
 	}
 }
 
 // Config defines KeyDB connection settings.
 type Config struct {
+	// Mode is standalone (the default), cluster or sentinel.
+	Mode KeyDBMode
+	// Addr is the server of a standalone deployment. Addrs lists the
+	// cluster seed nodes or the sentinels and defaults to Addr.
 	Addr     string
+	Addrs    []string
 	Username string
 	Password string
 	Database int
+	// KeyPrefix namespaces every key, so several deployments can share a
+	// database: "kv-vs" stores commits under "kv-vs:commit:...".
+	KeyPrefix string
+	// Migrate is auto (the default) to apply pending schema migrations when
+	// the store opens, or manual to refuse to open until they are applied.
+	// MigrateLockWait bounds the wait for another process's migration
+	// (two minutes).
+	Migrate         KeyDBMigrateMode
+	MigrateLockWait time.Duration
+	// MasterName is the sentinel master set; SentinelUsername and
+	// SentinelPassword authenticate to the sentinels themselves.
+	MasterName       string
+	SentinelUsername string
+	SentinelPassword string
+	TLS              KeyDBTLSConfig
+	// Pool and timeout tuning, per node; zero keeps the client defaults.
+	PoolSize        int
+	MinIdleConns    int
+	PoolTimeout     time.Duration
+	ConnMaxIdleTime time.Duration
+	DialTimeout     time.Duration
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	// TxRetries bounds how often a write that lost a race with a concurrent
+	// write is retried before failing as unavailable; zero means ten,
+	// negative disables retries. TxBackoff is the first delay (10ms) and
+	// doubles up to TxMaxBackoff (500ms).
+	TxRetries    int
+	TxBackoff    time.Duration
+	TxMaxBackoff time.Duration
+	// ReadBatchSize is the number of keys fetched per MGET when listing
+	// commits, branches and tags or scanning a repository's history; zero
+	// means 100.
+	ReadBatchSize int
 }
 
 // NewKeyDBStore initializes a Store backed by KeyDB.
 func NewKeyDBStore(cfg Config, opts Options) (Store, error) {
-	addr := cfg.Addr
-	if addr == "" {
-		addr = "localhost:6379"
+	keys, err := newKeyspace(cfg.KeyPrefix, cfg.Mode == KeyDBModeCluster)
+	if err != nil {
+		return nil, err
 	}
-
-	redisOpts := &redis.Options{
-		Addr:     addr,
-		Username: cfg.Username,
-		Password: cfg.Password,
-		DB:       cfg.Database,
+	client, err := newKeyDBClient(cfg)
+	if err != nil {
+		return nil, err
 	}
-
-	client := redis.NewClient(redisOpts)
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), max(2*time.Second, cfg.DialTimeout))
 	defer cancel()
 
 	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
 		return nil, fmt.Errorf("connect to keydb: %w", err)
 	}
-
-	return &keydbStore{
-		client:        client,
-		clock:         time.Now,
-		archive:       opts.Archive,
-		defaultPolicy: RetentionPolicy{HotCommitLimit: opts.Retention.HotCommitLimit, HotDuration: opts.Retention.HotDuration},
-	}, nil
+	switch cfg.Migrate {
+	case "", KeyDBMigrateAuto:
+		_, err = migrateSchema(context.Background(), client, keys, SchemaOptions{LockWait: cfg.MigrateLockWait})
+	case KeyDBMigrateManual:
+		err = checkSchema(ctx, client, keys)
+	default:
+		err = fmt.Errorf("unknown keydb migrate mode %q", cfg.Migrate)
+	}
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("keydb schema: %w", err)
+	}
+
+	s := &keydbStore{
+		client:         client,
+		keyspace:       keys,
+		clock:          time.Now,
+		archive:        opts.Archive,
+		defaultPolicy:  opts.Retention.policy(),
+		notify:         opts.notifier(),
+		policyCooldown: opts.PolicyCooldown,
+		txRetries:      cfg.TxRetries,
+		txBackoff:      cfg.TxBackoff,
+		txMaxBackoff:   cfg.TxMaxBackoff,
+		readBatch:      cfg.ReadBatchSize,
+	}
+	if s.txRetries == 0 {
+		s.txRetries = defaultKeyDBTxRetries
+	} else if s.txRetries < 0 {
+		s.txRetries = 0
+	}
+	if s.txBackoff <= 0 {
+		s.txBackoff = defaultKeyDBTxBackoff
+	}
+	if s.txMaxBackoff < s.txBackoff {
+		s.txMaxBackoff = max(defaultKeyDBTxMaxBackoff, s.txBackoff)
+	}
+	if s.readBatch <= 0 {
+		s.readBatch = defaultKeyDBReadBatch
+	}
+	s.keys = newDataKeyring(opts.MasterKeys, s)
+	return s, nil
 }
 
+// PutBlobAndCommit writes the commit atomically on the server and retries,
+// within the retry budget, while concurrent writes keep moving the branch.
 func (s *keydbStore) PutBlobAndCommit(ctx context.Context, req BlobWriteRequest) (BlobCommitResult, error) {
 	if ctx == nil {
 		ctx = context.Background()
@@ -97,130 +219,142 @@ func (s *keydbStore) PutBlobAndCommit(ctx context.Context, req BlobWriteRequest)
 		branch = defaultBranch
 	}
 
-	policy := s.getPolicy(ctx, req.Name)
-
-	branchKey := branchKey(req.Name, branch)
-	repoCommitsKey := repoCommitsKey(req.Name)
-	branchSet := branchSetKey(req.Name)
-	authorKeyName := authorKey(req.Name, req.AuthorID)
+	policy, err := s.GetPolicy(ctx, req.Name)
+	if err != nil {
+		return BlobCommitResult{}, err
+	}
+	stored, err := s.keys.encode(ctx, req.Name, policy.contentCodec(s.defaultPolicy), []byte(req.Content))
+	if err != nil {
+		return BlobCommitResult{}, err
+	}
 
 	var result BlobCommitResult
+	err = s.retryTx(ctx, "commit", func() error {
+		var err error
+		result, err = s.commitBlob(ctx, req, branch, stored)
+		return err
+	})
+	if err != nil {
+		return BlobCommitResult{}, err
+	}
+	s.notify(req.Name)
+	return result, nil
+}
 
-	for {
-		err := s.client.Watch(ctx, func(tx *redis.Tx) error {
-			parent := ""
-			branchBytes, err := tx.Get(ctx, branchKey).Bytes()
-			if errors.Is(err, redis.Nil) {
-				// no parent
-			} else if err != nil {
-				return err
-			} else {
-				var branchMeta types.Branch
-				if err := json.Unmarshal(branchBytes, &branchMeta); err != nil {
-					return err
-				}
-				parent = branchMeta.Commit
-			}
-
-			previousContent := ""
-			if parent != "" {
-				previousContent, err = tx.Get(ctx, contentKey(req.Name, parent)).Result()
-				if errors.Is(err, redis.Nil) {
-					return &NotFoundError{Resource: "content", Key: parent}
-				}
-				if err != nil {
-					return err
-				}
-			}
+// commitBlob computes the commit against the current branch head and writes
+// it with commitScript. It returns errTxContention when the head moved in
+// between.
+func (s *keydbStore) commitBlob(ctx context.Context, req BlobWriteRequest, branch string, stored []byte) (BlobCommitResult, error) {
+	branchKey := s.keyspace.branchKey(req.Name, branch)
+	parent := ""
+	head, err := s.client.Get(ctx, branchKey).Bytes()
+	if errors.Is(err, redis.Nil) {
+		// no parent
+	} else if err != nil {
+		return BlobCommitResult{}, err
+	} else {
+		var branchMeta types.Branch
+		if err := json.Unmarshal(head, &branchMeta); err != nil {
+			return BlobCommitResult{}, err
+		}
+		parent = branchMeta.Commit
+	}
 
-			existingAuthorName, err := tx.Get(ctx, authorKeyName).Result()
-			if err != nil && !errors.Is(err, redis.Nil) {
-				return err
-			}
-			if err == nil && existingAuthorName != req.AuthorName {
-				return &ConflictError{Resource: "author", Key: req.AuthorID}
+	previousContent := ""
+	if parent != "" {
+		data, err := s.client.Get(ctx, s.keyspace.contentKey(req.Name, parent)).Bytes()
+		switch {
+		case errors.Is(err, redis.Nil):
+			parentCommit, err := s.getCommitMetadata(ctx, req.Name, parent)
+			if errors.Is(err, redis.Nil) {
+				return BlobCommitResult{}, &NotFoundError{Resource: "content", Key: parent}
 			}
-
-			diff := computeDiff(previousContent, req.Content)
-			contentHash := computeContentHash(req.Content)
-			now := s.clock().UTC()
-			commitHash := computeCommitHash(req.Name, branch, req.Content, parent, now)
-
-			exists, err := tx.Exists(ctx, commitKey(req.Name, commitHash)).Result()
 			if err != nil {
-				return err
-			}
-			if exists == 1 {
-				return &ConflictError{Resource: "commit", Key: commitHash}
+				return BlobCommitResult{}, err
 			}
-
-			commit := types.Commit{
-				Repo:        req.Name,
-				Branch:      branch,
-				Hash:        commitHash,
-				Parent:      parent,
-				AuthorName:  req.AuthorName,
-				AuthorID:    req.AuthorID,
-				Message:     "auto commit",
-				ContentHash: contentHash,
-				Timestamp:   now,
-				Archived:    false,
+			if previousContent, err = parentContent(ctx, s.archive, s.keys, req.Name, parentCommit); err != nil {
+				return BlobCommitResult{}, err
 			}
-
-			payload, err := json.Marshal(commit)
+		case err != nil:
+			return BlobCommitResult{}, err
+		default:
+			raw, err := s.keys.decode(ctx, req.Name, data)
 			if err != nil {
-				return err
+				return BlobCommitResult{}, err
 			}
-
-			pipe := tx.TxPipeline()
-			pipe.Set(ctx, commitKey(req.Name, commitHash), payload, 0)
-			pipe.Set(ctx, contentKey(req.Name, commitHash), req.Content, 0)
-			branchPayload, err := json.Marshal(types.Branch{
-				Repo:      req.Name,
-				Name:      branch,
-				Commit:    commitHash,
-				UpdatedAt: now,
-			})
-			if err != nil {
-				return err
-			}
-			pipe.Set(ctx, branchKey, branchPayload, 0)
-			pipe.SAdd(ctx, branchSet, branch)
-			pipe.ZAdd(ctx, repoCommitsKey, redis.Z{Score: float64(now.UnixNano()), Member: commitHash})
-			pipe.Set(ctx, authorKeyName, req.AuthorName, 0)
-
-			if _, err := pipe.Exec(ctx); err != nil {
-				return err
-			}
-
-			result = BlobCommitResult{
-				CommitHash: commitHash,
-				Branch:     branch,
-				CreatedAt:  now,
-				Diff:       diff,
-			}
-			return nil
-		}, branchKey, repoCommitsKey)
-
-		if err == nil {
-			s.enforceRetention(ctx, req.Name, policy)
-			return result, nil
+			previousContent = string(raw)
 		}
+	}
 
-		if errors.Is(err, redis.TxFailedErr) {
-			continue
-		}
+	diff := computeDiff(previousContent, req.Content)
+	now := s.clock().UTC()
+	commitHash := computeCommitHash(req.Name, branch, req.Content, parent, now)
+	commit := types.Commit{
+		Repo:        req.Name,
+		Branch:      branch,
+		Hash:        commitHash,
+		Parent:      parent,
+		AuthorName:  req.AuthorName,
+		AuthorID:    req.AuthorID,
+		Message:     "auto commit",
+		ContentHash: computeContentHash(req.Content),
+		Timestamp:   now,
+		Archived:    false,
+	}
+	payload, err := json.Marshal(commit)
+	if err != nil {
+		return BlobCommitResult{}, err
+	}
+	branchPayload, err := json.Marshal(types.Branch{
+		Repo:      req.Name,
+		Name:      branch,
+		Commit:    commitHash,
+		UpdatedAt: now,
+	})
+	if err != nil {
+		return BlobCommitResult{}, err
+	}
 
+	keys := []string{
+		branchKey,
+		s.keyspace.commitKey(req.Name, commitHash),
+		s.keyspace.contentKey(req.Name, commitHash),
+		s.keyspace.branchSetKey(req.Name),
+		s.keyspace.repoCommitsKey(req.Name),
+		s.keyspace.authorKey(req.Name, req.AuthorID),
+	}
+	status, err := commitScript.Run(ctx, s.client, keys,
+		head, payload, stored, branchPayload, branch,
+		strconv.FormatFloat(float64(now.UnixNano()), 'f', -1, 64), commitHash, req.AuthorName,
+	).Text()
+	if err != nil {
 		return BlobCommitResult{}, err
 	}
+	switch status {
+	case "ok":
+		return BlobCommitResult{
+			CommitHash: commitHash,
+			Branch:     branch,
+			CreatedAt:  now,
+			Diff:       diff,
+		}, nil
+	case "stale":
+		return BlobCommitResult{}, errTxContention
+	case "author":
+		return BlobCommitResult{}, &ConflictError{Resource: "author", Key: req.AuthorID}
+	case "exists":
+		return BlobCommitResult{}, &ConflictError{Resource: "commit", Key: commitHash}
+	default:
+		return BlobCommitResult{}, fmt.Errorf("commit script returned %q", status)
+	}
 }
 
-func (s *keydbStore) ListCommits(ctx context.Context, opts ListCommitsOptions) []types.Commit {
+func (s *keydbStore) ListCommits(ctx context.Context, opts ListCommitsOptions) ([]types.Commit, error) {
 	if opts.Repo == "" {
-		return []types.Commit{}
+		return []types.Commit{}, nil
 	}
 
-	key := repoCommitsKey(opts.Repo)
+	key := s.keyspace.repoCommitsKey(opts.Repo)
 	var (
 		hashes []string
 		err    error
@@ -237,22 +371,14 @@ func (s *keydbStore) ListCommits(ctx context.Context, opts ListCommitsOptions) [
 		hashes, err = s.client.ZRange(ctx, key, 0, end).Result()
 	}
 	if err != nil {
-		return []types.Commit{}
+		return nil, &UnavailableError{Op: "list commits", Err: err}
 	}
 
-	result := make([]types.Commit, 0, len(hashes))
-	for _, hash := range hashes {
-		commitBytes, err := s.client.Get(ctx, commitKey(opts.Repo, hash)).Bytes()
-		if err != nil {
-			continue
-		}
-		var commit types.Commit
-		if err := json.Unmarshal(commitBytes, &commit); err != nil {
-			continue
-		}
-		result = append(result, commit)
+	result, unreadable, err := s.getCommits(ctx, opts.Repo, hashes)
+	if err != nil {
+		return nil, &UnavailableError{Op: "list commits", Err: err}
 	}
-	return result
+	return result, partialResult("commit", unreadable)
 }
 
 func (s *keydbStore) GetCommit(ctx context.Context, repo, hash string) (types.Commit, string, error) {
@@ -260,7 +386,7 @@ func (s *keydbStore) GetCommit(ctx context.Context, repo, hash string) (types.Co
 		ctx = context.Background()
 	}
 
-	commitBytes, err := s.client.Get(ctx, commitKey(repo, hash)).Bytes()
+	commitBytes, err := s.client.Get(ctx, s.keyspace.commitKey(repo, hash)).Bytes()
 	if err != nil {
 		if errors.Is(err, redis.Nil) {
 			return types.Commit{}, "", &NotFoundError{Resource: "commit", Key: hash}
@@ -272,14 +398,17 @@ func (s *keydbStore) GetCommit(ctx context.Context, repo, hash string) (types.Co
 	if err := json.Unmarshal(commitBytes, &commit); err != nil {
 		return types.Commit{}, "", err
 	}
+	if commit.Purged {
+		return commit, "", &GoneError{Resource: "content", Key: hash}
+	}
 
-	content, err := s.client.Get(ctx, contentKey(repo, hash)).Result()
+	stored, err := s.client.Get(ctx, s.keyspace.contentKey(repo, hash)).Bytes()
 	if err != nil {
 		if errors.Is(err, redis.Nil) {
 			if s.archive == nil {
 				return commit, "", &NotFoundError{Resource: "content", Key: hash}
 			}
-			data, err := s.archive.Fetch(ctx, repo, hash)
+			data, err := readArchived(ctx, s.archive, s.keys, repo, hash)
 			if err != nil {
 				return commit, "", err
 			}
@@ -287,8 +416,12 @@ func (s *keydbStore) GetCommit(ctx context.Context, repo, hash string) (types.Co
 		}
 		return commit, "", err
 	}
+	content, err := s.keys.decode(ctx, repo, stored)
+	if err != nil {
+		return commit, "", err
+	}
 
-	return commit, content, nil
+	return commit, string(content), nil
 }
 
 func (s *keydbStore) UpsertBranch(ctx context.Context, req BranchRequest) (types.Branch, error) {
@@ -317,33 +450,35 @@ func (s *keydbStore) UpsertBranch(ctx context.Context, req BranchRequest) (types
 	}
 
 	pipe := s.client.TxPipeline()
-	pipe.Set(ctx, branchKey(req.Repo, req.Name), payload, 0)
-	pipe.SAdd(ctx, branchSetKey(req.Repo), req.Name)
+	pipe.Set(ctx, s.keyspace.branchKey(req.Repo, req.Name), payload, 0)
+	pipe.SAdd(ctx, s.keyspace.branchSetKey(req.Repo), req.Name)
 	if _, err := pipe.Exec(ctx); err != nil {
 		return types.Branch{}, err
 	}
 
+	s.notify(req.Repo)
 	return branch, nil
 }
 
-func (s *keydbStore) ListBranches(ctx context.Context, repo string) []types.Branch {
+func (s *keydbStore) ListBranches(ctx context.Context, repo string) ([]types.Branch, error) {
 	if repo == "" {
-		return []types.Branch{}
+		return []types.Branch{}, nil
 	}
-	set := branchSetKey(repo)
+	set := s.keyspace.branchSetKey(repo)
 	names, err := s.client.SMembers(ctx, set).Result()
 	if err != nil {
-		return []types.Branch{}
+		return nil, &UnavailableError{Op: "list branches", Err: err}
 	}
 	slices.Sort(names)
-	result := make([]types.Branch, 0, len(names))
-	for _, name := range names {
-		branch, err := s.GetBranch(ctx, repo, name)
-		if err == nil {
-			result = append(result, branch)
-		}
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = s.keyspace.branchKey(repo, name)
 	}
-	return result
+	result, unreadable, err := getRecords[types.Branch](ctx, s, keys)
+	if err != nil {
+		return nil, &UnavailableError{Op: "list branches", Err: err}
+	}
+	return result, partialResult("branch", unreadable)
 }
 
 func (s *keydbStore) GetBranch(ctx context.Context, repo, name string) (types.Branch, error) {
@@ -351,7 +486,7 @@ func (s *keydbStore) GetBranch(ctx context.Context, repo, name string) (types.Br
 		return types.Branch{}, &ValidationError{Message: "repo and name are required"}
 	}
 
-	bytes, err := s.client.Get(ctx, branchKey(repo, name)).Bytes()
+	bytes, err := s.client.Get(ctx, s.keyspace.branchKey(repo, name)).Bytes()
 	if err != nil {
 		if errors.Is(err, redis.Nil) {
 			return types.Branch{}, &NotFoundError{Resource: "branch", Key: name}
@@ -379,7 +514,7 @@ func (s *keydbStore) CreateTag(ctx context.Context, req TagRequest) (types.Tag,
 		return types.Tag{}, &ValidationError{Message: "commit does not belong to repository"}
 	}
 
-	exists, err := s.client.Exists(ctx, tagKey(req.Repo, req.Name)).Result()
+	exists, err := s.client.Exists(ctx, s.keyspace.tagKey(req.Repo, req.Name)).Result()
 	if err != nil {
 		return types.Tag{}, err
 	}
@@ -401,32 +536,34 @@ func (s *keydbStore) CreateTag(ctx context.Context, req TagRequest) (types.Tag,
 	}
 
 	pipe := s.client.TxPipeline()
-	pipe.Set(ctx, tagKey(req.Repo, req.Name), payload, 0)
-	pipe.SAdd(ctx, tagSetKey(req.Repo), req.Name)
+	pipe.Set(ctx, s.keyspace.tagKey(req.Repo, req.Name), payload, 0)
+	pipe.SAdd(ctx, s.keyspace.tagSetKey(req.Repo), req.Name)
 	if _, err := pipe.Exec(ctx); err != nil {
 		return types.Tag{}, err
 	}
 
+	s.notify(req.Repo)
 	return tag, nil
 }
 
-func (s *keydbStore) ListTags(ctx context.Context, repo string) []types.Tag {
+func (s *keydbStore) ListTags(ctx context.Context, repo string) ([]types.Tag, error) {
 	if repo == "" {
-		return []types.Tag{}
+		return []types.Tag{}, nil
 	}
-	names, err := s.client.SMembers(ctx, tagSetKey(repo)).Result()
+	names, err := s.client.SMembers(ctx, s.keyspace.tagSetKey(repo)).Result()
 	if err != nil {
-		return []types.Tag{}
+		return nil, &UnavailableError{Op: "list tags", Err: err}
 	}
 	slices.Sort(names)
-	result := make([]types.Tag, 0, len(names))
-	for _, name := range names {
-		tag, err := s.GetTag(ctx, repo, name)
-		if err == nil {
-			result = append(result, tag)
-		}
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = s.keyspace.tagKey(repo, name)
+	}
+	result, unreadable, err := getRecords[types.Tag](ctx, s, keys)
+	if err != nil {
+		return nil, &UnavailableError{Op: "list tags", Err: err}
 	}
-	return result
+	return result, partialResult("tag", unreadable)
 }
 
 func (s *keydbStore) GetTag(ctx context.Context, repo, name string) (types.Tag, error) {
@@ -434,7 +571,7 @@ func (s *keydbStore) GetTag(ctx context.Context, repo, name string) (types.Tag,
 		return types.Tag{}, &ValidationError{Message: "repo and name are required"}
 	}
 
-	bytes, err := s.client.Get(ctx, tagKey(repo, name)).Bytes()
+	bytes, err := s.client.Get(ctx, s.keyspace.tagKey(repo, name)).Bytes()
 	if err != nil {
 		if errors.Is(err, redis.Nil) {
 			return types.Tag{}, &NotFoundError{Resource: "tag", Key: name}
@@ -449,52 +586,111 @@ func (s *keydbStore) GetTag(ctx context.Context, repo, name string) (types.Tag,
 	return tag, nil
 }
 
+// SetPolicy stores a new policy version and appends it to the history list.
+// The current policy key is watched so concurrent changes cannot both pass
+// the cooldown; a change that lost the race is evaluated again.
 func (s *keydbStore) SetPolicy(ctx context.Context, policy RetentionPolicy) (RetentionPolicy, error) {
-	if policy.Repo == "" {
-		return RetentionPolicy{}, &ValidationError{Message: "repository name is required"}
-	}
-	if policy.HotCommitLimit < 0 {
-		return RetentionPolicy{}, &ValidationError{Message: "hotCommitLimit must be >= 0"}
-	}
-	if policy.HotDuration < 0 {
-		return RetentionPolicy{}, &ValidationError{Message: "hotDuration must be >= 0"}
-	}
 	if ctx == nil {
 		ctx = context.Background()
 	}
 
-	key := policyKey(policy.Repo)
-	seconds := int64(policy.HotDuration / time.Second)
+	key := s.keyspace.policyKey(policy.Repo)
+	historyKey := s.keyspace.policyHistoryKey(policy.Repo)
+	var (
+		result  RetentionPolicy
+		changed bool
+	)
+	err := s.retryTx(ctx, "set policy", func() error {
+		return s.client.Watch(ctx, func(tx *redis.Tx) error {
+			current := s.defaultPolicy.WithRepo(policy.Repo)
+			data, err := tx.Get(ctx, key).Bytes()
+			if err == nil {
+				var rec retentionRecord
+				if err := json.Unmarshal(data, &rec); err != nil {
+					return err
+				}
+				current = rec.toPolicy(policy.Repo)
+			} else if !errors.Is(err, redis.Nil) {
+				return err
+			}
 
-	existing, err := s.client.Get(ctx, key).Bytes()
-	if err == nil {
-		var rec retentionRecord
-		if err := json.Unmarshal(existing, &rec); err == nil {
-			if rec.Locked && (rec.HotCommitLimit != policy.HotCommitLimit || rec.HotDurationSeconds != seconds) {
-				return rec.toPolicy(policy.Repo), &ConflictError{Resource: "policy", Key: policy.Repo}
+			next, unchanged, err := nextPolicy(current, policy, s.policyCooldown, s.clock())
+			if err != nil || unchanged {
+				result = next
+				return err
 			}
-		}
-	} else if err != nil && !errors.Is(err, redis.Nil) {
+			var seed []byte
+			if current.Version > 0 {
+				// A policy set before versioning has no history entry yet.
+				n, err := tx.LLen(ctx, historyKey).Result()
+				if err != nil {
+					return err
+				}
+				if n == 0 {
+					if seed, err = json.Marshal(newRetentionRecord(current)); err != nil {
+						return err
+					}
+				}
+			}
+			payload, err := json.Marshal(newRetentionRecord(next))
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, payload, 0)
+				if seed != nil {
+					pipe.RPush(ctx, historyKey, seed)
+				}
+				pipe.RPush(ctx, historyKey, payload)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			result, changed = next, true
+			return nil
+		}, key)
+	})
+	if err != nil {
 		return RetentionPolicy{}, err
 	}
+	if changed {
+		s.notify(policy.Repo)
+	}
+	return result, nil
+}
 
-	rec := retentionRecord{
-		HotCommitLimit:     policy.HotCommitLimit,
-		HotDurationSeconds: seconds,
-		Locked:             true,
+func (s *keydbStore) PolicyHistory(ctx context.Context, repo string) ([]RetentionPolicy, error) {
+	if repo == "" {
+		return nil, &ValidationError{Message: "name query parameter required"}
 	}
-	payload, err := json.Marshal(rec)
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	entries, err := s.client.LRange(ctx, s.keyspace.policyHistoryKey(repo), 0, -1).Result()
 	if err != nil {
-		return RetentionPolicy{}, err
+		return nil, &UnavailableError{Op: "policy history", Err: err}
 	}
-
-	if err := s.client.Set(ctx, key, payload, 0).Err(); err != nil {
-		return RetentionPolicy{}, err
+	history := make([]RetentionPolicy, 0, len(entries))
+	var unreadable []string
+	for i, entry := range entries {
+		var rec retentionRecord
+		if err := json.Unmarshal([]byte(entry), &rec); err != nil {
+			unreadable = append(unreadable, fmt.Sprintf("%s[%d]", s.keyspace.policyHistoryKey(repo), i))
+			continue
+		}
+		history = append(history, rec.toPolicy(repo))
 	}
-
-	policy.Locked = true
-	s.enforceRetention(ctx, policy.Repo, policy)
-	return policy, nil
+	if len(entries) == 0 {
+		current, err := s.GetPolicy(ctx, repo)
+		if err != nil {
+			return nil, &UnavailableError{Op: "policy history", Err: err}
+		}
+		if current.Version > 0 {
+			history = append(history, current)
+		}
+	}
+	return history, partialResult("policy", unreadable)
 }
 
 func (s *keydbStore) GetPolicy(ctx context.Context, repo string) (RetentionPolicy, error) {
@@ -504,7 +700,7 @@ func (s *keydbStore) GetPolicy(ctx context.Context, repo string) (RetentionPolic
 	if ctx == nil {
 		ctx = context.Background()
 	}
-	key := policyKey(repo)
+	key := s.keyspace.policyKey(repo)
 	bytes, err := s.client.Get(ctx, key).Bytes()
 	if err != nil {
 		if errors.Is(err, redis.Nil) {
@@ -519,73 +715,352 @@ func (s *keydbStore) GetPolicy(ctx context.Context, repo string) (RetentionPolic
 	return rec.toPolicy(repo), nil
 }
 
-func (s *keydbStore) getPolicy(ctx context.Context, repo string) RetentionPolicy {
+// EnforceRetention runs one retention pass. It hydrates every commit of the
+// repository, so it belongs on the retention worker rather than a write path.
+func (s *keydbStore) EnforceRetention(ctx context.Context, repo string) (RetentionRun, error) {
+	if repo == "" {
+		return RetentionRun{}, &ValidationError{Message: "name query parameter required"}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	run := RetentionRun{Repo: repo, StartedAt: s.clock().UTC()}
 	policy, err := s.GetPolicy(ctx, repo)
 	if err != nil {
-		return s.defaultPolicy.WithRepo(repo)
+		return run, &UnavailableError{Op: "enforce retention", Err: err}
+	}
+	if !policy.enforced() {
+		return run, nil
+	}
+	hashes, err := s.client.ZRange(ctx, s.keyspace.repoCommitsKey(repo), 0, -1).Result()
+	if err != nil {
+		return run, &UnavailableError{Op: "enforce retention", Err: err}
+	}
+	commits, _, err := s.getCommits(ctx, repo, hashes)
+	if err != nil {
+		return run, &UnavailableError{Op: "enforce retention", Err: err}
+	}
+	entries := make([]retentionEntry, 0, len(commits))
+	for _, commit := range commits {
+		entries = append(entries, retentionEntry{Hash: commit.Hash, Timestamp: commit.Timestamp, Archived: commit.Archived, Purged: commit.Purged})
+	}
+	reasons, err := s.pinReasons(ctx, repo, policy)
+	if err != nil {
+		return run, &UnavailableError{Op: "enforce retention", Err: err}
 	}
-	return policy
+
+	plan := planRetentionPass(entries, reasons, policy, s.clock(), s.archive != nil)
+	plan.Codec = policy.contentCodec(s.defaultPolicy)
+	applyRetention(ctx, s, repo, plan, &run)
+	return run, nil
 }
 
-func (s *keydbStore) enforceRetention(ctx context.Context, repo string, policy RetentionPolicy) {
-	if s.archive == nil {
-		return
+// ListRepos scans the history index keys, one per repository with commits.
+func (s *keydbStore) ListRepos(ctx context.Context) ([]string, error) {
+	if ctx == nil {
+		ctx = context.Background()
 	}
-	if policy.HotCommitLimit <= 0 && policy.HotDuration <= 0 {
-		return
+	prefix := s.keyspace.repoCommitsPrefix()
+	keys, err := scanKeys(ctx, s.client, escapeGlob(prefix)+"*")
+	if err != nil {
+		return nil, &UnavailableError{Op: "list repos", Err: err}
+	}
+	var repos []string
+	for _, key := range keys {
+		if repo, err := s.keyspace.parseRepo(strings.TrimPrefix(key, prefix)); err == nil && repo != "" {
+			repos = append(repos, repo)
+		}
+	}
+	slices.Sort(repos)
+	return slices.Compact(repos), nil
+}
+
+// Recompress rewrites hot content keys under WATCH, so a key changed or
+// deleted meanwhile is left for the next pass, then rewrites archived content.
+func (s *keydbStore) Recompress(ctx context.Context, repo string) (CompressionReport, error) {
+	if repo == "" {
+		return CompressionReport{}, &ValidationError{Message: "name query parameter required"}
 	}
-	hashes, err := s.client.ZRange(ctx, repoCommitsKey(repo), 0, -1).Result()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	report := CompressionReport{Repo: repo, StartedAt: s.clock().UTC()}
+	policy, err := s.GetPolicy(ctx, repo)
 	if err != nil {
-		return
+		return report, &UnavailableError{Op: "recompress", Err: err}
 	}
-	type entry struct {
-		hash      string
-		timestamp time.Time
-		archived  bool
+	report.Codec = policy.contentCodec(s.defaultPolicy)
+	hashes, err := s.client.ZRange(ctx, s.keyspace.repoCommitsKey(repo), 0, -1).Result()
+	if err != nil {
+		return report, &UnavailableError{Op: "recompress", Err: err}
 	}
-	entries := make([]entry, 0, len(hashes))
-	for _, hash := range hashes {
-		commit, err := s.getCommitMetadata(ctx, repo, hash)
-		if err != nil {
+
+	commits, _, err := s.getCommits(ctx, repo, hashes)
+	if err != nil {
+		return report, &UnavailableError{Op: "recompress", Err: err}
+	}
+
+	var archived []string
+	for _, commit := range commits {
+		if err := ctx.Err(); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+			return report, nil
+		}
+		hash := commit.Hash
+		if commit.Purged {
 			continue
 		}
-		entries = append(entries, entry{hash: commit.Hash, timestamp: commit.Timestamp, archived: commit.Archived})
-	}
-	toArchive := make(map[string]struct{})
-	if policy.HotDuration > 0 {
-		cutoff := s.clock().Add(-policy.HotDuration)
-		for _, e := range entries {
-			if e.archived {
-				continue
+		if commit.Archived {
+			archived = append(archived, hash)
+			continue
+		}
+		key := s.keyspace.contentKey(repo, hash)
+		err = s.client.Watch(ctx, func(tx *redis.Tx) error {
+			data, err := tx.Get(ctx, key).Bytes()
+			if errors.Is(err, redis.Nil) {
+				return nil
 			}
-			if e.timestamp.Before(cutoff) {
-				toArchive[e.hash] = struct{}{}
+			if err != nil {
+				return err
 			}
-		}
-	}
-	if policy.HotCommitLimit > 0 {
-		remaining := make([]entry, 0, len(entries))
-		for _, e := range entries {
-			if e.archived {
-				continue
+			content, err := s.keys.recode(ctx, repo, report.Codec, data)
+			if err != nil {
+				return err
 			}
-			if _, ok := toArchive[e.hash]; ok {
-				continue
+			if content.changed {
+				if _, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+					pipe.Set(ctx, key, content.data, 0)
+					return nil
+				}); err != nil {
+					return err
+				}
+				report.Recompressed++
 			}
-			remaining = append(remaining, e)
+			report.Hot.addContent(content)
+			return nil
+		}, key)
+		if err != nil && !errors.Is(err, redis.TxFailedErr) {
+			report.Errors = append(report.Errors, fmt.Sprintf("content %s: %v", hash, err))
 		}
-		if excess := len(remaining) - policy.HotCommitLimit; excess > 0 {
-			for i := 0; i < excess; i++ {
-				toArchive[remaining[i].hash] = struct{}{}
-			}
+	}
+
+	recompressArchive(ctx, s.archive, s.keys, repo, archived, report.Codec, func(hash string) bool {
+		commit, err := s.getCommitMetadata(ctx, repo, hash)
+		return err == nil && !commit.Purged
+	}, &report)
+	return report, nil
+}
+
+func (s *keydbStore) DataKeys(ctx context.Context, repo string) ([]DataKey, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return s.keys.list(ctx, repo)
+}
+
+func (s *keydbStore) Reencrypt(ctx context.Context, repo string, rotate bool) (ReencryptReport, error) {
+	return reencrypt(ctx, s.keys, s, repo, rotate)
+}
+
+// loadDataKeys reads the datakeys hash, which maps key IDs to JSON records.
+func (s *keydbStore) loadDataKeys(ctx context.Context, repo string) ([]DataKey, error) {
+	fields, err := s.client.HGetAll(ctx, s.keyspace.dataKeysKey(repo)).Result()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]DataKey, 0, len(fields))
+	for field, value := range fields {
+		var key DataKey
+		if err := json.Unmarshal([]byte(value), &key); err != nil {
+			return nil, fmt.Errorf("data key %s of %s: %w", field, repo, err)
 		}
+		keys = append(keys, key)
+	}
+	sortDataKeys(keys)
+	return keys, nil
+}
+
+func (s *keydbStore) createDataKey(ctx context.Context, key DataKey) error {
+	payload, err := json.Marshal(key)
+	if err != nil {
+		return err
 	}
-	for hash := range toArchive {
-		_ = s.archiveCommit(ctx, repo, hash)
+	created, err := s.client.HSetNX(ctx, s.keyspace.dataKeysKey(key.Repo), strconv.Itoa(key.ID), payload).Result()
+	if err != nil {
+		return err
+	}
+	if !created {
+		return &ConflictError{Resource: "data key", Key: fmt.Sprintf("%s/%d", key.Repo, key.ID)}
+	}
+	return nil
+}
+
+func (s *keydbStore) rewrapDataKey(ctx context.Context, key DataKey) error {
+	payload, err := json.Marshal(key)
+	if err != nil {
+		return err
 	}
+	return s.client.HSet(ctx, s.keyspace.dataKeysKey(key.Repo), strconv.Itoa(key.ID), payload).Err()
 }
 
-func (s *keydbStore) archiveCommit(ctx context.Context, repo, hash string) error {
+// restoreCommit copies archived content of a pinned commit back into hot
+// storage. The archive copy is kept.
+func (s *keydbStore) restoreCommit(ctx context.Context, repo, hash string) error {
+	commit, err := s.getCommitMetadata(ctx, repo, hash)
+	if err != nil {
+		return err
+	}
+	if commit.Purged || !commit.Archived {
+		return nil
+	}
+	data, err := s.archive.Fetch(ctx, repo, hash)
+	if err != nil {
+		return err
+	}
+	commit.Archived = false
+	payload, err := json.Marshal(commit)
+	if err != nil {
+		return err
+	}
+	pipe := s.client.TxPipeline()
+	pipe.Set(ctx, s.keyspace.contentKey(repo, hash), data, 0)
+	pipe.Set(ctx, s.keyspace.commitKey(repo, hash), payload, 0)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// pinReasons resolves the pinned commits of repo under policy. Unreadable
+// refs are skipped rather than failing retention.
+func (s *keydbStore) pinReasons(ctx context.Context, repo string, policy RetentionPolicy) (map[string][]PinReason, error) {
+	branches, err := s.ListBranches(ctx, repo)
+	if err != nil && !isPartial(err) {
+		return nil, err
+	}
+	tags, err := s.ListTags(ctx, repo)
+	if err != nil && !isPartial(err) {
+		return nil, err
+	}
+	pins, err := s.listPins(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	return pinReasons(policy, branches, tags, pins), nil
+}
+
+func (s *keydbStore) listPins(ctx context.Context, repo string) ([]types.Pin, error) {
+	raw, err := s.client.HGetAll(ctx, s.keyspace.pinsKey(repo)).Result()
+	if err != nil {
+		return nil, err
+	}
+	pins := make([]types.Pin, 0, len(raw))
+	for _, payload := range raw {
+		var pin types.Pin
+		if err := json.Unmarshal([]byte(payload), &pin); err != nil {
+			continue
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+func (s *keydbStore) PinCommit(ctx context.Context, req PinRequest) (types.Pin, error) {
+	if req.Repo == "" || req.Commit == "" {
+		return types.Pin{}, &ValidationError{Message: "repo and commit are required"}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if _, err := s.getCommitMetadata(ctx, req.Repo, req.Commit); err != nil {
+		if errors.Is(err, redis.Nil) {
+			return types.Pin{}, &NotFoundError{Resource: "commit", Key: req.Commit}
+		}
+		return types.Pin{}, err
+	}
+
+	pin := types.Pin{Repo: req.Repo, Commit: req.Commit, Reason: req.Reason, CreatedAt: s.clock().UTC()}
+	payload, err := json.Marshal(pin)
+	if err != nil {
+		return types.Pin{}, err
+	}
+	if err := s.client.HSet(ctx, s.keyspace.pinsKey(req.Repo), req.Commit, payload).Err(); err != nil {
+		return types.Pin{}, err
+	}
+	s.notify(req.Repo)
+	return pin, nil
+}
+
+func (s *keydbStore) UnpinCommit(ctx context.Context, repo, hash string) error {
+	if repo == "" || hash == "" {
+		return &ValidationError{Message: "repo and commit are required"}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	removed, err := s.client.HDel(ctx, s.keyspace.pinsKey(repo), hash).Result()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return &NotFoundError{Resource: "pin", Key: hash}
+	}
+	s.notify(repo)
+	return nil
+}
+
+func (s *keydbStore) ListPins(ctx context.Context, repo string) ([]PinnedCommit, error) {
+	if repo == "" {
+		return nil, &ValidationError{Message: "name query parameter required"}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	policy, err := s.GetPolicy(ctx, repo)
+	if err != nil {
+		return nil, &UnavailableError{Op: "list pins", Err: err}
+	}
+	reasons, err := s.pinReasons(ctx, repo, policy)
+	if err != nil {
+		return nil, &UnavailableError{Op: "list pins", Err: err}
+	}
+	archived := make(map[string]bool, len(reasons))
+	for hash := range reasons {
+		if commit, err := s.getCommitMetadata(ctx, repo, hash); err == nil {
+			archived[hash] = commit.Archived
+		}
+	}
+	return pinnedList(reasons, func(hash string) bool { return archived[hash] }), nil
+}
+
+// purgeCommit removes the archived copy first and then drops hot content
+// while marking the metadata purged, so failures are retried on the next pass.
+func (s *keydbStore) purgeCommit(ctx context.Context, repo, hash string) error {
+	commit, err := s.getCommitMetadata(ctx, repo, hash)
+	if err != nil {
+		return err
+	}
+	if commit.Purged {
+		return nil
+	}
+	if s.archive != nil {
+		if err := s.archive.Remove(ctx, repo, hash); err != nil {
+			return err
+		}
+	}
+	commit.Archived = true
+	commit.Purged = true
+	payload, err := json.Marshal(commit)
+	if err != nil {
+		return err
+	}
+	pipe := s.client.TxPipeline()
+	pipe.Set(ctx, s.keyspace.commitKey(repo, hash), payload, 0)
+	pipe.Del(ctx, s.keyspace.contentKey(repo, hash))
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (s *keydbStore) archiveCommit(ctx context.Context, repo, hash string, codec Codec) error {
 	if s.archive == nil {
 		return nil
 	}
@@ -596,7 +1071,11 @@ func (s *keydbStore) archiveCommit(ctx context.Context, repo, hash string) error
 	if commit.Archived {
 		return nil
 	}
-	if err := s.archive.Store(ctx, repo, hash, []byte(content)); err != nil {
+	stored, err := s.keys.encode(ctx, repo, codec, []byte(content))
+	if err != nil {
+		return err
+	}
+	if err := s.archive.Store(ctx, repo, hash, stored); err != nil {
 		return err
 	}
 	commit.Archived = true
@@ -605,14 +1084,19 @@ func (s *keydbStore) archiveCommit(ctx context.Context, repo, hash string) error
 		return err
 	}
 	pipe := s.client.TxPipeline()
-	pipe.Set(ctx, commitKey(repo, hash), payload, 0)
-	pipe.Del(ctx, contentKey(repo, hash))
+	pipe.Set(ctx, s.keyspace.commitKey(repo, hash), payload, 0)
+	pipe.Del(ctx, s.keyspace.contentKey(repo, hash))
 	_, err = pipe.Exec(ctx)
 	return err
 }
 
+// Close releases the KeyDB connection pool.
+func (s *keydbStore) Close() error {
+	return s.client.Close()
+}
+
 func (s *keydbStore) getCommitMetadata(ctx context.Context, repo, hash string) (types.Commit, error) {
-	bytes, err := s.client.Get(ctx, commitKey(repo, hash)).Bytes()
+	bytes, err := s.client.Get(ctx, s.keyspace.commitKey(repo, hash)).Bytes()
 	if err != nil {
 		return types.Commit{}, err
 	}
@@ -623,38 +1107,265 @@ func (s *keydbStore) getCommitMetadata(ctx context.Context, repo, hash string) (
 	return commit, nil
 }
 
-func commitKey(repo, hash string) string {
-	return fmt.Sprintf("commit:%s:%s", repo, hash)
+// isUnreadable reports whether err describes a missing or undecodable record
+// rather than a backend failure.
+func isUnreadable(err error) bool {
+	var notFound *NotFoundError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &notFound) || errors.As(err, &syntaxErr) || errors.As(err, &typeErr)
 }
 
-func contentKey(repo, hash string) string {
-	return fmt.Sprintf("content:%s:%s", repo, hash)
+func isNotFound(err error) bool {
+	var notFound *NotFoundError
+	return errors.As(err, &notFound)
 }
 
-func branchKey(repo, branch string) string {
-	return fmt.Sprintf("branch:%s:%s", repo, branch)
+func (s *keydbStore) Check(ctx context.Context, opts CheckOptions) (CheckReport, error) {
+	if opts.Repo == "" {
+		return CheckReport{}, &ValidationError{Message: "name query parameter required"}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	inv, err := s.inventory(ctx, opts.Repo)
+	if err != nil {
+		return CheckReport{}, err
+	}
+	return runCheck(ctx, opts.Repo, inv, s.archive, s.keys, s, opts.Repair, s.clock()), nil
 }
 
-func repoCommitsKey(repo string) string {
-	return fmt.Sprintf("%s:%s", repoCommitsKeyPrefix, repo)
-}
+// inventory gathers the repository state consumed by Check and CollectGarbage.
+func (s *keydbStore) inventory(ctx context.Context, repo string) (repoInventory, error) {
+	inv := repoInventory{
+		Commits: make(map[string]types.Commit),
+		Hot:     make(map[string]bool),
+		Indexed: make(map[string]bool),
+		LoadContent: func(ctx context.Context, hash string) (string, error) {
+			stored, err := s.client.Get(ctx, s.keyspace.contentKey(repo, hash)).Bytes()
+			if errors.Is(err, redis.Nil) {
+				return "", &NotFoundError{Resource: "content", Key: hash}
+			}
+			if err != nil {
+				return "", err
+			}
+			content, err := s.keys.decode(ctx, repo, stored)
+			return string(content), err
+		},
+	}
+
+	commitHashes, err := scanHashes(ctx, s.client, s.keyspace.commitKey(repo, ""))
+	if err != nil {
+		return repoInventory{}, err
+	}
+	for _, hash := range commitHashes {
+		commit, err := s.getCommitMetadata(ctx, repo, hash)
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			if !isUnreadable(err) {
+				return repoInventory{}, err
+			}
+			inv.Issues = append(inv.Issues, CheckIssue{
+				Kind:   IssueUnreadableRecord,
+				Hash:   hash,
+				Key:    s.keyspace.commitKey(repo, hash),
+				Detail: err.Error(),
+			})
+			continue
+		}
+		inv.Commits[hash] = commit
+	}
+
+	contentHashes, err := scanHashes(ctx, s.client, s.keyspace.contentKey(repo, ""))
+	if err != nil {
+		return repoInventory{}, err
+	}
+	for _, hash := range contentHashes {
+		inv.Hot[hash] = true
+	}
+
+	indexed, err := s.client.ZRange(ctx, s.keyspace.repoCommitsKey(repo), 0, -1).Result()
+	if err != nil {
+		return repoInventory{}, err
+	}
+	for _, hash := range indexed {
+		inv.Indexed[hash] = true
+	}
 
-func branchSetKey(repo string) string {
-	return fmt.Sprintf("branchset:%s", repo)
+	branchNames, err := s.client.SMembers(ctx, s.keyspace.branchSetKey(repo)).Result()
+	if err != nil {
+		return repoInventory{}, err
+	}
+	slices.Sort(branchNames)
+	for _, name := range branchNames {
+		branch, err := s.GetBranch(ctx, repo, name)
+		switch {
+		case err == nil:
+			inv.Branches = append(inv.Branches, branch)
+		case isNotFound(err):
+			inv.Issues = append(inv.Issues, CheckIssue{
+				Kind:       IssueOrphanedSetMember,
+				Name:       name,
+				Key:        s.keyspace.branchSetKey(repo),
+				Detail:     "branch listed without a branch record",
+				Repairable: true,
+			})
+		case isUnreadable(err):
+			inv.Issues = append(inv.Issues, CheckIssue{Kind: IssueUnreadableRecord, Name: name, Key: s.keyspace.branchKey(repo, name), Detail: err.Error()})
+		default:
+			return repoInventory{}, err
+		}
+	}
+
+	if inv.Pins, err = s.listPins(ctx, repo); err != nil {
+		return repoInventory{}, err
+	}
+
+	tagNames, err := s.client.SMembers(ctx, s.keyspace.tagSetKey(repo)).Result()
+	if err != nil {
+		return repoInventory{}, err
+	}
+	slices.Sort(tagNames)
+	for _, name := range tagNames {
+		tag, err := s.GetTag(ctx, repo, name)
+		switch {
+		case err == nil:
+			inv.Tags = append(inv.Tags, tag)
+		case isNotFound(err):
+			inv.Issues = append(inv.Issues, CheckIssue{
+				Kind:       IssueOrphanedSetMember,
+				Name:       name,
+				Key:        s.keyspace.tagSetKey(repo),
+				Detail:     "tag listed without a tag record",
+				Repairable: true,
+			})
+		case isUnreadable(err):
+			inv.Issues = append(inv.Issues, CheckIssue{Kind: IssueUnreadableRecord, Name: name, Key: s.keyspace.tagKey(repo, name), Detail: err.Error()})
+		default:
+			return repoInventory{}, err
+		}
+	}
+	return inv, nil
 }
 
-func tagKey(repo, name string) string {
-	return fmt.Sprintf("tag:%s:%s", repo, name)
+func (s *keydbStore) repairCheckIssue(ctx context.Context, repo string, issue CheckIssue, commit types.Commit) error {
+	switch issue.Kind {
+	case IssueMissingContent, IssueMissingArchiveEntry:
+		commit.Archived = issue.Kind == IssueMissingContent
+		payload, err := json.Marshal(commit)
+		if err != nil {
+			return err
+		}
+		return s.client.Set(ctx, s.keyspace.commitKey(repo, issue.Hash), payload, 0).Err()
+	case IssueStaleHotContent:
+		return s.client.Del(ctx, s.keyspace.contentKey(repo, issue.Hash)).Err()
+	case IssueUnindexedCommit:
+		return s.client.ZAdd(ctx, s.keyspace.repoCommitsKey(repo), redis.Z{Score: float64(commit.Timestamp.UnixNano()), Member: issue.Hash}).Err()
+	case IssueOrphanedIndexEntry:
+		return s.client.ZRem(ctx, s.keyspace.repoCommitsKey(repo), issue.Hash).Err()
+	case IssueOrphanedSetMember:
+		return s.client.SRem(ctx, issue.Key, issue.Name).Err()
+	default:
+		return fmt.Errorf("no repair for %s", issue.Kind)
+	}
 }
 
-func tagSetKey(repo string) string {
-	return fmt.Sprintf("tagset:%s", repo)
+func (s *keydbStore) CollectGarbage(ctx context.Context, opts GCOptions) (GCReport, error) {
+	if opts.Repo == "" {
+		return GCReport{}, &ValidationError{Message: "name query parameter required"}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	inv, err := s.inventory(ctx, opts.Repo)
+	if err != nil {
+		return GCReport{}, err
+	}
+	return runGC(ctx, inv, s.archive, s, opts, s.clock())
 }
 
-func authorKey(repo, authorID string) string {
-	return fmt.Sprintf("author:%s:%s", repo, authorID)
+// sweepGC deletes the plan inside a WATCH on every branch and tag key, so a
+// concurrent ref move aborts the sweep instead of racing it. An aborted
+// sweep checks the refs again and fails if one now points into the plan.
+func (s *keydbStore) sweepGC(ctx context.Context, repo string, plan gcPlan) error {
+	planned := gcPlanned(plan)
+	return s.retryTx(ctx, "gc", func() error {
+		return s.sweepGCOnce(ctx, repo, plan, planned)
+	})
 }
 
-func policyKey(repo string) string {
-	return fmt.Sprintf("policy:%s", repo)
+func (s *keydbStore) sweepGCOnce(ctx context.Context, repo string, plan gcPlan, planned map[string]bool) error {
+	branchNames, err := s.client.SMembers(ctx, s.keyspace.branchSetKey(repo)).Result()
+	if err != nil {
+		return err
+	}
+	tagNames, err := s.client.SMembers(ctx, s.keyspace.tagSetKey(repo)).Result()
+	if err != nil {
+		return err
+	}
+	watched := []string{s.keyspace.branchSetKey(repo), s.keyspace.tagSetKey(repo), s.keyspace.pinsKey(repo)}
+	for _, name := range branchNames {
+		watched = append(watched, s.keyspace.branchKey(repo, name))
+	}
+	for _, name := range tagNames {
+		watched = append(watched, s.keyspace.tagKey(repo, name))
+	}
+
+	return s.client.Watch(ctx, func(tx *redis.Tx) error {
+		check := func(resource, name, key string) error {
+			payload, err := tx.Get(ctx, key).Bytes()
+			if errors.Is(err, redis.Nil) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			var target struct {
+				Commit string `json:"commit"`
+			}
+			if err := json.Unmarshal(payload, &target); err != nil {
+				return err
+			}
+			if planned[target.Commit] {
+				return &ConflictError{Resource: resource, Key: name}
+			}
+			return nil
+		}
+		for _, name := range branchNames {
+			if err := check("branch", name, s.keyspace.branchKey(repo, name)); err != nil {
+				return err
+			}
+		}
+		for _, name := range tagNames {
+			if err := check("tag", name, s.keyspace.tagKey(repo, name)); err != nil {
+				return err
+			}
+		}
+		for _, commit := range plan.Commits {
+			pinned, err := tx.HExists(ctx, s.keyspace.pinsKey(repo), commit.Hash).Result()
+			if err != nil {
+				return err
+			}
+			if pinned {
+				return &ConflictError{Resource: "pin", Key: commit.Hash}
+			}
+		}
+
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, commit := range plan.Commits {
+				pipe.Del(ctx, s.keyspace.commitKey(repo, commit.Hash), s.keyspace.contentKey(repo, commit.Hash))
+				pipe.ZRem(ctx, s.keyspace.repoCommitsKey(repo), commit.Hash)
+			}
+			for _, hash := range plan.Content {
+				pipe.Del(ctx, s.keyspace.contentKey(repo, hash))
+			}
+			for _, hash := range plan.Index {
+				pipe.ZRem(ctx, s.keyspace.repoCommitsKey(repo), hash)
+			}
+			return nil
+		})
+		return err
+	}, watched...)
 }
@@ -1,14 +1,32 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/alicebob/miniredis/v2"
 	redis "github.com/redis/go-redis/v9"
 )
 
+// standaloneKeys names the keys of a store outside cluster mode.
+var standaloneKeys keyspace
+
 func TestKeyDBStorePutBlobAndCommit(t *testing.T) {
 	addr := os.Getenv("TEST_KEYDB_ADDR")
 	var cleanup func()
@@ -98,7 +116,10 @@ func TestKeyDBStorePutBlobAndCommit(t *testing.T) {
 		t.Fatalf("expected diff for updated content")
 	}
 
-	commits := store.ListCommits(ctx, ListCommitsOptions{Repo: "analytics", Descending: true})
+	commits, err := store.ListCommits(ctx, ListCommitsOptions{Repo: "analytics", Descending: true})
+	if err != nil {
+		t.Fatalf("ListCommits: %v", err)
+	}
 	if len(commits) != 2 {
 		t.Fatalf("expected 2 commits, got %d", len(commits))
 	}
@@ -114,7 +135,10 @@ func TestKeyDBStorePutBlobAndCommit(t *testing.T) {
 		t.Fatalf("unexpected branch commit")
 	}
 
-	branches := store.ListBranches(ctx, "analytics")
+	branches, err := store.ListBranches(ctx, "analytics")
+	if err != nil {
+		t.Fatalf("ListBranches: %v", err)
+	}
 	if len(branches) != 2 {
 		t.Fatalf("expected 2 branches, got %d", len(branches))
 	}
@@ -127,7 +151,10 @@ func TestKeyDBStorePutBlobAndCommit(t *testing.T) {
 		t.Fatalf("unexpected tag commit")
 	}
 
-	tags := store.ListTags(ctx, "analytics")
+	tags, err := store.ListTags(ctx, "analytics")
+	if err != nil {
+		t.Fatalf("ListTags: %v", err)
+	}
 	if len(tags) != 1 {
 		t.Fatalf("expected 1 tag, got %d", len(tags))
 	}
@@ -140,7 +167,7 @@ func TestKeyDBStorePutBlobAndCommit(t *testing.T) {
 	if err != nil {
 		t.Fatalf("SetPolicy: %v", err)
 	}
-	if !policy.Locked || policy.HotCommitLimit != 1 {
+	if policy.Version != 1 || policy.HotCommitLimit != 1 {
 		t.Fatalf("unexpected policy response")
 	}
 
@@ -152,3 +179,516 @@ func TestKeyDBStorePutBlobAndCommit(t *testing.T) {
 		t.Fatalf("unexpected policy limit: %d", policyGet.HotCommitLimit)
 	}
 }
+
+func TestKeyDBStoreListSurfacesBackendErrors(t *testing.T) {
+	mini, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("start miniredis: %v", err)
+	}
+	t.Cleanup(mini.Close)
+
+	store, err := NewKeyDBStore(Config{Addr: mini.Addr()}, Options{})
+	if err != nil {
+		t.Fatalf("create store: %v", err)
+	}
+	ctx := context.Background()
+
+	first, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "analytics", Content: "one", AuthorName: "Alice", AuthorID: "alice@id"})
+	if err != nil {
+		t.Fatalf("PutBlobAndCommit: %v", err)
+	}
+	if _, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "analytics", Content: "two", AuthorName: "Alice", AuthorID: "alice@id"}); err != nil {
+		t.Fatalf("second PutBlobAndCommit: %v", err)
+	}
+	if err := mini.Set(standaloneKeys.commitKey("analytics", first.CommitHash), "{not json"); err != nil {
+		t.Fatalf("corrupt commit: %v", err)
+	}
+
+	commits, err := store.ListCommits(ctx, ListCommitsOptions{Repo: "analytics"})
+	var partial *PartialResultError
+	if !errors.As(err, &partial) {
+		t.Fatalf("expected PartialResultError, got %v", err)
+	}
+	if len(commits) != 1 || len(partial.Keys) != 1 || partial.Keys[0] != standaloneKeys.commitKey("analytics", first.CommitHash) {
+		t.Fatalf("unexpected partial result: %d commits, keys %v", len(commits), partial.Keys)
+	}
+
+	mini.Close()
+	if _, err := store.ListBranches(ctx, "analytics"); err == nil {
+		t.Fatalf("expected error when backend is down")
+	} else {
+		var unavailable *UnavailableError
+		if !errors.As(err, &unavailable) {
+			t.Fatalf("expected UnavailableError, got %v", err)
+		}
+	}
+}
+
+func TestKeyDBStoreEncryption(t *testing.T) {
+	mini, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("start miniredis: %v", err)
+	}
+	t.Cleanup(mini.Close)
+
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	oldMaster, err := NewMasterKeys([]MasterKey{{ID: "old", Key: oldKey}})
+	if err != nil {
+		t.Fatalf("NewMasterKeys: %v", err)
+	}
+	archive := NewMemoryArchive()
+	options := Options{Archive: archive, MasterKeys: oldMaster, Retention: RetentionDefaults{HotCommitLimit: 1}}
+	store, err := NewKeyDBStore(Config{Addr: mini.Addr()}, options)
+	if err != nil {
+		t.Fatalf("create store: %v", err)
+	}
+	ctx := context.Background()
+
+	secret := "dsn=postgres://app:hunter2@db/prod\n"
+	first, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "config", Content: secret, AuthorName: "Alice", AuthorID: "alice@id"})
+	if err != nil {
+		t.Fatalf("PutBlobAndCommit: %v", err)
+	}
+	second, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "config", Content: secret + "pool=10\n", AuthorName: "Alice", AuthorID: "alice@id"})
+	if err != nil {
+		t.Fatalf("second PutBlobAndCommit: %v", err)
+	}
+	if raw, _ := mini.Get(standaloneKeys.contentKey("config", second.CommitHash)); !strings.HasPrefix(raw, string(sealedMagic)) || strings.Contains(raw, "hunter2") {
+		t.Fatalf("hot content stored in the clear: %q", raw)
+	}
+	if _, err := store.EnforceRetention(ctx, "config"); err != nil {
+		t.Fatalf("EnforceRetention: %v", err)
+	}
+	if data, err := archive.Fetch(ctx, "config", first.CommitHash); err != nil || !bytes.HasPrefix(data, sealedMagic) {
+		t.Fatalf("archived content not encrypted: %q %v", data, err)
+	}
+	if _, content, err := store.GetCommit(ctx, "config", first.CommitHash); err != nil || content != secret {
+		t.Fatalf("GetCommit archived: %q %v", content, err)
+	}
+	if commits, err := store.ListCommits(ctx, ListCommitsOptions{Repo: "config"}); err != nil || len(commits) != 2 {
+		t.Fatalf("ListCommits: %d %v", len(commits), err)
+	}
+
+	// Rotate the master key: the old key stays available until data keys are
+	// rewrapped, after which it can be dropped.
+	newMaster, err := NewMasterKeys([]MasterKey{{ID: "new", Key: newKey}, {ID: "old", Key: oldKey}})
+	if err != nil {
+		t.Fatalf("NewMasterKeys: %v", err)
+	}
+	options.MasterKeys = newMaster
+	store, err = NewKeyDBStore(Config{Addr: mini.Addr()}, options)
+	if err != nil {
+		t.Fatalf("reopen store: %v", err)
+	}
+	report, err := store.Reencrypt(ctx, "config", true)
+	if err != nil {
+		t.Fatalf("Reencrypt: %v", err)
+	}
+	if !report.Rotated || report.DataKey != 2 || report.Rewrapped != 1 || report.Content.Recompressed != 2 ||
+		report.Content.Hot.Encrypted != 1 || report.Content.Archive.Encrypted != 1 {
+		t.Fatalf("unexpected reencrypt report: %+v", report)
+	}
+	keys, err := store.DataKeys(ctx, "config")
+	if err != nil || len(keys) != 2 || keys[0].MasterKeyID != "new" || !keys[1].Current || keys[1].Wrapped != nil {
+		t.Fatalf("unexpected data keys: %+v %v", keys, err)
+	}
+
+	newOnly, err := NewMasterKeys([]MasterKey{{ID: "new", Key: newKey}})
+	if err != nil {
+		t.Fatalf("NewMasterKeys: %v", err)
+	}
+	options.MasterKeys = newOnly
+	store, err = NewKeyDBStore(Config{Addr: mini.Addr()}, options)
+	if err != nil {
+		t.Fatalf("reopen store: %v", err)
+	}
+	for hash, want := range map[string]string{first.CommitHash: secret, second.CommitHash: secret + "pool=10\n"} {
+		if _, content, err := store.GetCommit(ctx, "config", hash); err != nil || content != want {
+			t.Fatalf("GetCommit %s after rotation: %q %v", hash, content, err)
+		}
+	}
+	if report, err := store.Check(ctx, CheckOptions{Repo: "config"}); err != nil || len(report.Issues) != 0 {
+		t.Fatalf("Check after rotation: %+v %v", report, err)
+	}
+
+	options.MasterKeys = nil
+	store, err = NewKeyDBStore(Config{Addr: mini.Addr()}, options)
+	if err != nil {
+		t.Fatalf("reopen store: %v", err)
+	}
+	if _, _, err := store.GetCommit(ctx, "config", second.CommitHash); err == nil {
+		t.Fatalf("expected encrypted content to be unreadable without a master key")
+	}
+}
+
+func TestKeyDBStoreConcurrentCommits(t *testing.T) {
+	mini, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("start miniredis: %v", err)
+	}
+	t.Cleanup(mini.Close)
+
+	store, err := NewKeyDBStore(Config{Addr: mini.Addr(), TxRetries: 1000, TxBackoff: time.Millisecond, TxMaxBackoff: 5 * time.Millisecond}, Options{})
+	if err != nil {
+		t.Fatalf("create store: %v", err)
+	}
+	ctx := context.Background()
+
+	const writers, perWriter = 8, 5
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*perWriter)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				_, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{
+					Name:       "analytics",
+					Content:    fmt.Sprintf("writer %d revision %d", w, i),
+					AuthorName: "Alice",
+					AuthorID:   "alice@id",
+				})
+				errs <- err
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("PutBlobAndCommit: %v", err)
+		}
+	}
+
+	// Every commit must be on the branch's first-parent chain: none was
+	// lost to a concurrent write.
+	branch, err := store.GetBranch(ctx, "analytics", defaultBranch)
+	if err != nil {
+		t.Fatalf("GetBranch: %v", err)
+	}
+	chain := 0
+	for hash := branch.Commit; hash != ""; chain++ {
+		commit, _, err := store.GetCommit(ctx, "analytics", hash)
+		if err != nil {
+			t.Fatalf("GetCommit: %v", err)
+		}
+		hash = commit.Parent
+	}
+	if chain != writers*perWriter {
+		t.Fatalf("branch history has %d commits, want %d", chain, writers*perWriter)
+	}
+}
+
+func TestKeyDBStoreRetryBudget(t *testing.T) {
+	mini, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("start miniredis: %v", err)
+	}
+	t.Cleanup(mini.Close)
+
+	store, err := NewKeyDBStore(Config{Addr: mini.Addr(), TxRetries: 2, TxBackoff: time.Millisecond, TxMaxBackoff: 2 * time.Second}, Options{})
+	if err != nil {
+		t.Fatalf("create store: %v", err)
+	}
+	ks := store.(*keydbStore)
+	ctx := context.Background()
+
+	// The script refuses to commit against a branch head that moved.
+	if err := mini.Set(standaloneKeys.branchKey("analytics", defaultBranch), `{"commit":"moved"}`); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	keys := []string{standaloneKeys.branchKey("analytics", defaultBranch), standaloneKeys.commitKey("analytics", "c1"), standaloneKeys.contentKey("analytics", "c1"),
+		standaloneKeys.branchSetKey("analytics"), standaloneKeys.repoCommitsKey("analytics"), standaloneKeys.authorKey("analytics", "alice@id")}
+	status, err := commitScript.Run(ctx, ks.client, keys, "", "{}", "content", "{}", defaultBranch, "1", "c1", "Alice").Text()
+	if err != nil || status != "stale" {
+		t.Fatalf("commit script = %q, %v; want stale", status, err)
+	}
+	if mini.Exists(standaloneKeys.commitKey("analytics", "c1")) {
+		t.Fatalf("stale commit script wrote the commit")
+	}
+
+	attempts := 0
+	err = ks.retryTx(ctx, "commit", func() error {
+		attempts++
+		return errTxContention
+	})
+	var unavailable *UnavailableError
+	if !errors.As(err, &unavailable) || unavailable.RetryAfter != 2*time.Second {
+		t.Fatalf("expected UnavailableError with Retry-After once the budget is spent, got %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("retryTx made %d attempts, want 3", attempts)
+	}
+	if err := ks.retryTx(ctx, "commit", func() error { return &ConflictError{Resource: "author", Key: "alice@id"} }); err == nil || errors.As(err, &unavailable) {
+		t.Fatalf("expected other errors to be returned unchanged, got %v", err)
+	}
+}
+
+// seedKeyDBHistory starts miniredis and writes commits commits, branches
+// branches and tags tags to the analytics repository.
+func seedKeyDBHistory(tb testing.TB, cfg Config, commits, branches, tags int) (*miniredis.Miniredis, *keydbStore) {
+	tb.Helper()
+	mini, err := miniredis.Run()
+	if err != nil {
+		tb.Fatalf("start miniredis: %v", err)
+	}
+	tb.Cleanup(mini.Close)
+	cfg.Addr = mini.Addr()
+	store, err := NewKeyDBStore(cfg, Options{})
+	if err != nil {
+		tb.Fatalf("create store: %v", err)
+	}
+	ctx := context.Background()
+	var head string
+	for i := 0; i < commits; i++ {
+		result, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "analytics", Content: fmt.Sprintf("revision %d", i), AuthorName: "Alice", AuthorID: "alice@id"})
+		if err != nil {
+			tb.Fatalf("PutBlobAndCommit: %v", err)
+		}
+		head = result.CommitHash
+	}
+	for i := 0; i < branches; i++ {
+		if _, err := store.UpsertBranch(ctx, BranchRequest{Repo: "analytics", Name: fmt.Sprintf("feature-%03d", i), Commit: head}); err != nil {
+			tb.Fatalf("UpsertBranch: %v", err)
+		}
+	}
+	for i := 0; i < tags; i++ {
+		if _, err := store.CreateTag(ctx, TagRequest{Repo: "analytics", Name: fmt.Sprintf("v%03d", i), Commit: head}); err != nil {
+			tb.Fatalf("CreateTag: %v", err)
+		}
+	}
+	return mini, store.(*keydbStore)
+}
+
+func TestKeyDBStoreBatchedListings(t *testing.T) {
+	mini, store := seedKeyDBHistory(t, Config{ReadBatchSize: 7}, 20, 9, 9)
+	ctx := context.Background()
+
+	before := mini.CommandCount()
+	commits, err := store.ListCommits(ctx, ListCommitsOptions{Repo: "analytics", Descending: true})
+	if err != nil || len(commits) != 20 {
+		t.Fatalf("ListCommits = %d commits, %v", len(commits), err)
+	}
+	// One ZREVRANGE and three MGETs instead of one GET per commit.
+	if n := mini.CommandCount() - before; n != 4 {
+		t.Fatalf("ListCommits sent %d commands, want 4", n)
+	}
+	for i := 1; i < len(commits); i++ {
+		if commits[i-1].Parent != commits[i].Hash {
+			t.Fatalf("commit %d is out of order", i)
+		}
+	}
+
+	branches, err := store.ListBranches(ctx, "analytics")
+	if err != nil || len(branches) != 10 || branches[0].Name != "feature-000" || branches[9].Name != defaultBranch {
+		t.Fatalf("ListBranches = %+v, %v", branches, err)
+	}
+	if err := mini.Set(standaloneKeys.tagKey("analytics", "v004"), "{not json"); err != nil {
+		t.Fatalf("corrupt tag: %v", err)
+	}
+	mini.Del(standaloneKeys.tagKey("analytics", "v006"))
+	tags, err := store.ListTags(ctx, "analytics")
+	var partial *PartialResultError
+	if !errors.As(err, &partial) || len(tags) != 7 || len(partial.Keys) != 2 {
+		t.Fatalf("ListTags = %d tags, %v", len(tags), err)
+	}
+	if partial.Keys[0] != standaloneKeys.tagKey("analytics", "v004") || partial.Keys[1] != standaloneKeys.tagKey("analytics", "v006") {
+		t.Fatalf("unexpected unreadable keys %v", partial.Keys)
+	}
+}
+
+// BenchmarkKeyDBListCommits compares a GET per commit, as listings used to
+// read, with batched MGETs.
+func BenchmarkKeyDBListCommits(b *testing.B) {
+	_, store := seedKeyDBHistory(b, Config{}, 500, 0, 0)
+	ctx := context.Background()
+	hashes, err := store.client.ZRange(ctx, standaloneKeys.repoCommitsKey("analytics"), 0, -1).Result()
+	if err != nil {
+		b.Fatalf("ZRange: %v", err)
+	}
+
+	b.Run("get", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, hash := range hashes {
+				if _, err := store.getCommitMetadata(ctx, "analytics", hash); err != nil {
+					b.Fatalf("getCommitMetadata: %v", err)
+				}
+			}
+		}
+	})
+	for _, size := range []int{10, 100, 500} {
+		b.Run(fmt.Sprintf("mget-%d", size), func(b *testing.B) {
+			store.readBatch = size
+			for i := 0; i < b.N; i++ {
+				if commits, err := store.ListCommits(ctx, ListCommitsOptions{Repo: "analytics"}); err != nil || len(commits) != len(hashes) {
+					b.Fatalf("ListCommits = %d commits, %v", len(commits), err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkKeyDBListBranches compares a GET per branch with batched MGETs.
+func BenchmarkKeyDBListBranches(b *testing.B) {
+	_, store := seedKeyDBHistory(b, Config{}, 1, 200, 0)
+	ctx := context.Background()
+	names, err := store.client.SMembers(ctx, standaloneKeys.branchSetKey("analytics")).Result()
+	if err != nil {
+		b.Fatalf("SMembers: %v", err)
+	}
+
+	b.Run("get", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, name := range names {
+				if _, err := store.GetBranch(ctx, "analytics", name); err != nil {
+					b.Fatalf("GetBranch: %v", err)
+				}
+			}
+		}
+	})
+	b.Run("mget", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if branches, err := store.ListBranches(ctx, "analytics"); err != nil || len(branches) != len(names) {
+				b.Fatalf("ListBranches = %d branches, %v", len(branches), err)
+			}
+		}
+	})
+}
+
+// clusterSlot returns the Redis Cluster slot of key, honouring hash tags.
+func clusterSlot(key string) int {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		if j := strings.IndexByte(key[i+1:], '}'); j > 0 {
+			key = key[i+1 : i+1+j]
+		}
+	}
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for b := 0; b < 8; b++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return int(crc) % 16384
+}
+
+func TestKeyDBStoreClusterMode(t *testing.T) {
+	// miniredis answers CLUSTER SLOTS as a single node owning every slot.
+	mini, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("start miniredis: %v", err)
+	}
+	t.Cleanup(mini.Close)
+	if _, err := NewKeyDBStore(Config{Mode: KeyDBModeCluster, Addrs: []string{mini.Addr()}, Database: 1}, Options{}); err == nil {
+		t.Fatalf("expected cluster mode to reject a non-zero database")
+	}
+	store, err := NewKeyDBStore(Config{Mode: KeyDBModeCluster, Addrs: []string{mini.Addr()}}, Options{Archive: NewMemoryArchive()})
+	if err != nil {
+		t.Fatalf("create store: %v", err)
+	}
+	ctx := context.Background()
+
+	for _, repo := range []string{"analytics", "billing"} {
+		var head string
+		for i := 0; i < 3; i++ {
+			result, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: repo, Content: fmt.Sprintf("revision %d", i), AuthorName: "Alice", AuthorID: "alice@id"})
+			if err != nil {
+				t.Fatalf("PutBlobAndCommit: %v", err)
+			}
+			head = result.CommitHash
+		}
+		if _, err := store.CreateTag(ctx, TagRequest{Repo: repo, Name: "v1", Commit: head}); err != nil {
+			t.Fatalf("CreateTag: %v", err)
+		}
+		if _, err := store.PinCommit(ctx, PinRequest{Repo: repo, Commit: head, Reason: "release"}); err != nil {
+			t.Fatalf("PinCommit: %v", err)
+		}
+		if _, err := store.SetPolicy(ctx, RetentionPolicy{Repo: repo, HotCommitLimit: 1}); err != nil {
+			t.Fatalf("SetPolicy: %v", err)
+		}
+		if run, err := store.EnforceRetention(ctx, repo); err != nil || run.Archived != 1 {
+			t.Fatalf("EnforceRetention = %+v, %v", run, err)
+		}
+		if report, err := store.Check(ctx, CheckOptions{Repo: repo}); err != nil || report.Commits != 3 || len(report.Issues) != 0 {
+			t.Fatalf("Check = %+v, %v", report, err)
+		}
+	}
+
+	repos, err := store.ListRepos(ctx)
+	if err != nil || len(repos) != 2 || repos[0] != "analytics" || repos[1] != "billing" {
+		t.Fatalf("ListRepos = %v, %v", repos, err)
+	}
+	commits, err := store.ListCommits(ctx, ListCommitsOptions{Repo: "billing"})
+	if err != nil || len(commits) != 3 {
+		t.Fatalf("ListCommits = %d commits, %v", len(commits), err)
+	}
+
+	// Every key of a repository lands in the slot of its hash tag.
+	for _, key := range mini.Keys() {
+		if strings.HasPrefix(key, "meta:") {
+			continue
+		}
+		repo := "analytics"
+		if strings.Contains(key, "{billing}") {
+			repo = "billing"
+		} else if !strings.Contains(key, "{analytics}") {
+			t.Fatalf("key %q has no repository hash tag", key)
+		}
+		if clusterSlot(key) != clusterSlot(repo) {
+			t.Fatalf("key %q is in slot %d, want %d", key, clusterSlot(key), clusterSlot(repo))
+		}
+	}
+}
+
+func TestKeyDBStoreTLS(t *testing.T) {
+	dir := t.TempDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "keydb"},
+		DNSNames:              []string{"keydb"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("write ca: %v", err)
+	}
+	mini, err := miniredis.RunTLS(&tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}})
+	if err != nil {
+		t.Fatalf("start miniredis: %v", err)
+	}
+	t.Cleanup(mini.Close)
+
+	if _, err := NewKeyDBStore(Config{Addr: mini.Addr(), DialTimeout: time.Second}, Options{}); err == nil {
+		t.Fatalf("expected a plain connection to a TLS server to fail")
+	}
+	if _, err := NewKeyDBStore(Config{Addr: mini.Addr(), TLS: KeyDBTLSConfig{Enabled: true, ServerName: "keydb"}}, Options{}); err == nil {
+		t.Fatalf("expected an unknown CA to be rejected")
+	}
+	if _, err := NewKeyDBStore(Config{Addr: mini.Addr(), TLS: KeyDBTLSConfig{Enabled: true, CAFile: filepath.Join(dir, "missing.pem")}}, Options{}); err == nil {
+		t.Fatalf("expected a missing CA file to fail")
+	}
+	store, err := NewKeyDBStore(Config{Addr: mini.Addr(), TLS: KeyDBTLSConfig{Enabled: true, CAFile: caFile, ServerName: "keydb"}, PoolSize: 2}, Options{})
+	if err != nil {
+		t.Fatalf("create store over TLS: %v", err)
+	}
+	if _, err := store.PutBlobAndCommit(context.Background(), BlobWriteRequest{Name: "analytics", Content: "one", AuthorName: "Alice", AuthorID: "alice@id"}); err != nil {
+		t.Fatalf("PutBlobAndCommit over TLS: %v", err)
+	}
+}
@@ -2,8 +2,10 @@ package storage
 
 import (
 	"context"
+	"fmt"
 	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/onexay/kv-vs/internal/types"
@@ -12,16 +14,36 @@ import (
 // Store defines required persistence operations for versioned blobs.
 type Store interface {
 	PutBlobAndCommit(ctx context.Context, req BlobWriteRequest) (BlobCommitResult, error)
-	ListCommits(ctx context.Context, opts ListCommitsOptions) []types.Commit
+	ListCommits(ctx context.Context, opts ListCommitsOptions) ([]types.Commit, error)
 	GetCommit(ctx context.Context, repo, hash string) (types.Commit, string, error)
 	UpsertBranch(ctx context.Context, req BranchRequest) (types.Branch, error)
-	ListBranches(ctx context.Context, repo string) []types.Branch
+	ListBranches(ctx context.Context, repo string) ([]types.Branch, error)
 	GetBranch(ctx context.Context, repo, name string) (types.Branch, error)
 	CreateTag(ctx context.Context, req TagRequest) (types.Tag, error)
-	ListTags(ctx context.Context, repo string) []types.Tag
+	ListTags(ctx context.Context, repo string) ([]types.Tag, error)
 	GetTag(ctx context.Context, repo, name string) (types.Tag, error)
 	SetPolicy(ctx context.Context, policy RetentionPolicy) (RetentionPolicy, error)
 	GetPolicy(ctx context.Context, repo string) (RetentionPolicy, error)
+	// PolicyHistory returns every version of a repository's policy, oldest first.
+	PolicyHistory(ctx context.Context, repo string) ([]RetentionPolicy, error)
+	Check(ctx context.Context, opts CheckOptions) (CheckReport, error)
+	CollectGarbage(ctx context.Context, opts GCOptions) (GCReport, error)
+	PinCommit(ctx context.Context, req PinRequest) (types.Pin, error)
+	UnpinCommit(ctx context.Context, repo, hash string) error
+	ListPins(ctx context.Context, repo string) ([]PinnedCommit, error)
+	// EnforceRetention runs one synchronous retention pass over repo.
+	EnforceRetention(ctx context.Context, repo string) (RetentionRun, error)
+	// ListRepos returns the names of repositories known to the store.
+	ListRepos(ctx context.Context) ([]string, error)
+	// Recompress rewrites repo's stored content with its policy codec and
+	// reports the resulting compression stats.
+	Recompress(ctx context.Context, repo string) (CompressionReport, error)
+	// DataKeys lists repo's data keys, without key material.
+	DataKeys(ctx context.Context, repo string) ([]DataKey, error)
+	// Reencrypt optionally rotates repo's data key, rewraps its data keys
+	// under the active master key and reseals content under the current key.
+	Reencrypt(ctx context.Context, repo string, rotate bool) (ReencryptReport, error)
+	Close() error
 }
 
 // NotFoundError signals missing records.
@@ -44,6 +66,28 @@ func (e *ConflictError) Error() string {
 	return e.Resource + " " + e.Key + " conflicts with existing state"
 }
 
+// GoneError reports a record whose content was permanently purged by retention.
+type GoneError struct {
+	Resource string
+	Key      string
+}
+
+func (e *GoneError) Error() string {
+	return e.Resource + " " + e.Key + " was purged by retention policy"
+}
+
+// CooldownError rejects a change made before the cooldown since the previous
+// change has elapsed.
+type CooldownError struct {
+	Resource string
+	Key      string
+	Until    time.Time
+}
+
+func (e *CooldownError) Error() string {
+	return e.Resource + " " + e.Key + " cannot change again until " + e.Until.UTC().Format(time.RFC3339)
+}
+
 // ValidationError represents invalid input supplied by clients.
 type ValidationError struct {
 	Message string
@@ -53,42 +97,153 @@ func (e *ValidationError) Error() string {
 	return e.Message
 }
 
+// PartialResultError accompanies list results that omit entries the backend
+// could not read. Keys names the unreadable records in backend terms.
+type PartialResultError struct {
+	Resource string
+	Keys     []string
+}
+
+func (e *PartialResultError) Error() string {
+	return fmt.Sprintf("%d %s entries could not be read", len(e.Keys), e.Resource)
+}
+
+// UnavailableError signals that the storage backend failed to serve a request.
+// RetryAfter, when set, suggests how long clients should wait before trying
+// again.
+type UnavailableError struct {
+	Op         string
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *UnavailableError) Error() string {
+	return "storage unavailable: " + e.Op + ": " + e.Err.Error()
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// partialResult returns a PartialResultError when keys is non-empty.
+func partialResult(resource string, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return &PartialResultError{Resource: resource, Keys: keys}
+}
+
 // memoryStore provides an in-memory fallback for development and testing.
+// Each repository's state has its own lock, so a write to one repository
+// never waits on another.
 type memoryStore struct {
+	// reposMu guards the repos map. It is held for writing only while a
+	// repository is added.
+	reposMu        sync.RWMutex
+	repos          map[string]*memoryRepo
+	usage          *memoryUsage
+	clock          func() time.Time
+	policyCooldown time.Duration
+	defaultPolicy  RetentionPolicy
+	archive        Archive
+	keys           *dataKeyring
+	notify         func(repo string)
+	journal        *memoryJournal
+}
+
+// memoryRepo holds the state of one repository, guarded by mu.
+type memoryRepo struct {
+	name          string
+	usage         *memoryUsage
 	mu            sync.RWMutex
-	clock         func() time.Time
 	commits       map[string]types.Commit
 	contents      map[string]string
-	repoCommits   map[string][]string
-	branches      map[string]map[string]types.Branch // repo -> branch -> branch metadata
-	tags          map[string]map[string]types.Tag    // repo -> tag -> tag metadata
-	authors       map[string]map[string]string       // repo -> authorID -> authorName
-	policies      map[string]RetentionPolicy
-	defaultPolicy RetentionPolicy
-	archive       Archive
+	history       []string                // commit hashes in commit order
+	branches      map[string]types.Branch // branch -> branch metadata
+	tags          map[string]types.Tag    // tag -> tag metadata
+	pins          map[string]types.Pin    // commit -> explicit pin
+	authors       map[string]string       // authorID -> authorName
+	policy        *RetentionPolicy
+	policyHistory []RetentionPolicy // every policy version, oldest first
+	dataKeys      []DataKey         // wrapped data keys, by ID
+	// indexed is set once the history index exists, so ListRepos does not
+	// wait on repositories being written.
+	indexed atomic.Bool
+}
+
+func newMemoryRepo(name string, usage *memoryUsage) *memoryRepo {
+	return &memoryRepo{
+		name:     name,
+		usage:    usage,
+		commits:  make(map[string]types.Commit),
+		contents: make(map[string]string),
+		branches: make(map[string]types.Branch),
+		tags:     make(map[string]types.Tag),
+		pins:     make(map[string]types.Pin),
+		authors:  make(map[string]string),
+	}
 }
 
 // NewMemoryStore initializes an empty in-memory store.
 func NewMemoryStore(opts Options) Store {
-	return &memoryStore{
-		clock:         time.Now,
-		commits:       make(map[string]types.Commit),
-		contents:      make(map[string]string),
-		repoCommits:   make(map[string][]string),
-		branches:      make(map[string]map[string]types.Branch),
-		tags:          make(map[string]map[string]types.Tag),
-		authors:       make(map[string]map[string]string),
-		policies:      make(map[string]RetentionPolicy),
-		defaultPolicy: RetentionPolicy{HotCommitLimit: opts.Retention.HotCommitLimit, HotDuration: opts.Retention.HotDuration},
-		archive:       opts.Archive,
+	return newMemoryStore(opts)
+}
+
+func newMemoryStore(opts Options) *memoryStore {
+	m := &memoryStore{
+		repos:          make(map[string]*memoryRepo),
+		usage:          newMemoryUsage(opts.MemoryMaxBytes),
+		clock:          time.Now,
+		policyCooldown: opts.PolicyCooldown,
+		defaultPolicy:  opts.Retention.policy(),
+		archive:        opts.Archive,
+		notify:         opts.notifier(),
+	}
+	m.keys = newDataKeyring(opts.MasterKeys, m)
+	return m
+}
+
+// repo returns the state of name, or nil if nothing was stored for it.
+func (m *memoryStore) repo(name string) *memoryRepo {
+	m.reposMu.RLock()
+	defer m.reposMu.RUnlock()
+	return m.repos[name]
+}
+
+// ensureRepo returns the state of name, adding it if needed. It must not be
+// called while holding a repository lock.
+func (m *memoryStore) ensureRepo(name string) *memoryRepo {
+	if r := m.repo(name); r != nil {
+		return r
+	}
+	m.reposMu.Lock()
+	defer m.reposMu.Unlock()
+	r, ok := m.repos[name]
+	if !ok {
+		r = newMemoryRepo(name, m.usage)
+		m.repos[name] = r
 	}
+	return r
 }
 
+// PutBlobAndCommit commits req, then spills content to the archive if the
+// new content took hot content over the memory budget.
 func (m *memoryStore) PutBlobAndCommit(ctx context.Context, req BlobWriteRequest) (BlobCommitResult, error) {
 	if ctx == nil {
 		ctx = context.Background()
 	}
+	result, err := m.putBlob(ctx, req)
+	if err == nil {
+		m.spill(ctx)
+	}
+	return result, err
+}
 
+// putBlob computes the diff against the branch head without holding the
+// repository lock, then commits if the head has not moved meanwhile. A head
+// that moved is diffed again under the lock, or from the start if its
+// content was spilled to the archive.
+func (m *memoryStore) putBlob(ctx context.Context, req BlobWriteRequest) (BlobCommitResult, error) {
 	if req.Name == "" {
 		return BlobCommitResult{}, &ValidationError{Message: "name is required"}
 	}
@@ -104,44 +259,47 @@ func (m *memoryStore) PutBlobAndCommit(ctx context.Context, req BlobWriteRequest
 		branch = defaultBranch
 	}
 
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	repoBranches, ok := m.branches[req.Name]
-	if !ok {
-		repoBranches = make(map[string]types.Branch)
-		m.branches[req.Name] = repoBranches
+	sealed, err := m.sealForJournal(ctx, req.Name, req.Content)
+	if err != nil {
+		return BlobCommitResult{}, err
 	}
 
-	repoAuthors, ok := m.authors[req.Name]
-	if !ok {
-		repoAuthors = make(map[string]string)
-		m.authors[req.Name] = repoAuthors
-	}
-	if existingName, ok := repoAuthors[req.AuthorID]; ok && existingName != req.AuthorName {
-		return BlobCommitResult{}, &ConflictError{Resource: "author", Key: req.AuthorID}
+	r := m.ensureRepo(req.Name)
+	for {
+		parent, previousContent, err := m.branchHead(ctx, r, branch)
+		if err != nil {
+			return BlobCommitResult{}, err
+		}
+		diff := computeDiff(previousContent, req.Content)
+
+		r.mu.Lock()
+		if r.branches[branch].Commit != parent {
+			var hot bool
+			if parent, previousContent, hot = r.headLocked(branch); !hot {
+				r.mu.Unlock()
+				continue
+			}
+			diff = computeDiff(previousContent, req.Content)
+		}
+		result, err := m.commitBlobLocked(r, req, branch, parent, diff, sealed)
+		r.mu.Unlock()
+		return result, err
 	}
-	repoAuthors[req.AuthorID] = req.AuthorName
+}
 
-	parent := ""
-	if existing, ok := repoBranches[branch]; ok {
-		parent = existing.Commit
-	}
-	previousContent := ""
-	if parent != "" {
-		if content, ok := m.contents[parent]; ok {
-			previousContent = content
-		} else {
-			return BlobCommitResult{}, &NotFoundError{Resource: "commit", Key: parent}
-		}
+// commitBlobLocked writes the commit of req on top of parent, journaling
+// sealed in place of the content when set. Callers must hold r.mu for
+// writing.
+func (m *memoryStore) commitBlobLocked(r *memoryRepo, req BlobWriteRequest, branch, parent, diff string, sealed []byte) (BlobCommitResult, error) {
+	if existingName, ok := r.authors[req.AuthorID]; ok && existingName != req.AuthorName {
+		return BlobCommitResult{}, &ConflictError{Resource: "author", Key: req.AuthorID}
 	}
 
-	diff := computeDiff(previousContent, req.Content)
 	contentHash := computeContentHash(req.Content)
 	now := m.clock().UTC()
 	commitHash := computeCommitHash(req.Name, branch, req.Content, parent, now)
 
-	if _, exists := m.commits[commitHash]; exists {
+	if _, exists := r.commits[commitHash]; exists {
 		return BlobCommitResult{}, &ConflictError{Resource: "commit", Key: commitHash}
 	}
 
@@ -158,17 +316,11 @@ func (m *memoryStore) PutBlobAndCommit(ctx context.Context, req BlobWriteRequest
 		Archived:    false,
 	}
 
-	m.commits[commitHash] = commit
-	m.contents[commitHash] = req.Content
-	repoBranches[branch] = types.Branch{
-		Repo:      req.Name,
-		Name:      branch,
-		Commit:    commitHash,
-		UpdatedAt: now,
+	if err := m.commitLocked(r, journalRecord{Op: journalOpCommit, Commit: &commit, Content: req.Content, Sealed: sealed}); err != nil {
+		return BlobCommitResult{}, err
 	}
-	m.repoCommits[req.Name] = append(m.repoCommits[req.Name], commitHash)
 
-	m.applyRetentionLocked(ctx, req.Name)
+	m.notify(req.Name)
 
 	return BlobCommitResult{
 		CommitHash: commitHash,
@@ -178,20 +330,56 @@ func (m *memoryStore) PutBlobAndCommit(ctx context.Context, req BlobWriteRequest
 	}, nil
 }
 
-func (m *memoryStore) ListCommits(ctx context.Context, opts ListCommitsOptions) []types.Commit {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+// headLocked returns the head commit of branch and its hot content. hot is
+// false when the head's content is not in memory; a new branch has an empty,
+// hot head.
+func (r *memoryRepo) headLocked(branch string) (parent, content string, hot bool) {
+	parent = r.branches[branch].Commit
+	if parent == "" {
+		return "", "", true
+	}
+	content, hot = r.contents[parent]
+	return parent, content, hot
+}
+
+// branchHead returns the head commit of branch and its content, reading
+// content that was archived or spilled from the archive without holding the
+// repository lock. A purged head has empty content.
+func (m *memoryStore) branchHead(ctx context.Context, r *memoryRepo, branch string) (string, string, error) {
+	r.mu.RLock()
+	parent, content, hot := r.headLocked(branch)
+	commit := r.commits[parent]
+	r.mu.RUnlock()
+	if hot {
+		return parent, content, nil
+	}
+	if commit.Hash == "" {
+		return "", "", &NotFoundError{Resource: "commit", Key: parent}
+	}
+	content, err := parentContent(ctx, m.archive, m.keys, r.name, commit)
+	if err != nil {
+		return "", "", err
+	}
+	return parent, content, nil
+}
 
-	commitHashes, ok := m.repoCommits[opts.Repo]
-	if !ok {
-		return []types.Commit{}
+func (m *memoryStore) ListCommits(ctx context.Context, opts ListCommitsOptions) ([]types.Commit, error) {
+	r := m.repo(opts.Repo)
+	if r == nil {
+		return []types.Commit{}, nil
 	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 
+	commitHashes := r.history
 	result := make([]types.Commit, 0, len(commitHashes))
+	var unreadable []string
 	limit := opts.Limit
 	appendCommit := func(hash string) {
-		if commit, ok := m.commits[hash]; ok {
+		if commit, ok := r.commits[hash]; ok {
 			result = append(result, commit)
+		} else {
+			unreadable = append(unreadable, hash)
 		}
 	}
 
@@ -211,27 +399,39 @@ func (m *memoryStore) ListCommits(ctx context.Context, opts ListCommitsOptions)
 		}
 	}
 
-	return result
+	return result, partialResult("commit", unreadable)
 }
 
 func (m *memoryStore) GetCommit(ctx context.Context, repo, hash string) (types.Commit, string, error) {
 	if ctx == nil {
 		ctx = context.Background()
 	}
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	commit, ok := m.commits[hash]
-	if !ok || commit.Repo != repo {
+	r := m.repo(repo)
+	if r == nil {
 		return types.Commit{}, "", &NotFoundError{Resource: "commit", Key: hash}
 	}
+	r.mu.RLock()
+	commit, ok := r.commits[hash]
+	content, hot := r.contents[hash]
+	r.mu.RUnlock()
 
-	content, ok := m.contents[hash]
 	if !ok {
+		return types.Commit{}, "", &NotFoundError{Resource: "commit", Key: hash}
+	}
+	if hot {
+		m.usage.touch(hotKey{repo, hash})
+	}
+	if commit.Purged {
+		return commit, "", &GoneError{Resource: "content", Key: hash}
+	}
+
+	// The archive is read without holding the lock: the keyring may need to
+	// load data keys from the store.
+	if !hot {
 		if m.archive == nil {
 			return types.Commit{}, "", &NotFoundError{Resource: "content", Key: hash}
 		}
-		data, err := m.archive.Fetch(ctx, repo, hash)
+		data, err := readArchived(ctx, m.archive, m.keys, repo, hash)
 		if err != nil {
 			return types.Commit{}, "", err
 		}
@@ -242,124 +442,295 @@ func (m *memoryStore) GetCommit(ctx context.Context, repo, hash string) (types.C
 }
 
 func (m *memoryStore) SetPolicy(ctx context.Context, policy RetentionPolicy) (RetentionPolicy, error) {
-	if policy.Repo == "" {
-		return RetentionPolicy{}, &ValidationError{Message: "repository name is required"}
-	}
-	if policy.HotCommitLimit < 0 {
-		return RetentionPolicy{}, &ValidationError{Message: "hotCommitLimit must be >= 0"}
-	}
-	if policy.HotDuration < 0 {
-		return RetentionPolicy{}, &ValidationError{Message: "hotDuration must be >= 0"}
-	}
-	if ctx == nil {
-		ctx = context.Background()
-	}
-
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	r := m.ensureRepo(policy.Repo)
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	existing, ok := m.policies[policy.Repo]
-	if ok && existing.Locked && (existing.HotCommitLimit != policy.HotCommitLimit || existing.HotDuration != policy.HotDuration) {
-		return existing.Copy(), &ConflictError{Resource: "policy", Key: policy.Repo}
+	next, unchanged, err := nextPolicy(m.policyLocked(r, policy.Repo), policy, m.policyCooldown, m.clock())
+	if err != nil || unchanged {
+		return next, err
 	}
-
-	policy.Locked = true
-	m.policies[policy.Repo] = policy
-	m.applyRetentionLocked(ctx, policy.Repo)
-	return policy.Copy(), nil
+	if err := m.commitLocked(r, journalRecord{Op: journalOpPolicy, Policy: &next}); err != nil {
+		return RetentionPolicy{}, err
+	}
+	m.notify(policy.Repo)
+	return next.Copy(), nil
 }
 
 func (m *memoryStore) GetPolicy(ctx context.Context, repo string) (RetentionPolicy, error) {
 	if repo == "" {
 		return RetentionPolicy{}, &ValidationError{Message: "name query parameter required"}
 	}
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	policy := m.getPolicyLocked(repo)
-	return policy.Copy(), nil
+	return m.getPolicy(repo), nil
+}
+
+func (m *memoryStore) PolicyHistory(ctx context.Context, repo string) ([]RetentionPolicy, error) {
+	if repo == "" {
+		return nil, &ValidationError{Message: "name query parameter required"}
+	}
+	history := []RetentionPolicy{}
+	r := m.repo(repo)
+	if r == nil {
+		return history, nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	history = append(history, r.policyHistory...)
+	if len(history) == 0 && r.policy != nil {
+		history = append(history, m.policyLocked(r, repo))
+	}
+	return history, nil
 }
 
-func (m *memoryStore) getPolicyLocked(repo string) RetentionPolicy {
-	if policy, ok := m.policies[repo]; ok {
+// getPolicy returns the policy of repo, or the default policy.
+func (m *memoryStore) getPolicy(repo string) RetentionPolicy {
+	r := m.repo(repo)
+	if r == nil {
+		return m.defaultPolicy.WithRepo(repo)
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return m.policyLocked(r, repo)
+}
+
+// policyLocked returns the policy of r, or the default policy.
+func (m *memoryStore) policyLocked(r *memoryRepo, repo string) RetentionPolicy {
+	if r.policy != nil {
+		policy := *r.policy
+		if policy.Version == 0 {
+			// Set before policies were versioned.
+			policy.Version = 1
+		}
 		return policy.Copy()
 	}
 	return m.defaultPolicy.WithRepo(repo)
 }
 
-func (m *memoryStore) applyRetentionLocked(ctx context.Context, repo string) {
-	if m.archive == nil {
-		return
-	}
-	policy := m.getPolicyLocked(repo)
-	if policy.HotCommitLimit <= 0 && policy.HotDuration <= 0 {
-		return
+// EnforceRetention plans under the repository's read lock and performs
+// archive I/O without holding it, re-checking each commit before journaling
+// a change.
+func (m *memoryStore) EnforceRetention(ctx context.Context, repo string) (RetentionRun, error) {
+	if repo == "" {
+		return RetentionRun{}, &ValidationError{Message: "name query parameter required"}
 	}
-	hashes := m.repoCommits[repo]
-	if len(hashes) == 0 {
-		return
+	if ctx == nil {
+		ctx = context.Background()
 	}
+	run := RetentionRun{Repo: repo, StartedAt: m.clock().UTC()}
 
-	active := make([]types.Commit, 0, len(hashes))
-	for _, hash := range hashes {
-		commit := m.commits[hash]
-		if commit.Archived {
-			continue
-		}
-		active = append(active, commit)
+	r := m.repo(repo)
+	if r == nil {
+		return run, nil
+	}
+	r.mu.RLock()
+	policy := m.policyLocked(r, repo)
+	if !policy.enforced() {
+		r.mu.RUnlock()
+		return run, nil
+	}
+	entries := make([]retentionEntry, 0, len(r.history))
+	for _, hash := range r.history {
+		commit := r.commits[hash]
+		entries = append(entries, retentionEntry{Hash: hash, Timestamp: commit.Timestamp, Archived: commit.Archived, Purged: commit.Purged})
 	}
+	reasons := r.pinReasonsLocked(policy)
+	r.mu.RUnlock()
 
-	toArchive := make(map[string]struct{})
-	if policy.HotDuration > 0 {
-		cutoff := m.clock().Add(-policy.HotDuration)
-		for _, commit := range active {
-			if commit.Timestamp.Before(cutoff) {
-				toArchive[commit.Hash] = struct{}{}
-			}
+	plan := planRetentionPass(entries, reasons, policy, m.clock(), m.archive != nil)
+	plan.Codec = policy.contentCodec(m.defaultPolicy)
+	applyRetention(ctx, m, repo, plan, &run)
+	return run, nil
+}
+
+func (m *memoryStore) ListRepos(ctx context.Context) ([]string, error) {
+	m.reposMu.RLock()
+	defer m.reposMu.RUnlock()
+	repos := make([]string, 0, len(m.repos))
+	for name, r := range m.repos {
+		if r.indexed.Load() {
+			repos = append(repos, name)
 		}
 	}
+	slices.Sort(repos)
+	return repos, nil
+}
 
-	if policy.HotCommitLimit > 0 {
-		remaining := make([]types.Commit, 0, len(active))
-		for _, commit := range active {
-			if _, ok := toArchive[commit.Hash]; !ok {
-				remaining = append(remaining, commit)
-			}
+// Recompress only rewrites archived content: hot content is kept in memory
+// uncompressed and reported as such.
+func (m *memoryStore) Recompress(ctx context.Context, repo string) (CompressionReport, error) {
+	if repo == "" {
+		return CompressionReport{}, &ValidationError{Message: "name query parameter required"}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	report := CompressionReport{Repo: repo, StartedAt: m.clock().UTC()}
+	r := m.repo(repo)
+	if r == nil {
+		r = newMemoryRepo(repo, m.usage)
+	}
+	r.mu.RLock()
+	report.Codec = m.policyLocked(r, repo).contentCodec(m.defaultPolicy)
+	var archived []string
+	for _, hash := range r.history {
+		if content, ok := r.contents[hash]; ok {
+			report.Hot.add(CodecNone, false, len(content), len(content))
 		}
-		if excess := len(remaining) - policy.HotCommitLimit; excess > 0 {
-			for i := 0; i < excess; i++ {
-				toArchive[remaining[i].Hash] = struct{}{}
-			}
+		if commit := r.commits[hash]; commit.Archived && !commit.Purged {
+			archived = append(archived, hash)
 		}
 	}
+	r.mu.RUnlock()
+
+	recompressArchive(ctx, m.archive, m.keys, repo, archived, report.Codec, func(hash string) bool {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		commit, ok := r.commits[hash]
+		return ok && !commit.Purged
+	}, &report)
+	return report, nil
+}
 
-	for hash := range toArchive {
-		m.flushCommitLocked(ctx, repo, hash)
+// restoreCommit copies archived content of a pinned commit back into hot
+// storage. The archive copy is kept. Content that does not fit the memory
+// budget stays archived, so restores and spills do not undo each other.
+func (m *memoryStore) restoreCommit(ctx context.Context, repo, hash string) error {
+	data, err := fetchContent(ctx, m.archive, m.keys, repo, hash)
+	if err != nil {
+		return err
+	}
+	if !m.usage.fits(int64(len(data))) {
+		return errMemoryBudget
+	}
+	sealed, err := m.sealForJournal(ctx, repo, string(data))
+	if err != nil {
+		return err
+	}
+	r := m.repo(repo)
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if commit, ok := r.commits[hash]; !ok || !commit.Archived || commit.Purged {
+		return nil
 	}
+	return m.commitLocked(r, journalRecord{Op: journalOpRestore, Repo: repo, Hash: hash, Content: string(data), Sealed: sealed})
 }
 
-func (m *memoryStore) flushCommitLocked(ctx context.Context, repo, hash string) {
-	if m.archive == nil {
-		return
+// sealForJournal encrypts content for the journal when the store is durable
+// and encryption is enabled, and returns nil otherwise. It may create the
+// repository's first data key, so callers must not hold the repository lock.
+func (m *memoryStore) sealForJournal(ctx context.Context, repo, content string) ([]byte, error) {
+	if m.journal == nil || m.keys == nil {
+		return nil, nil
 	}
+	return m.keys.encode(ctx, repo, CodecNone, []byte(content))
+}
+
+func (m *memoryStore) DataKeys(ctx context.Context, repo string) ([]DataKey, error) {
 	if ctx == nil {
 		ctx = context.Background()
 	}
-	commit, ok := m.commits[hash]
-	if !ok || commit.Archived {
-		return
+	return m.keys.list(ctx, repo)
+}
+
+func (m *memoryStore) Reencrypt(ctx context.Context, repo string, rotate bool) (ReencryptReport, error) {
+	return reencrypt(ctx, m.keys, m, repo, rotate)
+}
+
+func (m *memoryStore) loadDataKeys(_ context.Context, repo string) ([]DataKey, error) {
+	r := m.repo(repo)
+	if r == nil {
+		return nil, nil
 	}
-	content, ok := m.contents[hash]
-	if !ok {
-		commit.Archived = true
-		m.commits[hash] = commit
-		return
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return slices.Clone(r.dataKeys), nil
+}
+
+func (m *memoryStore) createDataKey(_ context.Context, key DataKey) error {
+	r := m.ensureRepo(key.Repo)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.dataKeys {
+		if existing.ID == key.ID {
+			return &ConflictError{Resource: "data key", Key: fmt.Sprintf("%s/%d", key.Repo, key.ID)}
+		}
+	}
+	return m.commitLocked(r, journalRecord{Op: journalOpDataKey, DataKey: &key})
+}
+
+func (m *memoryStore) rewrapDataKey(_ context.Context, key DataKey) error {
+	r := m.ensureRepo(key.Repo)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return m.commitLocked(r, journalRecord{Op: journalOpDataKey, DataKey: &key})
+}
+
+func (r *memoryRepo) pinReasonsLocked(policy RetentionPolicy) map[string][]PinReason {
+	branches := make([]types.Branch, 0, len(r.branches))
+	for _, branch := range r.branches {
+		branches = append(branches, branch)
 	}
-	if err := m.archive.Store(ctx, repo, hash, []byte(content)); err != nil {
-		return
+	tags := make([]types.Tag, 0, len(r.tags))
+	for _, tag := range r.tags {
+		tags = append(tags, tag)
 	}
-	delete(m.contents, hash)
-	commit.Archived = true
-	m.commits[hash] = commit
+	pins := make([]types.Pin, 0, len(r.pins))
+	for _, pin := range r.pins {
+		pins = append(pins, pin)
+	}
+	return pinReasons(policy, branches, tags, pins)
+}
+
+// purgeCommit deletes the archived copy of hash before dropping hot content,
+// so a failed archive removal is retried on the next pass.
+func (m *memoryStore) purgeCommit(ctx context.Context, repo, hash string) error {
+	if m.archive != nil {
+		if err := m.archive.Remove(ctx, repo, hash); err != nil {
+			return err
+		}
+	}
+	r := m.repo(repo)
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if commit, ok := r.commits[hash]; !ok || commit.Purged {
+		return nil
+	}
+	return m.commitLocked(r, journalRecord{Op: journalOpPurge, Repo: repo, Hash: hash})
+}
+
+func (m *memoryStore) archiveCommit(ctx context.Context, repo, hash string, codec Codec) error {
+	r := m.repo(repo)
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	commit, ok := r.commits[hash]
+	content, hot := r.contents[hash]
+	r.mu.RUnlock()
+	if !ok || commit.Archived || commit.Purged {
+		return nil
+	}
+	if hot {
+		stored, err := m.keys.encode(ctx, repo, codec, []byte(content))
+		if err != nil {
+			return err
+		}
+		if err := m.archive.Store(ctx, repo, hash, stored); err != nil {
+			return err
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if commit, ok := r.commits[hash]; !ok || commit.Archived || commit.Purged {
+		return nil
+	}
+	return m.commitLocked(r, journalRecord{Op: journalOpArchive, Repo: repo, Hash: hash})
 }
 
 func (m *memoryStore) UpsertBranch(ctx context.Context, req BranchRequest) (types.Branch, error) {
@@ -367,18 +738,15 @@ func (m *memoryStore) UpsertBranch(ctx context.Context, req BranchRequest) (type
 		return types.Branch{}, &ValidationError{Message: "repo, name, and commit are required"}
 	}
 
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	commit, ok := m.commits[req.Commit]
-	if !ok || commit.Repo != req.Repo {
+	r := m.repo(req.Repo)
+	if r == nil {
 		return types.Branch{}, &NotFoundError{Resource: "commit", Key: req.Commit}
 	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	repoBranches, ok := m.branches[req.Repo]
-	if !ok {
-		repoBranches = make(map[string]types.Branch)
-		m.branches[req.Repo] = repoBranches
+	if _, ok := r.commits[req.Commit]; !ok {
+		return types.Branch{}, &NotFoundError{Resource: "commit", Key: req.Commit}
 	}
 
 	branch := types.Branch{
@@ -388,41 +756,42 @@ func (m *memoryStore) UpsertBranch(ctx context.Context, req BranchRequest) (type
 		UpdatedAt: m.clock().UTC(),
 	}
 
-	repoBranches[req.Name] = branch
+	if err := m.commitLocked(r, journalRecord{Op: journalOpBranch, Branch: &branch}); err != nil {
+		return types.Branch{}, err
+	}
+	m.notify(req.Repo)
 	return branch, nil
 }
 
-func (m *memoryStore) ListBranches(ctx context.Context, repo string) []types.Branch {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	repoBranches, ok := m.branches[repo]
-	if !ok {
-		return []types.Branch{}
+func (m *memoryStore) ListBranches(ctx context.Context, repo string) ([]types.Branch, error) {
+	r := m.repo(repo)
+	if r == nil {
+		return []types.Branch{}, nil
 	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 
-	names := make([]string, 0, len(repoBranches))
-	for name := range repoBranches {
+	names := make([]string, 0, len(r.branches))
+	for name := range r.branches {
 		names = append(names, name)
 	}
 	slices.Sort(names)
 	result := make([]types.Branch, 0, len(names))
 	for _, name := range names {
-		result = append(result, repoBranches[name])
+		result = append(result, r.branches[name])
 	}
-	return result
+	return result, nil
 }
 
 func (m *memoryStore) GetBranch(ctx context.Context, repo, name string) (types.Branch, error) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	repoBranches, ok := m.branches[repo]
-	if !ok {
+	r := m.repo(repo)
+	if r == nil {
 		return types.Branch{}, &NotFoundError{Resource: "branch", Key: name}
 	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 
-	branch, ok := repoBranches[name]
+	branch, ok := r.branches[name]
 	if !ok {
 		return types.Branch{}, &NotFoundError{Resource: "branch", Key: name}
 	}
@@ -435,21 +804,18 @@ func (m *memoryStore) CreateTag(ctx context.Context, req TagRequest) (types.Tag,
 		return types.Tag{}, &ValidationError{Message: "repo, name, and commit are required"}
 	}
 
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	commit, ok := m.commits[req.Commit]
-	if !ok || commit.Repo != req.Repo {
+	r := m.repo(req.Repo)
+	if r == nil {
 		return types.Tag{}, &NotFoundError{Resource: "commit", Key: req.Commit}
 	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	repoTags, ok := m.tags[req.Repo]
-	if !ok {
-		repoTags = make(map[string]types.Tag)
-		m.tags[req.Repo] = repoTags
+	if _, ok := r.commits[req.Commit]; !ok {
+		return types.Tag{}, &NotFoundError{Resource: "commit", Key: req.Commit}
 	}
 
-	if _, exists := repoTags[req.Name]; exists {
+	if _, exists := r.tags[req.Name]; exists {
 		return types.Tag{}, &ConflictError{Resource: "tag", Key: req.Name}
 	}
 
@@ -461,44 +827,228 @@ func (m *memoryStore) CreateTag(ctx context.Context, req TagRequest) (types.Tag,
 		CreatedAt: m.clock().UTC(),
 	}
 
-	repoTags[req.Name] = tag
+	if err := m.commitLocked(r, journalRecord{Op: journalOpTag, Tag: &tag}); err != nil {
+		return types.Tag{}, err
+	}
+	m.notify(req.Repo)
 	return tag, nil
 }
 
-func (m *memoryStore) ListTags(ctx context.Context, repo string) []types.Tag {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	repoTags, ok := m.tags[repo]
-	if !ok {
-		return []types.Tag{}
+func (m *memoryStore) ListTags(ctx context.Context, repo string) ([]types.Tag, error) {
+	r := m.repo(repo)
+	if r == nil {
+		return []types.Tag{}, nil
 	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 
-	names := make([]string, 0, len(repoTags))
-	for name := range repoTags {
+	names := make([]string, 0, len(r.tags))
+	for name := range r.tags {
 		names = append(names, name)
 	}
 	slices.Sort(names)
 	result := make([]types.Tag, 0, len(names))
 	for _, name := range names {
-		result = append(result, repoTags[name])
+		result = append(result, r.tags[name])
 	}
-	return result
+	return result, nil
 }
 
 func (m *memoryStore) GetTag(ctx context.Context, repo, name string) (types.Tag, error) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	repoTags, ok := m.tags[repo]
-	if !ok {
+	r := m.repo(repo)
+	if r == nil {
 		return types.Tag{}, &NotFoundError{Resource: "tag", Key: name}
 	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 
-	tag, ok := repoTags[name]
+	tag, ok := r.tags[name]
 	if !ok {
 		return types.Tag{}, &NotFoundError{Resource: "tag", Key: name}
 	}
 
 	return tag, nil
 }
+
+func (m *memoryStore) Check(ctx context.Context, opts CheckOptions) (CheckReport, error) {
+	if opts.Repo == "" {
+		return CheckReport{}, &ValidationError{Message: "name query parameter required"}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	inv := m.inventory(opts.Repo)
+	return runCheck(ctx, opts.Repo, inv, m.archive, m.keys, m, opts.Repair, m.clock()), nil
+}
+
+// inventory snapshots the repository for Check and CollectGarbage.
+func (m *memoryStore) inventory(repo string) repoInventory {
+	r := m.repo(repo)
+	if r == nil {
+		r = newMemoryRepo(repo, m.usage)
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	inv := repoInventory{
+		Commits: make(map[string]types.Commit),
+		Hot:     make(map[string]bool),
+		Indexed: make(map[string]bool),
+		LoadContent: func(_ context.Context, hash string) (string, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			content, ok := r.contents[hash]
+			if !ok {
+				return "", &NotFoundError{Resource: "content", Key: hash}
+			}
+			return content, nil
+		},
+	}
+	for hash, commit := range r.commits {
+		inv.Commits[hash] = commit
+		if _, ok := r.contents[hash]; ok {
+			inv.Hot[hash] = true
+		}
+	}
+	for _, hash := range r.history {
+		inv.Indexed[hash] = true
+	}
+	for _, branch := range r.branches {
+		inv.Branches = append(inv.Branches, branch)
+	}
+	for _, tag := range r.tags {
+		inv.Tags = append(inv.Tags, tag)
+	}
+	for _, pin := range r.pins {
+		inv.Pins = append(inv.Pins, pin)
+	}
+	return inv
+}
+
+func (m *memoryStore) repairCheckIssue(ctx context.Context, repo string, issue CheckIssue, commit types.Commit) error {
+	rec := journalRecord{Repo: repo, Hash: issue.Hash}
+	switch issue.Kind {
+	case IssueMissingContent, IssueStaleHotContent:
+		rec.Op = journalOpArchive
+	case IssueMissingArchiveEntry:
+		rec.Op = journalOpUnarchive
+	case IssueUnindexedCommit:
+		rec.Op = journalOpIndex
+	case IssueOrphanedIndexEntry:
+		rec.Op = journalOpUnindex
+	default:
+		return fmt.Errorf("no repair for %s", issue.Kind)
+	}
+
+	r := m.ensureRepo(repo)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return m.commitLocked(r, rec)
+}
+
+func (m *memoryStore) CollectGarbage(ctx context.Context, opts GCOptions) (GCReport, error) {
+	if opts.Repo == "" {
+		return GCReport{}, &ValidationError{Message: "name query parameter required"}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return runGC(ctx, m.inventory(opts.Repo), m.archive, m, opts, m.clock())
+}
+
+func (m *memoryStore) sweepGC(_ context.Context, repo string, plan gcPlan) error {
+	r := m.ensureRepo(repo)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	planned := gcPlanned(plan)
+	for name, branch := range r.branches {
+		if planned[branch.Commit] {
+			return &ConflictError{Resource: "branch", Key: name}
+		}
+	}
+	for name, tag := range r.tags {
+		if planned[tag.Commit] {
+			return &ConflictError{Resource: "tag", Key: name}
+		}
+	}
+	for hash := range r.pins {
+		if planned[hash] {
+			return &ConflictError{Resource: "pin", Key: hash}
+		}
+	}
+
+	for _, commit := range plan.Commits {
+		if err := m.commitLocked(r, journalRecord{Op: journalOpDelete, Repo: repo, Hash: commit.Hash}); err != nil {
+			return err
+		}
+	}
+	for _, hash := range plan.Index {
+		if err := m.commitLocked(r, journalRecord{Op: journalOpUnindex, Repo: repo, Hash: hash}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) PinCommit(ctx context.Context, req PinRequest) (types.Pin, error) {
+	if req.Repo == "" || req.Commit == "" {
+		return types.Pin{}, &ValidationError{Message: "repo and commit are required"}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	r := m.repo(req.Repo)
+	if r == nil {
+		return types.Pin{}, &NotFoundError{Resource: "commit", Key: req.Commit}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.commits[req.Commit]; !ok {
+		return types.Pin{}, &NotFoundError{Resource: "commit", Key: req.Commit}
+	}
+	pin := types.Pin{Repo: req.Repo, Commit: req.Commit, Reason: req.Reason, CreatedAt: m.clock().UTC()}
+	if err := m.commitLocked(r, journalRecord{Op: journalOpPin, Pin: &pin}); err != nil {
+		return types.Pin{}, err
+	}
+	m.notify(req.Repo)
+	return pin, nil
+}
+
+func (m *memoryStore) UnpinCommit(ctx context.Context, repo, hash string) error {
+	if repo == "" || hash == "" {
+		return &ValidationError{Message: "repo and commit are required"}
+	}
+	r := m.repo(repo)
+	if r == nil {
+		return &NotFoundError{Resource: "pin", Key: hash}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.pins[hash]; !ok {
+		return &NotFoundError{Resource: "pin", Key: hash}
+	}
+	if err := m.commitLocked(r, journalRecord{Op: journalOpUnpin, Repo: repo, Hash: hash}); err != nil {
+		return err
+	}
+	m.notify(repo)
+	return nil
+}
+
+func (m *memoryStore) ListPins(ctx context.Context, repo string) ([]PinnedCommit, error) {
+	if repo == "" {
+		return nil, &ValidationError{Message: "name query parameter required"}
+	}
+	r := m.repo(repo)
+	if r == nil {
+		r = newMemoryRepo(repo, m.usage)
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	reasons := r.pinReasonsLocked(m.policyLocked(r, repo))
+	return pinnedList(reasons, func(hash string) bool { return r.commits[hash].Archived }), nil
+}
@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// errMemoryBudget is returned by restores that would push hot content over
+// the memory budget.
+var errMemoryBudget = errors.New("memory budget exhausted")
+
+// MemoryStats reports the memory backend's hot content and spilling.
+type MemoryStats struct {
+	Repos int `json:"repos"`
+	// HotEntries and HotBytes count content held in memory; HotBytes is
+	// payload size and excludes bookkeeping overhead.
+	HotEntries int   `json:"hotEntries"`
+	HotBytes   int64 `json:"hotBytes"`
+	// MaxBytes is the budget for HotBytes; zero means unbounded.
+	MaxBytes      int64  `json:"maxBytes"`
+	Spills        int64  `json:"spills"`
+	SpilledBytes  int64  `json:"spilledBytes"`
+	SpillFailures int64  `json:"spillFailures"`
+	LastError     string `json:"lastError,omitempty"`
+	// HeapAlloc and HeapSys describe the process heap, from
+	// runtime.ReadMemStats.
+	HeapAlloc uint64 `json:"heapAlloc"`
+	HeapSys   uint64 `json:"heapSys"`
+}
+
+// MemoryReporter is implemented by the memory backend.
+type MemoryReporter interface {
+	MemoryStats() MemoryStats
+}
+
+type hotKey struct {
+	repo string
+	hash string
+}
+
+type hotEntry struct {
+	key  hotKey
+	size int64
+}
+
+// memoryUsage accounts for hot content across repositories. With a budget it
+// also orders content by recency, so the least recently used is spilled to
+// the archive first.
+type memoryUsage struct {
+	maxBytes int64
+	spilling atomic.Bool
+
+	mu      sync.Mutex
+	lru     *list.List // front is most recently used
+	entries map[hotKey]*list.Element
+	bytes   int64
+	stats   MemoryStats
+}
+
+func newMemoryUsage(maxBytes int64) *memoryUsage {
+	return &memoryUsage{
+		maxBytes: max(maxBytes, 0),
+		lru:      list.New(),
+		entries:  make(map[hotKey]*list.Element),
+	}
+}
+
+// add records content as most recently used, replacing an earlier entry.
+func (u *memoryUsage) add(key hotKey, size int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if elem, ok := u.entries[key]; ok {
+		u.removeLocked(elem)
+	}
+	u.entries[key] = u.lru.PushFront(&hotEntry{key: key, size: size})
+	u.bytes += size
+}
+
+func (u *memoryUsage) remove(key hotKey) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if elem, ok := u.entries[key]; ok {
+		u.removeLocked(elem)
+	}
+}
+
+func (u *memoryUsage) removeLocked(elem *list.Element) {
+	entry := u.lru.Remove(elem).(*hotEntry)
+	delete(u.entries, entry.key)
+	u.bytes -= entry.size
+}
+
+// touch marks content as read. Without a budget recency is not tracked.
+func (u *memoryUsage) touch(key hotKey) {
+	if u.maxBytes == 0 {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if elem, ok := u.entries[key]; ok {
+		u.lru.MoveToFront(elem)
+	}
+}
+
+// fits reports whether size more bytes stay within the budget.
+func (u *memoryUsage) fits(size int64) bool {
+	if u.maxBytes == 0 {
+		return true
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.bytes+size <= u.maxBytes
+}
+
+// victim returns the least recently used entry not in skip, provided hot
+// content is over the budget.
+func (u *memoryUsage) victim(skip map[hotKey]bool) (hotEntry, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.maxBytes == 0 || u.bytes <= u.maxBytes {
+		return hotEntry{}, false
+	}
+	for elem := u.lru.Back(); elem != nil; elem = elem.Prev() {
+		if entry := elem.Value.(*hotEntry); !skip[entry.key] {
+			return *entry, true
+		}
+	}
+	return hotEntry{}, false
+}
+
+func (u *memoryUsage) has(key hotKey) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	_, ok := u.entries[key]
+	return ok
+}
+
+func (u *memoryUsage) record(fn func(stats *MemoryStats)) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	fn(&u.stats)
+}
+
+// spill archives the least recently used hot content until it fits the
+// budget again. One caller spills at a time; others return at once and
+// leave the work to it. Content that cannot be archived is skipped for the
+// rest of the run.
+func (m *memoryStore) spill(ctx context.Context) {
+	u := m.usage
+	if m.archive == nil || u.maxBytes == 0 || !u.spilling.CompareAndSwap(false, true) {
+		return
+	}
+	defer u.spilling.Store(false)
+
+	skip := make(map[hotKey]bool)
+	for ctx.Err() == nil {
+		entry, ok := u.victim(skip)
+		if !ok {
+			return
+		}
+		codec := m.getPolicy(entry.key.repo).contentCodec(m.defaultPolicy)
+		err := m.archiveCommit(ctx, entry.key.repo, entry.key.hash, codec)
+		switch {
+		case err != nil:
+			skip[entry.key] = true
+			u.record(func(stats *MemoryStats) {
+				stats.SpillFailures++
+				stats.LastError = err.Error()
+			})
+		case u.has(entry.key):
+			// Archived or purged already, yet still hot; leave it to Check.
+			skip[entry.key] = true
+		default:
+			u.record(func(stats *MemoryStats) {
+				stats.Spills++
+				stats.SpilledBytes += entry.size
+			})
+		}
+	}
+}
+
+// MemoryStats reports hot content, the budget and spilling so far.
+func (m *memoryStore) MemoryStats() MemoryStats {
+	m.reposMu.RLock()
+	repos := len(m.repos)
+	m.reposMu.RUnlock()
+
+	var runtimeStats runtime.MemStats
+	runtime.ReadMemStats(&runtimeStats)
+
+	u := m.usage
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	stats := u.stats
+	stats.Repos = repos
+	stats.HotEntries = u.lru.Len()
+	stats.HotBytes = u.bytes
+	stats.MaxBytes = u.maxBytes
+	stats.HeapAlloc = runtimeStats.HeapAlloc
+	stats.HeapSys = runtimeStats.HeapSys
+	return stats
+}
@@ -0,0 +1,692 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/onexay/kv-vs/internal/types"
+)
+
+const (
+	journalFileName  = "wal.log"
+	snapshotFileName = "snapshot.json"
+)
+
+// FsyncPolicy controls when journal writes are flushed to stable storage.
+type FsyncPolicy string
+
+const (
+	// FsyncAlways syncs the journal after every record.
+	FsyncAlways FsyncPolicy = "always"
+	// FsyncInterval syncs the journal on a fixed schedule.
+	FsyncInterval FsyncPolicy = "interval"
+	// FsyncNever leaves flushing to the operating system.
+	FsyncNever FsyncPolicy = "never"
+)
+
+// PersistenceConfig enables the write-ahead log and snapshots for the memory backend.
+type PersistenceConfig struct {
+	Dir              string
+	Fsync            FsyncPolicy
+	FsyncInterval    time.Duration
+	SnapshotInterval time.Duration
+	SnapshotRecords  int
+}
+
+type journalOp string
+
+const (
+	journalOpCommit  journalOp = "commit"
+	journalOpBranch  journalOp = "branch"
+	journalOpTag     journalOp = "tag"
+	journalOpPolicy  journalOp = "policy"
+	journalOpArchive journalOp = "archive"
+	journalOpPurge   journalOp = "purge"
+	journalOpPin     journalOp = "pin"
+	journalOpUnpin   journalOp = "unpin"
+	// Restores archived content of a pinned commit to hot storage.
+	journalOpRestore journalOp = "restore"
+	// Repair operations issued by Check.
+	journalOpUnarchive journalOp = "unarchive"
+	journalOpIndex     journalOp = "index"
+	journalOpUnindex   journalOp = "unindex"
+	// Garbage collection of an unreachable commit.
+	journalOpDelete journalOp = "delete"
+	// Creates or rewraps a data key.
+	journalOpDataKey journalOp = "datakey"
+)
+
+// journalRecord is a single mutation in the memory store log. Commit records
+// also move the branch head and register the author carried on the commit.
+type journalRecord struct {
+	Seq     uint64        `json:"seq"`
+	Op      journalOp     `json:"op"`
+	Commit  *types.Commit `json:"commit,omitempty"`
+	Content string        `json:"content,omitempty"`
+	// Sealed is Content encrypted under the repository's data key. When it
+	// is set, only Sealed is written to the journal.
+	Sealed  []byte           `json:"sealed,omitempty"`
+	Branch  *types.Branch    `json:"branch,omitempty"`
+	Tag     *types.Tag       `json:"tag,omitempty"`
+	Policy  *RetentionPolicy `json:"policy,omitempty"`
+	Pin     *types.Pin       `json:"pin,omitempty"`
+	DataKey *DataKey         `json:"dataKey,omitempty"`
+	Repo    string           `json:"repo,omitempty"`
+	Hash    string           `json:"hash,omitempty"`
+}
+
+// memorySnapshot is the compacted form of the memory store state.
+type memorySnapshot struct {
+	Seq           uint64                             `json:"seq"`
+	Commits       map[string]types.Commit            `json:"commits"`
+	Contents      map[string]string                  `json:"contents"`
+	Sealed        map[string][]byte                  `json:"sealed,omitempty"`
+	RepoCommits   map[string][]string                `json:"repoCommits"`
+	Branches      map[string]map[string]types.Branch `json:"branches"`
+	Tags          map[string]map[string]types.Tag    `json:"tags"`
+	Authors       map[string]map[string]string       `json:"authors"`
+	Policies      map[string]RetentionPolicy         `json:"policies"`
+	Pins          map[string]map[string]types.Pin    `json:"pins,omitempty"`
+	PolicyHistory map[string][]RetentionPolicy       `json:"policyHistory,omitempty"`
+	DataKeys      map[string][]DataKey               `json:"dataKeys,omitempty"`
+}
+
+type memoryJournal struct {
+	mu      sync.Mutex
+	cfg     PersistenceConfig
+	file    *os.File
+	seq     uint64
+	pending int
+	dirty   bool
+	// due is signalled when SnapshotRecords records are pending.
+	due  chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewDurableMemoryStore initializes a memory store that journals every mutation
+// to cfg.Dir and replays the latest snapshot plus journal on startup.
+func NewDurableMemoryStore(cfg PersistenceConfig, opts Options) (Store, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("persistence directory is required")
+	}
+	switch cfg.Fsync {
+	case "":
+		cfg.Fsync = FsyncInterval
+	case FsyncAlways, FsyncInterval, FsyncNever:
+	default:
+		return nil, fmt.Errorf("unknown fsync policy %q", cfg.Fsync)
+	}
+	if cfg.Fsync == FsyncInterval && cfg.FsyncInterval <= 0 {
+		cfg.FsyncInterval = time.Second
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	m := newMemoryStore(opts)
+	seq, err := m.loadSnapshot(filepath.Join(cfg.Dir, snapshotFileName))
+	if err != nil {
+		return nil, fmt.Errorf("load snapshot: %w", err)
+	}
+	seq, pending, err := m.replayJournal(filepath.Join(cfg.Dir, journalFileName), seq)
+	if err != nil {
+		return nil, fmt.Errorf("replay journal: %w", err)
+	}
+
+	file, err := os.OpenFile(filepath.Join(cfg.Dir, journalFileName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	m.journal = &memoryJournal{
+		cfg:     cfg,
+		file:    file,
+		seq:     seq,
+		pending: pending,
+		due:     make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := m.sealState(context.Background()); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("seal content: %w", err)
+	}
+	go m.runJournalMaintenance()
+	m.spill(context.Background())
+	return m, nil
+}
+
+// sealState rewrites the snapshot with every hot content sealed when
+// encryption is enabled, so content journaled before it was enabled does not
+// stay on disk in the clear. Repositories with hot content get a data key
+// first; snapshot cannot create one while it holds their locks.
+func (m *memoryStore) sealState(ctx context.Context) error {
+	if m.keys == nil {
+		return nil
+	}
+	m.reposMu.RLock()
+	repos := maps.Clone(m.repos)
+	m.reposMu.RUnlock()
+	for name, r := range repos {
+		r.mu.RLock()
+		hot := len(r.contents) > 0
+		r.mu.RUnlock()
+		if !hot {
+			continue
+		}
+		if _, err := m.keys.prepare(ctx, name); err != nil {
+			return err
+		}
+	}
+	return m.snapshot()
+}
+
+// commitLocked journals rec (when persistence is enabled) and applies it to
+// r. Callers must hold r.mu for writing, so records of one repository are
+// applied in journal order.
+func (m *memoryStore) commitLocked(r *memoryRepo, rec journalRecord) error {
+	if m.journal != nil {
+		journaled := rec
+		if journaled.Sealed != nil {
+			journaled.Content = ""
+		}
+		if err := m.journal.append(&journaled); err != nil {
+			return fmt.Errorf("write journal: %w", err)
+		}
+	}
+	r.applyLocked(rec)
+	return nil
+}
+
+// repo returns the repository rec mutates.
+func (rec journalRecord) repo() string {
+	switch {
+	case rec.Commit != nil:
+		return rec.Commit.Repo
+	case rec.Branch != nil:
+		return rec.Branch.Repo
+	case rec.Tag != nil:
+		return rec.Tag.Repo
+	case rec.Policy != nil:
+		return rec.Policy.Repo
+	case rec.Pin != nil:
+		return rec.Pin.Repo
+	case rec.DataKey != nil:
+		return rec.DataKey.Repo
+	}
+	return rec.Repo
+}
+
+func (r *memoryRepo) setContentLocked(hash, content string) {
+	r.contents[hash] = content
+	r.usage.add(hotKey{r.name, hash}, int64(len(content)))
+}
+
+func (r *memoryRepo) dropContentLocked(hash string) {
+	if _, ok := r.contents[hash]; ok {
+		delete(r.contents, hash)
+		r.usage.remove(hotKey{r.name, hash})
+	}
+}
+
+func (r *memoryRepo) applyLocked(rec journalRecord) {
+	switch rec.Op {
+	case journalOpCommit:
+		commit := *rec.Commit
+		r.commits[commit.Hash] = commit
+		r.setContentLocked(commit.Hash, rec.Content)
+		r.history = append(r.history, commit.Hash)
+		r.indexed.Store(true)
+		r.branches[commit.Branch] = types.Branch{
+			Repo:      commit.Repo,
+			Name:      commit.Branch,
+			Commit:    commit.Hash,
+			UpdatedAt: commit.Timestamp,
+		}
+		r.authors[commit.AuthorID] = commit.AuthorName
+	case journalOpBranch:
+		r.branches[rec.Branch.Name] = *rec.Branch
+	case journalOpTag:
+		r.tags[rec.Tag.Name] = *rec.Tag
+	case journalOpPolicy:
+		if r.policy != nil && len(r.policyHistory) == 0 {
+			// Keep a policy set before versioning as the first history entry.
+			prev := *r.policy
+			prev.Version = max(prev.Version, 1)
+			r.policyHistory = append(r.policyHistory, prev)
+		}
+		policy := rec.Policy.Copy()
+		r.policy = &policy
+		r.policyHistory = append(r.policyHistory, rec.Policy.Copy())
+	case journalOpArchive:
+		commit, ok := r.commits[rec.Hash]
+		if !ok {
+			return
+		}
+		r.dropContentLocked(rec.Hash)
+		commit.Archived = true
+		r.commits[rec.Hash] = commit
+	case journalOpPurge:
+		commit, ok := r.commits[rec.Hash]
+		if !ok {
+			return
+		}
+		r.dropContentLocked(rec.Hash)
+		commit.Archived = true
+		commit.Purged = true
+		r.commits[rec.Hash] = commit
+	case journalOpPin:
+		r.pins[rec.Pin.Commit] = *rec.Pin
+	case journalOpUnpin:
+		delete(r.pins, rec.Hash)
+	case journalOpRestore:
+		commit, ok := r.commits[rec.Hash]
+		if !ok {
+			return
+		}
+		r.setContentLocked(rec.Hash, rec.Content)
+		commit.Archived = false
+		r.commits[rec.Hash] = commit
+	case journalOpUnarchive:
+		commit, ok := r.commits[rec.Hash]
+		if !ok {
+			return
+		}
+		commit.Archived = false
+		r.commits[rec.Hash] = commit
+	case journalOpIndex:
+		if !slices.Contains(r.history, rec.Hash) {
+			r.history = append(r.history, rec.Hash)
+		}
+		r.indexed.Store(true)
+	case journalOpUnindex:
+		r.history = slices.DeleteFunc(r.history, func(hash string) bool {
+			return hash == rec.Hash
+		})
+		r.indexed.Store(true)
+	case journalOpDataKey:
+		key := *rec.DataKey
+		keys := slices.DeleteFunc(r.dataKeys, func(existing DataKey) bool {
+			return existing.ID == key.ID
+		})
+		keys = append(keys, key)
+		sortDataKeys(keys)
+		r.dataKeys = keys
+	case journalOpDelete:
+		delete(r.commits, rec.Hash)
+		r.dropContentLocked(rec.Hash)
+		r.history = slices.DeleteFunc(r.history, func(hash string) bool {
+			return hash == rec.Hash
+		})
+	}
+}
+
+// loadSnapshot restores the state in path. Snapshots keep the layout of the
+// single-lock store, keyed by repository and commit hash.
+func (m *memoryStore) loadSnapshot(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var snap memorySnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return 0, err
+	}
+	for hash, commit := range snap.Commits {
+		r := m.ensureRepo(commit.Repo)
+		r.commits[hash] = commit
+		if content, ok := snap.Contents[hash]; ok {
+			r.setContentLocked(hash, content)
+		}
+	}
+	for repo, hashes := range snap.RepoCommits {
+		if hashes == nil {
+			hashes = []string{}
+		}
+		r := m.ensureRepo(repo)
+		r.history = hashes
+		r.indexed.Store(true)
+	}
+	for repo, branches := range snap.Branches {
+		maps.Copy(m.ensureRepo(repo).branches, branches)
+	}
+	for repo, tags := range snap.Tags {
+		maps.Copy(m.ensureRepo(repo).tags, tags)
+	}
+	for repo, authors := range snap.Authors {
+		maps.Copy(m.ensureRepo(repo).authors, authors)
+	}
+	for repo, policy := range snap.Policies {
+		m.ensureRepo(repo).policy = &policy
+	}
+	for repo, history := range snap.PolicyHistory {
+		m.ensureRepo(repo).policyHistory = history
+	}
+	for repo, pins := range snap.Pins {
+		maps.Copy(m.ensureRepo(repo).pins, pins)
+	}
+	for repo, keys := range snap.DataKeys {
+		m.ensureRepo(repo).dataKeys = keys
+	}
+	// Sealed content is opened once the data keys are in place.
+	for hash, sealed := range snap.Sealed {
+		commit, ok := snap.Commits[hash]
+		if !ok {
+			continue
+		}
+		content, err := m.keys.decode(context.Background(), commit.Repo, sealed)
+		if err != nil {
+			return 0, fmt.Errorf("content of %s: %w", hash, err)
+		}
+		m.ensureRepo(commit.Repo).setContentLocked(hash, string(content))
+	}
+	return snap.Seq, nil
+}
+
+// replayJournal applies journal records newer than seq. A torn trailing record
+// left by a crash is truncated away; corruption elsewhere is reported.
+func (m *memoryStore) replayJournal(path string, seq uint64) (uint64, int, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0o600)
+	if errors.Is(err, os.ErrNotExist) {
+		return seq, 0, nil
+	}
+	if err != nil {
+		return seq, 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var (
+		offset  int64
+		pending int
+	)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var rec journalRecord
+			complete := line[len(line)-1] == '\n'
+			if err := json.Unmarshal(bytes.TrimSpace(line), &rec); err != nil || !complete {
+				if _, peekErr := reader.Peek(1); peekErr == io.EOF {
+					return seq, pending, file.Truncate(offset)
+				}
+				return seq, pending, fmt.Errorf("corrupt journal record at offset %d", offset)
+			}
+			offset += int64(len(line))
+			if rec.Seq > seq {
+				if rec.Sealed != nil {
+					// Data keys are journaled before the content they seal.
+					content, err := m.keys.decode(context.Background(), rec.repo(), rec.Sealed)
+					if err != nil {
+						return seq, pending, fmt.Errorf("journal record %d: %w", rec.Seq, err)
+					}
+					rec.Content = string(content)
+				}
+				m.ensureRepo(rec.repo()).applyLocked(rec)
+				seq = rec.Seq
+				pending++
+			}
+		}
+		if errors.Is(readErr, io.EOF) {
+			return seq, pending, nil
+		}
+		if readErr != nil {
+			return seq, pending, readErr
+		}
+	}
+}
+
+// snapshot writes the full state to disk and truncates the journal. It
+// read-locks every repository, so no record is between being journaled and
+// applied, then holds the journal lock until the journal is truncated so no
+// record is written meanwhile. The repository map stays read-locked until
+// then, so no repository journals a record the snapshot does not see. Reads
+// are not blocked. With encryption enabled, content is sealed with the data
+// keys held by each repository: the keyring would take the repository locks
+// again.
+func (m *memoryStore) snapshot() error {
+	m.reposMu.RLock()
+	names := make([]string, 0, len(m.repos))
+	repos := make([]*memoryRepo, 0, len(m.repos))
+	for name, r := range m.repos {
+		names = append(names, name)
+		repos = append(repos, r)
+	}
+	for _, r := range repos {
+		r.mu.RLock()
+	}
+	j := m.journal
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	m.reposMu.RUnlock()
+	snap := memorySnapshot{
+		Seq:           j.seq,
+		Commits:       make(map[string]types.Commit),
+		Contents:      make(map[string]string),
+		Sealed:        make(map[string][]byte),
+		RepoCommits:   make(map[string][]string),
+		Branches:      make(map[string]map[string]types.Branch),
+		Tags:          make(map[string]map[string]types.Tag),
+		Authors:       make(map[string]map[string]string),
+		Policies:      make(map[string]RetentionPolicy),
+		PolicyHistory: make(map[string][]RetentionPolicy),
+		Pins:          make(map[string]map[string]types.Pin),
+		DataKeys:      make(map[string][]DataKey),
+	}
+	var err error
+	for i, r := range repos {
+		if err == nil {
+			var keys *repoDataKeys
+			if keys, err = m.keys.unwrap(names[i], r.dataKeys); err == nil {
+				err = r.snapshotLocked(names[i], keys, &snap)
+			}
+		}
+		r.mu.RUnlock()
+	}
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(j.cfg.Dir, snapshotFileName)
+	if err := writeFileAtomic(path, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(snap)
+	}); err != nil {
+		return err
+	}
+
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	j.pending = 0
+	j.dirty = false
+	return nil
+}
+
+// snapshotLocked copies the state of r, named repo, into snap. Content is
+// sealed with keys unless they are nil.
+func (r *memoryRepo) snapshotLocked(repo string, keys *repoDataKeys, snap *memorySnapshot) error {
+	maps.Copy(snap.Commits, r.commits)
+	if keys == nil {
+		maps.Copy(snap.Contents, r.contents)
+	} else {
+		for hash, content := range r.contents {
+			sealed, err := keys.encode(CodecNone, []byte(content))
+			if err != nil {
+				return fmt.Errorf("seal content of %s: %w", hash, err)
+			}
+			snap.Sealed[hash] = sealed
+		}
+	}
+	if r.indexed.Load() {
+		snap.RepoCommits[repo] = slices.Clone(r.history)
+	}
+	if len(r.branches) > 0 {
+		snap.Branches[repo] = maps.Clone(r.branches)
+	}
+	if len(r.tags) > 0 {
+		snap.Tags[repo] = maps.Clone(r.tags)
+	}
+	if len(r.authors) > 0 {
+		snap.Authors[repo] = maps.Clone(r.authors)
+	}
+	if r.policy != nil {
+		snap.Policies[repo] = r.policy.Copy()
+	}
+	if len(r.policyHistory) > 0 {
+		snap.PolicyHistory[repo] = slices.Clone(r.policyHistory)
+	}
+	if len(r.pins) > 0 {
+		snap.Pins[repo] = maps.Clone(r.pins)
+	}
+	if len(r.dataKeys) > 0 {
+		snap.DataKeys[repo] = slices.Clone(r.dataKeys)
+	}
+	return nil
+}
+
+func (m *memoryStore) runJournalMaintenance() {
+	j := m.journal
+	defer close(j.done)
+
+	var syncC, snapC <-chan time.Time
+	if j.cfg.Fsync == FsyncInterval {
+		ticker := time.NewTicker(j.cfg.FsyncInterval)
+		defer ticker.Stop()
+		syncC = ticker.C
+	}
+	if j.cfg.SnapshotInterval > 0 {
+		ticker := time.NewTicker(j.cfg.SnapshotInterval)
+		defer ticker.Stop()
+		snapC = ticker.C
+	}
+
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-syncC:
+			_ = j.sync()
+		case <-snapC:
+			if j.hasPending() {
+				_ = m.snapshot()
+			}
+		case <-j.due:
+			_ = m.snapshot()
+		}
+	}
+}
+
+// Close flushes the journal, writes a final snapshot and releases the log file.
+func (m *memoryStore) Close() error {
+	if m.journal == nil {
+		return nil
+	}
+	j := m.journal
+	select {
+	case <-j.stop:
+		return nil
+	default:
+	}
+	close(j.stop)
+	<-j.done
+
+	err := m.snapshot()
+	if syncErr := j.sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := j.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (j *memoryJournal) append(rec *journalRecord) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	rec.Seq = j.seq + 1
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	payload = append(payload, '\n')
+	if _, err := j.file.Write(payload); err != nil {
+		return err
+	}
+	if j.cfg.Fsync == FsyncAlways {
+		if err := j.file.Sync(); err != nil {
+			return err
+		}
+	} else {
+		j.dirty = true
+	}
+	j.seq = rec.Seq
+	j.pending++
+	if j.cfg.SnapshotRecords > 0 && j.pending >= j.cfg.SnapshotRecords {
+		// Snapshots are taken by the maintenance goroutine: the writer holds
+		// its repository lock, which the snapshot needs.
+		select {
+		case j.due <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (j *memoryJournal) hasPending() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.pending > 0
+}
+
+func (j *memoryJournal) sync() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !j.dirty {
+		return nil
+	}
+	j.dirty = false
+	return j.file.Sync()
+}
+
+// writeFileAtomic writes path via a synced temp file and rename.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	buf := bufio.NewWriter(tmp)
+	if err := write(buf); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -1,8 +1,19 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestMemoryStorePutBlobAndCommit(t *testing.T) {
@@ -26,7 +37,10 @@ func TestMemoryStorePutBlobAndCommit(t *testing.T) {
 		t.Fatalf("second PutBlobAndCommit: %v", err)
 	}
 
-	commits := store.ListCommits(ctx, ListCommitsOptions{Repo: "repo", Descending: true, Limit: 1})
+	commits, err := store.ListCommits(ctx, ListCommitsOptions{Repo: "repo", Descending: true, Limit: 1})
+	if err != nil {
+		t.Fatalf("ListCommits: %v", err)
+	}
 	if len(commits) != 1 {
 		t.Fatalf("expected 1 commit, got %d", len(commits))
 	}
@@ -45,7 +59,10 @@ func TestMemoryStorePutBlobAndCommit(t *testing.T) {
 		t.Fatalf("unexpected branch commit")
 	}
 
-	branches := store.ListBranches(ctx, "repo")
+	branches, err := store.ListBranches(ctx, "repo")
+	if err != nil {
+		t.Fatalf("ListBranches: %v", err)
+	}
 	if len(branches) != 2 {
 		t.Fatalf("expected 2 branches, got %d", len(branches))
 	}
@@ -58,7 +75,10 @@ func TestMemoryStorePutBlobAndCommit(t *testing.T) {
 		t.Fatalf("unexpected tag name")
 	}
 
-	tags := store.ListTags(ctx, "repo")
+	tags, err := store.ListTags(ctx, "repo")
+	if err != nil {
+		t.Fatalf("ListTags: %v", err)
+	}
 	if len(tags) != 1 {
 		t.Fatalf("expected 1 tag, got %d", len(tags))
 	}
@@ -79,7 +99,7 @@ func TestMemoryStorePutBlobAndCommit(t *testing.T) {
 	if err != nil {
 		t.Fatalf("SetPolicy: %v", err)
 	}
-	if !policy.Locked || policy.HotCommitLimit != 1 {
+	if policy.Version != 1 || policy.HotCommitLimit != 1 {
 		t.Fatalf("unexpected policy response")
 	}
 
@@ -91,3 +111,795 @@ func TestMemoryStorePutBlobAndCommit(t *testing.T) {
 		t.Fatalf("unexpected policy limit: %d", policyGet.HotCommitLimit)
 	}
 }
+
+func TestMemoryStorePersistenceReplay(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	cfg := PersistenceConfig{Dir: dir, Fsync: FsyncAlways, SnapshotRecords: 3}
+
+	store, err := NewDurableMemoryStore(cfg, Options{Archive: NewMemoryArchive()})
+	if err != nil {
+		t.Fatalf("NewDurableMemoryStore: %v", err)
+	}
+
+	first, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "repo", Content: "one", AuthorName: "Alice", AuthorID: "alice@id"})
+	if err != nil {
+		t.Fatalf("PutBlobAndCommit: %v", err)
+	}
+	second, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "repo", Content: "two", AuthorName: "Alice", AuthorID: "alice@id"})
+	if err != nil {
+		t.Fatalf("second PutBlobAndCommit: %v", err)
+	}
+	if _, err := store.UpsertBranch(ctx, BranchRequest{Repo: "repo", Name: "dev", Commit: first.CommitHash}); err != nil {
+		t.Fatalf("UpsertBranch: %v", err)
+	}
+	if _, err := store.CreateTag(ctx, TagRequest{Repo: "repo", Name: "v1", Commit: second.CommitHash}); err != nil {
+		t.Fatalf("CreateTag: %v", err)
+	}
+	if _, err := store.SetPolicy(ctx, RetentionPolicy{Repo: "repo", HotCommitLimit: 1}); err != nil {
+		t.Fatalf("SetPolicy: %v", err)
+	}
+	if _, err := store.EnforceRetention(ctx, "repo"); err != nil {
+		t.Fatalf("EnforceRetention: %v", err)
+	}
+
+	// Simulate a crash: drop the store without Close so the journal tail is replayed.
+	ms := store.(*memoryStore)
+	close(ms.journal.stop)
+	<-ms.journal.done
+	_ = ms.journal.file.Close()
+
+	reopened, err := NewDurableMemoryStore(cfg, Options{Archive: ms.archive})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	t.Cleanup(func() { _ = reopened.Close() })
+
+	commits, err := reopened.ListCommits(ctx, ListCommitsOptions{Repo: "repo"})
+	if err != nil {
+		t.Fatalf("ListCommits: %v", err)
+	}
+	if len(commits) != 2 {
+		t.Fatalf("expected 2 commits after replay, got %d", len(commits))
+	}
+	if !commits[0].Archived {
+		t.Fatalf("expected archived flag to survive replay")
+	}
+	if _, content, err := reopened.GetCommit(ctx, "repo", first.CommitHash); err != nil || content != "one" {
+		t.Fatalf("GetCommit archived: %q, %v", content, err)
+	}
+	branches, err := reopened.ListBranches(ctx, "repo")
+	if err != nil {
+		t.Fatalf("ListBranches: %v", err)
+	}
+	if len(branches) != 2 {
+		t.Fatalf("expected 2 branches, got %d", len(branches))
+	}
+	tags, err := reopened.ListTags(ctx, "repo")
+	if err != nil {
+		t.Fatalf("ListTags: %v", err)
+	}
+	if len(tags) != 1 {
+		t.Fatalf("expected 1 tag, got %d", len(tags))
+	}
+	policy, err := reopened.GetPolicy(ctx, "repo")
+	if err != nil || policy.Version != 1 || policy.HotCommitLimit != 1 {
+		t.Fatalf("unexpected policy after replay: %+v, %v", policy, err)
+	}
+	if _, err := reopened.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "repo", Content: "three", AuthorName: "Bob", AuthorID: "alice@id"}); err == nil {
+		t.Fatalf("expected author registry to survive replay")
+	}
+}
+
+func TestMemoryStoreEncryptedPersistence(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	cfg := PersistenceConfig{Dir: dir, Fsync: FsyncAlways}
+	master, err := NewMasterKeys([]MasterKey{{ID: "k1", Key: bytes.Repeat([]byte{7}, 32)}})
+	if err != nil {
+		t.Fatalf("NewMasterKeys: %v", err)
+	}
+	// Neither the raw content nor its base64 form may reach the disk.
+	assertSealed := func(name string, secrets ...string) {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("read %s: %v", name, err)
+		}
+		for _, secret := range secrets {
+			if bytes.Contains(data, []byte(secret)) || bytes.Contains(data, []byte(base64.StdEncoding.EncodeToString([]byte(secret)))) {
+				t.Fatalf("%s holds %q in the clear", name, secret)
+			}
+		}
+	}
+	crash := func(store Store) {
+		ms := store.(*memoryStore)
+		close(ms.journal.stop)
+		<-ms.journal.done
+		_ = ms.journal.file.Close()
+	}
+
+	// Content written before encryption was enabled.
+	plain, err := NewDurableMemoryStore(cfg, Options{})
+	if err != nil {
+		t.Fatalf("NewDurableMemoryStore: %v", err)
+	}
+	legacy, err := plain.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "repo", Content: "legacy secret", AuthorName: "Alice", AuthorID: "alice@id"})
+	if err != nil {
+		t.Fatalf("PutBlobAndCommit: %v", err)
+	}
+	crash(plain)
+
+	store, err := NewDurableMemoryStore(cfg, Options{MasterKeys: master})
+	if err != nil {
+		t.Fatalf("NewDurableMemoryStore: %v", err)
+	}
+	assertSealed(snapshotFileName, "legacy secret")
+	assertSealed(journalFileName, "legacy secret")
+	fresh, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "repo", Content: "fresh secret", AuthorName: "Alice", AuthorID: "alice@id"})
+	if err != nil {
+		t.Fatalf("PutBlobAndCommit: %v", err)
+	}
+	assertSealed(journalFileName, "fresh secret")
+	crash(store)
+
+	// The sealed journal record is replayed on top of the sealed snapshot.
+	reopened, err := NewDurableMemoryStore(cfg, Options{MasterKeys: master})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	for hash, want := range map[string]string{legacy.CommitHash: "legacy secret", fresh.CommitHash: "fresh secret"} {
+		if _, content, err := reopened.GetCommit(ctx, "repo", hash); err != nil || content != want {
+			t.Fatalf("GetCommit %s: %q, %v", hash, content, err)
+		}
+	}
+	if err := reopened.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	assertSealed(snapshotFileName, "legacy secret", "fresh secret")
+
+	if _, err := NewDurableMemoryStore(cfg, Options{}); err == nil {
+		t.Fatalf("expected sealed content to need the master key")
+	}
+}
+
+func TestMemoryStoreCheckRepairs(t *testing.T) {
+	archive := NewMemoryArchive()
+	store := newMemoryStore(Options{Archive: archive})
+	ctx := context.Background()
+
+	first, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "repo", Content: "v1", AuthorName: "Alice", AuthorID: "alice@id"})
+	if err != nil {
+		t.Fatalf("PutBlobAndCommit: %v", err)
+	}
+	second, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "repo", Content: "v2", AuthorName: "Alice", AuthorID: "alice@id"})
+	if err != nil {
+		t.Fatalf("second PutBlobAndCommit: %v", err)
+	}
+
+	report, err := store.Check(ctx, CheckOptions{Repo: "repo"})
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if len(report.Issues) != 0 || report.Commits != 2 {
+		t.Fatalf("expected clean report with 2 commits, got %+v", report)
+	}
+
+	// Lose the hot copy of the first commit after archiving it out of band,
+	// and drop the second commit from the history index.
+	if err := archive.Store(ctx, "repo", first.CommitHash, []byte("v1")); err != nil {
+		t.Fatalf("archive.Store: %v", err)
+	}
+	r := store.repo("repo")
+	r.mu.Lock()
+	r.dropContentLocked(first.CommitHash)
+	r.history = []string{first.CommitHash}
+	r.mu.Unlock()
+
+	report, err = store.Check(ctx, CheckOptions{Repo: "repo"})
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	kinds := map[CheckIssueKind]string{}
+	for _, issue := range report.Issues {
+		if !issue.Repairable || issue.Repaired {
+			t.Fatalf("expected repairable, unrepaired issue, got %+v", issue)
+		}
+		kinds[issue.Kind] = issue.Hash
+	}
+	if kinds[IssueMissingContent] != first.CommitHash || kinds[IssueUnindexedCommit] != second.CommitHash || len(kinds) != 2 {
+		t.Fatalf("unexpected issues: %+v", report.Issues)
+	}
+
+	report, err = store.Check(ctx, CheckOptions{Repo: "repo", Repair: true})
+	if err != nil {
+		t.Fatalf("Check repair: %v", err)
+	}
+	for _, issue := range report.Issues {
+		if !issue.Repaired {
+			t.Fatalf("expected issue repaired, got %+v", issue)
+		}
+	}
+
+	report, err = store.Check(ctx, CheckOptions{Repo: "repo"})
+	if err != nil {
+		t.Fatalf("Check after repair: %v", err)
+	}
+	if len(report.Issues) != 0 {
+		t.Fatalf("expected clean report after repair, got %+v", report.Issues)
+	}
+	commit, content, err := store.GetCommit(ctx, "repo", first.CommitHash)
+	if err != nil {
+		t.Fatalf("GetCommit: %v", err)
+	}
+	if !commit.Archived || content != "v1" {
+		t.Fatalf("expected first commit served from archive, got archived=%t content=%q", commit.Archived, content)
+	}
+}
+
+func TestMemoryStorePinning(t *testing.T) {
+	store := NewMemoryStore(Options{
+		Archive:   NewMemoryArchive(),
+		Retention: RetentionDefaults{HotCommitLimit: 1, PinTags: true, PinBranchHeads: true},
+	})
+	ctx := context.Background()
+
+	var hashes []string
+	for _, content := range []string{"v1", "v2", "v3"} {
+		result, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "repo", Content: content, AuthorName: "Alice", AuthorID: "alice@id"})
+		if err != nil {
+			t.Fatalf("PutBlobAndCommit: %v", err)
+		}
+		hashes = append(hashes, result.CommitHash)
+	}
+	enforce := func() {
+		t.Helper()
+		if _, err := store.EnforceRetention(ctx, "repo"); err != nil {
+			t.Fatalf("EnforceRetention: %v", err)
+		}
+	}
+	enforce()
+
+	archived := func(hash string) bool {
+		t.Helper()
+		commit, _, err := store.GetCommit(ctx, "repo", hash)
+		if err != nil {
+			t.Fatalf("GetCommit %s: %v", hash, err)
+		}
+		return commit.Archived
+	}
+	// The pinned branch head does not count against the hot limit.
+	if !archived(hashes[0]) || archived(hashes[1]) || archived(hashes[2]) {
+		t.Fatalf("expected only the oldest commit archived")
+	}
+
+	if _, err := store.CreateTag(ctx, TagRequest{Repo: "repo", Name: "v1", Commit: hashes[0]}); err != nil {
+		t.Fatalf("CreateTag: %v", err)
+	}
+	pin, err := store.PinCommit(ctx, PinRequest{Repo: "repo", Commit: hashes[1], Reason: "audit"})
+	if err != nil {
+		t.Fatalf("PinCommit: %v", err)
+	}
+	if pin.Commit != hashes[1] || pin.Reason != "audit" {
+		t.Fatalf("unexpected pin %+v", pin)
+	}
+	enforce()
+	if archived(hashes[0]) {
+		t.Fatalf("expected tagged commit restored to hot storage")
+	}
+
+	pinned, err := store.ListPins(ctx, "repo")
+	if err != nil {
+		t.Fatalf("ListPins: %v", err)
+	}
+	sources := map[string]PinSource{}
+	for _, p := range pinned {
+		if len(p.Reasons) != 1 {
+			t.Fatalf("expected one reason for %s, got %+v", p.Commit, p.Reasons)
+		}
+		sources[p.Commit] = p.Reasons[0].Source
+	}
+	if sources[hashes[0]] != PinSourceTag || sources[hashes[1]] != PinSourceExplicit || sources[hashes[2]] != PinSourceBranch {
+		t.Fatalf("unexpected pin sources %+v", sources)
+	}
+
+	if _, err := store.PinCommit(ctx, PinRequest{Repo: "repo", Commit: "missing"}); !isNotFound(err) {
+		t.Fatalf("expected not found pinning unknown commit, got %v", err)
+	}
+	if err := store.UnpinCommit(ctx, "repo", hashes[1]); err != nil {
+		t.Fatalf("UnpinCommit: %v", err)
+	}
+	if err := store.UnpinCommit(ctx, "repo", hashes[1]); !isNotFound(err) {
+		t.Fatalf("expected not found removing a missing pin, got %v", err)
+	}
+	if _, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "repo", Content: "v4", AuthorName: "Alice", AuthorID: "alice@id"}); err != nil {
+		t.Fatalf("PutBlobAndCommit: %v", err)
+	}
+	enforce()
+	if !archived(hashes[1]) || archived(hashes[2]) || archived(hashes[0]) {
+		t.Fatalf("expected unpinned commit archived and tagged commit kept hot")
+	}
+}
+
+func TestMemoryStoreRetentionWorker(t *testing.T) {
+	worker := NewRetentionWorker(RetentionWorkerConfig{Concurrency: 2})
+	store := newMemoryStore(Options{
+		Archive:         NewMemoryArchive(),
+		Retention:       RetentionDefaults{HotDuration: time.Hour},
+		RetentionNotify: worker.Enqueue,
+	})
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.clock = func() time.Time { return now }
+
+	var hashes []string
+	for _, content := range []string{"v1", "v2", "v3"} {
+		result, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "repo", Content: content, AuthorName: "Alice", AuthorID: "alice@id"})
+		if err != nil {
+			t.Fatalf("PutBlobAndCommit: %v", err)
+		}
+		hashes = append(hashes, result.CommitHash)
+		now = now.Add(40 * time.Minute)
+	}
+	if status := worker.Status(); status.Queued != 1 || status.Running {
+		t.Fatalf("expected one deduplicated entry queued before start, got %+v", status)
+	}
+
+	worker.Start(store)
+	t.Cleanup(worker.Stop)
+	waitIdle := func(runs int64) RetentionWorkerStatus {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			status := worker.Status()
+			if status.Runs >= runs && status.Queued == 0 && len(status.Active) == 0 {
+				return status
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("worker did not go idle: %+v", status)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// v1 is 120 minutes old and v2 80 minutes old when the pass runs.
+	status := waitIdle(1)
+	if status.Archived != 2 || status.Failures != 0 || status.Repos["repo"].Archived != 2 {
+		t.Fatalf("unexpected status after first pass: %+v", status)
+	}
+
+	// An idle repository only moves on a sweep.
+	now = now.Add(time.Hour)
+	if err := worker.Sweep(ctx); err != nil {
+		t.Fatalf("Sweep: %v", err)
+	}
+	status = waitIdle(2)
+	if status.Archived != 3 || status.LastSweep == nil || status.LastRun == nil || status.LastRun.Archived != 1 {
+		t.Fatalf("unexpected status after sweep: %+v", status)
+	}
+	for _, hash := range hashes {
+		if commit, _, err := store.GetCommit(ctx, "repo", hash); err != nil || !commit.Archived {
+			t.Fatalf("expected %s archived, got %+v, %v", hash, commit, err)
+		}
+	}
+}
+
+func TestMemoryStorePolicyHistory(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store, err := NewDurableMemoryStore(PersistenceConfig{Dir: dir}, Options{PolicyCooldown: time.Hour})
+	if err != nil {
+		t.Fatalf("NewDurableMemoryStore: %v", err)
+	}
+	store.(*memoryStore).clock = func() time.Time { return now }
+	ctx := context.Background()
+
+	first, err := store.SetPolicy(ctx, RetentionPolicy{Repo: "repo", HotCommitLimit: 1, AuthorID: "alice@id"})
+	if err != nil || first.Version != 1 || !first.UpdatedAt.Equal(now) {
+		t.Fatalf("unexpected first policy: %+v, %v", first, err)
+	}
+	if same, err := store.SetPolicy(ctx, RetentionPolicy{Repo: "repo", HotCommitLimit: 1}); err != nil || same.Version != 1 {
+		t.Fatalf("expected identical resubmission to be a no-op: %+v, %v", same, err)
+	}
+	var validation *ValidationError
+	if _, err := store.SetPolicy(ctx, RetentionPolicy{Repo: "repo", HotCommitLimit: 2}); !errors.As(err, &validation) {
+		t.Fatalf("expected reason to be required, got %v", err)
+	}
+	var cooldown *CooldownError
+	if _, err := store.SetPolicy(ctx, RetentionPolicy{Repo: "repo", HotCommitLimit: 2, Reason: "audit"}); !errors.As(err, &cooldown) || !cooldown.Until.Equal(now.Add(time.Hour)) {
+		t.Fatalf("expected cooldown, got %v", err)
+	}
+
+	now = now.Add(2 * time.Hour)
+	second, err := store.SetPolicy(ctx, RetentionPolicy{Repo: "repo", HotCommitLimit: 2, Reason: "audit", AuthorID: "bob@id"})
+	if err != nil || second.Version != 2 || second.Reason != "audit" {
+		t.Fatalf("unexpected second policy: %+v, %v", second, err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	reopened, err := NewDurableMemoryStore(PersistenceConfig{Dir: dir}, Options{})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	history, err := reopened.PolicyHistory(ctx, "repo")
+	if err != nil {
+		t.Fatalf("PolicyHistory: %v", err)
+	}
+	if len(history) != 2 || history[0].Version != 1 || history[0].AuthorID != "alice@id" || history[1].HotCommitLimit != 2 || history[1].AuthorID != "bob@id" {
+		t.Fatalf("unexpected history after replay: %+v", history)
+	}
+}
+
+func TestMemoryStoreRehydration(t *testing.T) {
+	cache := NewRehydrationCache(NewMemoryArchive(), RehydrationConfig{MaxBytes: 4, TTL: time.Minute, MinReads: 2})
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache.clock = func() time.Time { return now }
+	store := newMemoryStore(Options{Archive: cache, Retention: RetentionDefaults{HotCommitLimit: 1}})
+	ctx := context.Background()
+
+	var hashes []string
+	for _, content := range []string{"v1", "v2", "v3"} {
+		result, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "repo", Content: content, AuthorName: "Alice", AuthorID: "alice@id"})
+		if err != nil {
+			t.Fatalf("PutBlobAndCommit: %v", err)
+		}
+		hashes = append(hashes, result.CommitHash)
+	}
+	if run, err := store.EnforceRetention(ctx, "repo"); err != nil || run.Archived != 2 {
+		t.Fatalf("EnforceRetention: %+v, %v", run, err)
+	}
+
+	// The second archive read promotes; the third is served from memory.
+	for i := 0; i < 3; i++ {
+		commit, content, err := store.GetCommit(ctx, "repo", hashes[0])
+		if err != nil || content != "v1" || !commit.Archived {
+			t.Fatalf("GetCommit: %+v, %q, %v", commit, content, err)
+		}
+	}
+	if stats := cache.Stats(); stats.Hits != 1 || stats.Misses != 2 || stats.Promotions != 1 || stats.Bytes != 2 {
+		t.Fatalf("unexpected stats after reads: %+v", stats)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, _, err := store.GetCommit(ctx, "repo", hashes[0]); err != nil {
+		t.Fatalf("GetCommit after expiry: %v", err)
+	}
+	if stats := cache.Stats(); stats.Expirations != 1 || stats.Entries != 0 {
+		t.Fatalf("expected expired entry, got %+v", stats)
+	}
+
+	result, err := cache.Restore(ctx, store, RestoreRequest{Repo: "repo", From: hashes[0], TTL: time.Hour})
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if !slices.Equal(result.Restored, hashes[:2]) || !slices.Equal(result.Hot, hashes[2:]) || !result.ExpiresAt.Equal(now.Add(time.Hour)) {
+		t.Fatalf("unexpected restore result: %+v", result)
+	}
+	now = now.Add(30 * time.Minute)
+	if _, content, err := store.GetCommit(ctx, "repo", hashes[1]); err != nil || content != "v2" {
+		t.Fatalf("GetCommit restored: %q, %v", content, err)
+	}
+	if commit, _, _ := store.GetCommit(ctx, "repo", hashes[1]); !commit.Archived {
+		t.Fatalf("restore must not clear the archived flag")
+	}
+
+	// A third promotion evicts the least recently used entry, and archive
+	// removals drop cached copies.
+	if _, err := cache.Promote(ctx, "repo", hashes[0], 0); err != nil {
+		t.Fatalf("Promote: %v", err)
+	}
+	if err := cache.Archive.Store(ctx, "repo", "extra", []byte("xx")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if _, err := cache.Promote(ctx, "repo", "extra", 0); err != nil {
+		t.Fatalf("Promote extra: %v", err)
+	}
+	if stats := cache.Stats(); stats.Entries != 2 || stats.Evictions != 1 {
+		t.Fatalf("expected one eviction, got %+v", stats)
+	}
+	if err := cache.Remove(ctx, "repo", "extra"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if stats := cache.Stats(); stats.Entries != 1 || stats.Bytes != 2 {
+		t.Fatalf("expected removal to drop the cached copy, got %+v", stats)
+	}
+	if _, err := cache.Restore(ctx, store, RestoreRequest{Repo: "repo", From: hashes[2], To: hashes[0]}); err == nil {
+		t.Fatalf("expected inverted range to fail")
+	}
+}
+
+func TestMemoryStoreConcurrentRepos(t *testing.T) {
+	dir := t.TempDir()
+	archive := NewMemoryArchive()
+	cfg := PersistenceConfig{Dir: dir, Fsync: FsyncNever, SnapshotRecords: 10}
+	opts := Options{Archive: archive, Retention: RetentionDefaults{HotCommitLimit: 2}}
+	store, err := NewDurableMemoryStore(cfg, opts)
+	if err != nil {
+		t.Fatalf("NewDurableMemoryStore: %v", err)
+	}
+	ctx := context.Background()
+
+	const repos, writers, perWriter = 4, 4, 10
+	var wg sync.WaitGroup
+	errs := make(chan error, repos*writers*perWriter*4)
+	for r := 0; r < repos; r++ {
+		repo := fmt.Sprintf("repo-%d", r)
+		for w := 0; w < writers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < perWriter; i++ {
+					result, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{
+						Name:       repo,
+						Content:    fmt.Sprintf("writer %d revision %d", w, i),
+						AuthorName: "Alice",
+						AuthorID:   "alice@id",
+					})
+					if err != nil {
+						errs <- err
+						continue
+					}
+					if i%3 == 0 {
+						_, err = store.CreateTag(ctx, TagRequest{Repo: repo, Name: result.CommitHash[:12], Commit: result.CommitHash})
+						errs <- err
+					}
+				}
+			}(w)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				commits, err := store.ListCommits(ctx, ListCommitsOptions{Repo: repo})
+				if err != nil {
+					errs <- err
+					continue
+				}
+				for _, commit := range commits {
+					if _, _, err := store.GetCommit(ctx, repo, commit.Hash); err != nil {
+						errs <- err
+					}
+				}
+				if _, err := store.EnforceRetention(ctx, repo); err != nil {
+					errs <- err
+				}
+				if _, err := store.Check(ctx, CheckOptions{Repo: repo}); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("concurrent operation: %v", err)
+		}
+	}
+
+	verify := func(store Store) {
+		t.Helper()
+		names, err := store.ListRepos(ctx)
+		if err != nil || len(names) != repos {
+			t.Fatalf("ListRepos = %v, %v", names, err)
+		}
+		for _, repo := range names {
+			// Every commit must be on the branch's first-parent chain and in
+			// the history index.
+			branch, err := store.GetBranch(ctx, repo, defaultBranch)
+			if err != nil {
+				t.Fatalf("GetBranch: %v", err)
+			}
+			chain := 0
+			for hash := branch.Commit; hash != ""; chain++ {
+				commit, _, err := store.GetCommit(ctx, repo, hash)
+				if err != nil {
+					t.Fatalf("GetCommit %s: %v", repo, err)
+				}
+				hash = commit.Parent
+			}
+			commits, err := store.ListCommits(ctx, ListCommitsOptions{Repo: repo})
+			if err != nil {
+				t.Fatalf("ListCommits: %v", err)
+			}
+			if chain != writers*perWriter || len(commits) != chain {
+				t.Fatalf("%s: chain of %d commits, %d indexed, want %d", repo, chain, len(commits), writers*perWriter)
+			}
+			report, err := store.Check(ctx, CheckOptions{Repo: repo})
+			if err != nil || len(report.Issues) != 0 {
+				t.Fatalf("Check %s: %+v, %v", repo, report.Issues, err)
+			}
+		}
+	}
+	verify(store)
+
+	if err := store.(*memoryStore).Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	reopened, err := NewDurableMemoryStore(cfg, opts)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	t.Cleanup(func() { _ = reopened.(*memoryStore).Close() })
+	verify(reopened)
+}
+
+// TestMemoryStoreRepoIsolation holds one repository's lock, as a long upload
+// does, and expects other repositories to stay writable and readable.
+func TestMemoryStoreRepoIsolation(t *testing.T) {
+	store := newMemoryStore(Options{})
+	ctx := context.Background()
+	for _, repo := range []string{"busy", "idle"} {
+		if _, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: repo, Content: "v1", AuthorName: "Alice", AuthorID: "alice@id"}); err != nil {
+			t.Fatalf("PutBlobAndCommit: %v", err)
+		}
+	}
+
+	busy := store.repo("busy")
+	busy.mu.Lock()
+	done := make(chan error, 1)
+	go func() {
+		if _, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "idle", Content: "v2", AuthorName: "Alice", AuthorID: "alice@id"}); err != nil {
+			done <- err
+			return
+		}
+		if _, err := store.ListCommits(ctx, ListCommitsOptions{Repo: "idle"}); err != nil {
+			done <- err
+			return
+		}
+		_, err := store.ListRepos(ctx)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("idle repository: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("operations on an idle repository waited on a busy one")
+	}
+	busy.mu.Unlock()
+}
+
+// benchmarkContent is a 64-line blob whose last line varies with i, so each
+// upload diffs a realistic amount of text.
+func benchmarkContent(i int) string {
+	var sb strings.Builder
+	for line := 0; line < 63; line++ {
+		fmt.Fprintf(&sb, "line %d of the configuration blob\n", line)
+	}
+	fmt.Fprintf(&sb, "revision %d\n", i)
+	return sb.String()
+}
+
+// BenchmarkMemoryStoreParallelWrites uploads from parallel goroutines spread
+// over a varying number of repositories. With per-repository locking,
+// throughput grows with the number of repositories.
+func BenchmarkMemoryStoreParallelWrites(b *testing.B) {
+	for _, repos := range []int{1, 8, 64} {
+		b.Run(fmt.Sprintf("repos-%d", repos), func(b *testing.B) {
+			store := newMemoryStore(Options{})
+			ctx := context.Background()
+			var next, seq atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				repo := fmt.Sprintf("repo-%d", next.Add(1)%int64(repos))
+				for pb.Next() {
+					if _, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{
+						Name:       repo,
+						Content:    benchmarkContent(int(seq.Add(1))),
+						AuthorName: "Alice",
+						AuthorID:   "alice@id",
+					}); err != nil {
+						b.Fatalf("PutBlobAndCommit: %v", err)
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkMemoryStoreMixed reads one repository's history while another
+// repository takes uploads.
+func BenchmarkMemoryStoreMixed(b *testing.B) {
+	store := newMemoryStore(Options{})
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		if _, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "read", Content: benchmarkContent(i), AuthorName: "Alice", AuthorID: "alice@id"}); err != nil {
+			b.Fatalf("PutBlobAndCommit: %v", err)
+		}
+	}
+	var next, seq atomic.Int64
+	b.RunParallel(func(pb *testing.PB) {
+		writer := next.Add(1)%4 == 0
+		for pb.Next() {
+			if writer {
+				if _, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "write", Content: benchmarkContent(int(seq.Add(1))), AuthorName: "Alice", AuthorID: "alice@id"}); err != nil {
+					b.Fatalf("PutBlobAndCommit: %v", err)
+				}
+				continue
+			}
+			if commits, err := store.ListCommits(ctx, ListCommitsOptions{Repo: "read", Descending: true, Limit: 20}); err != nil || len(commits) != 20 {
+				b.Fatalf("ListCommits = %d commits, %v", len(commits), err)
+			}
+		}
+	})
+}
+
+func TestMemoryStoreBudget(t *testing.T) {
+	dir := t.TempDir()
+	archive := NewMemoryArchive()
+	cfg := PersistenceConfig{Dir: dir, Fsync: FsyncNever}
+	store, err := NewDurableMemoryStore(cfg, Options{Archive: archive, MemoryMaxBytes: 10})
+	if err != nil {
+		t.Fatalf("NewDurableMemoryStore: %v", err)
+	}
+	ms := store.(*memoryStore)
+	ctx := context.Background()
+
+	put := func(repo, content string) string {
+		t.Helper()
+		result, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: repo, Content: content, AuthorName: "Alice", AuthorID: "alice@id"})
+		if err != nil {
+			t.Fatalf("PutBlobAndCommit %s: %v", content, err)
+		}
+		if stats := ms.MemoryStats(); stats.HotBytes > 10 {
+			t.Fatalf("hot content over budget after %s: %+v", content, stats)
+		}
+		return result.CommitHash
+	}
+	a1 := put("a", "a-v1")
+	b1 := put("b", "b-v1")
+	// Reading a's head makes b's the least recently used.
+	if _, content, err := store.GetCommit(ctx, "a", a1); err != nil || content != "a-v1" {
+		t.Fatalf("GetCommit: %q, %v", content, err)
+	}
+	put("c", "c-v1")
+
+	commit, content, err := store.GetCommit(ctx, "b", b1)
+	if err != nil || content != "b-v1" || !commit.Archived {
+		t.Fatalf("expected b spilled and readable, got %+v %q %v", commit, content, err)
+	}
+	if commit, _, _ := store.GetCommit(ctx, "a", a1); commit.Archived {
+		t.Fatalf("expected recently read a to stay hot")
+	}
+	stats := ms.MemoryStats()
+	if stats.Spills != 1 || stats.SpilledBytes != 4 || stats.HotEntries != 2 || stats.HotBytes != 8 || stats.MaxBytes != 10 || stats.Repos != 3 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// Writing on top of a spilled head diffs against the archived content.
+	result, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "b", Content: "b-v2", AuthorName: "Alice", AuthorID: "alice@id"})
+	if err != nil {
+		t.Fatalf("PutBlobAndCommit on spilled head: %v", err)
+	}
+	if !strings.Contains(result.Diff, "-b-v1") {
+		t.Fatalf("expected diff against spilled content, got %q", result.Diff)
+	}
+
+	// Restoring content that does not fit is refused.
+	if err := ms.restoreCommit(ctx, "b", b1); !errors.Is(err, errMemoryBudget) {
+		t.Fatalf("expected budget error, got %v", err)
+	}
+
+	// A smaller budget spills on startup.
+	if err := ms.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	reopened, err := NewDurableMemoryStore(cfg, Options{Archive: archive, MemoryMaxBytes: 4})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	t.Cleanup(func() { _ = reopened.(*memoryStore).Close() })
+	if stats := reopened.(*memoryStore).MemoryStats(); stats.HotBytes > 4 || stats.HotEntries != 1 {
+		t.Fatalf("expected spill on startup, got %+v", stats)
+	}
+	if _, content, err := reopened.GetCommit(ctx, "a", a1); err != nil || content != "a-v1" {
+		t.Fatalf("GetCommit after reopen: %q, %v", content, err)
+	}
+	if report, err := reopened.Check(ctx, CheckOptions{Repo: "b"}); err != nil || len(report.Issues) != 0 {
+		t.Fatalf("Check: %+v, %v", report.Issues, err)
+	}
+}
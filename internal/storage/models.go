@@ -42,3 +42,10 @@ type TagRequest struct {
 	Commit string
 	Note   string
 }
+
+// PinRequest is used to pin a commit in hot storage.
+type PinRequest struct {
+	Repo   string
+	Commit string
+	Reason string
+}
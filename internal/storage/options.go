@@ -18,19 +18,76 @@ type RetentionPolicy struct {
 	Repo           string
 	HotCommitLimit int
 	HotDuration    time.Duration
-	Locked         bool
+	// PurgeAfter permanently removes content older than this from hot storage
+	// and the archive, keeping commit metadata marked as purged. Zero disables it.
+	PurgeAfter time.Duration
+	// PinTags and PinBranchHeads keep tagged commits and branch heads hot.
+	// Explicit pins always apply.
+	PinTags        bool
+	PinBranchHeads bool
+	// Compression selects the codec for new and recompressed content; empty
+	// means the store default.
+	Compression Codec
+	// Version counts changes to the repository's policy; zero means the store
+	// defaults apply. The remaining fields record who made the latest change,
+	// when and why.
+	Version    int
+	UpdatedAt  time.Time
+	AuthorName string
+	AuthorID   string
+	Reason     string
 }
 
 // RetentionDefaults provides fallback retention when no policy is configured.
 type RetentionDefaults struct {
 	HotCommitLimit int
 	HotDuration    time.Duration
+	PurgeAfter     time.Duration
+	PinTags        bool
+	PinBranchHeads bool
+	Compression    Codec
 }
 
 // Options control storage behaviour across backends.
 type Options struct {
 	Archive   Archive
 	Retention RetentionDefaults
+	// RetentionNotify, when set, receives the repository name after writes
+	// that can change what retention should do: commits, ref moves, policies
+	// and pins. Backends never enforce retention inline; the caller runs
+	// EnforceRetention, normally through a RetentionWorker.
+	RetentionNotify func(repo string)
+	// PolicyCooldown is the minimum time between changes to an existing
+	// retention policy. Zero allows changes at any time.
+	PolicyCooldown time.Duration
+	// MasterKeys enables encryption of content at rest. Each repository gets
+	// data keys wrapped by the active master key; nil stores content in the
+	// clear.
+	MasterKeys *MasterKeys
+	// MemoryMaxBytes bounds the content the memory backend keeps hot; least
+	// recently used content beyond it is spilled to Archive. Zero, or no
+	// archive, leaves it unbounded. Other backends ignore it.
+	MemoryMaxBytes int64
+}
+
+// notifier returns RetentionNotify, or a no-op when it is unset.
+func (o Options) notifier() func(repo string) {
+	if o.RetentionNotify != nil {
+		return o.RetentionNotify
+	}
+	return func(string) {}
+}
+
+// policy converts the defaults into an unbound retention policy.
+func (d RetentionDefaults) policy() RetentionPolicy {
+	return RetentionPolicy{
+		HotCommitLimit: d.HotCommitLimit,
+		HotDuration:    d.HotDuration,
+		PurgeAfter:     d.PurgeAfter,
+		PinTags:        d.PinTags,
+		PinBranchHeads: d.PinBranchHeads,
+		Compression:    d.Compression,
+	}
 }
 
 // WithRepo returns a copy of the policy bound to the provided repo name.
@@ -45,6 +102,80 @@ func (p RetentionPolicy) Copy() RetentionPolicy {
 		Repo:           p.Repo,
 		HotCommitLimit: p.HotCommitLimit,
 		HotDuration:    p.HotDuration,
-		Locked:         p.Locked,
+		PurgeAfter:     p.PurgeAfter,
+		PinTags:        p.PinTags,
+		PinBranchHeads: p.PinBranchHeads,
+		Compression:    p.Compression,
+		Version:        p.Version,
+		UpdatedAt:      p.UpdatedAt,
+		AuthorName:     p.AuthorName,
+		AuthorID:       p.AuthorID,
+		Reason:         p.Reason,
+	}
+}
+
+// validatePolicy checks the limits shared by every backend's SetPolicy.
+func validatePolicy(policy RetentionPolicy) error {
+	if policy.Repo == "" {
+		return &ValidationError{Message: "repository name is required"}
+	}
+	if policy.HotCommitLimit < 0 {
+		return &ValidationError{Message: "hotCommitLimit must be >= 0"}
+	}
+	if policy.HotDuration < 0 {
+		return &ValidationError{Message: "hotDuration must be >= 0"}
+	}
+	if policy.PurgeAfter < 0 {
+		return &ValidationError{Message: "purgeAfter must be >= 0"}
+	}
+	if policy.PurgeAfter > 0 && policy.PurgeAfter < policy.HotDuration {
+		return &ValidationError{Message: "purgeAfter must not be shorter than hotDuration"}
+	}
+	if _, err := ParseCodec(string(policy.Compression)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// sameLimits reports whether p and other enforce identical retention.
+func (p RetentionPolicy) sameLimits(other RetentionPolicy) bool {
+	return p.HotCommitLimit == other.HotCommitLimit && p.HotDuration == other.HotDuration && p.PurgeAfter == other.PurgeAfter &&
+		p.PinTags == other.PinTags && p.PinBranchHeads == other.PinBranchHeads && p.Compression == other.Compression
+}
+
+// contentCodec returns the codec for the policy's content, falling back to
+// the store defaults.
+func (p RetentionPolicy) contentCodec(defaults RetentionPolicy) Codec {
+	if p.Compression != "" {
+		return p.Compression
+	}
+	if defaults.Compression != "" {
+		return defaults.Compression
+	}
+	return CodecNone
+}
+
+// nextPolicy validates a change from current to req and returns the version to
+// store. unchanged reports a resubmission of the current limits, which is
+// accepted without a new version. Changing an existing policy needs a reason
+// and must respect the cooldown.
+func nextPolicy(current, req RetentionPolicy, cooldown time.Duration, now time.Time) (next RetentionPolicy, unchanged bool, err error) {
+	if err := validatePolicy(req); err != nil {
+		return RetentionPolicy{}, false, err
+	}
+	if current.Version > 0 {
+		if current.sameLimits(req) {
+			return current, true, nil
+		}
+		if req.Reason == "" {
+			return RetentionPolicy{}, false, &ValidationError{Message: "reason is required to change an existing policy"}
+		}
+		if until := current.UpdatedAt.Add(cooldown); cooldown > 0 && now.Before(until) {
+			return RetentionPolicy{}, false, &CooldownError{Resource: "policy", Key: req.Repo, Until: until}
+		}
 	}
+	next = req.Copy()
+	next.Version = current.Version + 1
+	next.UpdatedAt = now.UTC()
+	return next, false, nil
 }
@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Deltas describe a target payload as copies from a base payload and
+// literal inserts:
+//
+//	uvarint baseLen, uvarint targetLen, then ops until the end:
+//	0x00 uvarint n <n bytes>   insert
+//	0x01 uvarint off uvarint n copy base[off:off+n]
+const (
+	deltaOpInsert byte = 0x00
+	deltaOpCopy   byte = 0x01
+
+	// deltaBlock is the match granularity: the base is indexed in aligned
+	// blocks and the target is scanned with a rolling hash of this width.
+	deltaBlock = 16
+	deltaPrime = 1099511628211
+)
+
+var deltaPow = func() uint64 {
+	p := uint64(1)
+	for i := 0; i < deltaBlock-1; i++ {
+		p *= deltaPrime
+	}
+	return p
+}()
+
+func deltaHash(b []byte) uint64 {
+	var h uint64
+	for _, c := range b {
+		h = h*deltaPrime + uint64(c)
+	}
+	return h
+}
+
+// deltaIndex indexes a base payload for delta encoding. It is built once per
+// base and reused for every target compared against it.
+type deltaIndex struct {
+	base   []byte
+	blocks map[uint64]int
+}
+
+func newDeltaIndex(base []byte) *deltaIndex {
+	idx := &deltaIndex{base: base, blocks: make(map[uint64]int, len(base)/deltaBlock)}
+	for off := 0; off+deltaBlock <= len(base); off += deltaBlock {
+		h := deltaHash(base[off : off+deltaBlock])
+		if _, ok := idx.blocks[h]; !ok {
+			idx.blocks[h] = off
+		}
+	}
+	return idx
+}
+
+// delta encodes target against the indexed base. It gives up and returns
+// nil once the delta would exceed limit bytes.
+func (idx *deltaIndex) delta(target []byte, limit int) []byte {
+	base := idx.base
+	out := binary.AppendUvarint(nil, uint64(len(base)))
+	out = binary.AppendUvarint(out, uint64(len(target)))
+
+	literal := 0 // start of the pending insert
+	i := 0
+	var h uint64
+	if len(target) >= deltaBlock {
+		h = deltaHash(target[:deltaBlock])
+	}
+	for i+deltaBlock <= len(target) {
+		if len(out)+i-literal > limit {
+			return nil
+		}
+		if off, ok := idx.blocks[h]; ok && bytes.Equal(base[off:off+deltaBlock], target[i:i+deltaBlock]) {
+			start, baseStart := i, off
+			for start > literal && baseStart > 0 && target[start-1] == base[baseStart-1] {
+				start--
+				baseStart--
+			}
+			end, baseEnd := i+deltaBlock, off+deltaBlock
+			for end < len(target) && baseEnd < len(base) && target[end] == base[baseEnd] {
+				end++
+				baseEnd++
+			}
+			out = appendDeltaInsert(out, target[literal:start])
+			out = appendDeltaCopy(out, baseStart, end-start)
+			i, literal = end, end
+			if i+deltaBlock <= len(target) {
+				h = deltaHash(target[i : i+deltaBlock])
+			}
+			continue
+		}
+		if i+deltaBlock < len(target) {
+			h = (h-uint64(target[i])*deltaPow)*deltaPrime + uint64(target[i+deltaBlock])
+		}
+		i++
+	}
+	out = appendDeltaInsert(out, target[literal:])
+	if len(out) > limit {
+		return nil
+	}
+	return out
+}
+
+func appendDeltaInsert(out, literal []byte) []byte {
+	if len(literal) == 0 {
+		return out
+	}
+	out = append(out, deltaOpInsert)
+	out = binary.AppendUvarint(out, uint64(len(literal)))
+	return append(out, literal...)
+}
+
+func appendDeltaCopy(out []byte, off, n int) []byte {
+	out = append(out, deltaOpCopy)
+	out = binary.AppendUvarint(out, uint64(off))
+	return binary.AppendUvarint(out, uint64(n))
+}
+
+var errCorruptDelta = errors.New("corrupt delta")
+
+// applyDelta rebuilds the target a delta was computed for.
+func applyDelta(base, delta []byte) ([]byte, error) {
+	baseLen, n := binary.Uvarint(delta)
+	if n <= 0 || baseLen != uint64(len(base)) {
+		return nil, fmt.Errorf("%w: base is %d bytes, delta expects %d", errCorruptDelta, len(base), baseLen)
+	}
+	delta = delta[n:]
+	targetLen, n := binary.Uvarint(delta)
+	if n <= 0 || targetLen > uint64(len(base))+uint64(len(delta)) {
+		return nil, errCorruptDelta
+	}
+	delta = delta[n:]
+
+	out := make([]byte, 0, targetLen)
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+		switch op {
+		case deltaOpInsert:
+			size, n := binary.Uvarint(delta)
+			if n <= 0 || size > uint64(len(delta)-n) {
+				return nil, errCorruptDelta
+			}
+			out = append(out, delta[n:n+int(size)]...)
+			delta = delta[n+int(size):]
+		case deltaOpCopy:
+			off, n := binary.Uvarint(delta)
+			if n <= 0 {
+				return nil, errCorruptDelta
+			}
+			delta = delta[n:]
+			size, n := binary.Uvarint(delta)
+			if n <= 0 || off > uint64(len(base)) || size > uint64(len(base))-off {
+				return nil, errCorruptDelta
+			}
+			delta = delta[n:]
+			out = append(out, base[off:off+size]...)
+		default:
+			return nil, fmt.Errorf("%w: unknown op %d", errCorruptDelta, op)
+		}
+		if uint64(len(out)) > targetLen {
+			return nil, errCorruptDelta
+		}
+	}
+	if uint64(len(out)) != targetLen {
+		return nil, fmt.Errorf("%w: rebuilt %d bytes, want %d", errCorruptDelta, len(out), targetLen)
+	}
+	return out, nil
+}
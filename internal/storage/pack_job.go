@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// PackJobStatus reports the job's state and the last pack report per
+// repository.
+type PackJobStatus struct {
+	Running  bool   `json:"running"`
+	Interval string `json:"interval,omitempty"`
+	// Active is the repository being packed, if any.
+	Active    string                `json:"active,omitempty"`
+	Runs      int64                 `json:"runs"`
+	Failures  int64                 `json:"failures"`
+	Packed    int64                 `json:"packed"`
+	LastSweep *time.Time            `json:"lastSweep,omitempty"`
+	Repos     map[string]PackReport `json:"repos,omitempty"`
+}
+
+// PackJob packs the loose payloads of a BoltArchive, one repository at a
+// time. Scheduled sweeps only pack repositories with enough loose payloads;
+// full repacks, which also merge existing packs and reclaim removed
+// payloads, run on demand.
+type PackJob struct {
+	interval time.Duration
+	opts     PackOptions
+	clock    func() time.Time
+	wake     chan struct{}
+
+	mu      sync.Mutex
+	archive *BoltArchive
+	// pending maps queued repositories to whether a full repack was asked
+	// for.
+	pending map[string]bool
+	all     bool
+	allFull bool
+	status  PackJobStatus
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// NewPackJob creates a stopped job that sweeps every repository each
+// interval. Zero disables scheduled sweeps; Trigger still works.
+func NewPackJob(interval time.Duration, opts PackOptions) *PackJob {
+	opts.Full = false
+	return &PackJob{
+		interval: interval,
+		opts:     opts,
+		clock:    time.Now,
+		wake:     make(chan struct{}, 1),
+		pending:  make(map[string]bool),
+		status:   PackJobStatus{Repos: make(map[string]PackReport)},
+	}
+}
+
+// Start launches the job. With a sweep interval the first sweep runs
+// immediately.
+func (j *PackJob) Start(archive *BoltArchive) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	j.archive = archive
+	j.cancel = cancel
+	j.status.Running = true
+	if j.interval > 0 {
+		j.all = true
+	}
+	j.wg.Add(1)
+	go j.loop(ctx)
+	j.signal()
+}
+
+// Stop cancels the current pass and waits for the job to exit.
+func (j *PackJob) Stop() {
+	j.mu.Lock()
+	cancel := j.cancel
+	j.cancel = nil
+	j.status.Running = false
+	j.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	j.wg.Wait()
+}
+
+// Trigger queues a pass over repo, or over every repository when repo is
+// empty. full asks for a full repack. It never blocks.
+func (j *PackJob) Trigger(repo string, full bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if repo == "" {
+		j.all = true
+		j.allFull = j.allFull || full
+	} else {
+		j.pending[repo] = j.pending[repo] || full
+	}
+	j.signal()
+}
+
+func (j *PackJob) signal() {
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Status returns a snapshot of the job state and per-repository reports.
+func (j *PackJob) Status() PackJobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := j.status
+	if j.interval > 0 {
+		status.Interval = j.interval.String()
+	}
+	status.Repos = make(map[string]PackReport, len(j.status.Repos))
+	for repo, report := range j.status.Repos {
+		status.Repos[repo] = report
+	}
+	return status
+}
+
+func (j *PackJob) loop(ctx context.Context) {
+	defer j.wg.Done()
+	var tick <-chan time.Time
+	if j.interval > 0 {
+		ticker := time.NewTicker(j.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-j.wake:
+		case <-tick:
+			j.mu.Lock()
+			j.all = true
+			j.mu.Unlock()
+		}
+		j.drain(ctx)
+	}
+}
+
+// drain processes queued repositories until none are left.
+func (j *PackJob) drain(ctx context.Context) {
+	for ctx.Err() == nil {
+		j.mu.Lock()
+		archive, all, allFull := j.archive, j.all, j.allFull
+		queued := j.pending
+		j.pending = make(map[string]bool)
+		j.all, j.allFull = false, false
+		j.mu.Unlock()
+
+		if all {
+			listed, err := archive.PackRepos(ctx)
+			if err != nil {
+				j.mu.Lock()
+				j.status.Failures++
+				j.mu.Unlock()
+			}
+			for _, repo := range listed {
+				queued[repo] = queued[repo] || allFull
+			}
+			now := j.clock().UTC()
+			j.mu.Lock()
+			j.status.LastSweep = &now
+			j.mu.Unlock()
+		}
+		if len(queued) == 0 {
+			return
+		}
+		for repo, full := range queued {
+			if ctx.Err() != nil {
+				return
+			}
+			j.run(ctx, archive, repo, full)
+		}
+	}
+}
+
+func (j *PackJob) run(ctx context.Context, archive *BoltArchive, repo string, full bool) {
+	j.mu.Lock()
+	j.status.Active = repo
+	j.mu.Unlock()
+
+	opts := j.opts
+	opts.Full = full
+	started := j.clock()
+	report, err := archive.Pack(ctx, repo, opts)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	report.Repo = repo
+	report.Duration = j.clock().Sub(started).String()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.Active = ""
+	j.status.Runs++
+	if len(report.Errors) > 0 {
+		j.status.Failures++
+	}
+	j.status.Packed += int64(report.Packed)
+	j.status.Repos[repo] = report
+}
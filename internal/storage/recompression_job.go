@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RecompressionJobStatus reports the job's state and the last compression
+// report per repository.
+type RecompressionJobStatus struct {
+	Running  bool   `json:"running"`
+	Interval string `json:"interval,omitempty"`
+	// Active is the repository being recompressed, if any.
+	Active       string                       `json:"active,omitempty"`
+	Runs         int64                        `json:"runs"`
+	Failures     int64                        `json:"failures"`
+	Recompressed int64                        `json:"recompressed"`
+	LastSweep    *time.Time                   `json:"lastSweep,omitempty"`
+	Repos        map[string]CompressionReport `json:"repos,omitempty"`
+}
+
+// RecompressionJob rewrites stored content whose codec no longer matches the
+// repository's policy, such as content written before compression was
+// enabled or before a policy changed codec. It processes one repository at a
+// time so it never competes with client traffic for more than one
+// connection, and keeps the last report per repository as compression stats.
+type RecompressionJob struct {
+	interval time.Duration
+	clock    func() time.Time
+	wake     chan struct{}
+
+	mu      sync.Mutex
+	store   Store
+	pending map[string]bool
+	all     bool
+	status  RecompressionJobStatus
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// NewRecompressionJob creates a stopped job that sweeps every repository each
+// interval. Zero disables scheduled sweeps; Trigger still works.
+func NewRecompressionJob(interval time.Duration) *RecompressionJob {
+	return &RecompressionJob{
+		interval: interval,
+		clock:    time.Now,
+		wake:     make(chan struct{}, 1),
+		pending:  make(map[string]bool),
+		status:   RecompressionJobStatus{Repos: make(map[string]CompressionReport)},
+	}
+}
+
+// Start launches the job. With a sweep interval the first sweep runs
+// immediately.
+func (j *RecompressionJob) Start(store Store) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	j.store = store
+	j.cancel = cancel
+	j.status.Running = true
+	if j.interval > 0 {
+		j.all = true
+	}
+	j.wg.Add(1)
+	go j.loop(ctx)
+	j.signal()
+}
+
+// Stop cancels the current pass and waits for the job to exit.
+func (j *RecompressionJob) Stop() {
+	j.mu.Lock()
+	cancel := j.cancel
+	j.cancel = nil
+	j.status.Running = false
+	j.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	j.wg.Wait()
+}
+
+// Trigger queues a pass over repo, or over every repository when repo is
+// empty. It never blocks.
+func (j *RecompressionJob) Trigger(repo string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if repo == "" {
+		j.all = true
+	} else {
+		j.pending[repo] = true
+	}
+	j.signal()
+}
+
+func (j *RecompressionJob) signal() {
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Status returns a snapshot of the job state and per-repository stats.
+func (j *RecompressionJob) Status() RecompressionJobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := j.status
+	if j.interval > 0 {
+		status.Interval = j.interval.String()
+	}
+	status.Repos = make(map[string]CompressionReport, len(j.status.Repos))
+	for repo, report := range j.status.Repos {
+		status.Repos[repo] = report
+	}
+	return status
+}
+
+func (j *RecompressionJob) loop(ctx context.Context) {
+	defer j.wg.Done()
+	var tick <-chan time.Time
+	if j.interval > 0 {
+		ticker := time.NewTicker(j.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-j.wake:
+		case <-tick:
+			j.mu.Lock()
+			j.all = true
+			j.mu.Unlock()
+		}
+		j.drain(ctx)
+	}
+}
+
+// drain processes queued repositories until none are left.
+func (j *RecompressionJob) drain(ctx context.Context) {
+	for ctx.Err() == nil {
+		j.mu.Lock()
+		store, all := j.store, j.all
+		repos := make([]string, 0, len(j.pending))
+		for repo := range j.pending {
+			repos = append(repos, repo)
+		}
+		j.pending = make(map[string]bool)
+		j.all = false
+		j.mu.Unlock()
+
+		if all {
+			listed, err := store.ListRepos(ctx)
+			if err != nil {
+				j.mu.Lock()
+				j.status.Failures++
+				j.mu.Unlock()
+			}
+			repos = append(repos, listed...)
+			now := j.clock().UTC()
+			j.mu.Lock()
+			j.status.LastSweep = &now
+			j.mu.Unlock()
+		}
+		if len(repos) == 0 {
+			return
+		}
+		seen := make(map[string]bool, len(repos))
+		for _, repo := range repos {
+			if seen[repo] || ctx.Err() != nil {
+				continue
+			}
+			seen[repo] = true
+			j.run(ctx, store, repo)
+		}
+	}
+}
+
+func (j *RecompressionJob) run(ctx context.Context, store Store, repo string) {
+	j.mu.Lock()
+	j.status.Active = repo
+	j.mu.Unlock()
+
+	started := j.clock()
+	report, err := store.Recompress(ctx, repo)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	report.Repo = repo
+	if report.StartedAt.IsZero() {
+		report.StartedAt = started.UTC()
+	}
+	report.Duration = j.clock().Sub(started).String()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.Active = ""
+	j.status.Runs++
+	if len(report.Errors) > 0 {
+		j.status.Failures++
+	}
+	j.status.Recompressed += int64(report.Recompressed)
+	j.status.Repos[repo] = report
+}
@@ -0,0 +1,388 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRehydrationTTL      = time.Hour
+	defaultRehydrationMinReads = 2
+	// maxRehydrationCandidates bounds the read counters kept for archived
+	// content that has not been promoted yet.
+	maxRehydrationCandidates = 10000
+	// maxPromoteAttempts bounds the fetches of a promotion that keeps
+	// overlapping archive writes.
+	maxPromoteAttempts = 3
+)
+
+// RehydrationConfig controls the read-through tier in front of an archive.
+type RehydrationConfig struct {
+	// MaxBytes bounds the payload bytes held in memory; least recently used
+	// entries are evicted first. Zero or less disables the tier.
+	MaxBytes int64
+	// TTL is how long promoted content stays hot after its last read.
+	TTL time.Duration
+	// MinReads is the number of archive reads that promote content. Values
+	// below one mean the default of two.
+	MinReads int
+}
+
+// RehydrationStats reports the tier's occupancy and counters.
+type RehydrationStats struct {
+	Entries     int    `json:"entries"`
+	Bytes       int64  `json:"bytes"`
+	MaxBytes    int64  `json:"maxBytes"`
+	TTL         string `json:"ttl"`
+	Hits        int64  `json:"hits"`
+	Misses      int64  `json:"misses"`
+	Promotions  int64  `json:"promotions"`
+	Evictions   int64  `json:"evictions"`
+	Expirations int64  `json:"expirations"`
+}
+
+// RestoreRequest selects archived commits to promote into the rehydration
+// tier. From and To bound an inclusive range in history order, and either may
+// be empty for an open end; Commits names individual hashes. TTL overrides the
+// configured TTL when positive.
+type RestoreRequest struct {
+	Repo    string
+	From    string
+	To      string
+	Commits []string
+	TTL     time.Duration
+}
+
+// RestoreResult reports a restore. Hot commits never left hot storage and
+// purged commits have no content left; neither is restored.
+type RestoreResult struct {
+	Repo      string    `json:"repo"`
+	Restored  []string  `json:"restored"`
+	Hot       []string  `json:"hot,omitempty"`
+	Purged    []string  `json:"purged,omitempty"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Errors    []string  `json:"errors,omitempty"`
+}
+
+type rehydrationKey struct {
+	repo string
+	hash string
+}
+
+type rehydrationEntry struct {
+	key     rehydrationKey
+	data    []byte
+	expires time.Time
+}
+
+// RehydrationCache is an Archive that keeps frequently read archived content
+// in memory. Fetch always reads the underlying archive, so integrity checks
+// and retention see the durable copy; stores serve GetCommit through Read.
+// Store and Remove drop any cached copy before and after delegating, and a
+// fetch that overlapped a drop is not cached, which keeps purge, garbage
+// collection and re-encoding from serving stale content. Promotion never touches
+// a commit's Archived flag.
+type RehydrationCache struct {
+	Archive
+	cfg   RehydrationConfig
+	clock func() time.Time
+
+	mu      sync.Mutex
+	lru     *list.List // front is most recently used
+	entries map[rehydrationKey]*list.Element
+	reads   map[rehydrationKey]int
+	stats   RehydrationStats
+	// gen counts drops. Fetches record it first and are not cached if it
+	// moved, since their payload may predate the drop.
+	gen uint64
+}
+
+// NewRehydrationCache wraps archive with a read-through tier.
+func NewRehydrationCache(archive Archive, cfg RehydrationConfig) *RehydrationCache {
+	if cfg.TTL <= 0 {
+		cfg.TTL = defaultRehydrationTTL
+	}
+	if cfg.MinReads < 1 {
+		cfg.MinReads = defaultRehydrationMinReads
+	}
+	return &RehydrationCache{
+		Archive: archive,
+		cfg:     cfg,
+		clock:   time.Now,
+		lru:     list.New(),
+		entries: make(map[rehydrationKey]*list.Element),
+		reads:   make(map[rehydrationKey]int),
+	}
+}
+
+// Store writes through to the archive, replacing any cached copy.
+func (c *RehydrationCache) Store(ctx context.Context, repo, hash string, data []byte) error {
+	key := rehydrationKey{repo, hash}
+	c.drop(key)
+	defer c.drop(key)
+	return c.Archive.Store(ctx, repo, hash, data)
+}
+
+// Remove drops any cached copy and removes the archive entry.
+func (c *RehydrationCache) Remove(ctx context.Context, repo, hash string) error {
+	key := rehydrationKey{repo, hash}
+	c.drop(key)
+	defer c.drop(key)
+	return c.Archive.Remove(ctx, repo, hash)
+}
+
+// Read returns archived content, serving it from memory when promoted. Reads
+// that miss count towards promotion.
+func (c *RehydrationCache) Read(ctx context.Context, repo, hash string) ([]byte, error) {
+	key := rehydrationKey{repo, hash}
+	data, gen, ok := c.lookup(key)
+	if ok {
+		return data, nil
+	}
+	data, err := c.Archive.Fetch(ctx, repo, hash)
+	if err != nil {
+		return nil, err
+	}
+	if c.cfg.MaxBytes <= 0 {
+		return data, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen {
+		return data, nil
+	}
+	c.reads[key]++
+	if c.reads[key] >= c.cfg.MinReads {
+		delete(c.reads, key)
+		c.insertLocked(key, data, c.clock().Add(c.cfg.TTL))
+	} else if len(c.reads) > maxRehydrationCandidates {
+		c.reads = map[rehydrationKey]int{key: c.reads[key]}
+	}
+	return append([]byte{}, data...), nil
+}
+
+// Promote loads archived content into memory until now+ttl, or the configured
+// TTL when ttl is not positive. It returns the expiry.
+func (c *RehydrationCache) Promote(ctx context.Context, repo, hash string, ttl time.Duration) (time.Time, error) {
+	if c.cfg.MaxBytes <= 0 {
+		return time.Time{}, &ValidationError{Message: "rehydration tier is disabled"}
+	}
+	if ttl <= 0 {
+		ttl = c.cfg.TTL
+	}
+	key := rehydrationKey{repo, hash}
+	for attempt := 1; ; attempt++ {
+		c.mu.Lock()
+		gen := c.gen
+		c.mu.Unlock()
+		data, err := c.Archive.Fetch(ctx, repo, hash)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if int64(len(data)) > c.cfg.MaxBytes {
+			return time.Time{}, fmt.Errorf("content of %d bytes exceeds the rehydration tier capacity", len(data))
+		}
+		expires := c.clock().Add(ttl)
+		c.mu.Lock()
+		if c.gen != gen {
+			// Archive entries changed during the fetch; load it again.
+			c.mu.Unlock()
+			if attempt == maxPromoteAttempts {
+				return time.Time{}, &ConflictError{Resource: "archive entry", Key: hash}
+			}
+			continue
+		}
+		delete(c.reads, key)
+		c.insertLocked(key, data, expires)
+		c.mu.Unlock()
+		return expires, nil
+	}
+}
+
+// Restore promotes the archived commits selected by req. Commits are resolved
+// through store, so it works with every backend.
+func (c *RehydrationCache) Restore(ctx context.Context, store Store, req RestoreRequest) (RestoreResult, error) {
+	result := RestoreResult{Repo: req.Repo, Restored: []string{}}
+	if req.Repo == "" {
+		return result, &ValidationError{Message: "repository name is required"}
+	}
+	if req.From == "" && req.To == "" && len(req.Commits) == 0 {
+		return result, &ValidationError{Message: "from, to or commits is required"}
+	}
+
+	commits, err := store.ListCommits(ctx, ListCommitsOptions{Repo: req.Repo})
+	var partial *PartialResultError
+	if errors.As(err, &partial) {
+		result.Errors = append(result.Errors, err.Error())
+	} else if err != nil {
+		return result, err
+	}
+
+	selected := make([]bool, len(commits))
+	index := make(map[string]int, len(commits))
+	for i, commit := range commits {
+		index[commit.Hash] = i
+	}
+	for _, hash := range req.Commits {
+		i, ok := index[hash]
+		if !ok {
+			return result, &NotFoundError{Resource: "commit", Key: hash}
+		}
+		selected[i] = true
+	}
+	if req.From != "" || req.To != "" {
+		from, to := 0, len(commits)-1
+		if req.From != "" {
+			i, ok := index[req.From]
+			if !ok {
+				return result, &NotFoundError{Resource: "commit", Key: req.From}
+			}
+			from = i
+		}
+		if req.To != "" {
+			i, ok := index[req.To]
+			if !ok {
+				return result, &NotFoundError{Resource: "commit", Key: req.To}
+			}
+			to = i
+		}
+		if from > to {
+			return result, &ValidationError{Message: "from must not be newer than to"}
+		}
+		for i := from; i <= to; i++ {
+			selected[i] = true
+		}
+	}
+
+	for i, commit := range commits {
+		if !selected[i] {
+			continue
+		}
+		switch {
+		case commit.Purged:
+			result.Purged = append(result.Purged, commit.Hash)
+		case !commit.Archived:
+			result.Hot = append(result.Hot, commit.Hash)
+		default:
+			if err := ctx.Err(); err != nil {
+				result.Errors = append(result.Errors, err.Error())
+				return result, nil
+			}
+			expires, err := c.Promote(ctx, req.Repo, commit.Hash, req.TTL)
+			if err != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("restore %s: %v", commit.Hash, err))
+				continue
+			}
+			result.Restored = append(result.Restored, commit.Hash)
+			result.ExpiresAt = expires
+		}
+	}
+	return result, nil
+}
+
+// Stats returns a snapshot of the tier's occupancy and counters.
+func (c *RehydrationCache) Stats() RehydrationStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	stats.MaxBytes = c.cfg.MaxBytes
+	stats.TTL = c.cfg.TTL.String()
+	return stats
+}
+
+// lookup returns a live cached copy and slides its expiry. On a miss it
+// returns the drop generation for the following fetch.
+func (c *RehydrationCache) lookup(key rehydrationKey) ([]byte, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, c.gen, false
+	}
+	entry := elem.Value.(*rehydrationEntry)
+	now := c.clock()
+	if !now.Before(entry.expires) {
+		c.removeLocked(elem)
+		c.stats.Expirations++
+		c.stats.Misses++
+		return nil, c.gen, false
+	}
+	if next := now.Add(c.cfg.TTL); next.After(entry.expires) {
+		entry.expires = next
+	}
+	c.lru.MoveToFront(elem)
+	c.stats.Hits++
+	return append([]byte{}, entry.data...), 0, true
+}
+
+func (c *RehydrationCache) insertLocked(key rehydrationKey, data []byte, expires time.Time) {
+	size := int64(len(data))
+	if size > c.cfg.MaxBytes {
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		if entry := elem.Value.(*rehydrationEntry); entry.expires.After(expires) {
+			expires = entry.expires
+		}
+		c.removeLocked(elem)
+	}
+	for c.stats.Bytes+size > c.cfg.MaxBytes {
+		c.removeLocked(c.lru.Back())
+		c.stats.Evictions++
+	}
+	c.entries[key] = c.lru.PushFront(&rehydrationEntry{key: key, data: append([]byte{}, data...), expires: expires})
+	c.stats.Bytes += size
+	c.stats.Promotions++
+}
+
+func (c *RehydrationCache) removeLocked(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*rehydrationEntry)
+	delete(c.entries, entry.key)
+	c.stats.Bytes -= int64(len(entry.data))
+}
+
+func (c *RehydrationCache) drop(key rehydrationKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	delete(c.reads, key)
+	if elem, ok := c.entries[key]; ok {
+		c.removeLocked(elem)
+	}
+}
+
+// archiveReader is implemented by archives with a read-through tier.
+type archiveReader interface {
+	Read(ctx context.Context, repo, hash string) ([]byte, error)
+}
+
+// readArchived fetches and decodes content for a client read, going through
+// the rehydration tier when the archive has one. The tier caches stored
+// (compressed and encrypted) payloads.
+func readArchived(ctx context.Context, archive Archive, keys *dataKeyring, repo, hash string) ([]byte, error) {
+	reader, ok := archive.(archiveReader)
+	if !ok {
+		return fetchContent(ctx, archive, keys, repo, hash)
+	}
+	data, err := reader.Read(ctx, repo, hash)
+	if err != nil {
+		return nil, err
+	}
+	return keys.decode(ctx, repo, data)
+}
+
+// fetchContent reads and decodes content from the archive itself.
+func fetchContent(ctx context.Context, archive Archive, keys *dataKeyring, repo, hash string) ([]byte, error) {
+	data, err := archive.Fetch(ctx, repo, hash)
+	if err != nil {
+		return nil, err
+	}
+	return keys.decode(ctx, repo, data)
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRehydrationCacheDropDuringFetch(t *testing.T) {
+	ctx := context.Background()
+	inner := &blockingArchive{Archive: NewMemoryArchive(), fetching: make(chan struct{}, 1), release: make(chan struct{})}
+	if err := inner.Store(ctx, "repo", "abc", []byte("old")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	cache := NewRehydrationCache(inner, RehydrationConfig{MaxBytes: 1 << 20, MinReads: 1})
+
+	// Remove lands after Read fetched the payload but before it is cached.
+	type outcome struct {
+		data []byte
+		err  error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		data, err := cache.Read(ctx, "repo", "abc")
+		done <- outcome{data, err}
+	}()
+	<-inner.fetching
+	if err := cache.Remove(ctx, "repo", "abc"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	close(inner.release)
+	if got := <-done; got.err != nil || string(got.data) != "old" {
+		t.Fatalf("Read: %q, %v", got.data, got.err)
+	}
+	if data, err := cache.Read(ctx, "repo", "abc"); !isNotFound(err) {
+		t.Fatalf("expected removed content gone, got %q, %v", data, err)
+	}
+	if stats := cache.Stats(); stats.Entries != 0 || stats.Promotions != 0 {
+		t.Fatalf("expected nothing cached, got %+v", stats)
+	}
+
+	// A promotion that overlaps a store loads the new payload.
+	if err := inner.Archive.Store(ctx, "repo", "abc", []byte("old")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	inner.release = make(chan struct{})
+	promoted := make(chan error, 1)
+	go func() {
+		_, err := cache.Promote(ctx, "repo", "abc", 0)
+		promoted <- err
+	}()
+	<-inner.fetching
+	if err := cache.Store(ctx, "repo", "abc", []byte("new")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	close(inner.release)
+	<-inner.fetching
+	if err := <-promoted; err != nil {
+		t.Fatalf("Promote: %v", err)
+	}
+	if data, err := cache.Read(ctx, "repo", "abc"); err != nil || string(data) != "new" {
+		t.Fatalf("expected the stored payload promoted, got %q, %v", data, err)
+	}
+}
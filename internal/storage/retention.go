@@ -0,0 +1,271 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/onexay/kv-vs/internal/types"
+)
+
+// PinSource identifies what keeps a commit pinned.
+type PinSource string
+
+const (
+	// PinSourceExplicit is a pin created through the pin API.
+	PinSourceExplicit PinSource = "pin"
+	// PinSourceTag is a tagged commit under a policy with PinTags.
+	PinSourceTag PinSource = "tag"
+	// PinSourceBranch is a branch head under a policy with PinBranchHeads.
+	PinSourceBranch PinSource = "branch"
+)
+
+// PinReason explains one reason a commit is pinned. Name is the tag or
+// branch name, or the note given with an explicit pin.
+type PinReason struct {
+	Source PinSource `json:"source"`
+	Name   string    `json:"name,omitempty"`
+}
+
+// PinnedCommit reports a commit retention keeps hot and why.
+type PinnedCommit struct {
+	Commit   string      `json:"commit"`
+	Archived bool        `json:"archived"`
+	Reasons  []PinReason `json:"reasons"`
+}
+
+// RetentionRun reports one retention pass over a repository.
+type RetentionRun struct {
+	Repo      string    `json:"repo"`
+	StartedAt time.Time `json:"startedAt"`
+	// Duration is filled in by the retention worker.
+	Duration string   `json:"duration,omitempty"`
+	Archived int      `json:"archived"`
+	Purged   int      `json:"purged"`
+	Restored int      `json:"restored"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// enforced reports whether the policy gives retention anything to do.
+func (p RetentionPolicy) enforced() bool {
+	return p.HotCommitLimit > 0 || p.HotDuration > 0 || p.PurgeAfter > 0
+}
+
+// retentionEntry is the minimal commit view needed to plan archival.
+type retentionEntry struct {
+	Hash      string
+	Timestamp time.Time
+	Archived  bool
+	Purged    bool
+	Pinned    bool
+}
+
+// planRetention returns the hashes that should move to the archive under
+// policy. Entries must be ordered oldest first.
+func planRetention(entries []retentionEntry, policy RetentionPolicy, now time.Time) []string {
+	if policy.HotCommitLimit <= 0 && policy.HotDuration <= 0 {
+		return nil
+	}
+	// Purged content has nothing left to archive, and pinned commits neither
+	// move nor count against the hot limit.
+	entries = slices.DeleteFunc(slices.Clone(entries), func(e retentionEntry) bool { return e.Purged || e.Pinned })
+
+	toArchive := make(map[string]struct{})
+	if policy.HotDuration > 0 {
+		cutoff := now.Add(-policy.HotDuration)
+		for _, e := range entries {
+			if e.Archived {
+				continue
+			}
+			if e.Timestamp.Before(cutoff) {
+				toArchive[e.Hash] = struct{}{}
+			}
+		}
+	}
+
+	if policy.HotCommitLimit > 0 {
+		remaining := make([]retentionEntry, 0, len(entries))
+		for _, e := range entries {
+			if e.Archived {
+				continue
+			}
+			if _, ok := toArchive[e.Hash]; ok {
+				continue
+			}
+			remaining = append(remaining, e)
+		}
+		if excess := len(remaining) - policy.HotCommitLimit; excess > 0 {
+			for i := 0; i < excess; i++ {
+				toArchive[remaining[i].Hash] = struct{}{}
+			}
+		}
+	}
+
+	result := make([]string, 0, len(toArchive))
+	for _, e := range entries {
+		if _, ok := toArchive[e.Hash]; ok {
+			result = append(result, e.Hash)
+		}
+	}
+	return result
+}
+
+// planPurge returns the hashes whose content has passed the policy's purge
+// horizon, hot or archived. Entries must be ordered oldest first.
+func planPurge(entries []retentionEntry, policy RetentionPolicy, now time.Time) []string {
+	if policy.PurgeAfter <= 0 {
+		return nil
+	}
+	cutoff := now.Add(-policy.PurgeAfter)
+	var result []string
+	for _, e := range entries {
+		if !e.Purged && e.Timestamp.Before(cutoff) {
+			result = append(result, e.Hash)
+		}
+	}
+	return result
+}
+
+// parentContent returns the content a new commit on top of parent diffs
+// against once parent's content has left hot storage: archived content is
+// read back and purged content counts as empty.
+func parentContent(ctx context.Context, archive Archive, keys *dataKeyring, repo string, parent types.Commit) (string, error) {
+	if parent.Purged {
+		return "", nil
+	}
+	if !parent.Archived || archive == nil {
+		return "", &NotFoundError{Resource: "content", Key: parent.Hash}
+	}
+	data, err := readArchived(ctx, archive, keys, repo, parent.Hash)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// planRestore returns pinned commits that are archived but not purged, which
+// retention brings back into hot storage.
+func planRestore(entries []retentionEntry) []string {
+	var result []string
+	for _, e := range entries {
+		if e.Pinned && e.Archived && !e.Purged {
+			result = append(result, e.Hash)
+		}
+	}
+	return result
+}
+
+// pinReasons collects why each commit is pinned under policy.
+func pinReasons(policy RetentionPolicy, branches []types.Branch, tags []types.Tag, pins []types.Pin) map[string][]PinReason {
+	reasons := make(map[string][]PinReason)
+	for _, pin := range pins {
+		reasons[pin.Commit] = append(reasons[pin.Commit], PinReason{Source: PinSourceExplicit, Name: pin.Reason})
+	}
+	if policy.PinTags {
+		for _, tag := range tags {
+			reasons[tag.Commit] = append(reasons[tag.Commit], PinReason{Source: PinSourceTag, Name: tag.Name})
+		}
+	}
+	if policy.PinBranchHeads {
+		for _, branch := range branches {
+			reasons[branch.Commit] = append(reasons[branch.Commit], PinReason{Source: PinSourceBranch, Name: branch.Name})
+		}
+	}
+	for _, list := range reasons {
+		slices.SortFunc(list, func(a, b PinReason) int {
+			if c := cmp.Compare(a.Source, b.Source); c != 0 {
+				return c
+			}
+			return cmp.Compare(a.Name, b.Name)
+		})
+	}
+	return reasons
+}
+
+// markPinned flags entries whose commits appear in reasons.
+func markPinned(entries []retentionEntry, reasons map[string][]PinReason) {
+	for i := range entries {
+		entries[i].Pinned = len(reasons[entries[i].Hash]) > 0
+	}
+}
+
+// pinnedList renders reasons as a report ordered by commit hash. archived
+// reports whether a commit currently lives in the archive.
+func pinnedList(reasons map[string][]PinReason, archived func(hash string) bool) []PinnedCommit {
+	result := make([]PinnedCommit, 0, len(reasons))
+	for hash, list := range reasons {
+		result = append(result, PinnedCommit{Commit: hash, Archived: archived(hash), Reasons: list})
+	}
+	slices.SortFunc(result, func(a, b PinnedCommit) int { return cmp.Compare(a.Commit, b.Commit) })
+	return result
+}
+
+// retentionPlan is the work of one retention pass, in execution order.
+// Codec compresses content as it moves to the archive.
+type retentionPlan struct {
+	Purge   []string
+	Archive []string
+	Restore []string
+	Codec   Codec
+}
+
+// planRetentionPass marks pinned entries and plans purge, archival and
+// restore for one pass. Planned purges are assumed to succeed; a failed purge
+// is retried on the next pass. Archival and restore need an archive.
+func planRetentionPass(entries []retentionEntry, reasons map[string][]PinReason, policy RetentionPolicy, now time.Time, archive bool) retentionPlan {
+	markPinned(entries, reasons)
+	plan := retentionPlan{Purge: planPurge(entries, policy, now)}
+	if !archive {
+		return plan
+	}
+	purged := make(map[string]bool, len(plan.Purge))
+	for _, hash := range plan.Purge {
+		purged[hash] = true
+	}
+	for i := range entries {
+		entries[i].Purged = entries[i].Purged || purged[entries[i].Hash]
+	}
+	plan.Archive = planRetention(entries, policy, now)
+	plan.Restore = planRestore(entries)
+	return plan
+}
+
+// retentionApplier performs single retention steps for a backend. Each step
+// must tolerate a commit whose state changed after planning.
+type retentionApplier interface {
+	purgeCommit(ctx context.Context, repo, hash string) error
+	archiveCommit(ctx context.Context, repo, hash string, codec Codec) error
+	restoreCommit(ctx context.Context, repo, hash string) error
+}
+
+// applyRetention executes plan, counting completed steps in run and
+// recording failures without stopping. Cancellation ends the pass early.
+func applyRetention(ctx context.Context, a retentionApplier, repo string, plan retentionPlan, run *RetentionRun) {
+	steps := []struct {
+		op     string
+		hashes []string
+		apply  func(context.Context, string, string) error
+		count  *int
+	}{
+		{"purge", plan.Purge, a.purgeCommit, &run.Purged},
+		{"archive", plan.Archive, func(ctx context.Context, repo, hash string) error {
+			return a.archiveCommit(ctx, repo, hash, plan.Codec)
+		}, &run.Archived},
+		{"restore", plan.Restore, a.restoreCommit, &run.Restored},
+	}
+	for _, step := range steps {
+		for _, hash := range step.hashes {
+			if err := ctx.Err(); err != nil {
+				run.Errors = append(run.Errors, err.Error())
+				return
+			}
+			if err := step.apply(ctx, repo, hash); err != nil {
+				run.Errors = append(run.Errors, fmt.Sprintf("%s %s: %v", step.op, hash, err))
+				continue
+			}
+			*step.count++
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// clockedStores opens every backend with archive and a clock read from now.
+func clockedStores(t *testing.T, archive Archive, now *time.Time) map[string]Store {
+	t.Helper()
+	clock := func() time.Time { return *now }
+	opts := Options{Archive: archive}
+
+	memory := NewMemoryStore(opts)
+	memory.(*memoryStore).clock = clock
+
+	bolt, err := NewBoltStore(BoltConfig{Path: filepath.Join(t.TempDir(), "kv-vs.db")}, opts)
+	if err != nil {
+		t.Fatalf("create bolt store: %v", err)
+	}
+	t.Cleanup(func() { _ = bolt.Close() })
+	bolt.(*boltStore).clock = clock
+
+	sqlite, err := NewSQLiteStore(SQLiteConfig{Path: filepath.Join(t.TempDir(), "kv-vs.sqlite")}, opts)
+	if err != nil {
+		t.Fatalf("create sqlite store: %v", err)
+	}
+	t.Cleanup(func() { _ = sqlite.Close() })
+	sqlite.(*sqliteStore).clock = clock
+
+	mini, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("start miniredis: %v", err)
+	}
+	t.Cleanup(mini.Close)
+	keydb, err := NewKeyDBStore(Config{Addr: mini.Addr()}, opts)
+	if err != nil {
+		t.Fatalf("create keydb store: %v", err)
+	}
+	t.Cleanup(func() { _ = keydb.Close() })
+	keydb.(*keydbStore).clock = clock
+
+	return map[string]Store{"memory": memory, "bolt": bolt, "sqlite": sqlite, "keydb": keydb}
+}
+
+func TestPurgedBranchHeadAcceptsWrites(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for name, store := range clockedStores(t, NewMemoryArchive(), &now) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			repo := "purged-" + name
+			if _, err := store.SetPolicy(ctx, RetentionPolicy{Repo: repo, PurgeAfter: time.Hour}); err != nil {
+				t.Fatalf("SetPolicy: %v", err)
+			}
+			first, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: repo, Content: "v1", AuthorName: "Alice", AuthorID: "alice@id"})
+			if err != nil {
+				t.Fatalf("PutBlobAndCommit: %v", err)
+			}
+
+			now = now.Add(2 * time.Hour)
+			run, err := store.EnforceRetention(ctx, repo)
+			if err != nil {
+				t.Fatalf("EnforceRetention: %v", err)
+			}
+			if run.Purged != 1 || len(run.Errors) != 0 {
+				t.Fatalf("expected the head purged, got %+v", run)
+			}
+
+			res, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: repo, Content: "v2", AuthorName: "Alice", AuthorID: "alice@id"})
+			if err != nil {
+				t.Fatalf("write on purged head: %v", err)
+			}
+			if res.Diff != computeDiff("", "v2") {
+				t.Fatalf("expected diff against empty content, got %q", res.Diff)
+			}
+			commit, content, err := store.GetCommit(ctx, repo, res.CommitHash)
+			if err != nil {
+				t.Fatalf("GetCommit: %v", err)
+			}
+			if commit.Parent != first.CommitHash || content != "v2" {
+				t.Fatalf("unexpected commit %+v %q", commit, content)
+			}
+		})
+	}
+}
+
+func TestArchivedBranchHeadAcceptsWrites(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for name, store := range clockedStores(t, NewMemoryArchive(), &now) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			repo := "archived-" + name
+			if _, err := store.SetPolicy(ctx, RetentionPolicy{Repo: repo, HotDuration: time.Hour}); err != nil {
+				t.Fatalf("SetPolicy: %v", err)
+			}
+			first, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: repo, Content: "v1\n", AuthorName: "Alice", AuthorID: "alice@id"})
+			if err != nil {
+				t.Fatalf("PutBlobAndCommit: %v", err)
+			}
+
+			now = now.Add(2 * time.Hour)
+			run, err := store.EnforceRetention(ctx, repo)
+			if err != nil {
+				t.Fatalf("EnforceRetention: %v", err)
+			}
+			if run.Archived != 1 || len(run.Errors) != 0 {
+				t.Fatalf("expected the head archived, got %+v", run)
+			}
+
+			res, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: repo, Content: "v1\nv2\n", AuthorName: "Alice", AuthorID: "alice@id"})
+			if err != nil {
+				t.Fatalf("write on archived head: %v", err)
+			}
+			if res.Diff != computeDiff("v1\n", "v1\nv2\n") {
+				t.Fatalf("expected diff against the archived content, got %q", res.Diff)
+			}
+			commit, _, err := store.GetCommit(ctx, repo, res.CommitHash)
+			if err != nil {
+				t.Fatalf("GetCommit: %v", err)
+			}
+			if commit.Parent != first.CommitHash {
+				t.Fatalf("expected parent %s, got %s", first.CommitHash, commit.Parent)
+			}
+		})
+	}
+}
+
+func TestUnpinCommitValidation(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for name, store := range clockedStores(t, NewMemoryArchive(), &now) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			var validation *ValidationError
+			for _, args := range [][2]string{{"", "abc"}, {"repo", ""}} {
+				if err := store.UnpinCommit(ctx, args[0], args[1]); !errors.As(err, &validation) {
+					t.Fatalf("UnpinCommit(%q, %q): expected validation error, got %v", args[0], args[1], err)
+				}
+			}
+			if err := store.UnpinCommit(ctx, "repo", "abc"); !isNotFound(err) {
+				t.Fatalf("expected not found for a missing pin, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+const defaultRetentionQueueSize = 1024
+
+// RetentionWorkerConfig controls background retention enforcement.
+type RetentionWorkerConfig struct {
+	// Concurrency is the number of repositories enforced in parallel. Values
+	// below one mean one.
+	Concurrency int
+	// SweepInterval queues every repository periodically so duration-based
+	// policies and purge horizons fire on idle repositories. Zero disables
+	// scheduled sweeps.
+	SweepInterval time.Duration
+	// QueueSize bounds the repositories waiting for a pass. Notifications
+	// beyond it are dropped and picked up by the next sweep.
+	QueueSize int
+}
+
+// RetentionWorkerStatus reports the worker's state and run metrics.
+type RetentionWorkerStatus struct {
+	Running       bool     `json:"running"`
+	Concurrency   int      `json:"concurrency"`
+	SweepInterval string   `json:"sweepInterval,omitempty"`
+	Queued        int      `json:"queued"`
+	Active        []string `json:"active"`
+	// Runs counts completed passes; Failures counts passes that returned an
+	// error or recorded step errors.
+	Runs      int64      `json:"runs"`
+	Failures  int64      `json:"failures"`
+	Dropped   int64      `json:"dropped"`
+	Archived  int64      `json:"archived"`
+	Purged    int64      `json:"purged"`
+	Restored  int64      `json:"restored"`
+	LastSweep *time.Time `json:"lastSweep,omitempty"`
+	// LastRun is the most recently finished pass; Repos holds the last pass
+	// per repository.
+	LastRun *RetentionRun           `json:"lastRun,omitempty"`
+	Repos   map[string]RetentionRun `json:"repos,omitempty"`
+}
+
+// RetentionWorker runs retention passes off the write path. Stores report
+// changed repositories through Options.RetentionNotify, wired to Enqueue; a
+// repository is queued at most once and never enforced by two goroutines at
+// the same time.
+type RetentionWorker struct {
+	cfg   RetentionWorkerConfig
+	clock func() time.Time
+	queue chan string
+
+	mu      sync.Mutex
+	store   Store
+	pending map[string]bool
+	active  map[string]bool
+	rerun   map[string]bool
+	status  RetentionWorkerStatus
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// NewRetentionWorker creates a stopped worker. Enqueue may be called before
+// Start; queued repositories are processed once the worker starts.
+func NewRetentionWorker(cfg RetentionWorkerConfig) *RetentionWorker {
+	if cfg.Concurrency < 1 {
+		cfg.Concurrency = 1
+	}
+	if cfg.QueueSize < 1 {
+		cfg.QueueSize = defaultRetentionQueueSize
+	}
+	return &RetentionWorker{
+		cfg:     cfg,
+		clock:   time.Now,
+		queue:   make(chan string, cfg.QueueSize),
+		pending: make(map[string]bool),
+		active:  make(map[string]bool),
+		rerun:   make(map[string]bool),
+		status:  RetentionWorkerStatus{Repos: make(map[string]RetentionRun)},
+	}
+}
+
+// Start launches the workers and, when configured, the sweep scheduler. An
+// initial sweep catches up on repositories that changed while stopped.
+func (w *RetentionWorker) Start(store Store) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w.store = store
+	w.cancel = cancel
+	w.status.Running = true
+
+	for i := 0; i < w.cfg.Concurrency; i++ {
+		w.wg.Add(1)
+		go w.work(ctx)
+	}
+	if w.cfg.SweepInterval > 0 {
+		w.wg.Add(1)
+		go w.schedule(ctx)
+	}
+}
+
+// Stop cancels in-flight passes and waits for the workers to exit. Queued
+// repositories stay queued until the worker is started again.
+func (w *RetentionWorker) Stop() {
+	w.mu.Lock()
+	cancel := w.cancel
+	w.cancel = nil
+	w.status.Running = false
+	w.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	w.wg.Wait()
+}
+
+// Enqueue schedules a retention pass for repo. It never blocks.
+func (w *RetentionWorker) Enqueue(repo string) {
+	if repo == "" {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.enqueueLocked(repo)
+}
+
+func (w *RetentionWorker) enqueueLocked(repo string) {
+	if w.pending[repo] {
+		return
+	}
+	if w.active[repo] {
+		w.rerun[repo] = true
+		return
+	}
+	select {
+	case w.queue <- repo:
+		w.pending[repo] = true
+	default:
+		w.status.Dropped++
+	}
+}
+
+// Sweep queues every repository the store knows about.
+func (w *RetentionWorker) Sweep(ctx context.Context) error {
+	w.mu.Lock()
+	store := w.store
+	w.mu.Unlock()
+	if store == nil {
+		return nil
+	}
+	repos, err := store.ListRepos(ctx)
+	if err != nil {
+		return err
+	}
+	now := w.clock().UTC()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, repo := range repos {
+		w.enqueueLocked(repo)
+	}
+	w.status.LastSweep = &now
+	return nil
+}
+
+// Status returns a snapshot of the worker state and metrics.
+func (w *RetentionWorker) Status() RetentionWorkerStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	status := w.status
+	status.Concurrency = w.cfg.Concurrency
+	if w.cfg.SweepInterval > 0 {
+		status.SweepInterval = w.cfg.SweepInterval.String()
+	}
+	status.Queued = len(w.pending)
+	status.Active = make([]string, 0, len(w.active))
+	for repo := range w.active {
+		status.Active = append(status.Active, repo)
+	}
+	slices.Sort(status.Active)
+	status.Repos = make(map[string]RetentionRun, len(w.status.Repos))
+	for repo, run := range w.status.Repos {
+		status.Repos[repo] = run
+	}
+	if w.status.LastRun != nil {
+		last := *w.status.LastRun
+		status.LastRun = &last
+	}
+	return status
+}
+
+func (w *RetentionWorker) schedule(ctx context.Context) {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.cfg.SweepInterval)
+	defer ticker.Stop()
+	for {
+		_ = w.Sweep(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *RetentionWorker) work(ctx context.Context) {
+	defer w.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case repo := <-w.queue:
+			w.run(ctx, repo)
+		}
+	}
+}
+
+func (w *RetentionWorker) run(ctx context.Context, repo string) {
+	w.mu.Lock()
+	delete(w.pending, repo)
+	w.active[repo] = true
+	store := w.store
+	w.mu.Unlock()
+
+	started := w.clock()
+	run, err := store.EnforceRetention(ctx, repo)
+	if err != nil {
+		run.Errors = append(run.Errors, err.Error())
+	}
+	run.Repo = repo
+	if run.StartedAt.IsZero() {
+		run.StartedAt = started.UTC()
+	}
+	run.Duration = w.clock().Sub(started).String()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.active, repo)
+	w.status.Runs++
+	if len(run.Errors) > 0 {
+		w.status.Failures++
+	}
+	w.status.Archived += int64(run.Archived)
+	w.status.Purged += int64(run.Purged)
+	w.status.Restored += int64(run.Restored)
+	w.status.LastRun = &run
+	w.status.Repos[repo] = run
+	if w.rerun[repo] {
+		delete(w.rerun, repo)
+		w.enqueueLocked(repo)
+	}
+}
@@ -0,0 +1,1305 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"github.com/onexay/kv-vs/internal/types"
+)
+
+// errHeadMoved reports a branch head that moved after a commit was diffed
+// against it.
+var errHeadMoved = errors.New("branch head moved")
+
+// SQLiteConfig defines the SQLite store settings.
+type SQLiteConfig struct {
+	Path        string
+	BusyTimeout time.Duration
+}
+
+type sqliteStore struct {
+	db            *sql.DB
+	clock         func() time.Time
+	archive       Archive
+	keys          *dataKeyring
+	defaultPolicy RetentionPolicy
+	notify        func(repo string)
+	// policyCooldown is the minimum time between policy changes.
+	policyCooldown time.Duration
+}
+
+// sqliteMigration is one forward-only schema step. Versions must be unique
+// and ascending; applied versions are recorded in schema_migrations.
+type sqliteMigration struct {
+	Version    int
+	Statements []string
+}
+
+var sqliteMigrations = []sqliteMigration{
+	{
+		Version: 1,
+		Statements: []string{
+			`CREATE TABLE commits (
+				repo         TEXT    NOT NULL,
+				hash         TEXT    NOT NULL,
+				branch       TEXT    NOT NULL,
+				parent       TEXT    NOT NULL DEFAULT '',
+				author_name  TEXT    NOT NULL,
+				author_id    TEXT    NOT NULL,
+				message      TEXT    NOT NULL DEFAULT '',
+				content_hash TEXT    NOT NULL,
+				content_size INTEGER NOT NULL,
+				created_at   INTEGER NOT NULL,
+				archived     INTEGER NOT NULL DEFAULT 0,
+				PRIMARY KEY (repo, hash)
+			)`,
+			`CREATE INDEX commits_by_time ON commits (repo, created_at, hash)`,
+			`CREATE INDEX commits_by_author ON commits (repo, author_id, created_at)`,
+			`CREATE INDEX commits_by_branch ON commits (repo, branch, created_at)`,
+			`CREATE TABLE contents (
+				repo TEXT NOT NULL,
+				hash TEXT NOT NULL,
+				body TEXT NOT NULL,
+				PRIMARY KEY (repo, hash),
+				FOREIGN KEY (repo, hash) REFERENCES commits (repo, hash) ON DELETE CASCADE
+			)`,
+			`CREATE TABLE branches (
+				repo        TEXT    NOT NULL,
+				name        TEXT    NOT NULL,
+				commit_hash TEXT    NOT NULL,
+				updated_at  INTEGER NOT NULL,
+				PRIMARY KEY (repo, name),
+				FOREIGN KEY (repo, commit_hash) REFERENCES commits (repo, hash)
+			)`,
+			`CREATE TABLE tags (
+				repo        TEXT    NOT NULL,
+				name        TEXT    NOT NULL,
+				commit_hash TEXT    NOT NULL,
+				note        TEXT    NOT NULL DEFAULT '',
+				created_at  INTEGER NOT NULL,
+				PRIMARY KEY (repo, name),
+				FOREIGN KEY (repo, commit_hash) REFERENCES commits (repo, hash)
+			)`,
+			`CREATE TABLE authors (
+				repo        TEXT NOT NULL,
+				author_id   TEXT NOT NULL,
+				author_name TEXT NOT NULL,
+				PRIMARY KEY (repo, author_id)
+			)`,
+			`CREATE TABLE policies (
+				repo                 TEXT    NOT NULL PRIMARY KEY,
+				hot_commit_limit     INTEGER NOT NULL DEFAULT 0,
+				hot_duration_seconds INTEGER NOT NULL DEFAULT 0,
+				locked               INTEGER NOT NULL DEFAULT 0
+			)`,
+		},
+	},
+	{
+		// Purge horizon: metadata outlives content removed by retention.
+		Version: 2,
+		Statements: []string{
+			`ALTER TABLE commits ADD COLUMN purged INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE policies ADD COLUMN purge_after_seconds INTEGER NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		// Pinning: explicit pins and per-policy tag/branch-head pinning.
+		Version: 3,
+		Statements: []string{
+			`CREATE TABLE pins (
+				repo        TEXT    NOT NULL,
+				commit_hash TEXT    NOT NULL,
+				reason      TEXT    NOT NULL DEFAULT '',
+				created_at  INTEGER NOT NULL,
+				PRIMARY KEY (repo, commit_hash),
+				FOREIGN KEY (repo, commit_hash) REFERENCES commits (repo, hash)
+			)`,
+			`ALTER TABLE policies ADD COLUMN pin_tags INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE policies ADD COLUMN pin_branch_heads INTEGER NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		// Versioned policies: existing (locked) policies become version 1 and
+		// seed the history table.
+		Version: 4,
+		Statements: []string{
+			`ALTER TABLE policies ADD COLUMN version INTEGER NOT NULL DEFAULT 1`,
+			`ALTER TABLE policies ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE policies ADD COLUMN author_name TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE policies ADD COLUMN author_id TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE policies ADD COLUMN reason TEXT NOT NULL DEFAULT ''`,
+			`CREATE TABLE policy_history (
+				repo                 TEXT    NOT NULL,
+				version              INTEGER NOT NULL,
+				hot_commit_limit     INTEGER NOT NULL DEFAULT 0,
+				hot_duration_seconds INTEGER NOT NULL DEFAULT 0,
+				purge_after_seconds  INTEGER NOT NULL DEFAULT 0,
+				pin_tags             INTEGER NOT NULL DEFAULT 0,
+				pin_branch_heads     INTEGER NOT NULL DEFAULT 0,
+				updated_at           INTEGER NOT NULL DEFAULT 0,
+				author_name          TEXT    NOT NULL DEFAULT '',
+				author_id            TEXT    NOT NULL DEFAULT '',
+				reason               TEXT    NOT NULL DEFAULT '',
+				PRIMARY KEY (repo, version)
+			)`,
+			`INSERT INTO policy_history (repo, version, hot_commit_limit, hot_duration_seconds, purge_after_seconds, pin_tags, pin_branch_heads)
+				SELECT repo, version, hot_commit_limit, hot_duration_seconds, purge_after_seconds, pin_tags, pin_branch_heads FROM policies`,
+		},
+	},
+	{
+		// Compression: per-policy codec for archived content. Hot bodies stay
+		// uncompressed so they remain queryable.
+		Version: 5,
+		Statements: []string{
+			`ALTER TABLE policies ADD COLUMN compression TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE policy_history ADD COLUMN compression TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		// Encryption at rest: per-repository data keys, wrapped by a master key.
+		Version: 6,
+		Statements: []string{
+			`CREATE TABLE data_keys (
+				repo          TEXT    NOT NULL,
+				id            INTEGER NOT NULL,
+				master_key_id TEXT    NOT NULL,
+				wrapped       BLOB    NOT NULL,
+				created_at    INTEGER NOT NULL,
+				PRIMARY KEY (repo, id)
+			)`,
+		},
+	},
+}
+
+// NewSQLiteStore opens (or creates) a Store backed by a SQLite database and
+// applies any pending schema migrations. Timestamps are stored as Unix
+// nanoseconds so history can be ordered and range-scanned by index.
+func NewSQLiteStore(cfg SQLiteConfig, opts Options) (Store, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("sqlite path is required")
+	}
+	busy := cfg.BusyTimeout
+	if busy <= 0 {
+		busy = 5 * time.Second
+	}
+
+	cleaned := filepath.Clean(cfg.Path)
+	if dir := filepath.Dir(cleaned); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	query := url.Values{}
+	query.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", busy.Milliseconds()))
+	query.Add("_pragma", "journal_mode(WAL)")
+	query.Add("_pragma", "foreign_keys(1)")
+	query.Set("_txlock", "immediate")
+	db, err := sql.Open("sqlite", "file:"+cleaned+"?"+query.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), busy)
+	defer cancel()
+	if err := migrateSQLite(ctx, db); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("migrate sqlite: %w", err)
+	}
+
+	s := &sqliteStore{
+		db:             db,
+		clock:          time.Now,
+		archive:        opts.Archive,
+		defaultPolicy:  opts.Retention.policy(),
+		notify:         opts.notifier(),
+		policyCooldown: opts.PolicyCooldown,
+	}
+	s.keys = newDataKeyring(opts.MasterKeys, s)
+	return s, nil
+}
+
+func migrateSQLite(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER NOT NULL PRIMARY KEY,
+		applied_at INTEGER NOT NULL
+	)`); err != nil {
+		return err
+	}
+
+	for _, migration := range sqliteMigrations {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		var applied int
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM schema_migrations WHERE version = ?`, migration.Version).Scan(&applied); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if applied > 0 {
+			_ = tx.Rollback()
+			continue
+		}
+		for _, stmt := range migration.Statements {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				_ = tx.Rollback()
+				return fmt.Errorf("migration %d: %w", migration.Version, err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, migration.Version, time.Now().UnixNano()); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) PutBlobAndCommit(ctx context.Context, req BlobWriteRequest) (BlobCommitResult, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if req.Name == "" {
+		return BlobCommitResult{}, &ValidationError{Message: "name is required"}
+	}
+	if req.Content == "" {
+		return BlobCommitResult{}, &ValidationError{Message: "content is required"}
+	}
+	if req.AuthorName == "" || req.AuthorID == "" {
+		return BlobCommitResult{}, &ValidationError{Message: "author name and id are required"}
+	}
+
+	branch := req.Branch
+	if branch == "" {
+		branch = defaultBranch
+	}
+
+	// The head's content is read and diffed before the transaction: BEGIN
+	// IMMEDIATE takes the write lock, which must not be held while a cold
+	// head is fetched from the archive. The commit is retried if the head
+	// moves in between.
+	for {
+		parent, previousContent, err := s.branchHead(ctx, req.Name, branch)
+		if err != nil {
+			return BlobCommitResult{}, err
+		}
+		result, err := s.commitBlob(ctx, req, branch, parent, computeDiff(previousContent, req.Content))
+		if errors.Is(err, errHeadMoved) {
+			continue
+		}
+		if err != nil {
+			return BlobCommitResult{}, err
+		}
+		s.notify(req.Name)
+		return result, nil
+	}
+}
+
+// branchHead returns the head commit of branch and its content, reading
+// content that left hot storage from the archive.
+func (s *sqliteStore) branchHead(ctx context.Context, repo, branch string) (string, string, error) {
+	parent := ""
+	err := s.db.QueryRowContext(ctx, `SELECT commit_hash FROM branches WHERE repo = ? AND name = ?`, repo, branch).Scan(&parent)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	var content string
+	err = s.db.QueryRowContext(ctx, `SELECT body FROM contents WHERE repo = ? AND hash = ?`, repo, parent).Scan(&content)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return parent, content, err
+	}
+	commit, err := scanSQLiteCommit(s.db.QueryRowContext(ctx, `SELECT `+sqliteCommitColumns+` FROM commits WHERE repo = ? AND hash = ?`, repo, parent))
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", &NotFoundError{Resource: "content", Key: parent}
+	}
+	if err != nil {
+		return "", "", err
+	}
+	content, err = parentContent(ctx, s.archive, s.keys, repo, commit)
+	return parent, content, err
+}
+
+// commitBlob writes the commit of req on top of parent. It returns
+// errHeadMoved when the branch no longer points at parent.
+func (s *sqliteStore) commitBlob(ctx context.Context, req BlobWriteRequest, branch, parent, diff string) (BlobCommitResult, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return BlobCommitResult{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var existingName string
+	err = tx.QueryRowContext(ctx, `SELECT author_name FROM authors WHERE repo = ? AND author_id = ?`, req.Name, req.AuthorID).Scan(&existingName)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return BlobCommitResult{}, err
+	}
+	if err == nil && existingName != req.AuthorName {
+		return BlobCommitResult{}, &ConflictError{Resource: "author", Key: req.AuthorID}
+	}
+
+	head := ""
+	err = tx.QueryRowContext(ctx, `SELECT commit_hash FROM branches WHERE repo = ? AND name = ?`, req.Name, branch).Scan(&head)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return BlobCommitResult{}, err
+	}
+	if head != parent {
+		return BlobCommitResult{}, errHeadMoved
+	}
+
+	contentHash := computeContentHash(req.Content)
+	now := s.clock().UTC()
+	commitHash := computeCommitHash(req.Name, branch, req.Content, parent, now)
+
+	var exists int
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM commits WHERE repo = ? AND hash = ?`, req.Name, commitHash).Scan(&exists); err != nil {
+		return BlobCommitResult{}, err
+	}
+	if exists > 0 {
+		return BlobCommitResult{}, &ConflictError{Resource: "commit", Key: commitHash}
+	}
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO commits
+		(repo, hash, branch, parent, author_name, author_id, message, content_hash, content_size, created_at, archived)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0)`,
+		req.Name, commitHash, branch, parent, req.AuthorName, req.AuthorID, "auto commit", contentHash, len(req.Content), now.UnixNano()); err != nil {
+		return BlobCommitResult{}, err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO contents (repo, hash, body) VALUES (?, ?, ?)`, req.Name, commitHash, req.Content); err != nil {
+		return BlobCommitResult{}, err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO branches (repo, name, commit_hash, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (repo, name) DO UPDATE SET commit_hash = excluded.commit_hash, updated_at = excluded.updated_at`,
+		req.Name, branch, commitHash, now.UnixNano()); err != nil {
+		return BlobCommitResult{}, err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO authors (repo, author_id, author_name) VALUES (?, ?, ?)
+		ON CONFLICT (repo, author_id) DO NOTHING`, req.Name, req.AuthorID, req.AuthorName); err != nil {
+		return BlobCommitResult{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return BlobCommitResult{}, err
+	}
+	return BlobCommitResult{
+		CommitHash: commitHash,
+		Branch:     branch,
+		CreatedAt:  now,
+		Diff:       diff,
+	}, nil
+}
+
+const sqliteCommitColumns = `repo, hash, branch, parent, author_name, author_id, message, content_hash, created_at, archived, purged`
+
+func (s *sqliteStore) ListCommits(ctx context.Context, opts ListCommitsOptions) ([]types.Commit, error) {
+	order := "ASC"
+	if opts.Descending {
+		order = "DESC"
+	}
+	limit := -1
+	if opts.Limit > 0 {
+		limit = opts.Limit
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+sqliteCommitColumns+` FROM commits
+		WHERE repo = ? ORDER BY created_at `+order+`, hash `+order+` LIMIT ?`, opts.Repo, limit)
+	if err != nil {
+		return nil, &UnavailableError{Op: "list commits", Err: err}
+	}
+	defer rows.Close()
+
+	result := []types.Commit{}
+	for rows.Next() {
+		commit, err := scanSQLiteCommit(rows)
+		if err != nil {
+			return nil, &UnavailableError{Op: "list commits", Err: err}
+		}
+		result = append(result, commit)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &UnavailableError{Op: "list commits", Err: err}
+	}
+	return result, nil
+}
+
+func (s *sqliteStore) GetCommit(ctx context.Context, repo, hash string) (types.Commit, string, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	row := s.db.QueryRowContext(ctx, `SELECT `+sqliteCommitColumns+` FROM commits WHERE repo = ? AND hash = ?`, repo, hash)
+	commit, err := scanSQLiteCommit(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return types.Commit{}, "", &NotFoundError{Resource: "commit", Key: hash}
+	}
+	if err != nil {
+		return types.Commit{}, "", err
+	}
+
+	if commit.Purged {
+		return commit, "", &GoneError{Resource: "content", Key: hash}
+	}
+
+	var content string
+	err = s.db.QueryRowContext(ctx, `SELECT body FROM contents WHERE repo = ? AND hash = ?`, repo, hash).Scan(&content)
+	if errors.Is(err, sql.ErrNoRows) {
+		if s.archive == nil {
+			return commit, "", &NotFoundError{Resource: "content", Key: hash}
+		}
+		data, err := readArchived(ctx, s.archive, s.keys, repo, hash)
+		if err != nil {
+			return commit, "", err
+		}
+		return commit, string(data), nil
+	}
+	if err != nil {
+		return commit, "", err
+	}
+	return commit, content, nil
+}
+
+func (s *sqliteStore) UpsertBranch(ctx context.Context, req BranchRequest) (types.Branch, error) {
+	if req.Repo == "" || req.Name == "" || req.Commit == "" {
+		return types.Branch{}, &ValidationError{Message: "repo, name, and commit are required"}
+	}
+
+	branch := types.Branch{
+		Repo:      req.Repo,
+		Name:      req.Name,
+		Commit:    req.Commit,
+		UpdatedAt: s.clock().UTC(),
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return types.Branch{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := sqliteRequireCommit(ctx, tx, req.Repo, req.Commit); err != nil {
+		return types.Branch{}, err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO branches (repo, name, commit_hash, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (repo, name) DO UPDATE SET commit_hash = excluded.commit_hash, updated_at = excluded.updated_at`,
+		branch.Repo, branch.Name, branch.Commit, branch.UpdatedAt.UnixNano()); err != nil {
+		return types.Branch{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return types.Branch{}, err
+	}
+	s.notify(req.Repo)
+	return branch, nil
+}
+
+func (s *sqliteStore) ListBranches(ctx context.Context, repo string) ([]types.Branch, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT repo, name, commit_hash, updated_at FROM branches WHERE repo = ? ORDER BY name`, repo)
+	if err != nil {
+		return nil, &UnavailableError{Op: "list branches", Err: err}
+	}
+	defer rows.Close()
+
+	result := []types.Branch{}
+	for rows.Next() {
+		branch, err := scanSQLiteBranch(rows)
+		if err != nil {
+			return nil, &UnavailableError{Op: "list branches", Err: err}
+		}
+		result = append(result, branch)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &UnavailableError{Op: "list branches", Err: err}
+	}
+	return result, nil
+}
+
+func (s *sqliteStore) GetBranch(ctx context.Context, repo, name string) (types.Branch, error) {
+	if repo == "" || name == "" {
+		return types.Branch{}, &ValidationError{Message: "repo and name are required"}
+	}
+
+	row := s.db.QueryRowContext(ctx, `SELECT repo, name, commit_hash, updated_at FROM branches WHERE repo = ? AND name = ?`, repo, name)
+	branch, err := scanSQLiteBranch(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return types.Branch{}, &NotFoundError{Resource: "branch", Key: name}
+	}
+	if err != nil {
+		return types.Branch{}, err
+	}
+	return branch, nil
+}
+
+func (s *sqliteStore) CreateTag(ctx context.Context, req TagRequest) (types.Tag, error) {
+	if req.Repo == "" || req.Name == "" || req.Commit == "" {
+		return types.Tag{}, &ValidationError{Message: "repo, name, and commit are required"}
+	}
+
+	tag := types.Tag{
+		Repo:      req.Repo,
+		Name:      req.Name,
+		Commit:    req.Commit,
+		Note:      req.Note,
+		CreatedAt: s.clock().UTC(),
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return types.Tag{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := sqliteRequireCommit(ctx, tx, req.Repo, req.Commit); err != nil {
+		return types.Tag{}, err
+	}
+	res, err := tx.ExecContext(ctx, `INSERT INTO tags (repo, name, commit_hash, note, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (repo, name) DO NOTHING`,
+		tag.Repo, tag.Name, tag.Commit, tag.Note, tag.CreatedAt.UnixNano())
+	if err != nil {
+		return types.Tag{}, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return types.Tag{}, err
+	} else if n == 0 {
+		return types.Tag{}, &ConflictError{Resource: "tag", Key: req.Name}
+	}
+	if err := tx.Commit(); err != nil {
+		return types.Tag{}, err
+	}
+	s.notify(req.Repo)
+	return tag, nil
+}
+
+func (s *sqliteStore) ListTags(ctx context.Context, repo string) ([]types.Tag, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT repo, name, commit_hash, note, created_at FROM tags WHERE repo = ? ORDER BY name`, repo)
+	if err != nil {
+		return nil, &UnavailableError{Op: "list tags", Err: err}
+	}
+	defer rows.Close()
+
+	result := []types.Tag{}
+	for rows.Next() {
+		tag, err := scanSQLiteTag(rows)
+		if err != nil {
+			return nil, &UnavailableError{Op: "list tags", Err: err}
+		}
+		result = append(result, tag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &UnavailableError{Op: "list tags", Err: err}
+	}
+	return result, nil
+}
+
+func (s *sqliteStore) GetTag(ctx context.Context, repo, name string) (types.Tag, error) {
+	if repo == "" || name == "" {
+		return types.Tag{}, &ValidationError{Message: "repo and name are required"}
+	}
+
+	row := s.db.QueryRowContext(ctx, `SELECT repo, name, commit_hash, note, created_at FROM tags WHERE repo = ? AND name = ?`, repo, name)
+	tag, err := scanSQLiteTag(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return types.Tag{}, &NotFoundError{Resource: "tag", Key: name}
+	}
+	if err != nil {
+		return types.Tag{}, err
+	}
+	return tag, nil
+}
+
+// SetPolicy stores a new policy version in policies and policy_history within
+// one transaction.
+func (s *sqliteStore) SetPolicy(ctx context.Context, policy RetentionPolicy) (RetentionPolicy, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return RetentionPolicy{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	current := s.defaultPolicy.WithRepo(policy.Repo)
+	rec, err := scanSQLitePolicy(tx.QueryRowContext(ctx, `SELECT `+sqlitePolicyColumns+` FROM policies WHERE repo = ?`, policy.Repo))
+	if err == nil {
+		current = rec.toPolicy(policy.Repo)
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return RetentionPolicy{}, err
+	}
+
+	next, unchanged, err := nextPolicy(current, policy, s.policyCooldown, s.clock())
+	if err != nil || unchanged {
+		return next, err
+	}
+	rec = newRetentionRecord(next)
+	args := []any{policy.Repo, rec.HotCommitLimit, rec.HotDurationSeconds, rec.PurgeAfterSeconds, rec.PinTags, rec.PinBranchHeads,
+		rec.Version, rec.UpdatedAt.UnixNano(), rec.AuthorName, rec.AuthorID, rec.Reason, rec.Compression}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO policies (repo, `+sqlitePolicyColumns+`, locked)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 1)
+		ON CONFLICT (repo) DO UPDATE SET hot_commit_limit = excluded.hot_commit_limit,
+			hot_duration_seconds = excluded.hot_duration_seconds, purge_after_seconds = excluded.purge_after_seconds,
+			pin_tags = excluded.pin_tags, pin_branch_heads = excluded.pin_branch_heads, version = excluded.version,
+			updated_at = excluded.updated_at, author_name = excluded.author_name, author_id = excluded.author_id,
+			reason = excluded.reason, compression = excluded.compression`, args...); err != nil {
+		return RetentionPolicy{}, err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO policy_history (repo, `+sqlitePolicyColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, args...); err != nil {
+		return RetentionPolicy{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return RetentionPolicy{}, err
+	}
+
+	s.notify(policy.Repo)
+	return next, nil
+}
+
+func (s *sqliteStore) PolicyHistory(ctx context.Context, repo string) ([]RetentionPolicy, error) {
+	if repo == "" {
+		return nil, &ValidationError{Message: "name query parameter required"}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT `+sqlitePolicyColumns+` FROM policy_history WHERE repo = ? ORDER BY version`, repo)
+	if err != nil {
+		return nil, &UnavailableError{Op: "policy history", Err: err}
+	}
+	defer rows.Close()
+	history := []RetentionPolicy{}
+	for rows.Next() {
+		rec, err := scanSQLitePolicy(rows)
+		if err != nil {
+			return nil, &UnavailableError{Op: "policy history", Err: err}
+		}
+		history = append(history, rec.toPolicy(repo))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &UnavailableError{Op: "policy history", Err: err}
+	}
+	return history, nil
+}
+
+func (s *sqliteStore) GetPolicy(ctx context.Context, repo string) (RetentionPolicy, error) {
+	if repo == "" {
+		return RetentionPolicy{}, &ValidationError{Message: "name query parameter required"}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	rec, err := scanSQLitePolicy(s.db.QueryRowContext(ctx, `SELECT `+sqlitePolicyColumns+` FROM policies WHERE repo = ?`, repo))
+	if errors.Is(err, sql.ErrNoRows) {
+		return s.defaultPolicy.WithRepo(repo), nil
+	}
+	if err != nil {
+		return RetentionPolicy{}, err
+	}
+	return rec.toPolicy(repo), nil
+}
+
+// Close releases the database handle.
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+// EnforceRetention runs one retention pass. Each step commits its own
+// transaction so archive I/O never holds the database write lock.
+func (s *sqliteStore) EnforceRetention(ctx context.Context, repo string) (RetentionRun, error) {
+	if repo == "" {
+		return RetentionRun{}, &ValidationError{Message: "name query parameter required"}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	run := RetentionRun{Repo: repo, StartedAt: s.clock().UTC()}
+	policy, err := s.GetPolicy(ctx, repo)
+	if err != nil {
+		return run, &UnavailableError{Op: "enforce retention", Err: err}
+	}
+	if !policy.enforced() {
+		return run, nil
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT hash, created_at, archived, purged FROM commits WHERE repo = ? ORDER BY created_at, hash`, repo)
+	if err != nil {
+		return run, &UnavailableError{Op: "enforce retention", Err: err}
+	}
+	var entries []retentionEntry
+	for rows.Next() {
+		var (
+			e  retentionEntry
+			ns int64
+		)
+		if err := rows.Scan(&e.Hash, &ns, &e.Archived, &e.Purged); err != nil {
+			continue
+		}
+		e.Timestamp = time.Unix(0, ns).UTC()
+		entries = append(entries, e)
+	}
+	err = rows.Err()
+	_ = rows.Close()
+	if err != nil {
+		return run, &UnavailableError{Op: "enforce retention", Err: err}
+	}
+
+	reasons, err := s.pinReasons(ctx, repo, policy)
+	if err != nil {
+		return run, &UnavailableError{Op: "enforce retention", Err: err}
+	}
+	plan := planRetentionPass(entries, reasons, policy, s.clock(), s.archive != nil)
+	plan.Codec = policy.contentCodec(s.defaultPolicy)
+	applyRetention(ctx, s, repo, plan, &run)
+	return run, nil
+}
+
+func (s *sqliteStore) ListRepos(ctx context.Context) ([]string, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT DISTINCT repo FROM commits ORDER BY repo`)
+	if err != nil {
+		return nil, &UnavailableError{Op: "list repos", Err: err}
+	}
+	defer rows.Close()
+	var repos []string
+	for rows.Next() {
+		var repo string
+		if err := rows.Scan(&repo); err != nil {
+			return nil, &UnavailableError{Op: "list repos", Err: err}
+		}
+		repos = append(repos, repo)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &UnavailableError{Op: "list repos", Err: err}
+	}
+	return repos, nil
+}
+
+func (s *sqliteStore) DataKeys(ctx context.Context, repo string) ([]DataKey, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return s.keys.list(ctx, repo)
+}
+
+func (s *sqliteStore) Reencrypt(ctx context.Context, repo string, rotate bool) (ReencryptReport, error) {
+	return reencrypt(ctx, s.keys, s, repo, rotate)
+}
+
+func (s *sqliteStore) loadDataKeys(ctx context.Context, repo string) ([]DataKey, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, master_key_id, wrapped, created_at FROM data_keys WHERE repo = ? ORDER BY id`, repo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []DataKey
+	for rows.Next() {
+		key := DataKey{Repo: repo}
+		var createdAt int64
+		if err := rows.Scan(&key.ID, &key.MasterKeyID, &key.Wrapped, &createdAt); err != nil {
+			return nil, err
+		}
+		key.CreatedAt = time.Unix(0, createdAt).UTC()
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *sqliteStore) createDataKey(ctx context.Context, key DataKey) error {
+	res, err := s.db.ExecContext(ctx, `INSERT INTO data_keys (repo, id, master_key_id, wrapped, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (repo, id) DO NOTHING`, key.Repo, key.ID, key.MasterKeyID, key.Wrapped, key.CreatedAt.UnixNano())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return &ConflictError{Resource: "data key", Key: fmt.Sprintf("%s/%d", key.Repo, key.ID)}
+	}
+	return nil
+}
+
+func (s *sqliteStore) rewrapDataKey(ctx context.Context, key DataKey) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE data_keys SET master_key_id = ?, wrapped = ? WHERE repo = ? AND id = ?`,
+		key.MasterKeyID, key.Wrapped, key.Repo, key.ID)
+	return err
+}
+
+// restoreCommit copies archived content of a pinned commit back into hot
+// storage. The archive copy is kept.
+func (s *sqliteStore) restoreCommit(ctx context.Context, repo, hash string) error {
+	data, err := fetchContent(ctx, s.archive, s.keys, repo, hash)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	res, err := tx.ExecContext(ctx, `UPDATE commits SET archived = 0 WHERE repo = ? AND hash = ? AND purged = 0`, repo, hash)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT OR REPLACE INTO contents (repo, hash, body) VALUES (?, ?, ?)`, repo, hash, string(data)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// pinReasons resolves the pinned commits of repo under policy.
+func (s *sqliteStore) pinReasons(ctx context.Context, repo string, policy RetentionPolicy) (map[string][]PinReason, error) {
+	branches, err := s.ListBranches(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := s.ListTags(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	pins, err := s.listPins(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	return pinReasons(policy, branches, tags, pins), nil
+}
+
+func (s *sqliteStore) listPins(ctx context.Context, repo string) ([]types.Pin, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT commit_hash, reason, created_at FROM pins WHERE repo = ?`, repo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var pins []types.Pin
+	for rows.Next() {
+		var (
+			pin types.Pin
+			ns  int64
+		)
+		if err := rows.Scan(&pin.Commit, &pin.Reason, &ns); err != nil {
+			return nil, err
+		}
+		pin.Repo = repo
+		pin.CreatedAt = time.Unix(0, ns).UTC()
+		pins = append(pins, pin)
+	}
+	return pins, rows.Err()
+}
+
+// purgeCommit removes the archived copy first and then drops hot content
+// while marking the metadata purged, so failures are retried on the next pass.
+func (s *sqliteStore) purgeCommit(ctx context.Context, repo, hash string) error {
+	if s.archive != nil {
+		if err := s.archive.Remove(ctx, repo, hash); err != nil {
+			return err
+		}
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if _, err := tx.ExecContext(ctx, `UPDATE commits SET archived = 1, purged = 1 WHERE repo = ? AND hash = ?`, repo, hash); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM contents WHERE repo = ? AND hash = ?`, repo, hash); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Recompress only rewrites archived content: hot bodies stay uncompressed and
+// unencrypted so they remain queryable, and are reported as such.
+func (s *sqliteStore) Recompress(ctx context.Context, repo string) (CompressionReport, error) {
+	if repo == "" {
+		return CompressionReport{}, &ValidationError{Message: "name query parameter required"}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	report := CompressionReport{Repo: repo, StartedAt: s.clock().UTC()}
+	policy, err := s.GetPolicy(ctx, repo)
+	if err != nil {
+		return report, &UnavailableError{Op: "recompress", Err: err}
+	}
+	report.Codec = policy.contentCodec(s.defaultPolicy)
+
+	rows, err := s.db.QueryContext(ctx, `SELECT length(CAST(body AS BLOB)) FROM contents WHERE repo = ?`, repo)
+	if err != nil {
+		return report, &UnavailableError{Op: "recompress", Err: err}
+	}
+	for rows.Next() {
+		var size int
+		if err := rows.Scan(&size); err != nil {
+			rows.Close()
+			return report, &UnavailableError{Op: "recompress", Err: err}
+		}
+		report.Hot.add(CodecNone, false, size, size)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return report, &UnavailableError{Op: "recompress", Err: err}
+	}
+
+	rows, err = s.db.QueryContext(ctx, `SELECT hash FROM commits WHERE repo = ? AND archived = 1 AND purged = 0 ORDER BY created_at, hash`, repo)
+	if err != nil {
+		return report, &UnavailableError{Op: "recompress", Err: err}
+	}
+	var archived []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return report, &UnavailableError{Op: "recompress", Err: err}
+		}
+		archived = append(archived, hash)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return report, &UnavailableError{Op: "recompress", Err: err}
+	}
+	recompressArchive(ctx, s.archive, s.keys, repo, archived, report.Codec, func(hash string) bool {
+		var purged bool
+		err := s.db.QueryRowContext(ctx, `SELECT purged FROM commits WHERE repo = ? AND hash = ?`, repo, hash).Scan(&purged)
+		return err == nil && !purged
+	}, &report)
+	return report, nil
+}
+
+func (s *sqliteStore) archiveCommit(ctx context.Context, repo, hash string, codec Codec) error {
+	commit, content, err := s.GetCommit(ctx, repo, hash)
+	if err != nil {
+		return err
+	}
+	if commit.Archived {
+		return nil
+	}
+	stored, err := s.keys.encode(ctx, repo, codec, []byte(content))
+	if err != nil {
+		return err
+	}
+	if err := s.archive.Store(ctx, repo, hash, stored); err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if _, err := tx.ExecContext(ctx, `UPDATE commits SET archived = 1 WHERE repo = ? AND hash = ?`, repo, hash); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM contents WHERE repo = ? AND hash = ?`, repo, hash); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type sqliteScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanSQLiteCommit(row sqliteScanner) (types.Commit, error) {
+	var (
+		commit types.Commit
+		ns     int64
+	)
+	if err := row.Scan(&commit.Repo, &commit.Hash, &commit.Branch, &commit.Parent, &commit.AuthorName,
+		&commit.AuthorID, &commit.Message, &commit.ContentHash, &ns, &commit.Archived, &commit.Purged); err != nil {
+		return types.Commit{}, err
+	}
+	commit.Timestamp = time.Unix(0, ns).UTC()
+	return commit, nil
+}
+
+// sqlitePolicyColumns is shared by the policies and policy_history tables.
+const sqlitePolicyColumns = `hot_commit_limit, hot_duration_seconds, purge_after_seconds, pin_tags, pin_branch_heads,
+	version, updated_at, author_name, author_id, reason, compression`
+
+func scanSQLitePolicy(row sqliteScanner) (retentionRecord, error) {
+	var (
+		rec retentionRecord
+		ns  int64
+	)
+	if err := row.Scan(&rec.HotCommitLimit, &rec.HotDurationSeconds, &rec.PurgeAfterSeconds, &rec.PinTags, &rec.PinBranchHeads,
+		&rec.Version, &ns, &rec.AuthorName, &rec.AuthorID, &rec.Reason, &rec.Compression); err != nil {
+		return retentionRecord{}, err
+	}
+	if ns != 0 {
+		rec.UpdatedAt = time.Unix(0, ns).UTC()
+	}
+	return rec, nil
+}
+
+func scanSQLiteBranch(row sqliteScanner) (types.Branch, error) {
+	var (
+		branch types.Branch
+		ns     int64
+	)
+	if err := row.Scan(&branch.Repo, &branch.Name, &branch.Commit, &ns); err != nil {
+		return types.Branch{}, err
+	}
+	branch.UpdatedAt = time.Unix(0, ns).UTC()
+	return branch, nil
+}
+
+func scanSQLiteTag(row sqliteScanner) (types.Tag, error) {
+	var (
+		tag types.Tag
+		ns  int64
+	)
+	if err := row.Scan(&tag.Repo, &tag.Name, &tag.Commit, &tag.Note, &ns); err != nil {
+		return types.Tag{}, err
+	}
+	tag.CreatedAt = time.Unix(0, ns).UTC()
+	return tag, nil
+}
+
+func sqliteRequireCommit(ctx context.Context, tx *sql.Tx, repo, hash string) error {
+	var exists int
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM commits WHERE repo = ? AND hash = ?`, repo, hash).Scan(&exists); err != nil {
+		return err
+	}
+	if exists == 0 {
+		return &NotFoundError{Resource: "commit", Key: hash}
+	}
+	return nil
+}
+
+func (s *sqliteStore) Check(ctx context.Context, opts CheckOptions) (CheckReport, error) {
+	if opts.Repo == "" {
+		return CheckReport{}, &ValidationError{Message: "name query parameter required"}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	inv, err := s.inventory(ctx, opts.Repo)
+	if err != nil {
+		return CheckReport{}, err
+	}
+	return runCheck(ctx, opts.Repo, inv, s.archive, s.keys, s, opts.Repair, s.clock()), nil
+}
+
+// inventory gathers the repository state consumed by Check and CollectGarbage.
+func (s *sqliteStore) inventory(ctx context.Context, repo string) (repoInventory, error) {
+	inv := repoInventory{
+		Commits: make(map[string]types.Commit),
+		Hot:     make(map[string]bool),
+		Indexed: make(map[string]bool),
+		LoadContent: func(ctx context.Context, hash string) (string, error) {
+			var content string
+			err := s.db.QueryRowContext(ctx, `SELECT body FROM contents WHERE repo = ? AND hash = ?`, repo, hash).Scan(&content)
+			if errors.Is(err, sql.ErrNoRows) {
+				return "", &NotFoundError{Resource: "content", Key: hash}
+			}
+			return content, err
+		},
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+sqliteCommitColumns+` FROM commits WHERE repo = ?`, repo)
+	if err != nil {
+		return repoInventory{}, &UnavailableError{Op: "check commits", Err: err}
+	}
+	for rows.Next() {
+		commit, err := scanSQLiteCommit(rows)
+		if err != nil {
+			rows.Close()
+			return repoInventory{}, &UnavailableError{Op: "check commits", Err: err}
+		}
+		inv.Commits[commit.Hash] = commit
+		// The commits table is its own history index.
+		inv.Indexed[commit.Hash] = true
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return repoInventory{}, &UnavailableError{Op: "check commits", Err: err}
+	}
+	rows.Close()
+
+	rows, err = s.db.QueryContext(ctx, `SELECT hash FROM contents WHERE repo = ?`, repo)
+	if err != nil {
+		return repoInventory{}, &UnavailableError{Op: "check contents", Err: err}
+	}
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return repoInventory{}, &UnavailableError{Op: "check contents", Err: err}
+		}
+		inv.Hot[hash] = true
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return repoInventory{}, &UnavailableError{Op: "check contents", Err: err}
+	}
+	rows.Close()
+
+	if inv.Branches, err = s.ListBranches(ctx, repo); err != nil {
+		return repoInventory{}, err
+	}
+	if inv.Tags, err = s.ListTags(ctx, repo); err != nil {
+		return repoInventory{}, err
+	}
+	if inv.Pins, err = s.listPins(ctx, repo); err != nil {
+		return repoInventory{}, &UnavailableError{Op: "check pins", Err: err}
+	}
+	return inv, nil
+}
+
+func (s *sqliteStore) repairCheckIssue(ctx context.Context, repo string, issue CheckIssue, _ types.Commit) error {
+	var err error
+	switch issue.Kind {
+	case IssueMissingContent:
+		_, err = s.db.ExecContext(ctx, `UPDATE commits SET archived = 1 WHERE repo = ? AND hash = ?`, repo, issue.Hash)
+	case IssueMissingArchiveEntry:
+		_, err = s.db.ExecContext(ctx, `UPDATE commits SET archived = 0 WHERE repo = ? AND hash = ?`, repo, issue.Hash)
+	case IssueStaleHotContent:
+		_, err = s.db.ExecContext(ctx, `DELETE FROM contents WHERE repo = ? AND hash = ?`, repo, issue.Hash)
+	default:
+		err = errors.New("no repair for " + string(issue.Kind))
+	}
+	return err
+}
+
+func (s *sqliteStore) CollectGarbage(ctx context.Context, opts GCOptions) (GCReport, error) {
+	if opts.Repo == "" {
+		return GCReport{}, &ValidationError{Message: "name query parameter required"}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	inv, err := s.inventory(ctx, opts.Repo)
+	if err != nil {
+		return GCReport{}, err
+	}
+	return runGC(ctx, inv, s.archive, s, opts, s.clock())
+}
+
+func (s *sqliteStore) sweepGC(ctx context.Context, repo string, plan gcPlan) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	for _, commit := range plan.Commits {
+		var name, resource string
+		err := tx.QueryRowContext(ctx, `SELECT 'branch', name FROM branches WHERE repo = ? AND commit_hash = ?
+			UNION ALL SELECT 'tag', name FROM tags WHERE repo = ? AND commit_hash = ?
+			UNION ALL SELECT 'pin', commit_hash FROM pins WHERE repo = ? AND commit_hash = ? LIMIT 1`,
+			repo, commit.Hash, repo, commit.Hash, repo, commit.Hash).Scan(&resource, &name)
+		if err == nil {
+			return &ConflictError{Resource: resource, Key: name}
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		// Contents cascade with the commit row.
+		if _, err := tx.ExecContext(ctx, `DELETE FROM commits WHERE repo = ? AND hash = ?`, repo, commit.Hash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) PinCommit(ctx context.Context, req PinRequest) (types.Pin, error) {
+	if req.Repo == "" || req.Commit == "" {
+		return types.Pin{}, &ValidationError{Message: "repo and commit are required"}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	pin := types.Pin{Repo: req.Repo, Commit: req.Commit, Reason: req.Reason, CreatedAt: s.clock().UTC()}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return types.Pin{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if err := sqliteRequireCommit(ctx, tx, req.Repo, req.Commit); err != nil {
+		return types.Pin{}, err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO pins (repo, commit_hash, reason, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (repo, commit_hash) DO UPDATE SET reason = excluded.reason, created_at = excluded.created_at`,
+		pin.Repo, pin.Commit, pin.Reason, pin.CreatedAt.UnixNano()); err != nil {
+		return types.Pin{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return types.Pin{}, err
+	}
+	s.notify(req.Repo)
+	return pin, nil
+}
+
+func (s *sqliteStore) UnpinCommit(ctx context.Context, repo, hash string) error {
+	if repo == "" || hash == "" {
+		return &ValidationError{Message: "repo and commit are required"}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	res, err := s.db.ExecContext(ctx, `DELETE FROM pins WHERE repo = ? AND commit_hash = ?`, repo, hash)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return &NotFoundError{Resource: "pin", Key: hash}
+	}
+	s.notify(repo)
+	return nil
+}
+
+func (s *sqliteStore) ListPins(ctx context.Context, repo string) ([]PinnedCommit, error) {
+	if repo == "" {
+		return nil, &ValidationError{Message: "name query parameter required"}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	policy, err := s.GetPolicy(ctx, repo)
+	if err != nil {
+		return nil, &UnavailableError{Op: "list pins", Err: err}
+	}
+	reasons, err := s.pinReasons(ctx, repo, policy)
+	if err != nil {
+		return nil, &UnavailableError{Op: "list pins", Err: err}
+	}
+	archived := make(map[string]bool, len(reasons))
+	rows, err := s.db.QueryContext(ctx, `SELECT hash, archived FROM commits WHERE repo = ? AND archived = 1`, repo)
+	if err != nil {
+		return nil, &UnavailableError{Op: "list pins", Err: err}
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			hash string
+			flag bool
+		)
+		if err := rows.Scan(&hash, &flag); err != nil {
+			return nil, &UnavailableError{Op: "list pins", Err: err}
+		}
+		archived[hash] = flag
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &UnavailableError{Op: "list pins", Err: err}
+	}
+	return pinnedList(reasons, func(hash string) bool { return archived[hash] }), nil
+}
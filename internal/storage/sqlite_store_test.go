@@ -0,0 +1,314 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSQLiteStorePutBlobAndCommit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv-vs.sqlite")
+	archive := NewMemoryArchive()
+	store, err := NewSQLiteStore(SQLiteConfig{Path: path}, Options{Archive: archive})
+	if err != nil {
+		t.Fatalf("create store: %v", err)
+	}
+
+	req := BlobWriteRequest{
+		Name:       "analytics",
+		Content:    "line one\nline two\n",
+		AuthorName: "Alice",
+		AuthorID:   "alice@id",
+	}
+
+	ctx := context.Background()
+	result, err := store.PutBlobAndCommit(ctx, req)
+	if err != nil {
+		t.Fatalf("PutBlobAndCommit: %v", err)
+	}
+	if result.Branch != defaultBranch {
+		t.Fatalf("expected branch %s, got %s", defaultBranch, result.Branch)
+	}
+	if result.Diff == "" {
+		t.Fatalf("expected diff for first commit")
+	}
+
+	commit, content, err := store.GetCommit(ctx, "analytics", result.CommitHash)
+	if err != nil {
+		t.Fatalf("GetCommit: %v", err)
+	}
+	if content != req.Content {
+		t.Fatalf("unexpected content: %s", content)
+	}
+	if commit.Parent != "" {
+		t.Fatalf("expected empty parent for first commit")
+	}
+	if commit.AuthorName != "Alice" || commit.AuthorID != "alice@id" {
+		t.Fatalf("unexpected author metadata")
+	}
+
+	second, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{
+		Name:       "analytics",
+		Content:    "line one\nline two updated\n",
+		AuthorName: "Alice",
+		AuthorID:   "alice@id",
+	})
+	if err != nil {
+		t.Fatalf("second PutBlobAndCommit: %v", err)
+	}
+	if second.Diff == "" {
+		t.Fatalf("expected diff for updated content")
+	}
+
+	commits, err := store.ListCommits(ctx, ListCommitsOptions{Repo: "analytics", Descending: true})
+	if err != nil {
+		t.Fatalf("ListCommits: %v", err)
+	}
+	if len(commits) != 2 {
+		t.Fatalf("expected 2 commits, got %d", len(commits))
+	}
+	if commits[0].Hash != second.CommitHash {
+		t.Fatalf("expected newest commit first")
+	}
+	limited, err := store.ListCommits(ctx, ListCommitsOptions{Repo: "analytics", Limit: 1})
+	if err != nil {
+		t.Fatalf("ListCommits: %v", err)
+	}
+	if len(limited) != 1 || limited[0].Hash != result.CommitHash {
+		t.Fatalf("expected oldest commit for ascending limit 1")
+	}
+
+	branch, err := store.UpsertBranch(ctx, BranchRequest{Repo: "analytics", Name: "feature", Commit: result.CommitHash})
+	if err != nil {
+		t.Fatalf("UpsertBranch: %v", err)
+	}
+	if branch.Commit != result.CommitHash {
+		t.Fatalf("unexpected branch commit")
+	}
+	branches, err := store.ListBranches(ctx, "analytics")
+	if err != nil {
+		t.Fatalf("ListBranches: %v", err)
+	}
+	if len(branches) != 2 {
+		t.Fatalf("expected 2 branches, got %d", len(branches))
+	}
+
+	if _, err := store.CreateTag(ctx, TagRequest{Repo: "analytics", Name: "v1", Commit: second.CommitHash}); err != nil {
+		t.Fatalf("CreateTag: %v", err)
+	}
+	if _, err := store.CreateTag(ctx, TagRequest{Repo: "analytics", Name: "v1", Commit: second.CommitHash}); err == nil {
+		t.Fatalf("expected duplicate tag conflict")
+	}
+	tags, err := store.ListTags(ctx, "analytics")
+	if err != nil {
+		t.Fatalf("ListTags: %v", err)
+	}
+	if len(tags) != 1 {
+		t.Fatalf("expected 1 tag, got %d", len(tags))
+	}
+
+	if _, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "analytics", Content: "third", AuthorName: "Bob", AuthorID: "alice@id"}); err == nil {
+		t.Fatalf("expected author conflict")
+	}
+
+	policy, err := store.SetPolicy(ctx, RetentionPolicy{Repo: "analytics", HotCommitLimit: 1})
+	if err != nil {
+		t.Fatalf("SetPolicy: %v", err)
+	}
+	if policy.Version != 1 || policy.HotCommitLimit != 1 {
+		t.Fatalf("unexpected policy response")
+	}
+	var validation *ValidationError
+	if _, err := store.SetPolicy(ctx, RetentionPolicy{Repo: "analytics", HotCommitLimit: 2}); !errors.As(err, &validation) {
+		t.Fatalf("expected reason to be required, got %v", err)
+	}
+	if _, err := store.EnforceRetention(ctx, "analytics"); err != nil {
+		t.Fatalf("EnforceRetention: %v", err)
+	}
+
+	var authorCommits, totalSize int
+	db := store.(*sqliteStore).db
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*), SUM(content_size) FROM commits WHERE repo = ? AND author_id = ?`, "analytics", "alice@id").Scan(&authorCommits, &totalSize); err != nil {
+		t.Fatalf("ad-hoc query: %v", err)
+	}
+	if authorCommits != 2 || totalSize != len(req.Content)+len("line one\nline two updated\n") {
+		t.Fatalf("unexpected history aggregate: %d commits, %d bytes", authorCommits, totalSize)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	reopened, err := NewSQLiteStore(SQLiteConfig{Path: path}, Options{Archive: archive})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	t.Cleanup(func() { _ = reopened.Close() })
+
+	archived, content, err := reopened.GetCommit(ctx, "analytics", result.CommitHash)
+	if err != nil {
+		t.Fatalf("GetCommit after reopen: %v", err)
+	}
+	if !archived.Archived || content != req.Content {
+		t.Fatalf("expected archived commit served from archive")
+	}
+
+	policyGet, err := reopened.GetPolicy(ctx, "analytics")
+	if err != nil {
+		t.Fatalf("GetPolicy: %v", err)
+	}
+	if policyGet.HotCommitLimit != 1 {
+		t.Fatalf("unexpected policy limit: %d", policyGet.HotCommitLimit)
+	}
+}
+
+func TestSQLiteStorePurgeHorizon(t *testing.T) {
+	archive := NewMemoryArchive()
+	store, err := NewSQLiteStore(SQLiteConfig{Path: filepath.Join(t.TempDir(), "kv-vs.sqlite")}, Options{Archive: archive})
+	if err != nil {
+		t.Fatalf("create store: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	ctx := context.Background()
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.(*sqliteStore).clock = func() time.Time { return now }
+
+	if _, err := store.SetPolicy(ctx, RetentionPolicy{Repo: "repo", HotDuration: time.Hour, PurgeAfter: time.Minute}); err == nil {
+		t.Fatalf("expected purgeAfter shorter than hotDuration to be rejected")
+	}
+	if _, err := store.SetPolicy(ctx, RetentionPolicy{Repo: "repo", HotDuration: time.Hour, PurgeAfter: 2 * time.Hour}); err != nil {
+		t.Fatalf("SetPolicy: %v", err)
+	}
+
+	var hashes []string
+	for _, step := range []struct {
+		content string
+		advance time.Duration
+	}{{"v1", 0}, {"v2", 90 * time.Minute}, {"v3", 90 * time.Minute}} {
+		now = now.Add(step.advance)
+		res, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "repo", Content: step.content, AuthorName: "Alice", AuthorID: "alice@id"})
+		if err != nil {
+			t.Fatalf("PutBlobAndCommit: %v", err)
+		}
+		hashes = append(hashes, res.CommitHash)
+	}
+	run, err := store.EnforceRetention(ctx, "repo")
+	if err != nil {
+		t.Fatalf("EnforceRetention: %v", err)
+	}
+	if run.Purged != 1 || run.Archived != 1 || len(run.Errors) != 0 {
+		t.Fatalf("expected one purge and one archive, got %+v", run)
+	}
+
+	commit, _, err := store.GetCommit(ctx, "repo", hashes[0])
+	var gone *GoneError
+	if !errors.As(err, &gone) {
+		t.Fatalf("expected GoneError for purged commit, got %v", err)
+	}
+	if !commit.Purged {
+		t.Fatalf("expected purged metadata to be returned")
+	}
+	if _, err := archive.Fetch(ctx, "repo", hashes[0]); err == nil {
+		t.Fatalf("expected purged content removed from archive")
+	}
+
+	commit, content, err := store.GetCommit(ctx, "repo", hashes[1])
+	if err != nil {
+		t.Fatalf("GetCommit archived: %v", err)
+	}
+	if !commit.Archived || commit.Purged || content != "v2" {
+		t.Fatalf("expected v2 archived but readable, got %+v %q", commit, content)
+	}
+
+	commits, err := store.ListCommits(ctx, ListCommitsOptions{Repo: "repo"})
+	if err != nil {
+		t.Fatalf("ListCommits: %v", err)
+	}
+	if len(commits) != 3 || !commits[0].Purged {
+		t.Fatalf("expected purged commit to stay in history, got %+v", commits)
+	}
+
+	report, err := store.Check(ctx, CheckOptions{Repo: "repo"})
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if len(report.Issues) != 0 {
+		t.Fatalf("expected clean report, got %+v", report.Issues)
+	}
+}
+
+// blockingArchive holds the result of every Fetch until release is closed,
+// signalling fetching once the payload has been read.
+type blockingArchive struct {
+	Archive
+	fetching chan struct{}
+	release  chan struct{}
+}
+
+func (a *blockingArchive) Fetch(ctx context.Context, repo, hash string) ([]byte, error) {
+	data, err := a.Archive.Fetch(ctx, repo, hash)
+	a.fetching <- struct{}{}
+	<-a.release
+	return data, err
+}
+
+func TestSQLiteStoreColdHeadDoesNotBlockWriters(t *testing.T) {
+	archive := &blockingArchive{Archive: NewMemoryArchive(), fetching: make(chan struct{}, 1), release: make(chan struct{})}
+	cfg := SQLiteConfig{Path: filepath.Join(t.TempDir(), "kv-vs.sqlite"), BusyTimeout: 500 * time.Millisecond}
+	store, err := NewSQLiteStore(cfg, Options{Archive: archive})
+	if err != nil {
+		t.Fatalf("create store: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	ctx := context.Background()
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.(*sqliteStore).clock = func() time.Time { return now }
+	if _, err := store.SetPolicy(ctx, RetentionPolicy{Repo: "repo", HotDuration: time.Hour}); err != nil {
+		t.Fatalf("SetPolicy: %v", err)
+	}
+	if _, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "repo", Content: "v1\n", AuthorName: "Alice", AuthorID: "alice@id"}); err != nil {
+		t.Fatalf("PutBlobAndCommit: %v", err)
+	}
+	now = now.Add(2 * time.Hour)
+	dev, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "repo", Branch: "dev", Content: "dev\n", AuthorName: "Alice", AuthorID: "alice@id"})
+	if err != nil {
+		t.Fatalf("PutBlobAndCommit dev: %v", err)
+	}
+	if run, err := store.EnforceRetention(ctx, "repo"); err != nil || run.Archived != 1 {
+		t.Fatalf("EnforceRetention: %+v, %v", run, err)
+	}
+
+	type outcome struct {
+		result BlobCommitResult
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := store.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "repo", Content: "v2\n", AuthorName: "Alice", AuthorID: "alice@id"})
+		done <- outcome{result, err}
+	}()
+	<-archive.fetching
+
+	// Another writer gets through while the archive read is stalled, and
+	// moves the head the commit is being diffed against.
+	if _, err := store.UpsertBranch(ctx, BranchRequest{Repo: "repo", Name: defaultBranch, Commit: dev.CommitHash}); err != nil {
+		t.Fatalf("UpsertBranch during archive read: %v", err)
+	}
+	close(archive.release)
+
+	got := <-done
+	if got.err != nil {
+		t.Fatalf("PutBlobAndCommit: %v", got.err)
+	}
+	commit, _, err := store.GetCommit(ctx, "repo", got.result.CommitHash)
+	if err != nil {
+		t.Fatalf("GetCommit: %v", err)
+	}
+	if commit.Parent != dev.CommitHash || got.result.Diff != computeDiff("dev\n", "v2\n") {
+		t.Fatalf("expected the commit rebased on the moved head, got parent %s diff %q", commit.Parent, got.result.Diff)
+	}
+}
@@ -0,0 +1,339 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/onexay/kv-vs/internal/types"
+)
+
+const (
+	defaultCacheBranchTTL = time.Second
+	defaultCacheCommitTTL = time.Minute
+	// cacheEntryOverhead approximates the bookkeeping bytes of an entry on
+	// top of its strings.
+	cacheEntryOverhead = 256
+)
+
+// CacheConfig controls a CachingStore.
+type CacheConfig struct {
+	// MaxBytes bounds the cached commits and branch heads; least recently
+	// used entries are evicted first.
+	MaxBytes int64
+	// BranchTTL is how long a branch head is served from the cache. Heads
+	// moved through this store are invalidated at once; moves by other
+	// processes show after at most BranchTTL. Zero means one second; a
+	// negative value disables branch caching.
+	BranchTTL time.Duration
+	// CommitTTL is how long a commit and its content are served from the
+	// cache. Retention, garbage collection and repairs run through this
+	// store drop the repository's commits at once; the same work done by
+	// other processes, such as a purge on another replica, shows after at
+	// most CommitTTL. Zero means one minute; a negative value disables
+	// commit caching.
+	CommitTTL time.Duration
+}
+
+// CacheCounters reports one kind of cached entry.
+type CacheCounters struct {
+	Entries       int     `json:"entries"`
+	Hits          int64   `json:"hits"`
+	Misses        int64   `json:"misses"`
+	HitRate       float64 `json:"hitRate"`
+	Evictions     int64   `json:"evictions"`
+	Expirations   int64   `json:"expirations,omitempty"`
+	Invalidations int64   `json:"invalidations"`
+}
+
+// CacheStats reports a CachingStore's occupancy and counters.
+type CacheStats struct {
+	Bytes     int64         `json:"bytes"`
+	MaxBytes  int64         `json:"maxBytes"`
+	BranchTTL string        `json:"branchTTL"`
+	CommitTTL string        `json:"commitTTL"`
+	Commits   CacheCounters `json:"commits"`
+	Branches  CacheCounters `json:"branches"`
+}
+
+type cacheKind int
+
+const (
+	cacheCommit cacheKind = iota
+	cacheBranch
+)
+
+type cacheKey struct {
+	kind cacheKind
+	repo string
+	// name is the commit hash or branch name.
+	name string
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	size    int64
+	commit  types.Commit
+	content string
+	branch  types.Branch
+	expires time.Time
+}
+
+// CachingStore is a Store that serves commits and branch heads from an
+// in-process LRU. Retention, garbage collection and repairs change archive
+// flags, purge content or delete commits, so commits are cached for
+// CommitTTL and a repository's commits are dropped when that work runs
+// through this store. Branch heads are cached for BranchTTL and dropped when
+// moved through this store. Changes made by other processes are not seen
+// until the entries expire. Every other call goes straight to the wrapped
+// store.
+type CachingStore struct {
+	Store
+	cfg   CacheConfig
+	clock func() time.Time
+
+	mu      sync.Mutex
+	lru     *list.List // front is most recently used
+	entries map[cacheKey]*list.Element
+	repos   map[string]map[cacheKey]*list.Element
+	bytes   int64
+	stats   [2]CacheCounters
+	// gen counts invalidations. A miss records it before reading the
+	// wrapped store, and the insert is dropped if an invalidation ran in
+	// between. Invalidations are rare next to reads, so one counter for all
+	// repositories costs little.
+	gen uint64
+}
+
+// NewCachingStore wraps store with a read cache.
+func NewCachingStore(store Store, cfg CacheConfig) *CachingStore {
+	if cfg.BranchTTL == 0 {
+		cfg.BranchTTL = defaultCacheBranchTTL
+	}
+	if cfg.CommitTTL == 0 {
+		cfg.CommitTTL = defaultCacheCommitTTL
+	}
+	return &CachingStore{
+		Store:   store,
+		cfg:     cfg,
+		clock:   time.Now,
+		lru:     list.New(),
+		entries: make(map[cacheKey]*list.Element),
+		repos:   make(map[string]map[cacheKey]*list.Element),
+	}
+}
+
+func (c *CachingStore) GetCommit(ctx context.Context, repo, hash string) (types.Commit, string, error) {
+	if c.cfg.CommitTTL < 0 {
+		return c.Store.GetCommit(ctx, repo, hash)
+	}
+	key := cacheKey{kind: cacheCommit, repo: repo, name: hash}
+	entry, gen, ok := c.lookup(key)
+	if ok {
+		return entry.commit, entry.content, nil
+	}
+	commit, content, err := c.Store.GetCommit(ctx, repo, hash)
+	if err != nil {
+		return commit, content, err
+	}
+	c.insert(gen, &cacheEntry{
+		key:     key,
+		size:    int64(len(content)+len(commit.Repo)+len(commit.Branch)+len(commit.Hash)+len(commit.Parent)+len(commit.AuthorName)+len(commit.AuthorID)+len(commit.Message)+len(commit.ContentHash)) + cacheEntryOverhead,
+		commit:  commit,
+		content: content,
+		expires: c.clock().Add(c.cfg.CommitTTL),
+	})
+	return commit, content, nil
+}
+
+func (c *CachingStore) GetBranch(ctx context.Context, repo, name string) (types.Branch, error) {
+	if c.cfg.BranchTTL < 0 {
+		return c.Store.GetBranch(ctx, repo, name)
+	}
+	key := cacheKey{kind: cacheBranch, repo: repo, name: name}
+	entry, gen, ok := c.lookup(key)
+	if ok {
+		return entry.branch, nil
+	}
+	branch, err := c.Store.GetBranch(ctx, repo, name)
+	if err != nil {
+		return branch, err
+	}
+	c.insert(gen, &cacheEntry{
+		key:     key,
+		size:    int64(len(branch.Repo)+len(branch.Name)+len(branch.Commit)) + cacheEntryOverhead,
+		branch:  branch,
+		expires: c.clock().Add(c.cfg.BranchTTL),
+	})
+	return branch, nil
+}
+
+func (c *CachingStore) PutBlobAndCommit(ctx context.Context, req BlobWriteRequest) (BlobCommitResult, error) {
+	result, err := c.Store.PutBlobAndCommit(ctx, req)
+	if err == nil {
+		c.invalidate(cacheKey{kind: cacheBranch, repo: req.Name, name: result.Branch})
+	}
+	return result, err
+}
+
+func (c *CachingStore) UpsertBranch(ctx context.Context, req BranchRequest) (types.Branch, error) {
+	branch, err := c.Store.UpsertBranch(ctx, req)
+	if err == nil {
+		c.invalidate(cacheKey{kind: cacheBranch, repo: req.Repo, name: req.Name})
+	}
+	return branch, err
+}
+
+func (c *CachingStore) EnforceRetention(ctx context.Context, repo string) (RetentionRun, error) {
+	run, err := c.Store.EnforceRetention(ctx, repo)
+	if run.Archived+run.Purged+run.Restored > 0 {
+		c.invalidateCommits(repo)
+	}
+	return run, err
+}
+
+// CollectGarbage drops the repository's cached commits when the run
+// collected any. Sweeps are atomic, so a failed run changed nothing.
+func (c *CachingStore) CollectGarbage(ctx context.Context, opts GCOptions) (GCReport, error) {
+	if opts.Repo == "" {
+		return GCReport{}, &ValidationError{Message: "name query parameter required"}
+	}
+	report, err := c.Store.CollectGarbage(ctx, opts)
+	if err == nil && !report.DryRun && len(report.Commits) > 0 {
+		c.invalidateCommits(opts.Repo)
+	}
+	return report, err
+}
+
+// Check drops the repository's cached commits when a repair was applied,
+// even if a later repair failed.
+func (c *CachingStore) Check(ctx context.Context, opts CheckOptions) (CheckReport, error) {
+	if opts.Repo == "" {
+		return CheckReport{}, &ValidationError{Message: "name query parameter required"}
+	}
+	report, err := c.Store.Check(ctx, opts)
+	for _, issue := range report.Issues {
+		if issue.Repaired {
+			c.invalidateCommits(opts.Repo)
+			break
+		}
+	}
+	return report, err
+}
+
+// Stats returns a snapshot of the cache's occupancy and counters.
+func (c *CachingStore) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := CacheStats{
+		Bytes:     c.bytes,
+		MaxBytes:  c.cfg.MaxBytes,
+		BranchTTL: c.cfg.BranchTTL.String(),
+		CommitTTL: c.cfg.CommitTTL.String(),
+		Commits:   c.stats[cacheCommit],
+		Branches:  c.stats[cacheBranch],
+	}
+	if c.cfg.BranchTTL < 0 {
+		stats.BranchTTL = ""
+	}
+	if c.cfg.CommitTTL < 0 {
+		stats.CommitTTL = ""
+	}
+	for _, counters := range []*CacheCounters{&stats.Commits, &stats.Branches} {
+		if total := counters.Hits + counters.Misses; total > 0 {
+			counters.HitRate = float64(counters.Hits) / float64(total)
+		}
+	}
+	return stats
+}
+
+// lookup returns a live entry and marks it most recently used. On a miss it
+// returns the invalidation generation for the following insert.
+func (c *CachingStore) lookup(key cacheKey) (cacheEntry, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counters := &c.stats[key.kind]
+	elem, ok := c.entries[key]
+	if !ok {
+		counters.Misses++
+		return cacheEntry{}, c.gen, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !entry.expires.IsZero() && !c.clock().Before(entry.expires) {
+		c.removeLocked(elem)
+		counters.Expirations++
+		counters.Misses++
+		return cacheEntry{}, c.gen, false
+	}
+	c.lru.MoveToFront(elem)
+	counters.Hits++
+	return *entry, 0, true
+}
+
+// insert adds entry unless an invalidation ran since gen was read, in which
+// case entry may predate the change.
+func (c *CachingStore) insert(gen uint64, entry *cacheEntry) {
+	if entry.size > c.cfg.MaxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen {
+		return
+	}
+	if elem, ok := c.entries[entry.key]; ok {
+		c.removeLocked(elem)
+	}
+	for c.bytes+entry.size > c.cfg.MaxBytes {
+		oldest := c.lru.Back()
+		c.stats[oldest.Value.(*cacheEntry).key.kind].Evictions++
+		c.removeLocked(oldest)
+	}
+	elem := c.lru.PushFront(entry)
+	c.entries[entry.key] = elem
+	repoEntries, ok := c.repos[entry.key.repo]
+	if !ok {
+		repoEntries = make(map[cacheKey]*list.Element)
+		c.repos[entry.key.repo] = repoEntries
+	}
+	repoEntries[entry.key] = elem
+	c.bytes += entry.size
+	c.stats[entry.key.kind].Entries++
+}
+
+func (c *CachingStore) removeLocked(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	if repoEntries := c.repos[entry.key.repo]; repoEntries != nil {
+		delete(repoEntries, entry.key)
+		if len(repoEntries) == 0 {
+			delete(c.repos, entry.key.repo)
+		}
+	}
+	c.bytes -= entry.size
+	c.stats[entry.key.kind].Entries--
+}
+
+func (c *CachingStore) invalidate(key cacheKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if elem, ok := c.entries[key]; ok {
+		c.removeLocked(elem)
+		c.stats[key.kind].Invalidations++
+	}
+}
+
+// invalidateCommits drops the cached commits of repo.
+func (c *CachingStore) invalidateCommits(repo string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for key, elem := range c.repos[repo] {
+		if key.kind == cacheCommit {
+			c.removeLocked(elem)
+			c.stats[cacheCommit].Invalidations++
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/onexay/kv-vs/internal/types"
+)
+
+// countingStore counts the reads that reach the wrapped store.
+type countingStore struct {
+	Store
+	commitReads int
+	branchReads int
+	// afterBranchRead runs between a branch read and its return, standing
+	// in for a concurrent caller.
+	afterBranchRead func()
+}
+
+func (s *countingStore) GetCommit(ctx context.Context, repo, hash string) (types.Commit, string, error) {
+	s.commitReads++
+	return s.Store.GetCommit(ctx, repo, hash)
+}
+
+func (s *countingStore) GetBranch(ctx context.Context, repo, name string) (types.Branch, error) {
+	s.branchReads++
+	branch, err := s.Store.GetBranch(ctx, repo, name)
+	if s.afterBranchRead != nil {
+		s.afterBranchRead()
+	}
+	return branch, err
+}
+
+func TestCachingStore(t *testing.T) {
+	inner := &countingStore{Store: NewMemoryStore(Options{Archive: NewMemoryArchive()})}
+	cache := NewCachingStore(inner, CacheConfig{MaxBytes: 1 << 20, BranchTTL: time.Minute})
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache.clock = func() time.Time { return now }
+	ctx := context.Background()
+
+	first, err := cache.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "repo", Content: "v1", AuthorName: "Alice", AuthorID: "alice@id"})
+	if err != nil {
+		t.Fatalf("PutBlobAndCommit: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		branch, err := cache.GetBranch(ctx, "repo", defaultBranch)
+		if err != nil || branch.Commit != first.CommitHash {
+			t.Fatalf("GetBranch: %+v, %v", branch, err)
+		}
+		if _, content, err := cache.GetCommit(ctx, "repo", branch.Commit); err != nil || content != "v1" {
+			t.Fatalf("GetCommit: %q, %v", content, err)
+		}
+	}
+	if inner.branchReads != 1 || inner.commitReads != 1 {
+		t.Fatalf("expected one read of each, got %d branch and %d commit reads", inner.branchReads, inner.commitReads)
+	}
+
+	// A commit through the cache moves the head at once.
+	second, err := cache.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "repo", Content: "v2", AuthorName: "Alice", AuthorID: "alice@id"})
+	if err != nil {
+		t.Fatalf("second PutBlobAndCommit: %v", err)
+	}
+	if branch, err := cache.GetBranch(ctx, "repo", defaultBranch); err != nil || branch.Commit != second.CommitHash {
+		t.Fatalf("expected new head after commit, got %+v, %v", branch, err)
+	}
+
+	// A move by another writer shows once the TTL passes.
+	if _, err := inner.UpsertBranch(ctx, BranchRequest{Repo: "repo", Name: defaultBranch, Commit: first.CommitHash}); err != nil {
+		t.Fatalf("UpsertBranch: %v", err)
+	}
+	if branch, _ := cache.GetBranch(ctx, "repo", defaultBranch); branch.Commit != second.CommitHash {
+		t.Fatalf("expected cached head within the TTL, got %s", branch.Commit)
+	}
+	now = now.Add(time.Minute)
+	if branch, _ := cache.GetBranch(ctx, "repo", defaultBranch); branch.Commit != first.CommitHash {
+		t.Fatalf("expected refreshed head after the TTL, got %s", branch.Commit)
+	}
+
+	// Misses are not cached.
+	var notFound *NotFoundError
+	for i := 0; i < 2; i++ {
+		if _, _, err := cache.GetCommit(ctx, "repo", "missing"); !errors.As(err, &notFound) {
+			t.Fatalf("expected not found, got %v", err)
+		}
+	}
+	if inner.commitReads != 3 {
+		t.Fatalf("expected misses to reach the store, got %d commit reads", inner.commitReads)
+	}
+
+	// Retention that archives drops cached commits, so the flag is current.
+	if _, err := cache.SetPolicy(ctx, RetentionPolicy{Repo: "repo", HotCommitLimit: 1}); err != nil {
+		t.Fatalf("SetPolicy: %v", err)
+	}
+	if run, err := cache.EnforceRetention(ctx, "repo"); err != nil || run.Archived != 1 {
+		t.Fatalf("EnforceRetention: %+v, %v", run, err)
+	}
+	if commit, content, err := cache.GetCommit(ctx, "repo", first.CommitHash); err != nil || !commit.Archived || content != "v1" {
+		t.Fatalf("expected archived commit after retention, got %+v %q %v", commit, content, err)
+	}
+
+	stats := cache.Stats()
+	if stats.Branches.Hits != 3 || stats.Branches.Misses != 3 || stats.Branches.Expirations != 1 || stats.Branches.Invalidations != 1 {
+		t.Fatalf("unexpected branch stats: %+v", stats.Branches)
+	}
+	if stats.Commits.Hits != 2 || stats.Commits.Misses != 4 || stats.Commits.Invalidations != 1 || stats.Commits.HitRate != 2.0/6 {
+		t.Fatalf("unexpected commit stats: %+v", stats.Commits)
+	}
+	if stats.Bytes <= 0 || stats.MaxBytes != 1<<20 || stats.BranchTTL != "1m0s" {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestCachingStoreInvalidationRace(t *testing.T) {
+	inner := &countingStore{Store: NewMemoryStore(Options{})}
+	cache := NewCachingStore(inner, CacheConfig{MaxBytes: 1 << 20, BranchTTL: time.Minute})
+	ctx := context.Background()
+
+	first, err := cache.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "repo", Content: "v1", AuthorName: "Alice", AuthorID: "alice@id"})
+	if err != nil {
+		t.Fatalf("PutBlobAndCommit: %v", err)
+	}
+	second, err := cache.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "repo", Content: "v2", AuthorName: "Alice", AuthorID: "alice@id"})
+	if err != nil {
+		t.Fatalf("second PutBlobAndCommit: %v", err)
+	}
+
+	// The head moves after a miss read it but before the result is cached.
+	inner.afterBranchRead = func() {
+		inner.afterBranchRead = nil
+		if _, err := cache.UpsertBranch(ctx, BranchRequest{Repo: "repo", Name: defaultBranch, Commit: first.CommitHash}); err != nil {
+			t.Errorf("UpsertBranch: %v", err)
+		}
+	}
+	if branch, err := cache.GetBranch(ctx, "repo", defaultBranch); err != nil || branch.Commit != second.CommitHash {
+		t.Fatalf("GetBranch: %+v, %v", branch, err)
+	}
+	if branch, err := cache.GetBranch(ctx, "repo", defaultBranch); err != nil || branch.Commit != first.CommitHash {
+		t.Fatalf("expected the moved head, got %+v, %v", branch, err)
+	}
+	if inner.branchReads != 2 {
+		t.Fatalf("expected the stale read to stay uncached, got %d branch reads", inner.branchReads)
+	}
+}
+
+func TestCachingStoreCommitTTL(t *testing.T) {
+	inner := &countingStore{Store: NewMemoryStore(Options{Archive: NewMemoryArchive()})}
+	cache := NewCachingStore(inner, CacheConfig{MaxBytes: 1 << 20, CommitTTL: time.Minute})
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache.clock = func() time.Time { return now }
+	ctx := context.Background()
+
+	first, err := cache.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "repo", Content: "v1", AuthorName: "Alice", AuthorID: "alice@id"})
+	if err != nil {
+		t.Fatalf("PutBlobAndCommit: %v", err)
+	}
+	if _, err := cache.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "repo", Content: "v2", AuthorName: "Alice", AuthorID: "alice@id"}); err != nil {
+		t.Fatalf("second PutBlobAndCommit: %v", err)
+	}
+	if commit, _, err := cache.GetCommit(ctx, "repo", first.CommitHash); err != nil || commit.Archived {
+		t.Fatalf("GetCommit: %+v, %v", commit, err)
+	}
+
+	// Retention run by another replica shows once the TTL passes.
+	if _, err := inner.SetPolicy(ctx, RetentionPolicy{Repo: "repo", HotCommitLimit: 1}); err != nil {
+		t.Fatalf("SetPolicy: %v", err)
+	}
+	if run, err := inner.EnforceRetention(ctx, "repo"); err != nil || run.Archived != 1 {
+		t.Fatalf("EnforceRetention: %+v, %v", run, err)
+	}
+	if commit, _, _ := cache.GetCommit(ctx, "repo", first.CommitHash); commit.Archived {
+		t.Fatalf("expected the cached commit within the TTL")
+	}
+	now = now.Add(time.Minute)
+	if commit, content, err := cache.GetCommit(ctx, "repo", first.CommitHash); err != nil || !commit.Archived || content != "v1" {
+		t.Fatalf("expected the archived commit after the TTL, got %+v %q %v", commit, content, err)
+	}
+	if stats := cache.Stats(); inner.commitReads != 2 || stats.Commits.Expirations != 1 || stats.CommitTTL != "1m0s" {
+		t.Fatalf("unexpected commit reads %d, stats %+v", inner.commitReads, stats)
+	}
+}
+
+func TestCachingStoreCollectGarbage(t *testing.T) {
+	inner := &countingStore{Store: NewMemoryStore(Options{})}
+	cache := NewCachingStore(inner, CacheConfig{MaxBytes: 1 << 20})
+	ctx := context.Background()
+
+	var validation *ValidationError
+	if _, err := cache.CollectGarbage(ctx, GCOptions{}); !errors.As(err, &validation) {
+		t.Fatalf("expected validation error without a repo, got %v", err)
+	}
+	if _, err := cache.Check(ctx, CheckOptions{Repair: true}); !errors.As(err, &validation) {
+		t.Fatalf("expected validation error without a repo, got %v", err)
+	}
+
+	first, err := cache.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "repo", Content: "v1", AuthorName: "Alice", AuthorID: "alice@id"})
+	if err != nil {
+		t.Fatalf("PutBlobAndCommit: %v", err)
+	}
+	second, err := cache.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "repo", Content: "v2", AuthorName: "Alice", AuthorID: "alice@id"})
+	if err != nil {
+		t.Fatalf("second PutBlobAndCommit: %v", err)
+	}
+	if _, _, err := cache.GetCommit(ctx, "repo", second.CommitHash); err != nil {
+		t.Fatalf("GetCommit: %v", err)
+	}
+	// Rewind main, stranding the cached commit.
+	if _, err := cache.UpsertBranch(ctx, BranchRequest{Repo: "repo", Name: defaultBranch, Commit: first.CommitHash}); err != nil {
+		t.Fatalf("UpsertBranch: %v", err)
+	}
+
+	if _, err := cache.CollectGarbage(ctx, GCOptions{Repo: "repo", DryRun: true}); err != nil {
+		t.Fatalf("CollectGarbage dry run: %v", err)
+	}
+	if _, _, err := cache.GetCommit(ctx, "repo", second.CommitHash); err != nil {
+		t.Fatalf("expected the commit cached after a dry run, got %v", err)
+	}
+	report, err := cache.CollectGarbage(ctx, GCOptions{Repo: "repo"})
+	if err != nil || len(report.Commits) != 1 {
+		t.Fatalf("CollectGarbage: %+v, %v", report, err)
+	}
+	if _, _, err := cache.GetCommit(ctx, "repo", second.CommitHash); !isNotFound(err) {
+		t.Fatalf("expected the collected commit gone, got %v", err)
+	}
+	if inner.commitReads != 2 || cache.Stats().Commits.Invalidations != 1 {
+		t.Fatalf("unexpected commit reads %d, stats %+v", inner.commitReads, cache.Stats().Commits)
+	}
+}
+
+func TestCachingStoreEviction(t *testing.T) {
+	inner := &countingStore{Store: NewMemoryStore(Options{})}
+	// Room for two commit entries of about 420 bytes.
+	cache := NewCachingStore(inner, CacheConfig{MaxBytes: 1000, BranchTTL: -1})
+	ctx := context.Background()
+
+	var hashes []string
+	for _, content := range []string{"v1", "v2", "v3"} {
+		result, err := cache.PutBlobAndCommit(ctx, BlobWriteRequest{Name: "repo", Content: content, AuthorName: "Alice", AuthorID: "alice@id"})
+		if err != nil {
+			t.Fatalf("PutBlobAndCommit: %v", err)
+		}
+		hashes = append(hashes, result.CommitHash)
+	}
+	for _, hash := range hashes {
+		if _, _, err := cache.GetCommit(ctx, "repo", hash); err != nil {
+			t.Fatalf("GetCommit: %v", err)
+		}
+	}
+	// The first commit was evicted; the other two are served from memory.
+	for _, hash := range []string{hashes[2], hashes[1], hashes[0]} {
+		if _, _, err := cache.GetCommit(ctx, "repo", hash); err != nil {
+			t.Fatalf("GetCommit: %v", err)
+		}
+	}
+	stats := cache.Stats()
+	if inner.commitReads != 4 || stats.Commits.Entries != 2 || stats.Commits.Evictions != 2 || stats.Bytes > stats.MaxBytes {
+		t.Fatalf("unexpected eviction: %d reads, %+v", inner.commitReads, stats)
+	}
+
+	// Branch caching is disabled.
+	for i := 0; i < 2; i++ {
+		if _, err := cache.GetBranch(ctx, "repo", defaultBranch); err != nil {
+			t.Fatalf("GetBranch: %v", err)
+		}
+	}
+	if inner.branchReads != 2 || cache.Stats().BranchTTL != "" {
+		t.Fatalf("expected uncached branch reads, got %d", inner.branchReads)
+	}
+}
@@ -14,6 +14,8 @@ type Commit struct {
 	ContentHash string    `json:"contentHash"`
 	Timestamp   time.Time `json:"timestamp"`
 	Archived    bool      `json:"archived"`
+	// Purged marks a commit whose content retention has permanently deleted.
+	Purged bool `json:"purged,omitempty"`
 }
 
 // Branch points to the latest commit for a repository branch.
@@ -32,3 +34,11 @@ type Tag struct {
 	Note      string    `json:"note,omitempty"`
 	CreatedAt time.Time `json:"createdAt"`
 }
+
+// Pin keeps a commit in hot storage regardless of retention limits.
+type Pin struct {
+	Repo      string    `json:"repo"`
+	Commit    string    `json:"commit"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}